@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+var (
+	inputFile  = flag.String("in", "", "encrypted file: /path/to/sid.cast.gz")
+	outputFile = flag.String("out", "", "output file, default stdout")
+	keyFile    = flag.String("key-file", "", "key file, same as STORAGE_ENCRYPT_KEY_FILE")
+	showHeader = flag.Bool("header", false, "only print the encrypted file header")
+)
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+	if *inputFile == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	fd, err := os.Open(*inputFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fd.Close()
+	if *showHeader {
+		header, err1 := utils.ReadEnvelopeHeader(fd)
+		if err1 != nil {
+			log.Fatal(err1)
+		}
+		fmt.Printf("alg: %s\nkid: %s\nchunk_size: %d\n", header.Algorithm, header.KeyID, header.ChunkSize)
+		return
+	}
+	// 未指定密钥文件时使用环境变量 SECRET_ENCRYPT_KEY
+	key, err := utils.LoadEnvelopeKey(os.Getenv("SECRET_ENCRYPT_KEY"), *keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reader, err := utils.NewDecryptReader(fd, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var out io.Writer = os.Stdout
+	if *outputFile != "" {
+		outFd, err1 := os.Create(*outputFile)
+		if err1 != nil {
+			log.Fatal(err1)
+		}
+		defer outFd.Close()
+		out = outFd
+	}
+	if _, err = io.Copy(out, reader); err != nil {
+		log.Fatal(err)
+	}
+}
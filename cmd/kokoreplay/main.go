@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+/*
+离线录像工具，用于处理 ReplayFolderPath 下或者从存储下载的录像 (.cast, .cast.gz, .cast.zst，包括加密的录像)
+
+	kokoreplay play [-speed 2] [-idle-limit 2] sid.cast.gz
+	kokoreplay text [-screens] sid.cast.gz
+	kokoreplay grep [-i] [-input] pattern sid.cast.gz
+	kokoreplay validate sid.cast ...
+	kokoreplay split [-size 100] [-duration 60] [-out dir] sid.cast.gz
+	kokoreplay merge [-out sid.cast] sid.manifest.json | part files ...
+*/
+
+var commands = map[string]func(args []string){
+	"play":     runPlay,
+	"text":     runText,
+	"grep":     runGrep,
+	"validate": runValidate,
+	"split":    runSplit,
+	"merge":    runMerge,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: kokoreplay <play|text|grep|validate|split|merge> [options] file ...")
+	fmt.Fprintln(os.Stderr, "Run 'kokoreplay <command> -h' for command options.")
+	fmt.Fprintln(os.Stderr, "Encrypted replays are decrypted with env SECRET_ENCRYPT_KEY or -key-file.")
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(1)
+	}
+	run(os.Args[2:])
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if err1 := r.closers[i].Close(); err1 != nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// replayCompression 根据文件头判断压缩算法，未压缩时返回空
+func replayCompression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(magic, zstdMagic):
+		return "zstd"
+	}
+	return ""
+}
+
+// openReplay 根据文件内容自动处理加密和 gzip、zstd 压缩
+func openReplay(path, keyFile string) (io.ReadCloser, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ret := &readCloser{Reader: fd, closers: []io.Closer{fd}}
+	if utils.IsEncryptedFile(path) {
+		key, err1 := utils.LoadEnvelopeKey(os.Getenv("SECRET_ENCRYPT_KEY"), keyFile)
+		if err1 != nil {
+			_ = ret.Close()
+			return nil, err1
+		}
+		if ret.Reader, err = utils.NewDecryptReader(fd, key); err != nil {
+			_ = ret.Close()
+			return nil, err
+		}
+	}
+	buf := bufio.NewReader(ret.Reader)
+	ret.Reader = buf
+	magic, _ := buf.Peek(len(zstdMagic))
+	switch replayCompression(magic) {
+	case "gzip":
+		gz, err1 := gzip.NewReader(buf)
+		if err1 != nil {
+			_ = ret.Close()
+			return nil, err1
+		}
+		ret.Reader = gz
+		ret.closers = append(ret.closers, gz)
+	case "zstd":
+		zr, err1 := zstd.NewReader(buf)
+		if err1 != nil {
+			_ = ret.Close()
+			return nil, err1
+		}
+		ret.Reader = zr
+		ret.closers = append(ret.closers, zr.IOReadCloser())
+	}
+	return ret, nil
+}
+
+func mustOpenReplay(path, keyFile string) io.ReadCloser {
+	r, err := openReplay(path, keyFile)
+	if err != nil {
+		log.Fatalf("Open %s failed: %s", path, err)
+	}
+	return r
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/asciinema"
+	"github.com/jumpserver/koko/pkg/audit"
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "storage encrypt key file for encrypted replay")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	failed := false
+	for _, path := range fs.Args() {
+		if err := validateReplay(path, *keyFile); err != nil {
+			failed = true
+			fmt.Printf("%s: FAILED %s\n", path, err)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// validateReplay 未压缩的录像和 koko 启动时 (ValidateRemainReplayFile) 一样原地修复，压缩或加密的录像只检查
+func validateReplay(path, keyFile string) error {
+	if isPlainFile(path) {
+		if err := asciinema.RepairReplayFile(path); err != nil {
+			return err
+		}
+		if !asciinema.IsCastFile(path) {
+			fmt.Printf("%s: OK (json replay)\n", path)
+			return nil
+		}
+	}
+	r, err := openReplay(path, keyFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	reader := asciinema.NewReader(r)
+	header, err := reader.ReadHeader()
+	if err != nil {
+		return fmt.Errorf("invalid header: %w", err)
+	}
+	var (
+		count    int
+		duration float64
+	)
+	for {
+		event, err1 := reader.ReadEvent()
+		if err1 != nil {
+			if err1 == io.EOF {
+				break
+			}
+			return fmt.Errorf("invalid event %d: %w", count+1, err1)
+		}
+		count++
+		duration = event.Time
+	}
+	fmt.Printf("%s: OK (v%d %dx%d, %d events, %s)\n", path, header.Version, header.Width,
+		header.Height, count, asciinema.FormatOffset(duration))
+	return nil
+}
+
+// isPlainFile 只有未加密、未压缩的 json 或者 cast 录像才可以原地修复，文件头的判断和 openReplay 一致
+func isPlainFile(path string) bool {
+	if utils.IsEncryptedFile(path) {
+		return false
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	buf := bufio.NewReader(fd)
+	magic, _ := buf.Peek(len(zstdMagic))
+	if replayCompression(magic) != "" {
+		return false
+	}
+	for {
+		c, err1 := buf.ReadByte()
+		if err1 != nil {
+			return false
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c == '{'
+	}
+}
+
+func runSplit(args []string) {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	maxSize := fs.Int("size", 100, "max size of each part in MB, 0 means no limit")
+	maxDuration := fs.Int("duration", 0, "max duration of each part in minutes, 0 means no limit")
+	outDir := fs.String("out", ".", "output directory")
+	sid := fs.String("session", "", "session id, default parsed from the filename")
+	compress := fs.Bool("gzip", true, "gzip the parts")
+	keyFile := fs.String("key-file", "", "storage encrypt key file for encrypted replay")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || (*maxSize <= 0 && *maxDuration <= 0) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	path := fs.Arg(0)
+	if *sid == "" {
+		*sid = strings.SplitN(filepath.Base(path), ".", 2)[0]
+	}
+	r := mustOpenReplay(path, *keyFile)
+	defer r.Close()
+	s := splitter{
+		sid:         *sid,
+		outDir:      *outDir,
+		compress:    *compress,
+		maxSize:     int64(*maxSize) * 1024 * 1024,
+		maxDuration: float64(*maxDuration * 60),
+	}
+	if err := s.run(r); err != nil {
+		log.Fatal(err)
+	}
+	manifestPath := filepath.Join(*outDir, asciinema.ManifestFilename(*sid))
+	if err := s.manifest.WriteFile(manifestPath); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Split into %d parts, manifest: %s\n", len(s.manifest.Parts), manifestPath)
+}
+
+// splitter 按原始行拷贝事件，每一段都带上相同的 header，v3 的事件间隔保持不变
+type splitter struct {
+	sid         string
+	outDir      string
+	compress    bool
+	maxSize     int64
+	maxDuration float64
+
+	header   []byte
+	manifest asciinema.Manifest
+
+	part      asciinema.Part
+	partFile  *os.File
+	partGz    *gzip.Writer
+	partHash  *hashCounter
+	partStart float64
+	partSize  int64
+}
+
+func (s *splitter) run(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return io.ErrUnexpectedEOF
+	}
+	header, err := asciinema.ParseHeader(scanner.Bytes())
+	if err != nil {
+		return err
+	}
+	s.header = append([]byte(nil), scanner.Bytes()...)
+	s.manifest = asciinema.Manifest{
+		SessionID: s.sid,
+		Version:   header.Version,
+		DateStart: time.Unix(header.Timestamp, 0),
+	}
+	var elapsed float64
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		event, err1 := asciinema.ParseEvent(line)
+		if err1 != nil {
+			return err1
+		}
+		if header.Version == asciinema.Version3 {
+			elapsed += event.Time
+		} else {
+			elapsed = event.Time
+		}
+		if s.partFile != nil && s.needRotate(elapsed) {
+			if err = s.closePart(); err != nil {
+				return err
+			}
+		}
+		if s.partFile == nil {
+			if err = s.openPart(elapsed); err != nil {
+				return err
+			}
+		}
+		if err = s.write(line); err != nil {
+			return err
+		}
+		s.part.End = elapsed
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if s.partFile != nil {
+		if err = s.closePart(); err != nil {
+			return err
+		}
+	}
+	s.manifest.Finished = true
+	s.manifest.DateEnd = s.manifest.DateStart.Add(time.Duration(elapsed * float64(time.Second)))
+	return nil
+}
+
+func (s *splitter) needRotate(elapsed float64) bool {
+	if s.maxSize > 0 && s.partSize >= s.maxSize {
+		return true
+	}
+	return s.maxDuration > 0 && elapsed-s.partStart >= s.maxDuration
+}
+
+func (s *splitter) openPart(elapsed float64) error {
+	index := len(s.manifest.Parts) + 1
+	name := asciinema.PartFilename(s.sid, index)
+	if s.compress {
+		name += ".gz"
+	}
+	fd, err := os.Create(filepath.Join(s.outDir, name))
+	if err != nil {
+		return err
+	}
+	s.partFile = fd
+	s.partHash = &hashCounter{w: fd, hash: sha256.New()}
+	s.partGz = nil
+	if s.compress {
+		s.partGz = gzip.NewWriter(s.partHash)
+	}
+	s.part = asciinema.Part{Index: index, Target: name, Start: elapsed, End: elapsed}
+	s.partStart = elapsed
+	s.partSize = 0
+	return s.write(s.header)
+}
+
+func (s *splitter) write(line []byte) error {
+	var w io.Writer = s.partHash
+	if s.partGz != nil {
+		w = s.partGz
+	}
+	if _, err := w.Write(line); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{'\n'}); err != nil {
+		return err
+	}
+	s.partSize += int64(len(line)) + 1
+	return nil
+}
+
+func (s *splitter) closePart() error {
+	if s.partGz != nil {
+		if err := s.partGz.Close(); err != nil {
+			return err
+		}
+	}
+	if err := s.partFile.Close(); err != nil {
+		return err
+	}
+	s.part.Size = s.partHash.size
+	s.part.SHA256 = hex.EncodeToString(s.partHash.Sum())
+	s.manifest.AddPart(s.part)
+	s.partFile = nil
+	return nil
+}
+
+// hashCounter 计算写入文件的摘要和大小
+type hashCounter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func (h *hashCounter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+func (h *hashCounter) Sum() []byte {
+	return h.hash.Sum(nil)
+}
+
+func runMerge(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	output := fs.String("out", "", "output file, gzip when ends with .gz, default stdout")
+	keyFile := fs.String("key-file", "", "storage encrypt key file for encrypted parts")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	var (
+		parts []string
+		err   error
+	)
+	if fs.NArg() == 1 && strings.HasSuffix(fs.Arg(0), asciinema.ManifestSuffix) {
+		parts, err = manifestParts(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		parts = fs.Args()
+		sort.Strings(parts)
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		fd, err1 := os.Create(*output)
+		if err1 != nil {
+			log.Fatal(err1)
+		}
+		defer fd.Close()
+		w = fd
+		if strings.HasSuffix(*output, ".gz") {
+			gz := gzip.NewWriter(fd)
+			defer gz.Close()
+			w = gz
+		}
+	}
+	out := bufio.NewWriter(w)
+	for i, path := range parts {
+		if err = copyPart(out, path, *keyFile, i == 0); err != nil {
+			log.Fatalf("Merge %s failed: %s", path, err)
+		}
+	}
+	if err = out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// manifestParts 分段文件和 manifest 在同一目录，校验下载的分段是否完整
+func manifestParts(path string) ([]string, error) {
+	manifest, err := asciinema.ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	if !manifest.Finished {
+		log.Printf("Warning: manifest of %s is not finished, the replay may be incomplete", manifest.SessionID)
+	}
+	sort.Slice(manifest.Parts, func(i, j int) bool {
+		return manifest.Parts[i].Index < manifest.Parts[j].Index
+	})
+	dir := filepath.Dir(path)
+	parts := make([]string, 0, len(manifest.Parts))
+	for _, part := range manifest.Parts {
+		partPath := filepath.Join(dir, filepath.Base(part.Target))
+		if _, err = os.Stat(partPath); err != nil {
+			return nil, fmt.Errorf("part %d: %w", part.Index, err)
+		}
+		// 摘要是上传前 gzip 文件的摘要，加密的分段无法直接校验
+		if part.SHA256 != "" && !utils.IsEncryptedFile(partPath) {
+			digest, _, err1 := audit.FileDigest(partPath)
+			if err1 != nil {
+				return nil, err1
+			}
+			if hex.EncodeToString(digest) != part.SHA256 {
+				return nil, fmt.Errorf("part %d: %w", part.Index, audit.ErrDigestMismatch)
+			}
+		}
+		parts = append(parts, partPath)
+	}
+	return parts, nil
+}
+
+// copyPart 每一段都是完整的 cast 文件，只保留第一段的 header
+func copyPart(w io.Writer, path, keyFile string, withHeader bool) error {
+	r, err := openReplay(path, keyFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return asciinema.CopyPart(w, r, withHeader)
+}
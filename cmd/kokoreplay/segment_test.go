@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+const testCast = `{"version": 2, "width": 80, "height": 24, "timestamp": 1700000000}
+[0.5, "o", "ls\r\n"]
+[1.0, "o", "a.txt\r\n"]
+`
+
+func TestValidateReplay_Compressed(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "storage.key")
+	if err := os.WriteFile(keyFile, []byte("storage key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte(testCast))
+	_ = gw.Close()
+	zw, _ := zstd.NewWriter(nil)
+	zst := zw.EncodeAll([]byte(testCast), nil)
+	_ = zw.Close()
+
+	files := map[string][]byte{
+		"sid.cast":     []byte(testCast),
+		"sid.cast.gz":  gz.Bytes(),
+		"sid.cast.zst": zst,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encrypted := filepath.Join(dir, "enc.cast.zst")
+	if err := utils.EncryptFile(filepath.Join(dir, "sid.cast.zst"), encrypted,
+		utils.NewEnvelopeKey([]byte("storage key"))); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(encrypted)
+	files["enc.cast.zst"] = raw
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := validateReplay(path, keyFile); err != nil {
+			t.Errorf("validate %s: %s", name, err)
+		}
+		// 压缩和加密的录像不能被修改
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, content) {
+			t.Errorf("validate %s modified the file", name)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LeeEirc/terminalparser"
+
+	"github.com/jumpserver/koko/pkg/asciinema"
+)
+
+func runPlay(args []string) {
+	fs := flag.NewFlagSet("play", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "playback speed")
+	idleLimit := fs.Float64("idle-limit", 2, "max idle seconds between events, 0 means no limit")
+	keyFile := fs.String("key-file", "", "storage encrypt key file for encrypted replay")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || *speed <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	r := mustOpenReplay(fs.Arg(0), *keyFile)
+	defer r.Close()
+	reader := asciinema.NewReader(r)
+	header, err := reader.ReadHeader()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Replay %dx%d, speed %.1fx, press Ctrl+C to quit\n", header.Width, header.Height, *speed)
+	out := bufio.NewWriter(os.Stdout)
+	var (
+		last  float64
+		clock = time.Now()
+	)
+	for {
+		event, err1 := reader.ReadEvent()
+		if err1 != nil {
+			if err1 != io.EOF {
+				log.Fatal(err1)
+			}
+			break
+		}
+		delay := event.Time - last
+		last = event.Time
+		if *idleLimit > 0 && delay > *idleLimit {
+			delay = *idleLimit
+		}
+		if delay > 0 {
+			// 按累计时间计算，避免逐个 sleep 产生漂移
+			clock = clock.Add(time.Duration(delay / *speed * float64(time.Second)))
+			_ = out.Flush()
+			time.Sleep(time.Until(clock))
+		}
+		if event.Code == asciinema.EventOutput {
+			_, _ = out.WriteString(event.Data)
+		}
+	}
+	_ = out.Flush()
+}
+
+func runText(args []string) {
+	fs := flag.NewFlagSet("text", flag.ExitOnError)
+	screens := fs.Bool("screens", false, "print the final screen before each clear instead of the transcript")
+	keyFile := fs.String("key-file", "", "storage encrypt key file for encrypted replay")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	r := mustOpenReplay(fs.Arg(0), *keyFile)
+	defer r.Close()
+	if *screens {
+		if err := printScreens(r, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	_, lines, err := asciinema.RenderTranscript(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = asciinema.WriteTranscript(os.Stdout, lines); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 清屏和切换备用屏幕时认为一屏结束
+var clearScreenSeqs = [][]byte{
+	[]byte("\x1b[2J"), []byte("\x1b[3J"), []byte("\x1bc"),
+	[]byte("\x1b[?1049h"), []byte("\x1b[?1049l"), []byte("\x1b[?47h"), []byte("\x1b[?47l"),
+}
+
+func indexClearScreen(p []byte) (int, int) {
+	index, size := -1, 0
+	for _, seq := range clearScreenSeqs {
+		if i := bytes.Index(p, seq); i >= 0 && (index < 0 || i < index) {
+			index, size = i, len(seq)
+		}
+	}
+	return index, size
+}
+
+type screenPrinter struct {
+	w      io.Writer
+	screen *terminalparser.Screen
+	width  int
+	height int
+	count  int
+	last   string
+	start  float64
+}
+
+func (p *screenPrinter) reset(ts float64) {
+	p.screen = terminalparser.NewScreen(p.height, p.width)
+	p.start = ts
+}
+
+// snapshot 只输出屏幕可见的最后 height 行
+func (p *screenPrinter) snapshot() error {
+	rows := make([]string, 0, len(p.screen.Rows))
+	for _, row := range p.screen.GetRows() {
+		rows = append(rows, strings.TrimRight(row.String(), " "))
+	}
+	for len(rows) > 0 && rows[len(rows)-1] == "" {
+		rows = rows[:len(rows)-1]
+	}
+	if len(rows) > p.height {
+		rows = rows[len(rows)-p.height:]
+	}
+	content := strings.Join(rows, "\n")
+	if strings.TrimSpace(content) == "" || content == p.last {
+		return nil
+	}
+	p.last = content
+	p.count++
+	_, err := fmt.Fprintf(p.w, "=== screen %d [%s] ===\n%s\n", p.count, asciinema.FormatOffset(p.start), content)
+	return err
+}
+
+func printScreens(r io.Reader, w io.Writer) error {
+	reader := asciinema.NewReader(r)
+	header, err := reader.ReadHeader()
+	if err != nil {
+		return err
+	}
+	p := screenPrinter{w: w, width: header.Width, height: header.Height}
+	p.reset(0)
+	for {
+		event, err1 := reader.ReadEvent()
+		if err1 != nil {
+			if err1 != io.EOF {
+				return err1
+			}
+			break
+		}
+		if width, height, ok := event.Resize(); ok {
+			p.width, p.height = width, height
+			continue
+		}
+		if event.Code != asciinema.EventOutput {
+			continue
+		}
+		data := []byte(event.Data)
+		for {
+			index, size := indexClearScreen(data)
+			if index < 0 {
+				break
+			}
+			p.screen.Feed(data[:index])
+			if err = p.snapshot(); err != nil {
+				return err
+			}
+			p.reset(event.Time)
+			data = data[index+size:]
+		}
+		p.screen.Feed(data)
+	}
+	return p.snapshot()
+}
+
+func runGrep(args []string) {
+	fs := flag.NewFlagSet("grep", flag.ExitOnError)
+	ignoreCase := fs.Bool("i", false, "case insensitive")
+	withInput := fs.Bool("input", false, "also search recorded input events")
+	keyFile := fs.String("key-file", "", "storage encrypt key file for encrypted replay")
+	_ = fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	pattern := fs.Arg(0)
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Fatal(err)
+	}
+	files := fs.Args()[1:]
+	found := false
+	for _, path := range files {
+		prefix := ""
+		if len(files) > 1 {
+			prefix = path + ":"
+		}
+		matched, err1 := grepReplay(path, *keyFile, re, *withInput, prefix)
+		if err1 != nil {
+			log.Printf("%s: %s", path, err1)
+			continue
+		}
+		found = found || matched
+	}
+	if !found {
+		os.Exit(1)
+	}
+}
+
+func grepReplay(path, keyFile string, re *regexp.Regexp, withInput bool, prefix string) (bool, error) {
+	r, err := openReplay(path, keyFile)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	reader := asciinema.NewReader(r)
+	header, err := reader.ReadHeader()
+	if err != nil {
+		return false, err
+	}
+	start := time.Unix(header.Timestamp, 0)
+	format := func(ts float64, kind, text string) {
+		offset := asciinema.FormatOffset(ts)
+		if header.Timestamp > 0 {
+			at := start.Add(time.Duration(ts * float64(time.Second)))
+			offset += " " + at.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%s[%s] %s %s\n", prefix, offset, kind, text)
+	}
+	matched := false
+	transcript := asciinema.NewTranscript()
+	printed := 0
+	printLines := func() {
+		lines := transcript.Lines()
+		for ; printed < len(lines); printed++ {
+			if re.MatchString(lines[printed].Text) {
+				matched = true
+				format(lines[printed].Time, "o", lines[printed].Text)
+			}
+		}
+	}
+	for {
+		event, err1 := reader.ReadEvent()
+		if err1 != nil {
+			if err1 != io.EOF {
+				return matched, err1
+			}
+			break
+		}
+		switch event.Code {
+		case asciinema.EventOutput:
+			transcript.WriteOutput(event.Time, []byte(event.Data))
+			printLines()
+		case asciinema.EventInput:
+			if withInput && re.MatchString(event.Data) {
+				matched = true
+				text := strconv.Quote(event.Data)
+				if event.User != "" {
+					text += " (" + event.User + ")"
+				}
+				format(event.Time, "i", text)
+			}
+		}
+	}
+	transcript.Flush()
+	printLines()
+	return matched, nil
+}
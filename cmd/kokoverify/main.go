@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"github.com/jumpserver/koko/pkg/audit"
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+var (
+	inputFile    = flag.String("file", "", "downloaded replay or ftp file: /path/to/sid.cast.gz")
+	sigFile      = flag.String("sig", "", "signature file, default <file>.sig")
+	pubKeyFile   = flag.String("pub", "", "terminal public key (required): /path/to/audit_ed25519.pub")
+	encryptKey   = flag.String("key-file", "", "storage encrypt key file for encrypted file, default env SECRET_ENCRYPT_KEY")
+	chainFile    = flag.String("chain", "", "command chain file: /path/to/sid.commands.sig.jsonl")
+	commandsFile = flag.String("commands", "", "exported commands json array, ordered by timestamp")
+	sessionID    = flag.String("session", "", "session id of the command chain")
+)
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+
+	// 签名中的公钥可以被替换，必须使用终端的公钥校验
+	if *pubKeyFile == "" {
+		log.Println("terminal public key is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+	raw, err := os.ReadFile(*pubKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pub, err := audit.ParsePublicKey(raw)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case *inputFile != "":
+		verifyFile(pub)
+	case *chainFile != "":
+		verifyChain(pub)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+func verifyFile(pub ed25519.PublicKey) {
+	sigPath := *sigFile
+	if sigPath == "" {
+		sigPath = *inputFile + audit.SignatureSuffix
+	}
+	sig, err := audit.ReadSignatureFile(sigPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fd, err := os.Open(*inputFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fd.Close()
+	var reader io.Reader = fd
+	// 签名针对加密前的内容
+	if utils.IsEncryptedFile(*inputFile) {
+		key, err1 := utils.LoadEnvelopeKey(os.Getenv("SECRET_ENCRYPT_KEY"), *encryptKey)
+		if err1 != nil {
+			log.Fatal(err1)
+		}
+		if reader, err = utils.NewDecryptReader(fd, key); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err = audit.Verify(reader, sig, pub); err != nil {
+		log.Fatalf("Verify %s failed: %s", *inputFile, err)
+	}
+	fmt.Printf("OK %s sha256:%s signed by %s at %s\n", sig.Object, sig.SHA256, sig.KeyID, sig.SignedAt)
+}
+
+func verifyChain(pub ed25519.PublicKey) {
+	if *sessionID == "" {
+		log.Fatal("session id is required")
+	}
+	links, err := audit.ReadChainFile(*chainFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var commands []*model.Command
+	if *commandsFile != "" {
+		raw, err1 := os.ReadFile(*commandsFile)
+		if err1 != nil {
+			log.Fatal(err1)
+		}
+		if err1 = json.Unmarshal(raw, &commands); err1 != nil {
+			log.Fatal(err1)
+		}
+	}
+	if err = audit.VerifyChain(*sessionID, links, commands, pub); err != nil {
+		log.Fatalf("Verify command chain failed: %s", err)
+	}
+	fmt.Printf("OK %d chain links, %d commands\n", len(links), len(commands))
+}
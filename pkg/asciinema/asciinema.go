@@ -2,22 +2,40 @@ package asciinema
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"strconv"
 	"time"
 )
 
 const (
-	version      = 2
+	Version2 = 2
+	Version3 = 3
+
 	defaultShell = "/bin/bash"
 	defaultTerm  = "xterm"
 )
 
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+	EventMarker = "m"
+)
+
 var (
 	newLine = []byte{'\n'}
 )
 
+// 合并输出时缓存的最大字节数，超过后立即写入
+const maxCoalesceBytes = 64 * 1024
+
+// IdleMarkerPrefix 空闲时间被压缩时写入的标记，后面是实际的空闲秒数
+const IdleMarkerPrefix = "idle:"
+
 func NewWriter(w io.Writer, opts ...Option) *Writer {
 	conf := Config{
+		Version:  Version2,
 		Width:    80,
 		Height:   40,
 		EnvShell: defaultShell,
@@ -37,40 +55,197 @@ type Writer struct {
 	Config
 	TimestampNano int64
 	writer        io.Writer
+
+	// v3 的事件时间是相对上一个事件的间隔
+	lastTs float64
+
+	// 等待合并的输出
+	pending   []byte
+	pendingTs float64
+
+	// 上一个事件的实际时间和已经压缩掉的空闲时间
+	lastRawTs float64
+	idleShift float64
+	written   bool
+
+	stats WriterStats
+}
+
+// WriterStats 录像写入的统计
+type WriterStats struct {
+	Events      int64   `json:"events"`       // 写入的事件数
+	Coalesced   int64   `json:"coalesced"`    // 合并到上一个事件的输出数
+	IdleSkipped float64 `json:"idle_skipped"` // 压缩掉的空闲秒数
+}
+
+func (w *Writer) Stats() WriterStats {
+	return w.stats
+}
+
+// SetOutput 切换输出，用于分段录像，时间线保持不变
+func (w *Writer) SetOutput(out io.Writer) {
+	_ = w.Flush()
+	w.writer = out
+}
+
+// Flush 写入等待合并的输出，关闭文件前需要调用
+func (w *Writer) Flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	data := string(w.pending)
+	w.pending = w.pending[:0]
+	return w.writeEvent(w.pendingTs, EventOutput, data)
 }
 
 func (w *Writer) WriteHeader() error {
-	header := Header{
-		Version:   version,
-		Width:     w.Width,
-		Height:    w.Height,
-		Timestamp: w.Timestamp.Unix(),
-		Title:     w.Title,
-		Env: Env{
-			Shell: w.EnvShell,
-			Term:  w.EnvTerm,
-		},
+	return w.WriteHeaderTo(w.writer)
+}
+
+// WriteHeaderTo 只写入 header 到指定的输出，例如分段录像的新分段
+func (w *Writer) WriteHeaderTo(out io.Writer) error {
+	var header interface{}
+	switch w.Version {
+	case Version3:
+		header = HeaderV3{
+			Version: Version3,
+			Term: Term{
+				Cols: w.Width,
+				Rows: w.Height,
+				Type: w.EnvTerm,
+			},
+			Timestamp: w.Timestamp.Unix(),
+			Title:     w.Title,
+			Env: EnvV3{
+				Shell: w.EnvShell,
+			},
+		}
+	default:
+		header = Header{
+			Version:   Version2,
+			Width:     w.Width,
+			Height:    w.Height,
+			Timestamp: w.Timestamp.Unix(),
+			Title:     w.Title,
+			Env: Env{
+				Shell: w.EnvShell,
+				Term:  w.EnvTerm,
+			},
+		}
 	}
 	raw, err := json.Marshal(header)
 	if err != nil {
 		return err
 	}
-	_, err = w.writer.Write(raw)
+	_, err = out.Write(raw)
 	if err != nil {
 		return err
 	}
-	_, err = w.writer.Write(newLine)
+	_, err = out.Write(newLine)
 	return err
 }
 
-func (w *Writer) WriteRow(p []byte) error {
+func (w *Writer) elapsed() float64 {
 	now := time.Now().UnixNano()
-	ts := float64(now-w.TimestampNano) / 1000 / 1000 / 1000
-	return w.WriteStdout(ts, p)
+	return float64(now-w.TimestampNano) / 1000 / 1000 / 1000
 }
 
+func (w *Writer) WriteRow(p []byte) error {
+	return w.WriteStdout(w.elapsed(), p)
+}
+
+// WriteStdout 开启合并时，时间间隔在 Coalesce 内的输出合并成一个事件
 func (w *Writer) WriteStdout(ts float64, data []byte) error {
-	row := []interface{}{ts, "o", string(data)}
+	if w.Coalesce <= 0 {
+		return w.writeEvent(ts, EventOutput, string(data))
+	}
+	if len(w.pending) > 0 {
+		if ts-w.pendingTs <= w.Coalesce.Seconds() && len(w.pending)+len(data) <= maxCoalesceBytes {
+			w.pending = append(w.pending, data...)
+			w.stats.Coalesced++
+			return nil
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	w.pending = append(w.pending, data...)
+	w.pendingTs = ts
+	return nil
+}
+
+// WriteInputRow 记录用户输入，user 不为空时作为第四个元素写入，用于区分共享会话的参与者
+func (w *Writer) WriteInputRow(p []byte, user string) error {
+	return w.WriteInput(w.elapsed(), p, user)
+}
+
+func (w *Writer) WriteInput(ts float64, data []byte, user string) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if user != "" {
+		return w.writeEvent(ts, EventInput, string(data), user)
+	}
+	return w.writeEvent(ts, EventInput, string(data))
+}
+
+// WriteResizeRow 记录终端窗口大小的变化
+func (w *Writer) WriteResizeRow(width, height int) error {
+	return w.WriteResize(w.elapsed(), width, height)
+}
+
+func (w *Writer) WriteResize(ts float64, width, height int) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return w.writeEvent(ts, EventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+// WriteMarkerRow 记录一个标记，播放器可以据此跳转
+func (w *Writer) WriteMarkerRow(label string) error {
+	return w.WriteMarker(w.elapsed(), label)
+}
+
+func (w *Writer) WriteMarker(ts float64, label string) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return w.writeEvent(ts, EventMarker, label)
+}
+
+// writeEvent ts 是相对录像开始的时间。开启 IdleLimit 时超过的空闲时间从时间线中去掉，
+// 并写入一个记录实际空闲时间的标记
+func (w *Writer) writeEvent(ts float64, code, data string, extra ...interface{}) error {
+	idle := ts - w.lastRawTs
+	if ts > w.lastRawTs {
+		w.lastRawTs = ts
+	}
+	limit := w.IdleLimit.Seconds()
+	if limit > 0 && w.written && idle > limit {
+		w.idleShift += idle - limit
+		w.stats.IdleSkipped += idle - limit
+		label := IdleMarkerPrefix + strconv.FormatFloat(idle, 'f', 3, 64)
+		if err := w.writeRow(ts-w.idleShift, EventMarker, label); err != nil {
+			return err
+		}
+	}
+	w.written = true
+	return w.writeRow(ts-w.idleShift, code, data, extra...)
+}
+
+// writeRow v3 格式会转换成相对上一个事件的间隔
+func (w *Writer) writeRow(ts float64, code, data string, extra ...interface{}) error {
+	if w.Version == Version3 {
+		interval := ts - w.lastTs
+		if interval < 0 {
+			interval = 0
+		}
+		w.lastTs = ts
+		ts = interval
+	}
+	row := make([]interface{}, 0, 3+len(extra))
+	row = append(row, ts, code, data)
+	row = append(row, extra...)
 	raw, err := json.Marshal(row)
 	if err != nil {
 		return err
@@ -79,6 +254,7 @@ func (w *Writer) WriteStdout(ts float64, data []byte) error {
 	if err != nil {
 		return err
 	}
+	w.stats.Events++
 	_, err = w.writer.Write(newLine)
 	return err
 }
@@ -92,7 +268,26 @@ type Header struct {
 	Env       Env    `json:"env"`
 }
 
+// HeaderV3 https://docs.asciinema.org/manual/asciicast/v3/
+type HeaderV3 struct {
+	Version   int    `json:"version"`
+	Term      Term   `json:"term"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+	Env       EnvV3  `json:"env"`
+}
+
+type Term struct {
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+	Type string `json:"type,omitempty"`
+}
+
 type Env struct {
 	Shell string `json:"SHELL"`
 	Term  string `json:"TERM"`
 }
+
+type EnvV3 struct {
+	Shell string `json:"SHELL,omitempty"`
+}
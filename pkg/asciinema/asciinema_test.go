@@ -0,0 +1,232 @@
+package asciinema
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter_WriteInput(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, WithTimestamp(time.Now()))
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteStdout(0.1, []byte("ls\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteInput(0.2, []byte("secret\r"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteInput(0.3, []byte("id\r"), "admin(Administrator)"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %d", len(lines))
+	}
+	tests := []struct {
+		line   string
+		code   string
+		data   string
+		length int
+	}{
+		{lines[1], EventOutput, "ls\r\n", 3},
+		{lines[2], EventInput, "secret\r", 3},
+		{lines[3], EventInput, "id\r", 4},
+	}
+	for _, tt := range tests {
+		var row []interface{}
+		if err := json.Unmarshal([]byte(tt.line), &row); err != nil {
+			t.Fatal(err)
+		}
+		if len(row) != tt.length {
+			t.Fatalf("row %s expected %d elements, got %d", tt.line, tt.length, len(row))
+		}
+		if row[1] != tt.code || row[2] != tt.data {
+			t.Fatalf("row %s mismatch code %s data %q", tt.line, tt.code, tt.data)
+		}
+	}
+}
+
+func TestWriter_Version3(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, WithVersion(Version3), WithWidth(100), WithHeight(30),
+		WithTimestamp(time.Now()))
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.WriteStdout(1.5, []byte("a"))
+	_ = w.WriteResize(2.0, 120, 40)
+	_ = w.WriteMarker(3.25, "end")
+
+	reader := NewReader(&buf)
+	header, err := reader.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != Version3 || header.Width != 100 || header.Height != 30 {
+		t.Fatalf("unexpected header %+v", header)
+	}
+	expected := []float64{1.5, 2.0, 3.25}
+	for i := range expected {
+		event, err1 := reader.ReadEvent()
+		if err1 != nil {
+			t.Fatal(err1)
+		}
+		if event.Time != expected[i] {
+			t.Fatalf("event %d expected time %v, got %v", i, expected[i], event.Time)
+		}
+		if event.Code == EventResize {
+			if width, height, ok := event.Resize(); !ok || width != 120 || height != 40 {
+				t.Fatalf("unexpected resize event %+v", event)
+			}
+		}
+	}
+}
+
+func TestRepairCastFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.cast")
+	content := `{"version":2,"width":80,"height":40,"timestamp":0,"title":"","env":{"SHELL":"/bin/bash","TERM":"xterm"}}
+[0.1,"o","hello"]
+[0.2,"o","wor`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !IsCastFile(path) {
+		t.Fatal("expected cast file")
+	}
+	if err := RepairCastFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.HasSuffix(string(data), `[0.1,"o","hello"]`+"\n") {
+		t.Fatalf("unexpected repaired content: %s", data)
+	}
+}
+
+func TestWriter_SetOutput(t *testing.T) {
+	var part1, part2 bytes.Buffer
+	w := NewWriter(&part1, WithVersion(Version3), WithTimestamp(time.Now()))
+	_ = w.WriteHeader()
+	_ = w.WriteStdout(1.0, []byte("a"))
+	w.SetOutput(&part2)
+	_ = w.WriteHeader()
+	_ = w.WriteStdout(2.5, []byte("b"))
+
+	reader := NewReader(&part2)
+	if _, err := reader.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	event, err := reader.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 分段后 v3 的间隔沿用上一段的时间线
+	if event.Time != 1.5 || event.Data != "b" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestWriter_CoalesceIdleLimit(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, WithTimestamp(time.Now()),
+		WithCoalesce(50*time.Millisecond), WithIdleLimit(2*time.Second))
+	_ = w.WriteHeader()
+	_ = w.WriteStdout(0.10, []byte("a"))
+	_ = w.WriteStdout(0.12, []byte("b"))
+	_ = w.WriteStdout(0.15, []byte("c"))
+	_ = w.WriteStdout(0.30, []byte("d"))
+	_ = w.WriteInput(0.31, []byte("x"), "")
+	_ = w.WriteStdout(10.31, []byte("e"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewReader(&buf)
+	if _, err := reader.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		time float64
+		code string
+		data string
+	}{
+		{0.10, EventOutput, "abc"},
+		{0.30, EventOutput, "d"},
+		{0.31, EventInput, "x"},
+		{2.31, EventMarker, IdleMarkerPrefix + "10.000"},
+		{2.31, EventOutput, "e"},
+	}
+	for i := range expected {
+		event, err := reader.ReadEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Code != expected[i].code || event.Data != expected[i].data ||
+			math.Abs(event.Time-expected[i].time) > 1e-9 {
+			t.Fatalf("event %d expected %+v, got %+v", i, expected[i], event)
+		}
+	}
+	stats := w.Stats()
+	if stats.Events != 5 || stats.Coalesced != 2 || math.Abs(stats.IdleSkipped-8) > 1e-9 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	sid := "00000000-0000-0000-0000-000000000000"
+	if name := PartFilename(sid, 2); name != sid+".part-0002.cast" || !IsPartFilename(name) {
+		t.Fatalf("unexpected part filename %s", name)
+	}
+	path := filepath.Join(t.TempDir(), ManifestFilename(sid))
+	m := Manifest{SessionID: sid, Version: Version2}
+	m.AddPart(Part{Index: 1, Target: "2024-01-01/" + PartFilename(sid, 1) + ".gz", Size: 10})
+	m.AddPart(Part{Index: 2, Target: "2024-01-01/" + PartFilename(sid, 2) + ".gz", Size: 20})
+	if err := m.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Size != 30 || len(got.Parts) != 2 || got.Parts[1].Index != 2 {
+		t.Fatalf("unexpected manifest %+v", got)
+	}
+}
+
+func TestRenderTranscript(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	_ = w.WriteHeader()
+	_ = w.WriteStdout(0.5, []byte("$ ls\r\n"))
+	_ = w.WriteStdout(1.25, []byte("a.txt  b.txt\r\n\x1b[32m$ \x1b[0m"))
+	_ = w.WriteStdout(2, []byte("\r\x1b[K$ \r\n"))
+	_ = w.WriteStdout(3, []byte("$ \r\n"))
+	_, lines, err := RenderTranscript(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同一秒内的输出合并解析
+	want := []TranscriptLine{{0.5, "$ ls"}, {0.5, "a.txt  b.txt"}, {1.25, "$"}}
+	if len(lines) != len(want) {
+		t.Fatalf("unexpected lines %+v", lines)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Fatalf("line %d: want %+v, got %+v", i, want[i], lines[i])
+		}
+	}
+	s := lines[2].String()
+	if s != "[00:00:01.250] $" {
+		t.Fatalf("unexpected format %q", s)
+	}
+	if line, ok := ParseTranscriptLine(s); !ok || line != lines[2] {
+		t.Fatalf("parse transcript line %q failed: %+v", s, line)
+	}
+}
@@ -0,0 +1,111 @@
+package asciinema
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+分段录像:
+	每一段都是完整的 cast 文件 (包含 header)，文件名格式 sessionId.part-0001.cast.gz
+	事件时间沿用整个会话的时间线，拼接时保留第一段的 header，后续分段跳过 header 即可
+	manifest 文件名格式 sessionId.manifest.json
+*/
+
+const (
+	PartMarker     = ".part-"
+	ManifestSuffix = ".manifest.json"
+)
+
+func PartFilename(sid string, index int) string {
+	return fmt.Sprintf("%s%s%04d.cast", sid, PartMarker, index)
+}
+
+func ManifestFilename(sid string) string {
+	return sid + ManifestSuffix
+}
+
+// IsPartFilename 判断是否是分段录像文件
+func IsPartFilename(filename string) bool {
+	return strings.Contains(filename, PartMarker)
+}
+
+type Manifest struct {
+	SessionID string    `json:"session_id"`
+	Version   int       `json:"version"`
+	Parts     []Part    `json:"parts"`
+	Finished  bool      `json:"finished"`
+	Size      int64     `json:"size"`
+	DateStart time.Time `json:"date_start"`
+	DateEnd   time.Time `json:"date_end,omitempty"`
+}
+
+type Part struct {
+	Index  int    `json:"index"`
+	Target string `json:"target"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	// 分段第一个和最后一个事件相对录像开始的时间
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+func (m *Manifest) AddPart(part Part) {
+	m.Parts = append(m.Parts, part)
+	m.Size += part.Size
+}
+
+func (m *Manifest) WriteFile(path string) error {
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = os.WriteFile(tmpPath, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func ReadManifest(path string) (*Manifest, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err = json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// CopyPart 拷贝一个分段的内容，拼接时只有第一段需要 header
+func CopyPart(w io.Writer, r io.Reader, withHeader bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	first := true
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if first {
+			first = false
+			if _, err := ParseHeader(line); err != nil {
+				return err
+			}
+			if !withHeader {
+				continue
+			}
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
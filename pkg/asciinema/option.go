@@ -3,12 +3,18 @@ package asciinema
 import "time"
 
 type Config struct {
+	Version   int
 	Title     string
 	EnvShell  string
 	EnvTerm   string
 	Width     int
 	Height    int
 	Timestamp time.Time
+
+	// 合并输出的时间间隔，0 表示不合并
+	Coalesce time.Duration
+	// 空闲时间的上限，超过的部分从时间线中去掉，0 表示不限制
+	IdleLimit time.Duration
 }
 
 type Option func(options *Config)
@@ -48,3 +54,29 @@ func WithEnvTerm(term string) Option {
 		options.EnvTerm = term
 	}
 }
+
+// WithVersion 设置 asciicast 的格式版本，支持 Version2 和 Version3
+func WithVersion(version int) Option {
+	return func(options *Config) {
+		switch version {
+		case Version3:
+			options.Version = Version3
+		default:
+			options.Version = Version2
+		}
+	}
+}
+
+// WithCoalesce 合并时间间隔内的输出，减少录像的事件数
+func WithCoalesce(quantum time.Duration) Option {
+	return func(options *Config) {
+		options.Coalesce = quantum
+	}
+}
+
+// WithIdleLimit 限制事件之间的最大空闲时间，实际的空闲时间记录在标记中
+func WithIdleLimit(limit time.Duration) Option {
+	return func(options *Config) {
+		options.IdleLimit = limit
+	}
+}
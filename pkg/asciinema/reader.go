@@ -0,0 +1,253 @@
+package asciinema
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidEvent = errors.New("invalid asciicast event")
+
+// NewReader 读取 asciicast v2 和 v3 格式的录像，事件时间统一转换为相对录像开始的时间
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	return &Reader{scanner: scanner}
+}
+
+type Reader struct {
+	scanner *bufio.Scanner
+	header  *CastHeader
+
+	elapsed float64
+}
+
+// CastHeader 兼容 v2 和 v3 的头部信息
+type CastHeader struct {
+	Version   int
+	Width     int
+	Height    int
+	Timestamp int64
+	Title     string
+	Shell     string
+	Term      string
+}
+
+type rawHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title"`
+	Term      *Term  `json:"term"`
+	Env       Env    `json:"env"`
+}
+
+func ParseHeader(line []byte) (*CastHeader, error) {
+	var raw rawHeader
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return nil, err
+	}
+	header := CastHeader{
+		Version:   raw.Version,
+		Width:     raw.Width,
+		Height:    raw.Height,
+		Timestamp: raw.Timestamp,
+		Title:     raw.Title,
+		Shell:     raw.Env.Shell,
+		Term:      raw.Env.Term,
+	}
+	switch raw.Version {
+	case Version2:
+	case Version3:
+		if raw.Term != nil {
+			header.Width = raw.Term.Cols
+			header.Height = raw.Term.Rows
+			header.Term = raw.Term.Type
+		}
+	default:
+		return nil, fmt.Errorf("unsupported asciicast version %d", raw.Version)
+	}
+	return &header, nil
+}
+
+func (r *Reader) ReadHeader() (*CastHeader, error) {
+	if r.header != nil {
+		return r.header, nil
+	}
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	header, err := ParseHeader(r.scanner.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	r.header = header
+	return header, nil
+}
+
+type Event struct {
+	Time float64 // 相对录像开始的秒数
+	Code string
+	Data string
+	User string
+}
+
+// Resize 解析 "r" 事件的窗口大小
+func (e *Event) Resize() (width, height int, ok bool) {
+	if e.Code != EventResize {
+		return 0, 0, false
+	}
+	cols, rows, found := strings.Cut(e.Data, "x")
+	if !found {
+		return 0, 0, false
+	}
+	w, err1 := strconv.Atoi(cols)
+	h, err2 := strconv.Atoi(rows)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+func (r *Reader) ReadEvent() (*Event, error) {
+	if _, err := r.ReadHeader(); err != nil {
+		return nil, err
+	}
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		event, err := ParseEvent(line)
+		if err != nil {
+			return nil, err
+		}
+		if r.header.Version == Version3 {
+			r.elapsed += event.Time
+			event.Time = r.elapsed
+		}
+		return event, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// ParseEvent 解析一行事件，时间保持原始值
+func ParseEvent(line []byte) (*Event, error) {
+	var row []interface{}
+	if err := json.Unmarshal(line, &row); err != nil {
+		return nil, err
+	}
+	if len(row) < 3 {
+		return nil, ErrInvalidEvent
+	}
+	ts, ok1 := row[0].(float64)
+	code, ok2 := row[1].(string)
+	data, ok3 := row[2].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, ErrInvalidEvent
+	}
+	event := Event{Time: ts, Code: code, Data: data}
+	if len(row) > 3 {
+		if user, ok := row[3].(string); ok {
+			event.User = user
+		}
+	}
+	return &event, nil
+}
+
+// IsCastFile 判断文件是否以 asciicast 头部开始
+func IsCastFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	line, err := reader.ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false
+	}
+	_, err = ParseHeader(line)
+	return err == nil
+}
+
+// RepairCastFile 截断异常退出时写入不完整的最后一行，保证 v2 和 v3 录像都可以正常播放
+func RepairCastFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var validSize int64
+	for {
+		line, err1 := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			content := line[:len(line)-1]
+			if validSize == 0 {
+				if _, err2 := ParseHeader(content); err2 != nil {
+					return err2
+				}
+			} else if _, err2 := ParseEvent(content); err2 != nil {
+				break
+			}
+			validSize += int64(len(line))
+		}
+		if err1 != nil {
+			if errors.Is(err1, io.EOF) {
+				break
+			}
+			return err1
+		}
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() == validSize {
+		return nil
+	}
+	return f.Truncate(validSize)
+}
+
+// RepairReplayFile 修复异常退出时未写完整的录像文件，兼容旧的 json 录像
+func RepairReplayFile(path string) error {
+	if IsCastFile(path) {
+		return RepairCastFile(path)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tmp := make([]byte, 1)
+	_, err = f.Seek(-1, 2)
+	if err != nil {
+		return err
+	}
+	_, err = f.Read(tmp)
+	if err != nil {
+		return err
+	}
+	switch string(tmp) {
+	case "}":
+		return nil
+	case ",":
+		_, err = f.Write([]byte(`"0":""}`))
+	default:
+		_, err = f.Write([]byte(`}`))
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package asciinema
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/LeeEirc/terminalparser"
+)
+
+/*
+文本记录: 把录像的输出通过 VT 解析成纯文本行，每一行带上第一次出现的时间，
+连续重复的行 (例如 top、进度条反复刷新) 只保留一次，便于搜索和索引。
+*/
+
+const (
+	// terminalparser.ParseOutput 最多解析 500 行，按行数分批解析
+	transcriptBatchLines = 400
+	// 没有换行的输出 (例如进度条) 超过该大小也需要解析，避免缓存过大
+	transcriptMaxPending = 64 * 1024
+	// 同一秒内的输出合并解析，行的时间精确到该粒度
+	transcriptQuantum = 1.0
+)
+
+type TranscriptLine struct {
+	Time float64 // 相对录像开始的秒数
+	Text string
+}
+
+func (l TranscriptLine) String() string {
+	return "[" + FormatOffset(l.Time) + "] " + l.Text
+}
+
+func NewTranscript() *Transcript {
+	return &Transcript{}
+}
+
+type Transcript struct {
+	pending      []byte
+	pendingStart float64
+	pendingLines int
+	lastTime     float64
+
+	lines []TranscriptLine
+	last  string
+}
+
+// WriteOutput 写入一个输出事件，完整的行按时间粒度批量解析
+func (t *Transcript) WriteOutput(ts float64, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if len(t.pending) > 0 && ts-t.pendingStart >= transcriptQuantum {
+		if idx := bytes.LastIndexByte(t.pending, '\n'); idx >= 0 {
+			t.parse(idx + 1)
+		}
+	}
+	if len(t.pending) == 0 {
+		t.pendingStart = ts
+	}
+	t.lastTime = ts
+	t.pending = append(t.pending, data...)
+	t.pendingLines += bytes.Count(data, newLine)
+	if t.pendingLines >= transcriptBatchLines || len(t.pending) >= transcriptMaxPending {
+		t.parse(len(t.pending))
+	}
+}
+
+// Flush 解析剩余没有换行的输出
+func (t *Transcript) Flush() {
+	if len(t.pending) > 0 {
+		t.parse(len(t.pending))
+	}
+}
+
+func (t *Transcript) Lines() []TranscriptLine {
+	return t.lines
+}
+
+// Drain 返回并清空已经解析的行，用于边录制边写入文件
+func (t *Transcript) Drain() []TranscriptLine {
+	lines := t.lines
+	t.lines = nil
+	return lines
+}
+
+func (t *Transcript) parse(n int) {
+	chunk := t.pending[:n]
+	for len(chunk) > 0 {
+		batch := chunk
+		if idx := nthIndexByte(chunk, '\n', transcriptBatchLines); idx >= 0 {
+			batch = chunk[:idx+1]
+		}
+		chunk = chunk[len(batch):]
+		for _, text := range parseOutputLines(batch) {
+			if text == t.last {
+				continue
+			}
+			t.last = text
+			t.lines = append(t.lines, TranscriptLine{Time: t.pendingStart, Text: text})
+		}
+	}
+	rest := t.pending[n:]
+	t.pending = append(t.pending[:0], rest...)
+	t.pendingLines = bytes.Count(t.pending, newLine)
+	// 剩余未换行的内容近似为最后一个事件的时间
+	t.pendingStart = t.lastTime
+}
+
+// parseOutputLines terminalparser 会丢弃第一个换行之前的内容，补一个换行
+func parseOutputLines(p []byte) []string {
+	data := make([]byte, 0, len(p)+1)
+	data = append(data, '\n')
+	data = append(data, p...)
+	return terminalparser.ParseOutput(data)
+}
+
+func nthIndexByte(p []byte, c byte, n int) int {
+	offset := 0
+	for i := 0; i < n; i++ {
+		idx := bytes.IndexByte(p[offset:], c)
+		if idx < 0 {
+			return -1
+		}
+		offset += idx + 1
+	}
+	return offset - 1
+}
+
+// RenderTranscript 读取整个录像，生成文本记录
+func RenderTranscript(r io.Reader) (*CastHeader, []TranscriptLine, error) {
+	reader := NewReader(r)
+	header, err := reader.ReadHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	transcript := NewTranscript()
+	for {
+		event, err1 := reader.ReadEvent()
+		if err1 != nil {
+			if err1 == io.EOF {
+				break
+			}
+			return header, nil, err1
+		}
+		if event.Code == EventOutput {
+			transcript.WriteOutput(event.Time, []byte(event.Data))
+		}
+	}
+	transcript.Flush()
+	return header, transcript.Lines(), nil
+}
+
+// WriteTranscript 每行格式为 [00:01:02.345] text
+func WriteTranscript(w io.Writer, lines []TranscriptLine) error {
+	var buf strings.Builder
+	for i := range lines {
+		buf.WriteString(lines[i].String())
+		buf.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// ParseTranscriptLine 解析 WriteTranscript 写入的一行
+func ParseTranscriptLine(line string) (TranscriptLine, bool) {
+	offset, text, found := strings.Cut(line, "] ")
+	if !found || !strings.HasPrefix(offset, "[") {
+		return TranscriptLine{}, false
+	}
+	var h, m, sec, ms int64
+	if _, err := fmt.Sscanf(offset[1:], "%d:%d:%d.%d", &h, &m, &sec, &ms); err != nil {
+		return TranscriptLine{}, false
+	}
+	ts := float64(h*3600000+m*60000+sec*1000+ms) / 1000
+	return TranscriptLine{Time: ts, Text: text}, true
+}
+
+// FormatOffset 把相对时间格式化为 HH:MM:SS.mmm
+func FormatOffset(seconds float64) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	ms := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,94 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+)
+
+func TestSigner_Verify(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "audit_ed25519")
+	signer, err := LoadOrCreateSigner(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 再次加载得到同一个密钥
+	loaded, err := LoadOrCreateSigner(keyPath)
+	if err != nil || loaded.KeyID != signer.KeyID {
+		t.Fatalf("reload signer failed: %v", err)
+	}
+	content := []byte("replay content")
+	digest, size, _ := ReaderDigest(bytes.NewReader(content))
+	sig := signer.SignDigest("2024-01-01/sid.cast.gz", digest, size)
+	if err = Verify(bytes.NewReader(content), sig, signer.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err = Verify(bytes.NewReader([]byte("replay c0ntent")), sig, signer.PublicKey()); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected digest mismatch, got %v", err)
+	}
+	if err = Verify(bytes.NewReader(content), sig, nil); !errors.Is(err, ErrNoPublicKey) {
+		t.Fatalf("expected public key required, got %v", err)
+	}
+	sig.Object = "2024-01-01/other.cast.gz"
+	if err = Verify(bytes.NewReader(content), sig, signer.PublicKey()); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature, got %v", err)
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	signer, err := LoadOrCreateSigner(filepath.Join(t.TempDir(), "audit_ed25519"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := []*model.Command{
+		{SessionID: "sid", Input: "ls", Timestamp: 1},
+		{SessionID: "sid", Input: "id", Timestamp: 2},
+		{SessionID: "sid", Input: "rm -rf /tmp/a", Timestamp: 3},
+	}
+	chain := NewCommandChain("sid", signer)
+	links := []*ChainLink{chain.Append(commands[:2]), chain.Append(commands[2:])}
+	if err = VerifyChain("sid", links, commands, signer.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyChain("sid", links, commands, nil); !errors.Is(err, ErrNoPublicKey) {
+		t.Fatalf("expected public key required, got %v", err)
+	}
+	if err = VerifyChain("sid", links, commands[:2], signer.PublicKey()); !errors.Is(err, ErrChainBroken) {
+		t.Fatalf("expected chain broken, got %v", err)
+	}
+	tampered := []*model.Command{commands[0], commands[1], {SessionID: "sid", Input: "ls /tmp", Timestamp: 3}}
+	if err = VerifyChain("sid", links, tampered, signer.PublicKey()); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected digest mismatch, got %v", err)
+	}
+}
+
+func TestVerifyChain_PinKey(t *testing.T) {
+	signer, _ := LoadOrCreateSigner(filepath.Join(t.TempDir(), "audit_ed25519"))
+	other, _ := LoadOrCreateSigner(filepath.Join(t.TempDir(), "audit_ed25519"))
+	commands := []*model.Command{
+		{SessionID: "sid", Input: "ls", Timestamp: 1},
+		{SessionID: "sid", Input: "id", Timestamp: 2},
+	}
+	first := NewCommandChain("sid", signer).Append(commands[:1])
+	// 使用其他密钥伪造后续的节点
+	forged, err := ResumeCommandChain("sid", other, []*ChainLink{first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := []*ChainLink{first, forged.Append(commands[1:])}
+	if err = VerifyChain("sid", links, commands, signer.PublicKey()); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature, got %v", err)
+	}
+	if err = VerifyChain("sid", links[:1], commands[:1], other.PublicKey()); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature with untrusted key, got %v", err)
+	}
+
+	resumed, _ := ResumeCommandChain("sid", signer, []*ChainLink{first})
+	links = []*ChainLink{first, resumed.Append(commands[1:])}
+	if err = VerifyChain("sid", links, commands, signer.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+}
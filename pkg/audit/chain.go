@@ -0,0 +1,192 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+)
+
+/*
+命令哈希链:
+	每批命令的摘要 = sha256(上一批摘要 || 每条命令的规范化内容)，第一批的上一批摘要为空
+	每一批单独签名，删除、插入或者修改任意一条命令都会导致后续的链校验失败
+*/
+
+var ErrChainBroken = errors.New("audit: command chain broken")
+
+type ChainLink struct {
+	Seq       int        `json:"seq"`
+	Count     int        `json:"count"`
+	Prev      string     `json:"prev"`
+	Signature *Signature `json:"signature"`
+}
+
+func (l *ChainLink) Digest() string {
+	return l.Signature.SHA256
+}
+
+type CommandChain struct {
+	sessionID string
+	signer    *Signer
+
+	seq  int
+	prev []byte
+}
+
+func NewCommandChain(sessionID string, signer *Signer) *CommandChain {
+	return &CommandChain{sessionID: sessionID, signer: signer}
+}
+
+// ResumeCommandChain 从已有的链继续追加，用于补传中断的会话的命令
+func ResumeCommandChain(sessionID string, signer *Signer, links []*ChainLink) (*CommandChain, error) {
+	chain := NewCommandChain(sessionID, signer)
+	if len(links) == 0 {
+		return chain, nil
+	}
+	last := links[len(links)-1]
+	prev, err := hex.DecodeString(last.Digest())
+	if err != nil {
+		return nil, fmt.Errorf("%w: link %d digest", ErrChainBroken, last.Seq)
+	}
+	chain.seq = last.Seq
+	chain.prev = prev
+	return chain, nil
+}
+
+func (c *CommandChain) Append(commands []*model.Command) *ChainLink {
+	digest := chainDigest(c.prev, commands)
+	c.seq++
+	link := &ChainLink{
+		Seq:       c.seq,
+		Count:     len(commands),
+		Prev:      hex.EncodeToString(c.prev),
+		Signature: c.signer.SignDigest(chainObject(c.sessionID, c.seq), digest, int64(len(commands))),
+	}
+	c.prev = digest
+	return link
+}
+
+func chainObject(sessionID string, seq int) string {
+	return fmt.Sprintf("session/%s/commands/%d", sessionID, seq)
+}
+
+func chainDigest(prev []byte, commands []*model.Command) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	for i := range commands {
+		h.Write(CommandContent(commands[i]))
+	}
+	return h.Sum(nil)
+}
+
+// CommandContent 命令的规范化内容，只包含命令存储后不会变化的字段
+func CommandContent(cmd *model.Command) []byte {
+	fields := []string{
+		cmd.SessionID, cmd.OrgID, cmd.Input, cmd.Output, cmd.User, cmd.Server, cmd.Account,
+		strconv.FormatInt(cmd.Timestamp, 10), strconv.FormatInt(cmd.RiskLevel, 10),
+	}
+	for i := range fields {
+		fields[i] = strconv.Quote(fields[i])
+	}
+	return []byte(strings.Join(fields, ",") + "\n")
+}
+
+// VerifyChain 按照链的顺序校验命令，commands 需要按照记录时间排序
+// pub 为终端的公钥，不能为空
+func VerifyChain(sessionID string, links []*ChainLink, commands []*model.Command, pub ed25519.PublicKey) error {
+	if pub == nil {
+		return ErrNoPublicKey
+	}
+	var prev []byte
+	offset := 0
+	for i, link := range links {
+		if link.Seq != i+1 || link.Prev != hex.EncodeToString(prev) {
+			return fmt.Errorf("%w: link %d", ErrChainBroken, i+1)
+		}
+		if link.Signature.Object != chainObject(sessionID, link.Seq) {
+			return fmt.Errorf("%w: link %d object %s", ErrChainBroken, link.Seq, link.Signature.Object)
+		}
+		if err := VerifySignature(link.Signature, pub); err != nil {
+			return fmt.Errorf("link %d: %w", link.Seq, err)
+		}
+		if commands == nil {
+			prev, _ = hex.DecodeString(link.Digest())
+			continue
+		}
+		if offset+link.Count > len(commands) {
+			return fmt.Errorf("%w: link %d missing commands", ErrChainBroken, link.Seq)
+		}
+		digest := chainDigest(prev, commands[offset:offset+link.Count])
+		if hex.EncodeToString(digest) != link.Digest() {
+			return fmt.Errorf("%w: link %d", ErrDigestMismatch, link.Seq)
+		}
+		offset += link.Count
+		prev = digest
+	}
+	if commands != nil && offset != len(commands) {
+		return fmt.Errorf("%w: %d commands not in chain", ErrChainBroken, len(commands)-offset)
+	}
+	return nil
+}
+
+func WriteSignatureFile(path string, sig *Signature) error {
+	raw, err := json.MarshalIndent(sig, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, raw, 0644)
+}
+
+func ReadSignatureFile(path string) (*Signature, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sig Signature
+	if err = json.Unmarshal(raw, &sig); err != nil {
+		return nil, err
+	}
+	return &sig, nil
+}
+
+// AppendChainLink 以 json lines 格式追加到链文件
+func AppendChainLink(path string, link *ChainLink) error {
+	raw, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = fd.Write(append(raw, '\n'))
+	return err
+}
+
+func ReadChainFile(path string) ([]*ChainLink, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]*ChainLink, 0, 8)
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		if line == "" {
+			continue
+		}
+		var link ChainLink
+		if err = json.Unmarshal([]byte(line), &link); err != nil {
+			return nil, err
+		}
+		links = append(links, &link)
+	}
+	return links, nil
+}
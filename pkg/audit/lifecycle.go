@@ -0,0 +1,42 @@
+package audit
+
+import (
+	"sync"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+	"github.com/jumpserver-dev/sdk-go/service"
+
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+// LifecycleSink 接收会话生命周期事件，例如 syslog
+type LifecycleSink interface {
+	SessionLifecycle(sid string, event model.LifecycleEvent, logObj model.SessionLifecycleLog) error
+	TypeName() string
+}
+
+var (
+	sinksLock sync.RWMutex
+	sinks     []LifecycleSink
+)
+
+func RegisterLifecycleSink(sink LifecycleSink) {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	sinks = append(sinks, sink)
+}
+
+// RecordSessionLifecycleLog 记录到 core，同时异步发送给注册的 sink
+func RecordSessionLifecycleLog(jmsService *service.JMService, sid string,
+	event model.LifecycleEvent, logObj model.SessionLifecycleLog) error {
+	sinksLock.RLock()
+	for i := range sinks {
+		go func(sink LifecycleSink) {
+			if err := sink.SessionLifecycle(sid, event, logObj); err != nil {
+				logger.Errorf("Send session %s lifecycle %s to %s failed: %s", sid, event, sink.TypeName(), err)
+			}
+		}(sinks[i])
+	}
+	sinksLock.RUnlock()
+	return jmsService.RecordSessionLifecycleLog(sid, event, logObj)
+}
@@ -0,0 +1,224 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+录像、上传下载文件和命令的防篡改签名:
+	对文件计算 sha256，使用终端持有的 Ed25519 私钥签名，签名文件保存在对象旁边 (target + ".sig")
+	审计时使用终端公钥校验下载的文件
+*/
+
+const (
+	SignatureSuffix = ".sig"
+
+	AlgEd25519 = "ed25519"
+
+	signatureVersion = 1
+)
+
+var (
+	ErrDigestMismatch   = errors.New("audit: sha256 digest mismatch")
+	ErrSizeMismatch     = errors.New("audit: size mismatch")
+	ErrInvalidSignature = errors.New("audit: invalid signature")
+	ErrNoPublicKey      = errors.New("audit: public key is required")
+)
+
+type Signer struct {
+	KeyID      string
+	privateKey ed25519.PrivateKey
+}
+
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	return s.privateKey.Public().(ed25519.PublicKey)
+}
+
+// LoadOrCreateSigner 加载签名私钥，不存在时生成新的密钥对，公钥保存在 path + ".pub"
+func LoadOrCreateSigner(path string) (*Signer, error) {
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		return parseSigner(raw)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	privatePem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err = os.WriteFile(path, privatePem, 0600); err != nil {
+		return nil, err
+	}
+	signer := &Signer{privateKey: privateKey, KeyID: KeyID(privateKey.Public().(ed25519.PublicKey))}
+	publicPem, err := EncodePublicKey(signer.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path+".pub", publicPem, 0644); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+func parseSigner(raw []byte) (*Signer, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("audit: invalid private key pem")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("audit: private key is not ed25519")
+	}
+	return &Signer{privateKey: privateKey, KeyID: KeyID(privateKey.Public().(ed25519.PublicKey))}, nil
+}
+
+func EncodePublicKey(pub ed25519.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func ParsePublicKey(raw []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("audit: invalid public key pem")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("audit: public key is not ed25519")
+	}
+	return pub, nil
+}
+
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+type Signature struct {
+	Version   int       `json:"version"`
+	Algorithm string    `json:"alg"`
+	KeyID     string    `json:"kid"`
+	PublicKey []byte    `json:"public_key"`
+	Object    string    `json:"object"`
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	SignedAt  time.Time `json:"signed_at"`
+	Signature []byte    `json:"signature"`
+}
+
+// message 被签名的内容，字段顺序固定
+func (s *Signature) message() []byte {
+	return []byte(strings.Join([]string{
+		"koko-audit-v" + strconv.Itoa(s.Version),
+		s.Object,
+		s.SHA256,
+		strconv.FormatInt(s.Size, 10),
+		strconv.FormatInt(s.SignedAt.Unix(), 10),
+	}, "\n"))
+}
+
+func (s *Signer) SignDigest(object string, digest []byte, size int64) *Signature {
+	sig := &Signature{
+		Version:   signatureVersion,
+		Algorithm: AlgEd25519,
+		KeyID:     s.KeyID,
+		PublicKey: s.PublicKey(),
+		Object:    object,
+		SHA256:    hex.EncodeToString(digest),
+		Size:      size,
+		SignedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	sig.Signature = ed25519.Sign(s.privateKey, sig.message())
+	return sig
+}
+
+func (s *Signer) SignFile(path, object string) (*Signature, error) {
+	digest, size, err := FileDigest(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.SignDigest(object, digest, size), nil
+}
+
+func FileDigest(path string) ([]byte, int64, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fd.Close()
+	return ReaderDigest(fd)
+}
+
+func ReaderDigest(r io.Reader) ([]byte, int64, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), size, nil
+}
+
+// VerifySignature 使用终端的公钥校验签名，签名中的公钥任何人都可以替换，不能用来校验
+func VerifySignature(sig *Signature, pub ed25519.PublicKey) error {
+	if pub == nil {
+		return ErrNoPublicKey
+	}
+	if sig.Algorithm != AlgEd25519 {
+		return fmt.Errorf("audit: unsupported algorithm %s", sig.Algorithm)
+	}
+	if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, sig.message(), sig.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Verify 校验 reader 的内容与签名是否一致
+func Verify(r io.Reader, sig *Signature, pub ed25519.PublicKey) error {
+	if err := VerifySignature(sig, pub); err != nil {
+		return err
+	}
+	digest, size, err := ReaderDigest(r)
+	if err != nil {
+		return err
+	}
+	if size != sig.Size {
+		return fmt.Errorf("%w: expected %d, got %d", ErrSizeMismatch, sig.Size, size)
+	}
+	if hex.EncodeToString(digest) != sig.SHA256 {
+		return ErrDigestMismatch
+	}
+	return nil
+}
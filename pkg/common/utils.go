@@ -9,6 +9,8 @@ import (
 	"sync"
 	"time"
 	"unsafe"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 func FileExists(name string) bool {
@@ -27,6 +29,53 @@ func EnsureDirExist(name string) error {
 	return nil
 }
 
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	SuffixGzip = ".gz"
+	SuffixZstd = ".zst"
+)
+
+// CompressionSuffix 压缩后的文件后缀，未知的算法使用 gzip
+func CompressionSuffix(algorithm string) string {
+	if algorithm == CompressionZstd {
+		return SuffixZstd
+	}
+	return SuffixGzip
+}
+
+// CompressFile 按照算法压缩文件，未知的算法使用 gzip
+func CompressFile(srcPath, dstPath, algorithm string) error {
+	if algorithm == CompressionZstd {
+		return ZstdCompressFile(srcPath, dstPath)
+	}
+	return GzipCompressFile(srcPath, dstPath)
+}
+
+func ZstdCompressFile(srcPath, dstPath string) error {
+	sf, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	df, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+	// 录像是大量重复的 json 行，较高的压缩等级收益明显
+	writer, err := zstd.NewWriter(df, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(writer, sf); err != nil {
+		_ = writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
 func GzipCompressFile(srcPath, dstPath string) error {
 	sf, err := os.Open(srcPath)
 	if err != nil {
@@ -67,8 +67,81 @@ type Config struct {
 
 	DisableInputAsCommand bool `mapstructure:"DISABLE_INPUT_AS_COMMAND"`
 
+	// 录像中记录用户输入 (asciicast "i" 事件)，包含未回显的输入，例如密码，core 没有下发 TERMINAL_REPLAY_RECORD_INPUT 时使用
+	ReplayRecordInput bool `mapstructure:"REPLAY_RECORD_INPUT"`
+
+	// 录像的 asciicast 格式版本 [2, 3]
+	ReplayCastVersion int `mapstructure:"REPLAY_CAST_VERSION"`
+
+	// 录像合并输出的时间间隔 (毫秒) 和最大空闲时间 (秒)，0 表示不合并、不限制
+	ReplayCoalesceMs int `mapstructure:"REPLAY_COALESCE_MS"`
+	ReplayIdleLimit  int `mapstructure:"REPLAY_IDLE_LIMIT"`
+	// 录像的压缩算法，上传到 core 读取的存储，只支持 gzip
+	ReplayCompression string `mapstructure:"REPLAY_COMPRESSION"`
+
+	// 分段录像，按照大小 (MB) 或者时长 (分钟) 切分，会话进行中上传已完成的分段，0 表示不分段
+	ReplaySegmentSize     int `mapstructure:"REPLAY_SEGMENT_SIZE"`
+	ReplaySegmentDuration int `mapstructure:"REPLAY_SEGMENT_DURATION"`
+
+	// 会话结束时生成录像的文本记录 [storage, es]，storage 上传到录像旁边，es 索引到 es 命令存储，空表示不生成
+	ReplayTranscript string `mapstructure:"REPLAY_TRANSCRIPT"`
+
+	// 录像存储类型为 local 时，录像和文件复制到的目录 (NFS/CIFS 挂载点)
+	LocalStorageRoot string `mapstructure:"LOCAL_STORAGE_ROOT"`
+
 	SecretEncryptKey string `mapstructure:"SECRET_ENCRYPT_KEY"`
 
+	// 命令同时写入的其他存储类型，例如 [server]，每个存储单独重试
+	CommandStorageExtra []string `mapstructure:"COMMAND_STORAGE_EXTRA"`
+
+	// syslog 命令存储和会话事件，network [udp, tcp, tls]，format [cef, json]
+	SyslogNetwork            string `mapstructure:"SYSLOG_NETWORK"`
+	SyslogAddress            string `mapstructure:"SYSLOG_ADDRESS"`
+	SyslogFormat             string `mapstructure:"SYSLOG_FORMAT"`
+	SyslogInsecureSkipVerify bool   `mapstructure:"SYSLOG_INSECURE_SKIP_VERIFY"`
+
+	// webhook 命令存储，format [json, ndjson]，设置 body 模板时忽略 format
+	WebhookURL                string            `mapstructure:"WEBHOOK_URL"`
+	WebhookMethod             string            `mapstructure:"WEBHOOK_METHOD"`
+	WebhookFormat             string            `mapstructure:"WEBHOOK_FORMAT"`
+	WebhookBodyTemplate       string            `mapstructure:"WEBHOOK_BODY_TEMPLATE"`
+	WebhookHeaders            map[string]string `mapstructure:"WEBHOOK_HEADERS"`
+	WebhookSecret             string            `mapstructure:"WEBHOOK_SECRET"`
+	WebhookBatchSize          int               `mapstructure:"WEBHOOK_BATCH_SIZE"`
+	WebhookInsecureSkipVerify bool              `mapstructure:"WEBHOOK_INSECURE_SKIP_VERIFY"`
+
+	// 录像和上传下载文件在上传到外部存储前加密，密钥优先使用密钥文件，其次使用 SECRET_ENCRYPT_KEY
+	StorageEncryptEnabled bool   `mapstructure:"STORAGE_ENCRYPT_ENABLED"`
+	StorageEncryptKeyFile string `mapstructure:"STORAGE_ENCRYPT_KEY_FILE"`
+
+	// 录像、上传下载文件和命令使用终端的 Ed25519 密钥签名，默认密钥文件为 data/keys/audit_ed25519
+	AuditSignEnabled bool   `mapstructure:"AUDIT_SIGN_ENABLED"`
+	AuditSignKeyFile string `mapstructure:"AUDIT_SIGN_KEY_FILE"`
+
+	// 本地磁盘水位 (百分比)，超过低水位告警，超过高水位不再创建录像和文件记录，开启 fail closed 时拒绝新的会话
+	DiskWatermarkLow  int  `mapstructure:"DISK_WATERMARK_LOW"`
+	DiskWatermarkHigh int  `mapstructure:"DISK_WATERMARK_HIGH"`
+	DiskFailClosed    bool `mapstructure:"DISK_FAIL_CLOSED"`
+	// 超过高水位时从最旧的上传失败的录像和文件开始删除，直到低于低水位
+	DiskPressureEvict bool `mapstructure:"DISK_PRESSURE_EVICT"`
+	// 上传失败的录像、文件以及本地保留的签名和文本记录的保留天数，0 表示不删除
+	ArtifactRetentionDays int `mapstructure:"ARTIFACT_RETENTION_DAYS"`
+	// 已下载的 zip 打包临时文件的保留时间 (小时)
+	ZipTmpRetentionHours int `mapstructure:"ZIP_TMP_RETENTION_HOURS"`
+
+	// 上传失败的录像和文件进入上传队列持续重试，失败次数达到 FALLBACK_ATTEMPTS 后使用 server 存储
+	UploadQueueWorkers          int `mapstructure:"UPLOAD_QUEUE_WORKERS"`
+	UploadQueueFallbackAttempts int `mapstructure:"UPLOAD_QUEUE_FALLBACK_ATTEMPTS"`
+
+	// rz sz 单个文件的最大传输大小 (MB)，超过时取消传输，0 表示不限制
+	ZmodemMaxFileSize int `mapstructure:"ZMODEM_MAX_FILE_SIZE"`
+
+	// 命令复核工单的等待时间 (分钟)，超时自动取消工单，0 表示不限制
+	CommandReviewTimeout int `mapstructure:"COMMAND_REVIEW_TIMEOUT"`
+
+	// 登录 Linux 资产后向 bash、zsh 注入 OSC 133 标记，精确解析命令、输出、退出码和执行时长
+	ShellIntegration bool `mapstructure:"SHELL_INTEGRATION"`
+
 	// Force both public key and password authentication (two-factor SSH login)
 	ForceMultiAuth bool `mapstructure:"FORCE_MULTI_AUTH"`
 
@@ -80,12 +153,18 @@ type Config struct {
 	ReplayFolderPath  string
 	FTPFileFolderPath string
 	CertsFolderPath   string
+
+	CommandSpoolFolderPath string
 }
 
 func (c *Config) EnsureConfigValid() {
 	if c.LanguageCode == "" {
 		c.LanguageCode = "en"
 	}
+	// core 的播放器只支持 .cast.gz，上传的录像不能使用 zstd 压缩
+	if strings.EqualFold(c.ReplayCompression, "zstd") {
+		log.Fatalf("REPLAY_COMPRESSION zstd is not supported: core player only plays gzip replays")
+	}
 }
 
 func (c *Config) UpdateRedisPassword(val string) {
@@ -116,6 +195,7 @@ func getDefaultConfig() Config {
 	dataFolderPath := filepath.Join(rootPath, "data")
 	replayFolderPath := filepath.Join(dataFolderPath, "replays")
 	ftpFileFolderPath := filepath.Join(dataFolderPath, "ftp_files")
+	commandSpoolFolderPath := filepath.Join(dataFolderPath, "commands")
 	LogDirPath := filepath.Join(dataFolderPath, "logs")
 	keyFolderPath := filepath.Join(dataFolderPath, "keys")
 	CertsFolderPath := filepath.Join(dataFolderPath, "certs")
@@ -148,6 +228,8 @@ func getDefaultConfig() Config {
 		CertsFolderPath:    CertsFolderPath,
 		LanguageCode:       "en",
 
+		CommandSpoolFolderPath: commandSpoolFolderPath,
+
 		Comment:             "KOKO",
 		UploadFailedReplay:  true,
 		UploadFailedFTPFile: true,
@@ -166,6 +248,14 @@ func getDefaultConfig() Config {
 		EnableLocalPortForward: false,
 		EnableVscodeSupport:    false,
 		DisableInputAsCommand:  true,
+		ReplayCastVersion:      2,
+		ReplayCompression:      "gzip",
+		DiskWatermarkLow:       85,
+		DiskWatermarkHigh:      95,
+		ZipTmpRetentionHours:   24,
+
+		UploadQueueWorkers:          2,
+		UploadQueueFallbackAttempts: 5,
 	}
 
 }
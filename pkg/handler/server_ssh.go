@@ -20,12 +20,15 @@ import (
 	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver-dev/sdk-go/service"
 
+	"github.com/jumpserver/koko/pkg/audit"
 	"github.com/jumpserver/koko/pkg/auth"
 	"github.com/jumpserver/koko/pkg/cache"
 	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/i18n"
 	"github.com/jumpserver/koko/pkg/logger"
 	"github.com/jumpserver/koko/pkg/proxy"
+	"github.com/jumpserver/koko/pkg/rsync"
+	"github.com/jumpserver/koko/pkg/scp"
 	"github.com/jumpserver/koko/pkg/session"
 	"github.com/jumpserver/koko/pkg/srvconn"
 	"github.com/jumpserver/koko/pkg/utils"
@@ -379,20 +382,9 @@ func (s *Server) proxyTokenInfo(sess ssh.Session, tokenInfo *model.ConnectToken)
 	}
 }
 
-func IsScpCommand(rawStr string) bool {
-	rawCommands := strings.Split(rawStr, ";")
-	for _, cmd := range rawCommands {
-		cmd = strings.TrimSpace(cmd)
-		if strings.HasPrefix(cmd, "scp") {
-			return true
-		}
-	}
-	return false
-}
-
 func (s *Server) recordSessionLifecycle(sid string, event model.LifecycleEvent, reason string) {
 	logObj := model.SessionLifecycleLog{Reason: reason}
-	if err2 := s.jmsService.RecordSessionLifecycleLog(sid, event, logObj); err2 != nil {
+	if err2 := audit.RecordSessionLifecycleLog(s.jmsService, sid, event, logObj); err2 != nil {
 		logger.Errorf("Record session %s lifecycle %s failed: %s", sid, event, err2)
 	}
 }
@@ -400,39 +392,28 @@ func (s *Server) recordSessionLifecycle(sid string, event model.LifecycleEvent,
 func (s *Server) proxyAssetCommand(sess ssh.Session, sshClient *srvconn.SSHClient,
 	tokenInfo *model.ConnectToken) {
 	rawStr := sess.RawCommand()
-	if IsScpCommand(rawStr) {
-		if !config.GetConf().EnableVscodeSupport {
-			logger.Errorf("Not support scp command: %s", rawStr)
-			utils.IgnoreErrWriteString(sess, "Not support scp command")
-			return
-		}
-		// 开启了 vscode 支持，放开使用 scp 命令传输文件
-		// todo: 解析 scp 数据包，获取文件信息
+	scpCmd, isScp := scp.ParseCommand(rawStr)
+	rsyncCmd, isRsync := rsync.ParseCommand(rawStr)
+	if isScp {
 		logger.Infof("Execute scp command: %s", rawStr)
+	} else if isRsync {
+		logger.Infof("Execute rsync command: %s", rawStr)
 	} else {
 		logger.Infof("Execute command: %s", rawStr)
 	}
 
-	// todo: 暂且不支持 acl 工单
 	acls := tokenInfo.CommandFilterACLs
 	sort.Sort(model.CommandACLs(acls))
-	for i := range acls {
-		acl := acls[i]
-		_, action, _ := acl.Match(rawStr)
-		switch action {
+	matchedRule, _, matched := proxy.MatchCommandACLs(acls, rawStr)
+	if matched {
+		switch matchedRule.Acl.Action {
 		case model.ActionReview:
-			msg := "SSH Command not support ACL review ticket"
-			utils.IgnoreErrWriteString(sess, msg)
-			logger.Errorf("SSH Command not support ACL review ticket `%s`", rawStr)
-			return
+			logger.Infof("ACL review execute %s ", rawStr)
 		case model.ActionReject:
 			logger.Errorf("ACL reject execute %s ", rawStr)
 			return
-		default:
-		}
-		if action == model.ActionAccept {
+		case model.ActionAccept:
 			logger.Debugf("ACL accept execute %s ", rawStr)
-			break
 		}
 	}
 
@@ -473,9 +454,57 @@ func (s *Server) proxyAssetCommand(sess ssh.Session, sshClient *srvconn.SSHClien
 		session.RemoveSession(traceSession)
 	}()
 
+	if isScp {
+		if err1 := checkScpPermission(scpCmd, tokenInfo.Actions); err1 != nil {
+			logger.Errorf("User %s scp %s rejected: %s", tokenInfo.User.String(), rawStr, err1)
+			s.newScpAudit(scpCmd, &respSession, host, nil).RecordDenied(scpCmd.Paths)
+			// scp 协议的错误响应，客户端会显示错误信息并退出
+			utils.IgnoreErrWriteString(sess, fmt.Sprintf("\x01scp: %s\n", err1))
+			_ = sess.Exit(1)
+			return
+		}
+	}
+	if isRsync {
+		if err1 := checkRsyncPermission(rsyncCmd, tokenInfo.Actions); err1 != nil {
+			logger.Errorf("User %s rsync %s rejected: %s", tokenInfo.User.String(), rawStr, err1)
+			s.newRsyncAudit(rsyncCmd, &respSession, host, nil).RecordDenied()
+			utils.IgnoreErrWriteString(sess.Stderr(), fmt.Sprintf("rsync: %s\n", err1))
+			_ = sess.Exit(1)
+			return
+		}
+	}
+
+	// scp 和 rsync 传输的是二进制数据，不录像，解析出传输的文件
+	execRecord := s.newExecAudit(sess, &respSession, rawStr, isScp || isRsync)
+	if matched {
+		execRecord.SetFilterRule(matchedRule)
+		if matchedRule.Acl.Action == model.ActionReview {
+			// 复核的提示写入 stderr 和录像，审批通过之后才连接资产执行命令
+			lang := i18n.NewLang(tokenInfo.User.Language)
+			reviewWriter := io.MultiWriter(sess.Stderr(), execRecord.StderrWriter())
+			result := s.waitExecCommandReview(ctx, sess, reviewWriter, &respSession, matchedRule, rawStr, lang)
+			switch result.action {
+			case model.ActionAccept:
+				execRecord.SetRiskLevel(model.ReviewAccept)
+			case model.ActionReject:
+				execRecord.SetRiskLevel(model.ReviewReject)
+			default:
+				execRecord.SetRiskLevel(model.ReviewCancel)
+			}
+			if result.action != model.ActionAccept {
+				logger.Infof("User %s exec command %s not approved: %s", tokenInfo.User.String(),
+					rawStr, result.action)
+				execRecord.Finish(1)
+				_ = sess.Exit(1)
+				return
+			}
+		}
+	}
+
 	goSess, err := sshClient.AcquireSession()
 	if err != nil {
 		logger.Errorf("Get SSH session failed: %s", err)
+		execRecord.Finish(-1)
 		return
 	}
 	s.recordSessionLifecycle(respSession.ID, model.AssetConnectSuccess, "")
@@ -502,65 +531,77 @@ func (s *Server) proxyAssetCommand(sess ssh.Session, sshClient *srvconn.SSHClien
 		)
 	}
 
-	goSess.Stdin = sess
+	goSess.Stdin = execRecord.StdinReader(sess)
+	stdoutWriter := execRecord.StdoutWriter()
+	var scpRecord *scpAudit
+	if isScp {
+		scpRecord = s.newScpAudit(scpCmd, &respSession, host, execRecord)
+		switch scpCmd.Mode {
+		case scp.ModeSink:
+			goSess.Stdin = io.TeeReader(sess, scpRecord)
+		case scp.ModeSource:
+			stdoutWriter = scpRecord
+		}
+	}
+	runCmd := rawStr
+	var rsyncRecord *rsyncAudit
+	if isRsync {
+		// 关闭增量递归，资产在传输开始前发送完整的文件列表
+		runCmd = rsyncCmd.DisableIncRecurse(rawStr)
+		rsyncRecord = s.newRsyncAudit(rsyncCmd, &respSession, host, execRecord)
+		goSess.Stdin = io.TeeReader(sess, rsyncRecord.ClientWriter())
+		stdoutWriter = rsyncRecord.ServerWriter()
+	}
 	out, err := goSess.StdoutPipe()
 	if err != nil {
 		logger.Errorf("Get SSH session stdout failed: %s", err)
+		execRecord.Finish(-1)
 		return
 	}
 	errOut, err := goSess.StderrPipe()
 	if err != nil {
 		logger.Errorf("Get SSH session stderr failed: %s", err)
+		execRecord.Finish(-1)
 		return
 	}
 	stderrWriter := sess.Stderr()
-	recordBuf := utils.NewMaxSizeBuffer(1024)
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		outRecorderWriter := io.MultiWriter(sess, recordBuf)
+		outRecorderWriter := io.MultiWriter(sess, stdoutWriter)
 		_, _ = io.Copy(outRecorderWriter, out)
 		logger.Debugf("User %s finished session stdout", tokenInfo.User.String())
 	}()
 
 	go func() {
 		defer wg.Done()
-		errRecorderWriter := io.MultiWriter(stderrWriter, recordBuf)
+		errRecorderWriter := io.MultiWriter(stderrWriter, execRecord.StderrWriter())
 		_, _ = io.Copy(errRecorderWriter, errOut)
 		logger.Debugf("User %s finished session stderr", tokenInfo.User.String())
 	}()
-	now := time.Now()
-	err = goSess.Run(rawStr)
+	exitCode := 0
+	err = goSess.Run(runCmd)
 	if err != nil {
 		logger.Errorf("User %s Run command %s failed: %s",
 			tokenInfo.User.String(), rawStr, err)
+		exitCode = -1
 		var exitErr *gossh.ExitError
 		if errors.As(err, &exitErr) {
-			exitCode := exitErr.ExitStatus()
+			exitCode = exitErr.ExitStatus()
 			if err1 := sess.Exit(exitCode); err1 != nil {
 				logger.Errorf("Create sess exit code %d err: %s", exitCode, err1)
 			}
 		}
 	}
 	wg.Wait()
-	cmd := model.Command{
-		SessionID:   respSession.ID,
-		OrgID:       respSession.OrgID,
-		Input:       rawStr,
-		User:        respSession.User,
-		Server:      respSession.Asset,
-		Account:     respSession.Account,
-		Timestamp:   now.Unix(),
-		DateCreated: now,
-	}
-	outResult := recordBuf.String()
-	cmd.Output = strings.ReplaceAll(outResult, "\x00", "")
-	termCfg := s.GetTerminalConfig()
-	cmdStorage := proxy.NewCommandStorage(s.jmsService, &termCfg)
-	if err2 := cmdStorage.BulkSave([]*model.Command{&cmd}); err2 != nil {
-		logger.Errorf("Create command err: %s", err2)
+	if scpRecord != nil {
+		scpRecord.Close()
+	}
+	if rsyncRecord != nil {
+		rsyncRecord.Finish(exitCode)
 	}
+	execRecord.Finish(exitCode)
 	reason := string(model.ReasonErrConnectDisconnect)
 	s.recordSessionLifecycle(respSession.ID, model.AssetConnectFinished, reason)
 }
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/proxy"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+/*
+非交互式命令 (ssh user@koko 'command') 的审计:
+	stdout 和 stderr 按照终端显示的顺序写入录像，开启 REPLAY_RECORD_INPUT 时记录 stdin
+	scp 不录像，传输的文件由 scp 解析记录
+	录像开始和结束写入 exec:命令 和 exit:退出码 标记
+	命令通过命令记录器保存，Output 记录 stdout，stderr 单独保存在 Stderr 字段，并附带退出码和执行时长
+*/
+
+const execOutputMaxSize = 1024
+
+type execAudit struct {
+	session *model.Session
+	input   string
+	user    string
+
+	replay *proxy.ReplyRecorder
+	cmdR   *proxy.CommandRecorder
+
+	stdout *utils.SyncBuffer
+	stderr *utils.SyncBuffer
+	start  time.Time
+
+	// scp 等二进制数据不录像，stdout 不记录到命令输出
+	binary bool
+
+	riskLevel int64
+	rule      proxy.CommandRule
+}
+
+// newExecAudit binary 为 true 时不录像，例如 scp 传输的二进制数据
+func (s *Server) newExecAudit(sess ssh.Session, respSession *model.Session, rawStr string,
+	binary bool) *execAudit {
+	termCfg := s.GetTerminalConfig()
+	a := &execAudit{
+		session: respSession,
+		input:   rawStr,
+		user:    respSession.User,
+		cmdR:    proxy.NewCommandRecorder(respSession.ID, s.jmsService, &termCfg),
+		stdout:  utils.NewMaxSizeBuffer(execOutputMaxSize),
+		stderr:  utils.NewMaxSizeBuffer(execOutputMaxSize),
+		start:   time.Now(),
+		binary:  binary,
+	}
+	if binary {
+		return a
+	}
+	info := &proxy.ReplyInfo{Width: 80, Height: 40, TimeStamp: a.start}
+	if pty, _, isPty := sess.Pty(); isPty {
+		info.Width = pty.Window.Width
+		info.Height = pty.Window.Height
+	}
+	replay, err := proxy.NewReplayRecord(respSession.ID, s.jmsService,
+		proxy.NewReplayStorage(s.jmsService, &termCfg), info)
+	if err != nil {
+		logger.Errorf("Session %s: create exec replay failed: %s", respSession.ID, err)
+	}
+	a.replay = replay
+	a.replay.RecordMarker("exec:" + rawStr)
+	return a
+}
+
+func (a *execAudit) StdoutWriter() io.Writer {
+	if a.binary {
+		return io.Discard
+	}
+	return &execOutputWriter{audit: a, buf: a.stdout}
+}
+
+// SetFilterRule 命令匹配的过滤规则，警告规则同时设置风险等级
+func (a *execAudit) SetFilterRule(rule proxy.CommandRule) {
+	a.rule = rule
+	switch rule.Acl.Action {
+	case model.ActionWarning, model.ActionNotifyAndWarn:
+		a.riskLevel = model.WarningLevel
+	}
+}
+
+// SetRiskLevel 复核的结果
+func (a *execAudit) SetRiskLevel(level int64) {
+	a.riskLevel = level
+}
+
+// AddOutput 追加到命令输出，例如 scp 传输的文件
+func (a *execAudit) AddOutput(output string) {
+	_, _ = a.stdout.Write([]byte(output))
+}
+
+func (a *execAudit) StderrWriter() io.Writer {
+	return &execOutputWriter{audit: a, buf: a.stderr}
+}
+
+// StdinReader 开启记录用户输入时 stdin 写入录像
+func (a *execAudit) StdinReader(r io.Reader) io.Reader {
+	if a.replay == nil || !proxy.ReplayRecordInputEnabled() {
+		return r
+	}
+	return io.TeeReader(r, &execInputWriter{audit: a})
+}
+
+// Finish 记录退出码并结束录像和命令记录
+func (a *execAudit) Finish(exitCode int) {
+	duration := time.Since(a.start)
+	if a.replay != nil {
+		a.replay.RecordMarker(fmt.Sprintf("exit:%d", exitCode))
+		a.replay.End()
+	}
+	cmd := storage.Command{Command: model.Command{
+		SessionID:   a.session.ID,
+		OrgID:       a.session.OrgID,
+		Input:       a.input,
+		Output:      strings.ReplaceAll(a.stdout.String(), "\x00", ""),
+		User:        a.session.User,
+		Server:      a.session.Asset,
+		Account:     a.session.Account,
+		Timestamp:   a.start.Unix(),
+		RiskLevel:   a.riskLevel,
+		DateCreated: a.start,
+	}}
+	cmd.SetExitStatus(exitCode, duration)
+	cmd.Stderr = strings.ReplaceAll(a.stderr.String(), "\x00", "")
+	if a.rule.Acl != nil {
+		cmd.CmdFilterAclId = a.rule.Acl.ID
+		cmd.CmdGroupId = a.rule.Item.ID
+	}
+	a.cmdR.Record(&cmd)
+	a.cmdR.End()
+	logger.Infof("Session %s: exec command finished, exit status %d, duration %s",
+		a.session.ID, exitCode, duration)
+}
+
+type execOutputWriter struct {
+	audit *execAudit
+	buf   *utils.SyncBuffer
+}
+
+func (w *execOutputWriter) Write(p []byte) (int, error) {
+	_, _ = w.buf.Write(p)
+	if w.audit.replay != nil {
+		w.audit.replay.Record(p)
+	}
+	return len(p), nil
+}
+
+type execInputWriter struct {
+	audit *execAudit
+}
+
+func (w *execInputWriter) Write(p []byte) (int, error) {
+	w.audit.replay.RecordInput(p, w.audit.user)
+	return len(p), nil
+}
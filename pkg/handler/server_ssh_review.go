@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"github.com/jumpserver/koko/pkg/i18n"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/proxy"
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+/*
+ssh exec 命令的复核:
+	提交工单后等待审批，审批通过才执行命令，进度输出到 stderr，不影响 stdout 的数据
+	客户端可以通过环境变量设置等待的超时时间，超时或者断开连接时取消工单，例如:
+		ssh -o SetEnv=KOKO_REVIEW_TIMEOUT=10m user@koko 'command'
+	超时时间是秒数或者 Go 的时间格式 (30s 10m)，没有设置时一直等待
+*/
+
+const (
+	execReviewTimeoutEnv = "KOKO_REVIEW_TIMEOUT"
+
+	// execReviewProgressInterval stderr 输出等待时间的间隔
+	execReviewProgressInterval = 10 * time.Second
+)
+
+// execReviewTimeout 客户端环境变量中的复核超时时间
+func execReviewTimeout(sess ssh.Session) time.Duration {
+	for _, item := range sess.Environ() {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || name != execReviewTimeoutEnv {
+			continue
+		}
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+			return duration
+		}
+		logger.Errorf("Invalid exec review timeout %s", value)
+	}
+	return 0
+}
+
+type execReviewResult struct {
+	action    model.CommandAction
+	processor string
+}
+
+// waitExecCommandReview 提交复核工单并等待审批，返回 ActionAccept、ActionReject 或者取消的 ActionUnknown
+func (s *Server) waitExecCommandReview(ctx context.Context, sess ssh.Session, stderr io.Writer,
+	respSession *model.Session, rule proxy.CommandRule, command string, lang i18n.LanguageCode) execReviewResult {
+	review, err := proxy.SubmitCommandReview(s.jmsService, respSession.ID, rule, command)
+	if err != nil {
+		logger.Errorf("Session %s: submit exec command review err: %s", respSession.ID, err)
+		return execReviewResult{action: model.ActionReject}
+	}
+	if timeout := execReviewTimeout(sess); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var tipString strings.Builder
+	tipString.WriteString(lang.T("Need ticket confirm to execute command, already send email to the reviewers"))
+	tipString.WriteString("\n")
+	tipString.WriteString(fmt.Sprintf(lang.T("Ticket Reviewers: %s"), strings.Join(review.Reviewers(), ", ")))
+	tipString.WriteString("\n")
+	tipString.WriteString(fmt.Sprintf(lang.T("Could copy website URL to notify reviewers: %s"),
+		review.TicketDetailURL()))
+	tipString.WriteString("\n")
+	utils.IgnoreErrWriteString(stderr, tipString.String())
+
+	waitCtx, waitCancel := context.WithCancel(ctx)
+	defer waitCancel()
+	go func() {
+		start := time.Now()
+		ticker := time.NewTicker(execReviewProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-waitCtx.Done():
+				return
+			case now := <-ticker.C:
+				msg := fmt.Sprintf(lang.T("Waiting for the command review, %ds elapsed"),
+					int(now.Sub(start).Seconds()))
+				utils.IgnoreErrWriteString(stderr, msg+"\n")
+			}
+		}
+	}()
+	action := review.Wait(waitCtx)
+	waitCancel()
+	result := execReviewResult{action: action, processor: review.Processor()}
+	switch action {
+	case model.ActionAccept:
+		utils.IgnoreErrWriteString(stderr, fmt.Sprintf(lang.T("%s approved"), result.processor)+"\n")
+	case model.ActionReject:
+		utils.IgnoreErrWriteString(stderr, fmt.Sprintf(lang.T("%s rejected"), result.processor)+"\n")
+	default:
+		if review.TimedOut() || ctx.Err() == context.DeadlineExceeded {
+			utils.IgnoreErrWriteString(stderr, lang.T("Command review timed out")+"\n")
+		}
+	}
+	logger.Infof("Session %s: exec command review finished, action %s processor %s",
+		respSession.ID, action, result.processor)
+	return result
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jumpserver-dev/sdk-go/common"
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/rsync"
+)
+
+/*
+rsync over ssh 的审计:
+	解析发送端的文件列表，传输结束后每个文件生成一条上传下载记录
+	rsync 传输的是增量数据，无法还原文件内容，不保存文件
+	文件列表包含没有变化而跳过传输的文件，记录的是本次同步涉及的文件
+	无法解析文件列表时 (协议版本过低、不支持的选项) 按照命令中的路径记录
+*/
+
+const rsyncMaxFTPLogs = 1000
+
+type rsyncAudit struct {
+	s          *Server
+	cmd        rsync.Command
+	session    *model.Session
+	remoteAddr string
+	operate    string
+
+	parser *rsync.Parser
+	exec   *execAudit
+}
+
+func (s *Server) newRsyncAudit(cmd rsync.Command, respSession *model.Session, remoteAddr string,
+	execRecord *execAudit) *rsyncAudit {
+	return &rsyncAudit{
+		s:          s,
+		cmd:        cmd,
+		session:    respSession,
+		remoteAddr: remoteAddr,
+		operate:    rsyncOperate(cmd),
+		parser:     rsync.NewParser(cmd),
+		exec:       execRecord,
+	}
+}
+
+func rsyncOperate(cmd rsync.Command) string {
+	if cmd.Mode == rsync.ModeReceiver {
+		return model.OperateUpload
+	}
+	return model.OperateDownload
+}
+
+// checkRsyncPermission 资产是接收端时需要上传权限，是发送端时需要下载权限
+func checkRsyncPermission(cmd rsync.Command, actions model.Actions) error {
+	switch cmd.Mode {
+	case rsync.ModeReceiver:
+		if !actions.EnableUpload() {
+			return fmt.Errorf("upload is not permitted")
+		}
+	case rsync.ModeSender:
+		if !actions.EnableDownload() {
+			return fmt.Errorf("download is not permitted")
+		}
+	}
+	return nil
+}
+
+func (a *rsyncAudit) newFTPLog(path string, isSuccess bool) *model.FTPLog {
+	return &model.FTPLog{
+		ID:         common.UUID(),
+		OrgID:      a.session.OrgID,
+		User:       a.session.User,
+		Asset:      a.session.Asset,
+		Account:    a.session.Account,
+		RemoteAddr: a.remoteAddr,
+		Operate:    a.operate,
+		Path:       path,
+		DateStart:  common.NewNowUTCTime(),
+		IsSuccess:  isSuccess,
+		Session:    a.session.ID,
+	}
+}
+
+func (a *rsyncAudit) createFTPLog(path string, isSuccess bool) {
+	if err := a.s.jmsService.CreateFileOperationLog(*a.newFTPLog(path, isSuccess)); err != nil {
+		logger.Errorf("Create rsync ftp log err: %s", err)
+	}
+}
+
+// RecordDenied 没有权限时记录失败的操作
+func (a *rsyncAudit) RecordDenied() {
+	_, _ = a.parser.Close()
+	for _, path := range a.cmd.Paths {
+		a.createFTPLog(path, false)
+	}
+}
+
+// ClientWriter 写入客户端发送给资产的数据
+func (a *rsyncAudit) ClientWriter() io.Writer {
+	return a.parser.ClientWriter()
+}
+
+// ServerWriter 写入资产发送给客户端的数据
+func (a *rsyncAudit) ServerWriter() io.Writer {
+	return a.parser.ServerWriter()
+}
+
+// Finish 命令结束后记录文件列表，退出码不为 0 时记录为失败
+func (a *rsyncAudit) Finish(exitCode int) {
+	entries, err := a.parser.Close()
+	success := exitCode == 0
+	if err != nil {
+		logger.Warnf("Session %s: parse rsync file list failed: %s", a.session.ID, err)
+	}
+	var paths []string
+	for i := range entries {
+		if entries[i].IsRegular() || entries[i].IsLink() {
+			paths = append(paths, entries[i].Path)
+		}
+	}
+	if len(paths) == 0 && err != nil {
+		paths = a.cmd.Paths
+	}
+	for i, path := range paths {
+		if i >= rsyncMaxFTPLogs {
+			a.exec.AddOutput(fmt.Sprintf("[rsync] %s and %d more files\n", a.operate,
+				len(paths)-rsyncMaxFTPLogs))
+			break
+		}
+		a.createFTPLog(path, success)
+		a.exec.AddOutput(fmt.Sprintf("[rsync] %s %s success: %v\n", a.operate, path, success))
+	}
+	logger.Infof("Session %s: rsync %s %d files success: %v", a.session.ID, a.operate,
+		len(paths), success)
+}
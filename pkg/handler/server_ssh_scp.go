@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/jumpserver-dev/sdk-go/common"
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/proxy"
+	"github.com/jumpserver/koko/pkg/scp"
+)
+
+// scpAudit 解析 scp 数据，每个文件生成一条上传下载记录，并保存文件内容
+type scpAudit struct {
+	s          *Server
+	session    *model.Session
+	remoteAddr string
+	operate    string
+
+	parser   *scp.Parser
+	recorder *proxy.FTPFileRecorder
+	exec     *execAudit
+
+	current     *model.FTPLog
+	recordError bool
+}
+
+func (s *Server) newScpAudit(cmd scp.Command, respSession *model.Session, remoteAddr string,
+	execRecord *execAudit) *scpAudit {
+	a := &scpAudit{
+		s:          s,
+		session:    respSession,
+		remoteAddr: remoteAddr,
+		operate:    scpOperate(cmd),
+		parser:     scp.NewParser(cmd),
+		recorder:   proxy.GetFTPFileRecorder(s.jmsService),
+		exec:       execRecord,
+	}
+	a.parser.OnFileStart = a.onFileStart
+	a.parser.OnFileData = a.onFileData
+	a.parser.OnFileEnd = a.onFileEnd
+	return a
+}
+
+func scpOperate(cmd scp.Command) string {
+	if cmd.Mode == scp.ModeSink {
+		return model.OperateUpload
+	}
+	return model.OperateDownload
+}
+
+// checkScpPermission 按照授权的上传下载动作检查 scp 命令
+func checkScpPermission(cmd scp.Command, actions model.Actions) error {
+	switch cmd.Mode {
+	case scp.ModeSink:
+		if !actions.EnableUpload() {
+			return fmt.Errorf("upload is not permitted")
+		}
+	case scp.ModeSource:
+		if !actions.EnableDownload() {
+			return fmt.Errorf("download is not permitted")
+		}
+	}
+	return nil
+}
+
+func (a *scpAudit) newFTPLog(path string, isSuccess bool) *model.FTPLog {
+	return &model.FTPLog{
+		ID:         common.UUID(),
+		OrgID:      a.session.OrgID,
+		User:       a.session.User,
+		Asset:      a.session.Asset,
+		Account:    a.session.Account,
+		RemoteAddr: a.remoteAddr,
+		Operate:    a.operate,
+		Path:       path,
+		DateStart:  common.NewNowUTCTime(),
+		IsSuccess:  isSuccess,
+		Session:    a.session.ID,
+	}
+}
+
+func (a *scpAudit) createFTPLog(ftpLog *model.FTPLog) {
+	if err := a.s.jmsService.CreateFileOperationLog(*ftpLog); err != nil {
+		logger.Errorf("Create scp ftp log err: %s", err)
+	}
+}
+
+// RecordDenied 没有权限时记录失败的操作
+func (a *scpAudit) RecordDenied(paths []string) {
+	for _, path := range paths {
+		a.createFTPLog(a.newFTPLog(path, false))
+	}
+}
+
+func (a *scpAudit) Write(p []byte) (int, error) {
+	return a.parser.Write(p)
+}
+
+func (a *scpAudit) Close() {
+	a.parser.Close()
+}
+
+func (a *scpAudit) onFileStart(info *scp.FileInfo) {
+	a.current = a.newFTPLog(info.Path, false)
+	a.recordError = false
+}
+
+func (a *scpAudit) onFileData(info *scp.FileInfo, p []byte) {
+	if a.current == nil || a.recordError {
+		return
+	}
+	if err := a.recorder.RecordChunk(a.current, p); err != nil {
+		logger.Errorf("Record scp file %s err: %s", info.Path, err)
+		a.recordError = true
+	}
+}
+
+func (a *scpAudit) onFileEnd(info *scp.FileInfo, success bool) {
+	ftpLog := a.current
+	a.current = nil
+	if ftpLog == nil {
+		return
+	}
+	ftpLog.IsSuccess = success
+	a.createFTPLog(ftpLog)
+	if success {
+		a.recorder.FinishFTPFile(ftpLog.ID)
+	} else {
+		a.recorder.AbortFTPFile(ftpLog.ID)
+	}
+	a.exec.AddOutput(fmt.Sprintf("[scp] %s %s %d bytes success: %v\n", a.operate, info.Path,
+		info.Size, success))
+	logger.Infof("Session %s: scp %s %s %d bytes success: %v", a.session.ID, a.operate,
+		info.Path, info.Size, success)
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"time"
 
+	"github.com/jumpserver/koko/pkg/audit"
 	"github.com/jumpserver/koko/pkg/i18n"
 	"github.com/jumpserver/koko/pkg/proxy"
 	"github.com/jumpserver/koko/pkg/srvconn"
@@ -308,7 +309,7 @@ var (
 
 func (userCon *UserWebsocket) RecordLifecycleLog(sid string, event model.LifecycleEvent,
 	logObj model.SessionLifecycleLog) {
-	if err := userCon.apiClient.RecordSessionLifecycleLog(sid, event, logObj); err != nil {
+	if err := audit.RecordSessionLifecycleLog(userCon.apiClient, sid, event, logObj); err != nil {
 		logger.Errorf("Record session lifecycle log err: %s", err)
 	}
 }
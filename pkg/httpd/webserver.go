@@ -21,6 +21,7 @@ import (
 	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/httpd/ws"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/proxy"
 )
 
 const (
@@ -228,6 +229,13 @@ func (s *Server) HealthStatusHandler(ctx *gin.Context) {
 	now := time.Now()
 	status["timestamp"] = now.UTC()
 	status["uptime"] = now.Sub(upTime).String()
+	if health := proxy.CommandStoragesHealth(); health != nil {
+		status["command_storages"] = health
+	}
+	status["replay_compression"] = proxy.GetReplayCompressionStats()
+	if queueStatus := proxy.GetUploadQueueStatus(); queueStatus != nil {
+		status["upload_queue"] = queueStatus
+	}
 	ctx.JSON(http.StatusOK, status)
 }
 
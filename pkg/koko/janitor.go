@@ -0,0 +1,321 @@
+package koko
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+	"github.com/jumpserver-dev/sdk-go/service"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/proxy"
+	"github.com/jumpserver/koko/pkg/session"
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+/*
+磁盘清理任务: 定时检查录像、上传下载文件和 zip 临时目录所在磁盘的使用率
+	超过低水位告警
+	超过高水位不再创建新的录像和文件记录 (开启 DISK_FAIL_CLOSED 时拒绝新的会话)，
+	开启 DISK_PRESSURE_EVICT 时从最旧的上传失败的文件开始删除，直到低于低水位
+	按照保留时间删除上传失败的文件、本地保留的签名和文本记录、已下载的 zip 临时文件
+正在进行的会话和最近修改过的文件不会被删除。
+*/
+
+const (
+	janitorInterval    = time.Minute
+	diskAlertInterval  = 10 * time.Minute
+	artifactActiveTime = 10 * time.Minute
+)
+
+// elfinder 打包下载的临时文件名: 时间 + md5.zip
+var zipTmpPattern = regexp.MustCompile(`^\d{14}[0-9a-f]{32}\.zip$`)
+
+type DiskStatus struct {
+	UsedPercent      float64   `json:"used_percent"`
+	Level            string    `json:"level"`
+	RecordingRefused bool      `json:"recording_refused"`
+	ReplaySize       int64     `json:"replay_size"`
+	FTPFileSize      int64     `json:"ftp_file_size"`
+	ZipTmpSize       int64     `json:"zip_tmp_size"`
+	PendingReplays   int       `json:"pending_replays"`
+	PendingFTPFiles  int       `json:"pending_ftp_files"`
+	Evicted          int       `json:"evicted"`
+	CheckedAt        time.Time `json:"checked_at"`
+}
+
+var (
+	diskStatusLock sync.Mutex
+	diskStatus     *DiskStatus
+)
+
+// GetDiskStatus 磁盘清理任务未运行时返回 nil
+func GetDiskStatus() *DiskStatus {
+	diskStatusLock.Lock()
+	defer diskStatusLock.Unlock()
+	if diskStatus == nil {
+		return nil
+	}
+	status := *diskStatus
+	return &status
+}
+
+func setDiskStatus(status *DiskStatus) {
+	diskStatusLock.Lock()
+	defer diskStatusLock.Unlock()
+	diskStatus = status
+}
+
+type localArtifact struct {
+	path    string
+	kind    string // replay, ftp, audit
+	id      string
+	size    int64
+	modTime time.Time
+}
+
+func runDiskJanitor(jmsService *service.JMService) {
+	j := diskJanitor{jmsService: jmsService}
+	j.check()
+	tick := time.NewTicker(janitorInterval)
+	defer tick.Stop()
+	for range tick.C {
+		j.check()
+	}
+}
+
+type diskJanitor struct {
+	jmsService *service.JMService
+
+	level     int32
+	lastAlert time.Time
+	evicted   int
+}
+
+func (j *diskJanitor) check() {
+	conf := config.GetConf()
+	now := time.Now()
+	alive := make(map[string]bool)
+	for _, id := range session.GetAliveSessionIds() {
+		alive[id] = true
+	}
+	replays := scanArtifacts(conf.ReplayFolderPath, "replay")
+	ftpFiles := scanArtifacts(conf.FTPFileFolderPath, "ftp")
+	status := DiskStatus{CheckedAt: now}
+
+	if conf.ArtifactRetentionDays > 0 {
+		maxAge := time.Duration(conf.ArtifactRetentionDays) * 24 * time.Hour
+		audits := scanArtifacts(filepath.Join(conf.DataFolderPath, "audit"), "audit")
+		for _, items := range [][]localArtifact{replays, ftpFiles, audits} {
+			for i := range items {
+				if now.Sub(items[i].modTime) > maxAge && j.evictable(items[i], alive, now) {
+					j.evict(items[i], "exceeds retention days")
+				}
+			}
+		}
+		replays = existArtifacts(replays)
+		ftpFiles = existArtifacts(ftpFiles)
+	}
+	status.ZipTmpSize = j.cleanZipTmp(conf.ZipTmpPath, time.Duration(conf.ZipTmpRetentionHours)*time.Hour, now)
+
+	usedPercent := diskUsedPercent(conf)
+	if conf.DiskPressureEvict && conf.DiskWatermarkHigh > 0 && usedPercent >= float64(conf.DiskWatermarkHigh) {
+		items := make([]localArtifact, 0, len(replays)+len(ftpFiles))
+		items = append(items, replays...)
+		items = append(items, ftpFiles...)
+		usedPercent = j.evictUnderPressure(conf, items, alive, now, usedPercent)
+		replays = existArtifacts(replays)
+		ftpFiles = existArtifacts(ftpFiles)
+	}
+
+	for i := range replays {
+		status.ReplaySize += replays[i].size
+		if isPendingReplay(replays[i].path) {
+			status.PendingReplays++
+		}
+	}
+	for i := range ftpFiles {
+		status.FTPFileSize += ftpFiles[i].size
+		status.PendingFTPFiles++
+	}
+	level := diskLevel(conf, usedPercent)
+	j.alert(level, usedPercent, now)
+	proxy.SetDiskLevel(level)
+
+	status.UsedPercent = usedPercent
+	status.Level = diskLevelName(level)
+	status.RecordingRefused = level >= proxy.DiskLevelCritical
+	status.Evicted = j.evicted
+	setDiskStatus(&status)
+}
+
+// evictable 正在进行的会话和最近修改过的文件不删除
+func (j *diskJanitor) evictable(item localArtifact, alive map[string]bool, now time.Time) bool {
+	if alive[item.id] {
+		return false
+	}
+	return now.Sub(item.modTime) > artifactActiveTime
+}
+
+func (j *diskJanitor) evict(item localArtifact, reason string) {
+	if err := os.Remove(item.path); err != nil {
+		logger.Errorf("Disk janitor remove %s failed: %s", item.path, err)
+		return
+	}
+	j.evicted++
+	logger.Warnf("Disk janitor removed %s %s (%d bytes): %s", item.kind, item.path, item.size, reason)
+	if item.kind != "replay" {
+		return
+	}
+	if replay, ok := parseReplayFilename(filepath.Base(item.path)); ok {
+		replayErr := model.SessionReplayErrUploadFailed
+		if _, err := j.jmsService.SessionReplayFailed(replay.Id, replayErr); err != nil {
+			logger.Errorf("Session[%s] update replay status %s failed: %s", replay.Id, replayErr, err)
+		}
+	}
+}
+
+// evictUnderPressure 从最旧的文件开始删除，直到低于低水位
+func (j *diskJanitor) evictUnderPressure(conf config.Config, items []localArtifact,
+	alive map[string]bool, now time.Time, usedPercent float64) float64 {
+	sort.Slice(items, func(a, b int) bool {
+		return items[a].modTime.Before(items[b].modTime)
+	})
+	logger.Errorf("Disk usage %.1f%% exceeds high watermark %d%%, evict oldest failed files",
+		usedPercent, conf.DiskWatermarkHigh)
+	for i := range items {
+		if usedPercent < float64(conf.DiskWatermarkLow) {
+			break
+		}
+		if !j.evictable(items[i], alive, now) {
+			continue
+		}
+		j.evict(items[i], "disk pressure")
+		usedPercent = diskUsedPercent(conf)
+	}
+	return usedPercent
+}
+
+func (j *diskJanitor) cleanZipTmp(dir string, maxAge time.Duration, now time.Time) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || !zipTmpPattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err1 := entry.Info()
+		if err1 != nil {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if maxAge > 0 && now.Sub(info.ModTime()) > maxAge {
+			if err1 = os.Remove(path); err1 == nil {
+				logger.Infof("Disk janitor removed zip tmp file %s", path)
+				continue
+			}
+		}
+		total += info.Size()
+	}
+	return total
+}
+
+func (j *diskJanitor) alert(level int32, usedPercent float64, now time.Time) {
+	conf := config.GetConf()
+	changed := level != j.level
+	j.level = level
+	switch level {
+	case proxy.DiskLevelCritical:
+		if changed || now.Sub(j.lastAlert) >= diskAlertInterval {
+			j.lastAlert = now
+			logger.Errorf("Disk usage %.1f%% exceeds high watermark %d%%, new recordings are refused (fail closed: %v)",
+				usedPercent, conf.DiskWatermarkHigh, conf.DiskFailClosed)
+		}
+	case proxy.DiskLevelWarning:
+		if changed || now.Sub(j.lastAlert) >= diskAlertInterval {
+			j.lastAlert = now
+			logger.Warnf("Disk usage %.1f%% exceeds low watermark %d%%", usedPercent, conf.DiskWatermarkLow)
+		}
+	default:
+		if changed {
+			logger.Infof("Disk usage %.1f%% back to normal", usedPercent)
+		}
+	}
+}
+
+func diskLevel(conf config.Config, usedPercent float64) int32 {
+	switch {
+	case conf.DiskWatermarkHigh > 0 && usedPercent >= float64(conf.DiskWatermarkHigh):
+		return proxy.DiskLevelCritical
+	case conf.DiskWatermarkLow > 0 && usedPercent >= float64(conf.DiskWatermarkLow):
+		return proxy.DiskLevelWarning
+	default:
+		return proxy.DiskLevelNormal
+	}
+}
+
+func diskLevelName(level int32) string {
+	switch level {
+	case proxy.DiskLevelCritical:
+		return "critical"
+	case proxy.DiskLevelWarning:
+		return "warning"
+	default:
+		return "normal"
+	}
+}
+
+// diskUsedPercent 目录可能挂载在不同的磁盘，取最高的使用率
+func diskUsedPercent(conf config.Config) float64 {
+	var used float64
+	for _, dir := range []string{conf.ReplayFolderPath, conf.FTPFileFolderPath, conf.ZipTmpPath} {
+		if dir == "" {
+			continue
+		}
+		if percent := utils.DiskUsagePercentOf(dir); percent > used {
+			used = percent
+		}
+	}
+	return used
+}
+
+func scanArtifacts(dir, kind string) []localArtifact {
+	var items []localArtifact
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		items = append(items, localArtifact{
+			path:    path,
+			kind:    kind,
+			id:      strings.SplitN(info.Name(), ".", 2)[0],
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	return items
+}
+
+func existArtifacts(items []localArtifact) []localArtifact {
+	ret := items[:0]
+	for i := range items {
+		if _, err := os.Stat(items[i].path); err == nil {
+			ret = append(ret, items[i])
+		}
+	}
+	return ret
+}
+
+func isPendingReplay(path string) bool {
+	_, ok := parseReplayFilename(filepath.Base(path))
+	return ok
+}
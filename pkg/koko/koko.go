@@ -7,11 +7,13 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/jumpserver/koko/pkg/audit"
 	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/exchange"
 	"github.com/jumpserver/koko/pkg/httpd"
 	"github.com/jumpserver/koko/pkg/i18n"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/proxy"
 	"github.com/jumpserver/koko/pkg/sshd"
 
 	"github.com/jumpserver-dev/sdk-go/model"
@@ -61,6 +63,9 @@ func bootstrap() {
 func bootstrapWithJMService(jmsService *service.JMService) {
 	updateEncryptConfigValue(jmsService)
 	exchange.Initial()
+	if syslogStorage := proxy.GetSyslogStorage(); syslogStorage != nil {
+		audit.RegisterLifecycleSink(syslogStorage)
+	}
 }
 
 func updateEncryptConfigValue(jmsService *service.JMService) {
@@ -82,12 +87,16 @@ func updateEncryptConfigValue(jmsService *service.JMService) {
 }
 
 func runTasks(jmsService *service.JMService) {
+	proxy.StartUploadQueue(jmsService)
 	if config.GetConf().UploadFailedReplay {
 		go uploadRemainReplay(jmsService)
 	}
 	if config.GetConf().UploadFailedFTPFile {
 		go uploadRemainFTPFile(jmsService)
 	}
+	go uploadRemainCommands(jmsService)
+	go runDiskJanitor(jmsService)
+	go keepTerminalConfigExt(jmsService)
 	go keepHeartbeat(jmsService)
 
 	go RunConnectTokensCheck(jmsService)
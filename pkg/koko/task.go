@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -13,6 +14,9 @@ import (
 	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver-dev/sdk-go/service"
 
+	"github.com/jumpserver/koko/pkg/asciinema"
+	"github.com/jumpserver/koko/pkg/audit"
+	com "github.com/jumpserver/koko/pkg/common"
 	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/logger"
 	"github.com/jumpserver/koko/pkg/proxy"
@@ -28,11 +32,16 @@ func uploadRemainReplay(jmsService *service.JMService) {
 		return
 	}
 	replayStorage := proxy.NewReplayStorage(jmsService, &conf)
+	queue := proxy.GetUploadQueue()
 	allRemainFiles := make(map[string]RemainReplay)
 	_ = filepath.Walk(replayDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info.IsDir() {
 			return nil
 		}
+		// 已经在上传队列中的文件由队列重试
+		if queue != nil && queue.Has(path) {
+			return nil
+		}
 		if replayInfo, ok := parseReplayFilename(info.Name()); ok {
 			finishedTime := common.NewUTCTime(info.ModTime())
 			if _, err2 := jmsService.SessionFinished(replayInfo.Id, finishedTime); err2 != nil {
@@ -46,7 +55,7 @@ func uploadRemainReplay(jmsService *service.JMService) {
 
 	recordLifecycleLog := func(id string, event model.LifecycleEvent, reason string) {
 		logObj := model.SessionLifecycleLog{Reason: reason}
-		if err1 := jmsService.RecordSessionLifecycleLog(id, event, logObj); err1 != nil {
+		if err1 := audit.RecordSessionLifecycleLog(jmsService, id, event, logObj); err1 != nil {
 			logger.Errorf("Update session %s activity log failed: %s", id, err1)
 		}
 	}
@@ -54,13 +63,14 @@ func uploadRemainReplay(jmsService *service.JMService) {
 		logger.Info("No remain replay file to upload")
 		return
 	}
+	rebuildRemainReplayParts(allRemainFiles)
 
 	logger.Infof("Start upload remain %d replay files 10 min later ", len(allRemainFiles))
 	time.Sleep(10 * time.Minute)
 
 	for absPath, remainReplay := range allRemainFiles {
 		absGzPath := absPath
-		if !remainReplay.IsGzip {
+		if !remainReplay.IsCompressed {
 			switch remainReplay.Version {
 			case model.Version2:
 				if err := ValidateRemainReplayFile(absPath); err != nil {
@@ -68,6 +78,9 @@ func uploadRemainReplay(jmsService *service.JMService) {
 				}
 				absGzPath = absPath + model.SuffixReplayGz
 			case model.Version3:
+				if err := ValidateRemainReplayFile(absPath); err != nil {
+					logger.Errorf("Validate remain replay file %s failed: %s", absPath, err)
+				}
 				absGzPath = absPath + model.SuffixGz
 			default:
 				absGzPath = absPath + model.SuffixGz
@@ -88,7 +101,8 @@ func uploadRemainReplay(jmsService *service.JMService) {
 
 		recordLifecycleLog(remainReplay.Id, model.ReplayUploadStart, "")
 		logger.Infof("Upload replay file: %s, type: %s", absGzPath, replayStorage.TypeName())
-		if err2 := replayStorage.Upload(absGzPath, target); err2 != nil {
+		// 加密保存的录像只有关闭存储加密后才会解密上传到 server 存储，否则留在上传队列中
+		if err2 := proxy.UploadFile(replayStorage, absGzPath, target); err2 != nil {
 			logger.Errorf("Upload remain replay file %s failed: %s", absGzPath, err2)
 			reason := model.SessionReplayErrUploadFailed
 			if _, err3 := jmsService.SessionReplayFailed(remainReplay.Id, reason); err3 != nil {
@@ -96,6 +110,20 @@ func uploadRemainReplay(jmsService *service.JMService) {
 			}
 			failureMsg := strings.ReplaceAll(err2.Error(), ",", " ")
 			recordLifecycleLog(remainReplay.Id, model.ReplayUploadFailure, failureMsg)
+			kind := proxy.UploadKindReplay
+			if remainReplay.IsPart {
+				kind = proxy.UploadKindReplayPart
+			}
+			if queue != nil {
+				queue.Enqueue(proxy.UploadItem{Path: absGzPath, Target: target, Kind: kind,
+					ObjectID: remainReplay.Id, LastError: err2.Error()})
+			}
+			continue
+		}
+		if remainReplay.IsPart {
+			// 分段只补传文件，完整录像已经由 rebuildRemainReplayParts 拼接
+			_ = os.Remove(absGzPath)
+			logger.Infof("Upload remain replay part file %s success", absGzPath)
 			continue
 		}
 		replaySize := absFileInfo.Size()
@@ -119,11 +147,15 @@ func uploadRemainFTPFile(jmsService *service.JMService) {
 		return
 	}
 	ftpFileStorage := proxy.NewFTPFileStorage(jmsService, &conf)
+	queue := proxy.GetUploadQueue()
 	allRemainFiles := make(map[string]RemainFTPFile)
 	_ = filepath.Walk(ftpFileDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info.IsDir() {
 			return nil
 		}
+		if queue != nil && queue.Has(path) {
+			return nil
+		}
 		if ftpFileInfo, ok := parseFTPFilename(info.Name()); ok {
 			allRemainFiles[path] = ftpFileInfo
 		}
@@ -142,8 +174,12 @@ func uploadRemainFTPFile(jmsService *service.JMService) {
 		targetName := strings.Join([]string{proxy.FtpTargetPrefix, dateTarget}, "/")
 		logger.Infof("Upload FTP file: %s, target: %s, type: %s", absGzPath,
 			targetName, ftpFileStorage.TypeName())
-		if err = ftpFileStorage.Upload(absGzPath, targetName); err != nil {
+		if err = proxy.UploadFile(ftpFileStorage, absGzPath, targetName); err != nil {
 			logger.Errorf("Upload remain FTP file %s failed: %s", absGzPath, err)
+			if queue != nil {
+				queue.Enqueue(proxy.UploadItem{Path: absGzPath, Target: targetName,
+					Kind: proxy.UploadKindFTPFile, ObjectID: remainFTPFile.Id, LastError: err.Error()})
+			}
 			continue
 		}
 		if err := jmsService.FinishFTPFile(remainFTPFile.Id); err != nil {
@@ -156,6 +192,64 @@ func uploadRemainFTPFile(jmsService *service.JMService) {
 	logger.Info("Upload remain FTP file done")
 }
 
+// uploadRemainCommands 上传异常退出时遗留在 spool 中的命令
+func uploadRemainCommands(jmsService *service.JMService) {
+	spoolDir := config.GetConf().CommandSpoolFolderPath
+	// 启动时先收集文件，避免处理新会话的 spool
+	allRemainFiles := make([]string, 0, 10)
+	_ = filepath.Walk(spoolDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(info.Name(), proxy.CommandSpoolSuffix) {
+			allRemainFiles = append(allRemainFiles, path)
+		}
+		return nil
+	})
+	if len(allRemainFiles) == 0 {
+		logger.Info("No remain command spool to upload")
+		return
+	}
+	conf, err := jmsService.GetTerminalConfig()
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	cmdStorage := proxy.NewCommandStorage(jmsService, &conf)
+	replayStorage := proxy.NewReplayStorage(jmsService, &conf)
+	logger.Infof("Start upload remain %d command spool files", len(allRemainFiles))
+	for _, absPath := range allRemainFiles {
+		commands, err1 := proxy.ReadCommandSpool(absPath)
+		if err1 != nil {
+			logger.Errorf("Read command spool %s failed: %s", absPath, err1)
+			continue
+		}
+		if len(commands) > 0 {
+			sid := strings.TrimSuffix(filepath.Base(absPath), proxy.CommandSpoolSuffix)
+			if err1 = proxy.SaveRemainCommands(jmsService, cmdStorage, replayStorage, sid, commands); err1 != nil {
+				logger.Errorf("Upload remain command spool %s failed: %s", absPath, err1)
+				continue
+			}
+		}
+		_ = os.Remove(absPath)
+		logger.Infof("Upload remain command spool %s success, %d commands", absPath, len(commands))
+	}
+	logger.Info("Upload remain command spool done")
+}
+
+// keepTerminalConfigExt 定时更新 sdk 的 TerminalConfig 之外的终端配置
+func keepTerminalConfigExt(jmsService *service.JMService) {
+	for {
+		conf, err := proxy.FetchTerminalConfigExt(jmsService)
+		if err != nil {
+			logger.Errorf("Update terminal config ext failed: %s", err)
+		} else {
+			proxy.UpdateTerminalConfigExt(conf)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
 // keepHeartbeat 保持心跳
 func keepHeartbeat(jmsService *service.JMService) {
 	KeepWsHeartbeat(jmsService)
@@ -182,6 +276,43 @@ func handleTerminalTask(jmsService *service.JMService, tasks []model.TerminalTas
 	}
 }
 
+// commandReviewTask 命令复核工单状态变化的任务，kwargs 与其他任务不同
+type commandReviewTask struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Args   string `json:"args"`
+	Kwargs struct {
+		TicketID  string `json:"ticket_id"`
+		State     string `json:"state"`
+		Processor string `json:"processor"`
+	} `json:"kwargs"`
+}
+
+func handleCommandReviewTask(jmsService *service.JMService, message []byte) {
+	var tasks []commandReviewTask
+	if err := json.Unmarshal(message, &tasks); err != nil {
+		logger.Errorf("Ws client Unmarshal command review task failed: %s", err)
+		return
+	}
+	for _, task := range tasks {
+		if task.Name != proxy.TaskCommandReviewState {
+			continue
+		}
+		event := proxy.CommandReviewEvent{
+			SessionID: task.Args,
+			TicketID:  task.Kwargs.TicketID,
+			State:     task.Kwargs.State,
+			Processor: task.Kwargs.Processor,
+		}
+		if !proxy.NotifyCommandReviewEvent(event) {
+			logger.Infof("Task %s command review of session %s not found", task.ID, task.Args)
+		}
+		if err := jmsService.FinishTask(task.ID); err != nil {
+			logger.Errorf("Finish task %s failed: %s", task.ID, err)
+		}
+	}
+}
+
 func KeepWsHeartbeat(jmsService *service.JMService) {
 	ws, err := jmsService.GetWsClient()
 	if err != nil {
@@ -214,8 +345,20 @@ func KeepWsHeartbeat(jmsService *service.JMService) {
 				logger.Errorf("Ws client Unmarshal failed: %s", err)
 				continue
 			}
-			if len(tasks) != 0 {
-				handleTerminalTask(jmsService, tasks)
+			sessionTasks := make([]model.TerminalTask, 0, len(tasks))
+			hasReviewTask := false
+			for i := range tasks {
+				if tasks[i].Name == proxy.TaskCommandReviewState {
+					hasReviewTask = true
+					continue
+				}
+				sessionTasks = append(sessionTasks, tasks[i])
+			}
+			if hasReviewTask {
+				handleCommandReviewTask(jmsService, message)
+			}
+			if len(sessionTasks) != 0 {
+				handleTerminalTask(jmsService, sessionTasks)
 			}
 		}
 	}()
@@ -228,6 +371,7 @@ func KeepWsHeartbeat(jmsService *service.JMService) {
 		select {
 		case <-done:
 			logger.Info("Ws client closed")
+			proxy.SetCommandReviewSubscribed(false)
 			time.Sleep(10 * time.Second)
 			go KeepWsHeartbeat(jmsService)
 			return
@@ -252,40 +396,56 @@ func GetStatusData() interface{} {
 	}
 	return map[string]interface{}{
 		"type":    "status",
-		"payload": payload,
+		"payload": statusPayload{HeartbeatData: payload, Disk: GetDiskStatus()},
 	}
 }
 
-func ValidateRemainReplayFile(path string) error {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, os.ModePerm)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	tmp := make([]byte, 1)
-	_, err = f.Seek(-1, 2)
-	if err != nil {
-		return err
-	}
-	_, err = f.Read(tmp)
-	if err != nil {
-		return err
+// statusPayload 在心跳中附带本地磁盘水位，便于 core 发现磁盘即将写满的终端
+type statusPayload struct {
+	model.HeartbeatData
+	Disk *DiskStatus `json:"disk,omitempty"`
+}
+
+// rebuildRemainReplayParts 分段录像在会话结束时才拼接完整录像，异常退出时使用本地的分段拼接
+func rebuildRemainReplayParts(remainFiles map[string]RemainReplay) {
+	parts := make(map[string][]string)
+	hasFull := make(map[string]bool)
+	for path, replay := range remainFiles {
+		if replay.IsPart {
+			parts[replay.Id] = append(parts[replay.Id], path)
+		} else {
+			hasFull[replay.Id] = true
+		}
 	}
-	switch string(tmp) {
-	case "}":
-		return nil
-	case ",":
-		_, err = f.Write([]byte(`"0":""}`))
-	default:
-		_, err = f.Write([]byte(`}`))
+	for sid, paths := range parts {
+		if hasFull[sid] {
+			continue
+		}
+		// 分段的序号补齐了位数，按照文件名排序即可
+		sort.Strings(paths)
+		fullPath := filepath.Join(filepath.Dir(paths[0]), sid+model.SuffixCast)
+		if err := proxy.RebuildReplayFile(fullPath, paths); err != nil {
+			logger.Errorf("Rebuild remain replay %s from parts failed: %s", sid, err)
+			continue
+		}
+		if replay, ok := parseReplayFilename(filepath.Base(fullPath)); ok {
+			remainFiles[fullPath] = replay
+			logger.Infof("Rebuild remain replay %s from %d parts", fullPath, len(paths))
+		}
 	}
-	return err
+}
+
+// ValidateRemainReplayFile 修复异常退出时未写完整的录像文件，
+// 兼容旧的 json 录像和 asciicast v2/v3 格式的录像
+func ValidateRemainReplayFile(path string) error {
+	return asciinema.RepairReplayFile(path)
 }
 
 type RemainReplay struct {
-	Id      string // session id
-	IsGzip  bool
-	Version model.ReplayVersion
+	Id           string // session id
+	IsCompressed bool
+	IsPart       bool // 分段录像的一部分
+	Version      model.ReplayVersion
 }
 
 type RemainFTPFile struct {
@@ -301,7 +461,8 @@ func parseReplayFilename(filename string) (replay RemainReplay, ok bool) {
 		return
 	}
 	if replay.Id, replay.Version, ok = isReplayFile(filename); ok {
-		replay.IsGzip = isGzipFile(filename)
+		replay.IsCompressed = isCompressedFile(filename)
+		replay.IsPart = asciinema.IsPartFilename(filename)
 	}
 	return
 }
@@ -315,14 +476,18 @@ func parseFTPFilename(filename string) (ftpFile RemainFTPFile, ok bool) {
 	return
 }
 
-func isGzipFile(filename string) bool {
-	return strings.HasSuffix(filename, model.SuffixGz)
+// isCompressedFile 录像压缩后的后缀 .gz 或者 .zst
+func isCompressedFile(filename string) bool {
+	return strings.HasSuffix(filename, model.SuffixGz) || strings.HasSuffix(filename, com.SuffixZstd)
 }
 
+const castZstSuffix = ".cast" + com.SuffixZstd
+
 func isReplayFile(filename string) (id string, version model.ReplayVersion, ok bool) {
 	suffixesMap := map[string]model.ReplayVersion{
 		model.SuffixCast:     model.Version3,
 		model.SuffixCastGz:   model.Version3,
+		castZstSuffix:        model.Version3,
 		model.SuffixReplayGz: model.Version2}
 	for suffix := range suffixesMap {
 		if strings.HasSuffix(filename, suffix) {
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+	"github.com/jumpserver-dev/sdk-go/service"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+命令复核工单的状态:
+	core 通过终端的 websocket 推送 command_review_state 任务，args 是会话 id，
+	kwargs 中包含 ticket_id、state 和 processor，收到后立即结束等待
+	旧版本的 core 不推送工单状态，收到第一个推送之后才低频查询工单状态，避免遗漏推送；
+	在此之前以及 websocket 连接断开之后每 10 秒查询一次
+	配置 COMMAND_REVIEW_TIMEOUT 时超时自动取消工单
+*/
+
+const (
+	// TaskCommandReviewState 命令复核工单状态变化的任务
+	TaskCommandReviewState = "command_review_state"
+
+	// commandReviewCheckInterval core 没有推送过工单状态时查询的间隔
+	commandReviewCheckInterval = 10 * time.Second
+	// commandReviewFallbackInterval core 推送工单状态时查询的间隔
+	commandReviewFallbackInterval = time.Minute
+)
+
+var ticketIDRegexp = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// CommandReviewEvent core 推送的工单状态
+type CommandReviewEvent struct {
+	SessionID string
+	TicketID  string
+	State     string
+	Processor string
+}
+
+var reviewSubscriber = commandReviewSubscriber{waiters: make(map[string]map[*CommandReview]struct{})}
+
+type commandReviewSubscriber struct {
+	sync.Mutex
+	// 当前的 websocket 连接收到过工单状态的推送
+	available bool
+	// 会话 id 对应等待中的工单
+	waiters map[string]map[*CommandReview]struct{}
+}
+
+// SetCommandReviewSubscribed 设置是否可以接收工单状态的推送，websocket 断开时设置为 false
+func SetCommandReviewSubscribed(available bool) {
+	reviewSubscriber.Lock()
+	defer reviewSubscriber.Unlock()
+	reviewSubscriber.available = available
+}
+
+func isCommandReviewSubscribed() bool {
+	reviewSubscriber.Lock()
+	defer reviewSubscriber.Unlock()
+	return reviewSubscriber.available
+}
+
+func addReviewWaiter(r *CommandReview) {
+	reviewSubscriber.Lock()
+	defer reviewSubscriber.Unlock()
+	waiters, ok := reviewSubscriber.waiters[r.sid]
+	if !ok {
+		waiters = make(map[*CommandReview]struct{})
+		reviewSubscriber.waiters[r.sid] = waiters
+	}
+	waiters[r] = struct{}{}
+}
+
+func removeReviewWaiter(r *CommandReview) {
+	reviewSubscriber.Lock()
+	defer reviewSubscriber.Unlock()
+	if waiters, ok := reviewSubscriber.waiters[r.sid]; ok {
+		delete(waiters, r)
+		if len(waiters) == 0 {
+			delete(reviewSubscriber.waiters, r.sid)
+		}
+	}
+}
+
+// NotifyCommandReviewEvent 通知等待中的工单，返回是否有匹配的工单。
+// 收到推送说明 core 支持推送工单状态，之后降低查询的频率
+func NotifyCommandReviewEvent(event CommandReviewEvent) bool {
+	reviewSubscriber.Lock()
+	defer reviewSubscriber.Unlock()
+	reviewSubscriber.available = true
+	found := false
+	for r := range reviewSubscriber.waiters[event.SessionID] {
+		if event.TicketID != "" && r.ticketID != "" && event.TicketID != r.ticketID {
+			continue
+		}
+		select {
+		case r.events <- model.TicketState{State: model.LabelField(event.State), Processor: event.Processor}:
+		default:
+		}
+		found = true
+	}
+	return found
+}
+
+// CommandReview 命令复核工单，终端会话和 ssh exec 命令共用
+type CommandReview struct {
+	jmsService *service.JMService
+	sid        string
+	ticket     model.CommandTicketInfo
+	ticketID   string
+
+	events chan model.TicketState
+
+	processor string
+	timedOut  bool
+}
+
+// SubmitCommandReview 提交命令复核工单
+func SubmitCommandReview(jmsService *service.JMService, sid string, rule CommandRule,
+	cmd string) (*CommandReview, error) {
+	resp, err := jmsService.SubmitCommandReview(sid, rule.Acl.ID, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return &CommandReview{
+		jmsService: jmsService,
+		sid:        sid,
+		ticket:     resp,
+		ticketID:   ticketIDRegexp.FindString(resp.CheckReq.URL),
+		events:     make(chan model.TicketState, 1),
+	}, nil
+}
+
+func (r *CommandReview) Reviewers() []string {
+	return r.ticket.Reviewers
+}
+
+func (r *CommandReview) TicketDetailURL() string {
+	return r.ticket.TicketDetailUrl
+}
+
+// Processor 审批的处理人
+func (r *CommandReview) Processor() string {
+	return r.processor
+}
+
+// TimedOut 超过 COMMAND_REVIEW_TIMEOUT 自动取消
+func (r *CommandReview) TimedOut() bool {
+	return r.timedOut
+}
+
+/*
+Wait 等待审批结束，返回 ActionAccept 或 ActionReject，
+ctx 结束或者超时时取消工单并返回 ActionUnknown
+*/
+func (r *CommandReview) Wait(ctx context.Context) model.CommandAction {
+	addReviewWaiter(r)
+	defer removeReviewWaiter(r)
+	var timeoutChan <-chan time.Time
+	if timeout := config.GetConf().CommandReviewTimeout; timeout > 0 {
+		timeoutTimer := time.NewTimer(time.Duration(timeout) * time.Minute)
+		defer timeoutTimer.Stop()
+		timeoutChan = timeoutTimer.C
+	}
+	checkTimer := time.NewTimer(r.checkInterval())
+	defer checkTimer.Stop()
+	for {
+		var statusResp model.TicketState
+		select {
+		case <-ctx.Done():
+			r.Cancel()
+			return model.ActionUnknown
+		case <-timeoutChan:
+			logger.Infof("Session %s: command review timeout", r.sid)
+			r.timedOut = true
+			r.Cancel()
+			return model.ActionUnknown
+		case statusResp = <-r.events:
+			logger.Infof("Session %s: receive command review state %s", r.sid, statusResp.State)
+		case <-checkTimer.C:
+			checkTimer.Reset(r.checkInterval())
+			var err error
+			statusResp, err = r.jmsService.CheckConfirmStatusByRequestInfo(r.ticket.CheckReq)
+			if err != nil {
+				logger.Errorf("Session %s: check command confirm status err: %s", r.sid, err)
+				continue
+			}
+		}
+		switch statusResp.State {
+		case model.TicketOpen:
+			continue
+		case model.TicketApproved:
+			r.processor = statusResp.Processor
+			return model.ActionAccept
+		case model.TicketRejected, model.TicketClosed:
+			r.processor = statusResp.Processor
+			return model.ActionReject
+		default:
+			logger.Errorf("Receive unknown command confirm status %s", statusResp.Status)
+		}
+	}
+}
+
+func (r *CommandReview) checkInterval() time.Duration {
+	if isCommandReviewSubscribed() {
+		return commandReviewFallbackInterval
+	}
+	return commandReviewCheckInterval
+}
+
+// Cancel 取消工单
+func (r *CommandReview) Cancel() {
+	if err := r.jmsService.CancelConfirmByRequestInfo(r.ticket.CloseReq); err != nil {
+		logger.Errorf("Session %s: Cancel command confirm err: %s", r.sid, err)
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+)
+
+func TestCommandReview_WaitEvent(t *testing.T) {
+	SetCommandReviewSubscribed(false)
+	const (
+		sid      = "2f7c9a33-3f51-4a7e-9a0e-8d1f5b1b1c01"
+		ticketID = "6b0e5a5e-0c5d-4c1e-bf3e-2a1f9c7d8e02"
+	)
+	newReview := func() *CommandReview {
+		r := &CommandReview{sid: sid, events: make(chan model.TicketState, 1)}
+		r.ticket.CheckReq.URL = "/api/v1/tickets/tickets/" + ticketID + "/"
+		r.ticketID = ticketIDRegexp.FindString(r.ticket.CheckReq.URL)
+		return r
+	}
+	tests := []struct {
+		event     CommandReviewEvent
+		action    model.CommandAction
+		processor string
+	}{
+		{CommandReviewEvent{SessionID: sid, TicketID: ticketID, State: model.TicketApproved,
+			Processor: "admin"}, model.ActionAccept, "admin"},
+		{CommandReviewEvent{SessionID: sid, State: model.TicketRejected,
+			Processor: "auditor"}, model.ActionReject, "auditor"},
+	}
+	for _, tt := range tests {
+		r := newReview()
+		result := make(chan model.CommandAction, 1)
+		go func() { result <- r.Wait(context.Background()) }()
+		deadline := time.Now().Add(time.Second)
+		for !NotifyCommandReviewEvent(tt.event) {
+			if time.Now().After(deadline) {
+				t.Fatal("review waiter not registered")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		select {
+		case action := <-result:
+			if action != tt.action || r.Processor() != tt.processor {
+				t.Errorf("Wait() = %s %s, want %s %s", action, r.Processor(), tt.action, tt.processor)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Wait() not finished after event")
+		}
+	}
+
+	// 收到推送后降低查询频率，websocket 断开后恢复
+	r := newReview()
+	if r.checkInterval() != commandReviewFallbackInterval {
+		t.Errorf("checkInterval() = %s after pushed event", r.checkInterval())
+	}
+	SetCommandReviewSubscribed(false)
+	if r.checkInterval() != commandReviewCheckInterval {
+		t.Errorf("checkInterval() = %s after disconnected", r.checkInterval())
+	}
+
+	// 其他工单和其他会话的事件不匹配
+	addReviewWaiter(r)
+	defer removeReviewWaiter(r)
+	if NotifyCommandReviewEvent(CommandReviewEvent{SessionID: sid, TicketID: sid, State: model.TicketApproved}) {
+		t.Error("event of other ticket should not match")
+	}
+	if NotifyCommandReviewEvent(CommandReviewEvent{SessionID: ticketID, State: model.TicketApproved}) {
+		t.Error("event of other session should not match")
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jumpserver-dev/sdk-go/service"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
+)
+
+/*
+命令持久化队列: 每个会话一个 jsonl 文件，命令进入队列时先写入文件，
+保存成功后清空，koko 退出时未保存的命令保留在文件中，启动时补传。
+*/
+
+const CommandSpoolSuffix = ".jsonl"
+
+type commandSpool struct {
+	path string
+	fd   *os.File
+	lock sync.Mutex
+}
+
+func newCommandSpool(sid string) *commandSpool {
+	dirPath := config.GetConf().CommandSpoolFolderPath
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		logger.Errorf("Session %s: create command spool dir failed: %s", sid, err)
+		return nil
+	}
+	path := filepath.Join(dirPath, sid+CommandSpoolSuffix)
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Errorf("Session %s: open command spool failed: %s", sid, err)
+		return nil
+	}
+	return &commandSpool{path: path, fd: fd}
+}
+
+func (s *commandSpool) Append(cmd *storage.Command) {
+	if s == nil {
+		return
+	}
+	raw, err := json.Marshal(cmd)
+	if err != nil {
+		logger.Errorf("Command spool %s marshal failed: %s", s.path, err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err = s.fd.Write(append(raw, '\n')); err != nil {
+		logger.Errorf("Command spool %s write failed: %s", s.path, err)
+		return
+	}
+	if err = s.fd.Sync(); err != nil {
+		logger.Errorf("Command spool %s sync failed: %s", s.path, err)
+	}
+}
+
+// Truncate 命令保存成功后清空
+func (s *commandSpool) Truncate() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.fd.Truncate(0); err != nil {
+		logger.Errorf("Command spool %s truncate failed: %s", s.path, err)
+	}
+}
+
+// Close 保留文件，等待下次启动时补传
+func (s *commandSpool) Close() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_ = s.fd.Close()
+}
+
+func (s *commandSpool) Remove() {
+	if s == nil {
+		return
+	}
+	s.Close()
+	_ = os.Remove(s.path)
+}
+
+// ReadCommandSpool 读取遗留的命令，最后一行不完整时忽略
+func ReadCommandSpool(path string) ([]*storage.Command, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	commands := make([]*storage.Command, 0, 10)
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var cmd storage.Command
+		if err = json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+			logger.Errorf("Command spool %s invalid line: %s", path, err)
+			continue
+		}
+		commands = append(commands, &cmd)
+	}
+	return commands, scanner.Err()
+}
+
+// SaveCommands 保存到命令存储，失败时使用 server 存储，多存储时其他存储稍后重试
+func SaveCommands(jmsService *service.JMService, cmdStorage CommandStorage, commands []*storage.Command) error {
+	err := cmdStorage.BulkSave(commands)
+	if err != nil && cmdStorage.TypeName() != "server" {
+		logger.Warnf("Switch default command storage save: %s", err)
+		if err = jmsService.PushSessionCommand(storage.ModelCommands(commands)); err != nil {
+			return err
+		}
+		if multi, ok := cmdStorage.(*MultiCommandStorage); ok {
+			err = multi.queueExcept(commands, "server")
+		}
+	}
+	return err
+}
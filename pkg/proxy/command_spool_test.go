@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCommandSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sid"+CommandSpoolSuffix)
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool := &commandSpool{path: path, fd: fd}
+	commands := testCommands("ls", "id", "whoami")
+	commands[2].SetExitStatus(1, time.Second)
+	spool.Append(commands[0])
+	spool.Append(commands[1])
+	spool.Truncate()
+	spool.Append(commands[2])
+	// 模拟异常退出时写了一半的行
+	_, _ = fd.Write([]byte(`{"input":"rm`))
+	spool.Close()
+
+	commands, err = ReadCommandSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 1 || commands[0].Input != "whoami" ||
+		commands[0].ExitStatus == nil || *commands[0].ExitStatus != 1 {
+		t.Fatalf("unexpected commands %+v", commands)
+	}
+}
@@ -0,0 +1,472 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+	"github.com/jumpserver-dev/sdk-go/service"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
+)
+
+/*
+命令多存储: 同一批命令写入多个存储 (例如 es + server + SIEM)，每个存储有自己的积压队列。
+只要有一个存储保存成功，失败的存储把这批命令追加到自己的积压文件 (spool 目录下 backlog/类型.backlog)，
+稍后按顺序重试，不影响其他存储，也不会导致成功的存储重复写入，koko 重启后继续重试。
+webhook 限流 (Retry-After) 时直接进入积压文件，限流结束后重试，只使用 webhook 存储时也是如此。
+全部失败时返回错误，由 CommandRecorder 保留在 spool 中。
+*/
+
+const (
+	commandBacklogSuffix = ".backlog"
+	// multiStorageRetryBatch 重试积压命令时每次保存的数量
+	multiStorageRetryBatch = 1000
+
+	multiStorageMinBackoff = 5 * time.Second
+	multiStorageMaxBackoff = 5 * time.Minute
+)
+
+var errBackendBackoff = errors.New("command storage in backoff")
+
+// backlogLocks 配置变化时会创建新的多存储，同一个积压文件只能由一个存储写入
+var backlogLocks sync.Map
+
+type commandBackend struct {
+	storage CommandStorage
+	// backlogPath 积压的命令，为空时只保存在内存中
+	backlogPath string
+
+	lock        *sync.Mutex
+	pending     int
+	failures    int
+	lastErr     error
+	lastSuccess time.Time
+	nextRetry   time.Time
+}
+
+func newCommandBackend(storage CommandStorage, backlogDir string) *commandBackend {
+	b := &commandBackend{storage: storage, lock: &sync.Mutex{}}
+	if backlogDir == "" {
+		return b
+	}
+	if err := os.MkdirAll(backlogDir, 0700); err != nil {
+		logger.Errorf("Create command backlog dir %s failed: %s", backlogDir, err)
+		return b
+	}
+	b.backlogPath = filepath.Join(backlogDir, storage.TypeName()+commandBacklogSuffix)
+	lock, _ := backlogLocks.LoadOrStore(b.backlogPath, b.lock)
+	b.lock = lock.(*sync.Mutex)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if commands, err := ReadCommandSpool(b.backlogPath); err == nil {
+		b.pending = len(commands)
+	}
+	return b
+}
+
+// save 先保存积压的命令，再保存新的命令，保证同一存储内的顺序
+func (b *commandBackend) save(commands []*storage.Command) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.pending > 0 && time.Now().Before(b.nextRetry) {
+		return errBackendBackoff
+	}
+	if b.pending > 0 {
+		if err := b.saveBacklog(); err != nil {
+			return err
+		}
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	if err := b.storage.BulkSave(commands); err != nil {
+		b.failed(err)
+		return err
+	}
+	b.succeed()
+	return nil
+}
+
+// saveBacklog 分批保存积压的命令，失败时积压文件中只保留未保存的命令
+func (b *commandBackend) saveBacklog() error {
+	backlog, err := ReadCommandSpool(b.backlogPath)
+	if err != nil {
+		b.failed(err)
+		return err
+	}
+	saved := 0
+	for saved < len(backlog) {
+		batch := backlog[saved:min(saved+multiStorageRetryBatch, len(backlog))]
+		if err = b.storage.BulkSave(batch); err != nil {
+			// 部分保存成功时不再重复保存，返回的错误与新的命令无关
+			var partial *storage.PartialSaveError
+			if errors.As(err, &partial) {
+				saved += partial.Saved
+				err = partial.Err
+			}
+			break
+		}
+		saved += len(batch)
+	}
+	if saved > 0 {
+		if err1 := writeCommandBacklog(b.backlogPath, backlog[saved:]); err1 != nil {
+			logger.Errorf("Rewrite command backlog %s failed: %s", b.backlogPath, err1)
+			if err == nil {
+				err = err1
+			}
+		} else {
+			b.pending = len(backlog) - saved
+		}
+	}
+	if err != nil {
+		b.failed(err)
+		return err
+	}
+	b.succeed()
+	return nil
+}
+
+func (b *commandBackend) failed(err error) {
+	b.failures++
+	b.lastErr = err
+	b.nextRetry = time.Now().Add(backendBackoff(b.failures))
+}
+
+func (b *commandBackend) succeed() {
+	b.failures = 0
+	b.lastErr = nil
+	b.lastSuccess = time.Now()
+}
+
+// enqueue 追加到积压文件，写入失败时返回错误，命令保留在会话的 spool 中
+func (b *commandBackend) enqueue(commands []*storage.Command) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := appendCommandBacklog(b.backlogPath, commands); err != nil {
+		return err
+	}
+	b.pending += len(commands)
+	return nil
+}
+
+func (b *commandBackend) pendingCount() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.pending
+}
+
+func (b *commandBackend) health() CommandStorageHealth {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	h := CommandStorageHealth{
+		Type:        b.storage.TypeName(),
+		Healthy:     b.failures == 0,
+		Pending:     b.pending,
+		Failures:    b.failures,
+		LastSuccess: b.lastSuccess,
+	}
+	if b.lastErr != nil {
+		h.LastError = b.lastErr.Error()
+	}
+	return h
+}
+
+func appendCommandBacklog(path string, commands []*storage.Command) error {
+	if path == "" {
+		return errors.New("command backlog not available")
+	}
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err = writeCommandLines(fd, commands); err != nil {
+		return err
+	}
+	return fd.Sync()
+}
+
+// writeCommandBacklog 写入临时文件后替换，异常退出时不会丢失积压的命令
+func writeCommandBacklog(path string, commands []*storage.Command) error {
+	if len(commands) == 0 {
+		return os.Remove(path)
+	}
+	tmpPath := path + ".tmp"
+	fd, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = writeCommandLines(fd, commands); err == nil {
+		err = fd.Sync()
+	}
+	_ = fd.Close()
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func writeCommandLines(w io.Writer, commands []*storage.Command) error {
+	bw := bufio.NewWriter(w)
+	for i := range commands {
+		raw, err := json.Marshal(commands[i])
+		if err != nil {
+			return err
+		}
+		_, _ = bw.Write(raw)
+		_ = bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+func backendBackoff(failures int) time.Duration {
+	backoff := multiStorageMinBackoff
+	for i := 1; i < failures && backoff < multiStorageMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > multiStorageMaxBackoff {
+		backoff = multiStorageMaxBackoff
+	}
+	return backoff
+}
+
+type CommandStorageHealth struct {
+	Type        string    `json:"type"`
+	Healthy     bool      `json:"healthy"`
+	Pending     int       `json:"pending"`
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+}
+
+// NewMultiCommandStorage backlogDir 保存每个存储积压的命令，上次退出时积压的命令继续重试
+func NewMultiCommandStorage(backlogDir string, storages ...CommandStorage) *MultiCommandStorage {
+	backends := make([]*commandBackend, 0, len(storages))
+	for i := range storages {
+		backends = append(backends, newCommandBackend(storages[i], backlogDir))
+	}
+	m := &MultiCommandStorage{backends: backends}
+	for i := range backends {
+		if backends[i].pendingCount() > 0 {
+			m.startFlush()
+			break
+		}
+	}
+	return m
+}
+
+type MultiCommandStorage struct {
+	backends []*commandBackend
+
+	flushing sync.Mutex
+	running  bool
+}
+
+func (m *MultiCommandStorage) BulkSave(commands []*storage.Command) error {
+	results := make([]error, len(m.backends))
+	var wg sync.WaitGroup
+	for i := range m.backends {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = m.backends[i].save(commands)
+		}(i)
+	}
+	wg.Wait()
+
+	var (
+		accepted bool
+		errs     []string
+	)
+	for i := range results {
+		if results[i] == nil {
+			accepted = true
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", m.backends[i].storage.TypeName(), results[i]))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	// 限流的存储先进入积压队列，积压成功也算作已经接收
+	queued := make([]bool, len(results))
+	for i := range results {
+		if results[i] == nil || !isRetryLater(results[i]) {
+			continue
+		}
+		if err := m.backends[i].enqueue(remainCommands(commands, results[i])); err != nil {
+			logger.Errorf("Command storage %s queue failed: %s", m.backends[i].storage.TypeName(), err)
+			continue
+		}
+		queued[i] = true
+		accepted = true
+	}
+	if !accepted {
+		return fmt.Errorf("all command storages failed: %s", strings.Join(errs, "; "))
+	}
+	logger.Warnf("Command storage partial failed, queued for retry: %s", strings.Join(errs, "; "))
+	for i := range results {
+		if results[i] == nil || queued[i] {
+			continue
+		}
+		// 已经有存储保存成功，积压失败时只记录日志，返回错误会导致成功的存储重复写入
+		if err := m.backends[i].enqueue(remainCommands(commands, results[i])); err != nil {
+			logger.Errorf("Command storage %s queue failed, commands dropped: %s",
+				m.backends[i].storage.TypeName(), err)
+		}
+	}
+	m.startFlush()
+	return nil
+}
+
+// remainCommands 部分保存成功时只重试未保存的命令
+func remainCommands(commands []*storage.Command, err error) []*storage.Command {
+	var partial *storage.PartialSaveError
+	if errors.As(err, &partial) {
+		return commands[partial.Saved:]
+	}
+	return commands
+}
+
+// isRetryLater 存储限流或者积压的命令还在等待重试，新的命令直接进入积压队列
+func isRetryLater(err error) bool {
+	return errors.Is(err, storage.ErrWebhookBackpressure) || errors.Is(err, errBackendBackoff)
+}
+
+// queueExcept 全部存储失败后使用 core 保存成功时，其他存储稍后重试这批命令
+func (m *MultiCommandStorage) queueExcept(commands []*storage.Command, except string) error {
+	for i := range m.backends {
+		if m.backends[i].storage.TypeName() == except {
+			continue
+		}
+		if err := m.backends[i].enqueue(commands); err != nil {
+			return err
+		}
+	}
+	m.startFlush()
+	return nil
+}
+
+func (m *MultiCommandStorage) TypeName() string {
+	names := make([]string, 0, len(m.backends))
+	for i := range m.backends {
+		names = append(names, m.backends[i].storage.TypeName())
+	}
+	return "multi(" + strings.Join(names, ",") + ")"
+}
+
+func (m *MultiCommandStorage) Health() []CommandStorageHealth {
+	ret := make([]CommandStorageHealth, 0, len(m.backends))
+	for i := range m.backends {
+		ret = append(ret, m.backends[i].health())
+	}
+	return ret
+}
+
+// startFlush 会话结束后也需要重试积压的命令，队列清空后退出
+func (m *MultiCommandStorage) startFlush() {
+	m.flushing.Lock()
+	defer m.flushing.Unlock()
+	if m.running {
+		return
+	}
+	m.running = true
+	go m.flush()
+}
+
+func (m *MultiCommandStorage) flush() {
+	tick := time.NewTicker(multiStorageMinBackoff)
+	defer tick.Stop()
+	for range tick.C {
+		remain := 0
+		for i := range m.backends {
+			b := m.backends[i]
+			if b.pendingCount() == 0 {
+				continue
+			}
+			if err := b.save(nil); err != nil && !errors.Is(err, errBackendBackoff) {
+				logger.Errorf("Command storage %s retry failed: %s", b.storage.TypeName(), err)
+			}
+			remain += b.pendingCount()
+		}
+		if remain == 0 && m.stopFlush() {
+			return
+		}
+	}
+}
+
+func (m *MultiCommandStorage) stopFlush() bool {
+	m.flushing.Lock()
+	defer m.flushing.Unlock()
+	for i := range m.backends {
+		if m.backends[i].pendingCount() > 0 {
+			return false
+		}
+	}
+	m.running = false
+	return true
+}
+
+var (
+	multiStorageLock sync.Mutex
+	multiStorageKey  string
+	multiStorage     *MultiCommandStorage
+)
+
+// getMultiCommandStorage 多存储在所有会话间共享，会话结束后积压的命令仍然可以重试
+func getMultiCommandStorage(jmsService *service.JMService, conf *model.TerminalConfig,
+	primary CommandStorage, extraTypes []string) CommandStorage {
+	storages := []CommandStorage{primary}
+	seen := map[string]bool{primary.TypeName(): true}
+	for _, tp := range extraTypes {
+		extra := newCommandStorageByType(jmsService, conf, tp)
+		if seen[extra.TypeName()] {
+			continue
+		}
+		seen[extra.TypeName()] = true
+		storages = append(storages, extra)
+	}
+	if len(storages) == 1 && !needBacklog(primary) {
+		return primary
+	}
+	raw, _ := json.Marshal(conf.CommandStorage)
+	key := strings.Join(extraTypes, ",") + string(raw)
+	multiStorageLock.Lock()
+	defer multiStorageLock.Unlock()
+	if multiStorage == nil || multiStorageKey != key {
+		backlogDir := filepath.Join(config.GetConf().CommandSpoolFolderPath, "backlog")
+		multiStorage = NewMultiCommandStorage(backlogDir, storages...)
+		multiStorageKey = key
+		logger.Infof("Command storage fan-out to %s", multiStorage.TypeName())
+	}
+	return multiStorage
+}
+
+// CommandStoragesHealth 未开启多存储时返回 nil
+func CommandStoragesHealth() []CommandStorageHealth {
+	multiStorageLock.Lock()
+	storage := multiStorage
+	multiStorageLock.Unlock()
+	if storage == nil {
+		return nil
+	}
+	return storage.Health()
+}
+
+// needBacklog webhook 限流时需要积压队列，只使用 webhook 存储时也使用多存储
+func needBacklog(st CommandStorage) bool {
+	_, ok := st.(*storage.WebhookStorage)
+	return ok
+}
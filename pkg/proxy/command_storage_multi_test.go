@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
+)
+
+func testCommands(inputs ...string) []*storage.Command {
+	commands := make([]*storage.Command, 0, len(inputs))
+	for _, input := range inputs {
+		commands = append(commands, &storage.Command{Command: model.Command{Input: input}})
+	}
+	return commands
+}
+
+type fakeCommandStorage struct {
+	name  string
+	fail  bool
+	err   error
+	saved []*storage.Command
+}
+
+func (f *fakeCommandStorage) BulkSave(commands []*storage.Command) error {
+	if f.fail {
+		if f.err != nil {
+			return f.err
+		}
+		return errors.New("unavailable")
+	}
+	f.saved = append(f.saved, commands...)
+	return nil
+}
+
+func (f *fakeCommandStorage) TypeName() string {
+	return f.name
+}
+
+func TestMultiCommandStorage_BulkSave(t *testing.T) {
+	es := &fakeCommandStorage{name: "es"}
+	server := &fakeCommandStorage{name: "server", fail: true}
+	multi := NewMultiCommandStorage(t.TempDir(), es, server)
+
+	first := testCommands("ls")
+	if err := multi.BulkSave(first); err != nil {
+		t.Fatal(err)
+	}
+	health := multi.Health()
+	if !health[0].Healthy || health[1].Healthy || health[1].Pending != 1 {
+		t.Fatalf("unexpected health %+v", health)
+	}
+
+	// 恢复后积压的命令按顺序补写，成功的存储不会重复写入
+	server.fail = false
+	multi.backends[1].nextRetry = multi.backends[1].lastSuccess
+	if err := multi.BulkSave(testCommands("id")); err != nil {
+		t.Fatal(err)
+	}
+	if len(es.saved) != 2 || len(server.saved) != 2 || server.saved[0].Input != "ls" {
+		t.Fatalf("unexpected saved es %d server %d", len(es.saved), len(server.saved))
+	}
+
+	es.fail, server.fail = true, true
+	if err := multi.BulkSave(testCommands("whoami")); err == nil {
+		t.Fatal("expected error when all storages failed")
+	}
+	if multi.Health()[0].Pending != 0 {
+		t.Fatal("all failed batch should not be queued")
+	}
+}
+
+func TestMultiCommandStorage_Backlog(t *testing.T) {
+	dir := t.TempDir()
+	es := &fakeCommandStorage{name: "es", fail: true}
+	webhook := &fakeCommandStorage{name: "webhook"}
+	multi := NewMultiCommandStorage(dir, es, webhook)
+	if err := multi.BulkSave(testCommands("ls")); err != nil {
+		t.Fatal(err)
+	}
+	// 全部失败后由 core 保存，其他存储稍后重试
+	webhook.fail = true
+	if err := multi.queueExcept(testCommands("id"), "server"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后从积压文件继续重试
+	es.fail = false
+	restarted := NewMultiCommandStorage(dir, es, &fakeCommandStorage{name: "webhook"})
+	if health := restarted.Health(); health[0].Pending != 2 || health[1].Pending != 1 {
+		t.Fatalf("unexpected health %+v", health)
+	}
+	if err := restarted.BulkSave(testCommands("whoami")); err != nil {
+		t.Fatal(err)
+	}
+	if len(es.saved) != 3 || es.saved[0].Input != "ls" || es.saved[2].Input != "whoami" {
+		t.Fatalf("unexpected es saved %+v", es.saved)
+	}
+	if restarted.Health()[0].Pending != 0 {
+		t.Fatal("es backlog should be empty")
+	}
+}
+
+func TestMultiCommandStorage_Backpressure(t *testing.T) {
+	webhook := &fakeCommandStorage{name: "webhook", fail: true, err: storage.ErrWebhookBackpressure}
+	multi := NewMultiCommandStorage(t.TempDir(), webhook)
+	// 限流时进入积压队列，不交给 core 保存
+	if err := multi.BulkSave(testCommands("ls")); err != nil {
+		t.Fatal(err)
+	}
+	if err := multi.BulkSave(testCommands("id")); err != nil {
+		t.Fatal(err)
+	}
+	if pending := multi.Health()[0].Pending; pending != 2 {
+		t.Fatalf("unexpected pending %d", pending)
+	}
+	webhook.fail = false
+	multi.backends[0].nextRetry = time.Time{}
+	if err := multi.backends[0].save(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(webhook.saved) != 2 || webhook.saved[0].Input != "ls" || webhook.saved[1].Input != "id" {
+		t.Fatalf("unexpected webhook saved %+v", webhook.saved)
+	}
+}
+
+func TestMultiCommandStorage_QueueFailed(t *testing.T) {
+	es := &fakeCommandStorage{name: "es"}
+	server := &fakeCommandStorage{name: "server", fail: true}
+	// 没有积压目录时积压失败，已经保存成功的存储不能重复写入
+	multi := NewMultiCommandStorage("", es, server)
+	if err := SaveCommands(nil, multi, testCommands("ls")); err != nil {
+		t.Fatal(err)
+	}
+	if len(es.saved) != 1 {
+		t.Fatalf("unexpected es saved %+v", es.saved)
+	}
+}
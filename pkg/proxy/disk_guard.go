@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+/*
+磁盘水位，由 koko 的磁盘清理任务更新:
+	warning  超过低水位，告警并清理过期的文件
+	critical 超过高水位，不再创建新的录像和文件记录，开启 DISK_FAIL_CLOSED 时拒绝新的会话
+*/
+
+const (
+	DiskLevelNormal int32 = iota
+	DiskLevelWarning
+	DiskLevelCritical
+)
+
+var ErrDiskFull = errors.New("local disk usage exceeds the high watermark")
+
+var diskLevel atomic.Int32
+
+func SetDiskLevel(level int32) {
+	diskLevel.Store(level)
+}
+
+func GetDiskLevel() int32 {
+	return diskLevel.Load()
+}
+
+// recordingRefused 超过高水位时不再写入新的录像和文件
+func recordingRefused() bool {
+	return diskLevel.Load() >= DiskLevelCritical
+}
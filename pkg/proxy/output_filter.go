@@ -0,0 +1,331 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+服务器输出的过滤规则:
+	终端配置的 TERMINAL_OUTPUT_FILTER_RULES 下发规则，例如私钥、AWS key、信用卡号、/etc/shadow 的内容
+	匹配时记录一条风险命令，mask 为 true 时把匹配的内容替换为 *，用户、共享会话和录像都只能看到替换后的内容
+	输出分包到达，为了匹配跨包的内容:
+		保留上一包末尾的数据一起匹配，只处理结束位置在新数据中的匹配，不重复记录
+		有 mask 规则时暂不输出最后不完整的一行，没有新数据时 outputFilterFlushDelay 之后输出
+		规则固定前缀 (例如 -----BEGIN ) 之后还没有完整匹配的内容一直保留，不匹配换行的规则只检查最后一行，
+		直到超过 outputFilterWindow 字节或者 outputFilterMaxLines 行，会话结束时替换为 *
+	命令记录中只保存匹配内容开始的几个字符，其余替换为 *
+*/
+
+const (
+	// outputFilterWindow 跨包匹配时保留的最大长度
+	outputFilterWindow = 8 * 1024
+	// outputFilterMaxLines 固定前缀之后没有完整匹配时最多保留的行数
+	outputFilterMaxLines = 128
+	// outputFilterFlushDelay 没有新的输出时，输出暂存的不完整的一行
+	outputFilterFlushDelay = 20 * time.Millisecond
+
+	// outputFilterEvidenceSize 命令记录中保存的匹配内容的最大长度
+	outputFilterEvidenceSize = 128
+	// outputFilterEvidenceVisible 没有 mask 的规则，命令记录中不替换的长度
+	outputFilterEvidenceVisible = 8
+
+	outputFilterInputPrefix = "[output filter] "
+)
+
+// OutputFilterRule 终端配置下发的输出过滤规则，risk_level 为 0 时使用警告等级
+type OutputFilterRule struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Pattern   string `json:"pattern"`
+	Mask      bool   `json:"mask"`
+	RiskLevel int64  `json:"risk_level"`
+}
+
+type outputRule struct {
+	OutputFilterRule
+	re     *regexp.Regexp
+	prefix []byte
+	// 可以匹配换行，例如私钥
+	multiline bool
+}
+
+var outputFilterRules atomic.Value
+
+// updateOutputFilterRules 更新规则，只对之后创建的会话生效，无效的规则忽略
+func updateOutputFilterRules(rules []OutputFilterRule) {
+	compiled := make([]*outputRule, 0, len(rules))
+	for i := range rules {
+		rule, err := compileOutputRule(rules[i])
+		if err != nil {
+			logger.Errorf("Invalid output filter rule %s pattern %q: %v", rules[i].Name, rules[i].Pattern, err)
+			continue
+		}
+		compiled = append(compiled, rule)
+	}
+	outputFilterRules.Store(compiled)
+}
+
+func compileOutputRule(rule OutputFilterRule) (*outputRule, error) {
+	if rule.Pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := syntax.Parse(rule.Pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prefix, _ := re.LiteralPrefix()
+	return &outputRule{OutputFilterRule: rule, re: re, prefix: []byte(prefix),
+		multiline: matchNewline(parsed)}, nil
+}
+
+// matchNewline 规则是否可以匹配换行
+func matchNewline(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpAnyChar:
+		return true
+	case syntax.OpCharClass:
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if re.Rune[i] <= '\n' && re.Rune[i+1] >= '\n' {
+				return true
+			}
+		}
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if r == '\n' {
+				return true
+			}
+		}
+	}
+	for _, sub := range re.Sub {
+		if matchNewline(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func currentOutputFilterRules() []*outputRule {
+	rules, _ := outputFilterRules.Load().([]*outputRule)
+	return rules
+}
+
+// OutputFilterMatch 一次输出中匹配的规则
+type OutputFilterMatch struct {
+	Rule     OutputFilterRule
+	Count    int
+	Evidence string
+}
+
+type outputFilter struct {
+	rules   []*outputRule
+	hasMask bool
+
+	// tail 已经输出的数据的末尾，只用于匹配
+	tail []byte
+	// pending 暂不输出的数据
+	pending []byte
+}
+
+func newOutputFilter(rules []*outputRule) *outputFilter {
+	if len(rules) == 0 {
+		return nil
+	}
+	f := &outputFilter{rules: rules}
+	for _, rule := range rules {
+		if rule.Mask {
+			f.hasMask = true
+		}
+	}
+	return f
+}
+
+// Pending 是否有暂存的数据
+func (f *outputFilter) Pending() bool {
+	return len(f.pending) > 0
+}
+
+// Filter 返回可以输出的数据和匹配的规则
+func (f *outputFilter) Filter(p []byte) ([]byte, []OutputFilterMatch) {
+	buf := append(f.pending, p...)
+	hold := len(buf)
+	if f.hasMask {
+		hold = f.holdPoint(buf, false)
+	}
+	f.pending = append([]byte(nil), buf[hold:]...)
+	return f.process(buf[:hold])
+}
+
+// FlushIdle 没有新的输出时输出不完整的一行，固定前缀之后还没有完整匹配的内容继续保留
+func (f *outputFilter) FlushIdle() ([]byte, []OutputFilterMatch) {
+	hold := f.holdPoint(f.pending, true)
+	buf := f.pending[:hold]
+	f.pending = append([]byte(nil), f.pending[hold:]...)
+	return f.process(buf)
+}
+
+// Flush 会话结束或者开始传输文件时输出全部暂存的数据，固定前缀之后还没有完整匹配的内容替换为 *
+func (f *outputFilter) Flush() ([]byte, []OutputFilterMatch) {
+	buf := f.pending
+	f.pending = nil
+	maskBytes(buf[f.unresolvedPoint(buf):])
+	return f.process(buf)
+}
+
+// holdPoint 可以输出的位置，idle 为 false 时最后不完整的一行也暂不输出
+func (f *outputFilter) holdPoint(buf []byte, idle bool) int {
+	hold := len(buf)
+	if !idle {
+		hold = bytes.LastIndexByte(buf, '\n') + 1
+	}
+	hold = min(hold, f.unresolvedPoint(buf))
+	if len(buf)-hold > outputFilterWindow {
+		hold = len(buf) - outputFilterWindow
+	}
+	return hold
+}
+
+// unresolvedPoint mask 规则的固定前缀之后还没有完整匹配的位置，没有时返回 len(buf)
+func (f *outputFilter) unresolvedPoint(buf []byte) int {
+	point := len(buf)
+	lineStart := bytes.LastIndexByte(buf, '\n') + 1
+	for _, rule := range f.rules {
+		if !rule.Mask || len(rule.prefix) == 0 {
+			continue
+		}
+		start := lineStart
+		if rule.multiline {
+			start = 0
+		}
+		idx := bytes.LastIndex(buf[start:], rule.prefix)
+		if idx == -1 {
+			// 结尾是固定前缀的开始部分
+			if keep := partialPrefixLen(buf[start:], string(rule.prefix)); keep > 0 {
+				point = min(point, len(buf)-keep)
+			}
+			continue
+		}
+		idx += start
+		if loc := rule.re.FindIndex(buf[idx:]); loc != nil && loc[0] == 0 {
+			continue
+		}
+		if bytes.Count(buf[idx:], []byte{'\n'}) > outputFilterMaxLines {
+			continue
+		}
+		point = min(point, idx)
+	}
+	return point
+}
+
+func (f *outputFilter) process(data []byte) ([]byte, []OutputFilterMatch) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	text := make([]byte, 0, len(f.tail)+len(data))
+	text = append(text, f.tail...)
+	text = append(text, data...)
+	offset := len(f.tail)
+	var (
+		out     []byte
+		matches []OutputFilterMatch
+	)
+	for _, rule := range f.rules {
+		var match *OutputFilterMatch
+		for _, loc := range rule.re.FindAllIndex(text, -1) {
+			// 结束位置在之前的数据中的匹配已经处理过
+			if loc[1] <= offset || loc[0] == loc[1] {
+				continue
+			}
+			if match == nil {
+				matches = append(matches, OutputFilterMatch{Rule: rule.OutputFilterRule})
+				match = &matches[len(matches)-1]
+			}
+			match.Count++
+			if rule.Mask {
+				if out == nil {
+					out = append([]byte(nil), data...)
+				}
+				maskBytes(out[max(loc[0]-offset, 0) : loc[1]-offset])
+			}
+			if match.Evidence == "" {
+				visible := outputFilterEvidenceVisible
+				if rule.Mask {
+					visible = 0
+				}
+				match.Evidence = outputFilterEvidence(text[loc[0]:loc[1]], visible)
+			}
+		}
+	}
+	if out == nil {
+		out = data
+	}
+	if len(text) > outputFilterWindow {
+		text = text[len(text)-outputFilterWindow:]
+	}
+	f.tail = append(f.tail[:0], text...)
+	return out, matches
+}
+
+// maskBytes 可见字符替换为 *，保留换行等控制字符，长度不变
+func maskBytes(p []byte) []byte {
+	for i := range p {
+		if p[i] >= 0x20 && p[i] != 0x7f {
+			p[i] = '*'
+		}
+	}
+	return p
+}
+
+// outputFilterEvidence 命令记录中保存的匹配内容，只保留开始的 visible 个字节，其余替换为 *
+func outputFilterEvidence(match []byte, visible int) string {
+	evidence := []byte(truncateUTF8(match, outputFilterEvidenceSize))
+	if visible < len(evidence) {
+		for visible > 0 && !utf8.RuneStart(evidence[visible]) {
+			visible--
+		}
+		maskBytes(evidence[visible:])
+	}
+	return string(evidence)
+}
+
+func truncateUTF8(p []byte, size int) string {
+	if len(p) <= size {
+		return string(p)
+	}
+	for size > 0 && !utf8.RuneStart(p[size]) {
+		size--
+	}
+	return string(p[:size])
+}
+
+// outputFilterCommand 匹配的规则记录为风险命令
+func (p *Parser) outputFilterCommand(match OutputFilterMatch) *ExecutedCommand {
+	riskLevel := match.Rule.RiskLevel
+	if riskLevel == 0 {
+		riskLevel = model.WarningLevel
+	}
+	output := match.Evidence
+	if match.Count > 1 {
+		output = fmt.Sprintf("%s\n[matched %d times]", output, match.Count)
+	}
+	return &ExecutedCommand{
+		Command:     outputFilterInputPrefix + match.Rule.Name,
+		Output:      output,
+		CreatedDate: time.Now(),
+		RiskLevel:   riskLevel,
+		User:        p.currentActiveUser,
+	}
+}
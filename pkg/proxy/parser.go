@@ -79,11 +79,17 @@ type Parser struct {
 	confirmStatus commandConfirmStatus
 
 	zmodemParser        *zmodem.ZmodemParser
+	trzszParser         *zmodem.TrzszParser
+	trzszDetector       zmodem.TrzszDetector
 	enableDownload      bool
 	enableUpload        bool
 	abortedFileTransfer bool
 	currentActiveUser   CurrentActiveUser
 
+	// 超过传输大小取消 zmodem 之后，一段时间内丢弃发送端还在传输的数据
+	zmodemDiscardType  string
+	zmodemDiscardUntil time.Time
+
 	i18nLang string
 
 	platform *model.Platform
@@ -93,7 +99,16 @@ type Parser struct {
 
 	userInputFilter func([]byte) []byte
 
+	userInputRecorder func(p []byte, meta exchange.MetaMessage)
+
 	disableInputAsCmd bool
+
+	// 登录后注入 shell integration，服务器输出停止一段时间后注入，用户先输入时不再注入
+	shellIntegration   bool
+	shellInjectPending bool
+
+	// 终端配置下发的输出过滤规则，没有规则时为 nil
+	outputFilter *outputFilter
 }
 
 func (p *Parser) setCurrentCmdStatusLevel(level int64) {
@@ -148,12 +163,23 @@ func (p *Parser) initial(w, h int) {
 	p.closed = make(chan struct{})
 	p.cmdRecordChan = make(chan *ExecutedCommand, 1024)
 	p.disableInputAsCmd = config.GetConf().DisableInputAsCommand
+	p.outputFilter = newOutputFilter(currentOutputFilterRules())
+	if p.shellIntegration {
+		p.TerminalParser.EnableShellIntegration()
+		p.TerminalParser.EmitShellCommand = p.EmitShellCommandEvent
+		p.shellInjectPending = true
+	}
 }
 
 func (p *Parser) SetUserInputFilter(filter func([]byte) []byte) {
 	p.userInputFilter = filter
 }
 
+// SetUserInputRecorder 设置用户原始输入的记录回调，在过滤和解析之前调用
+func (p *Parser) SetUserInputRecorder(recorder func(p []byte, meta exchange.MetaMessage)) {
+	p.userInputRecorder = recorder
+}
+
 // ParseStream 解析数据流
 func (p *Parser) ParseStream(userInChan chan *exchange.RoomMessage, srvInChan <-chan []byte) (userOut, srvOut <-chan []byte) {
 	p.userOutputChan = make(chan []byte, 1)
@@ -162,16 +188,26 @@ func (p *Parser) ParseStream(userInChan chan *exchange.RoomMessage, srvInChan <-
 	go func() {
 		defer func() {
 			// 会话结束，结算命令结果
+			if cmd, ok := p.TerminalParser.FlushShellCommand(); ok {
+				p.EmitShellCommandEvent(cmd)
+			}
 			p.sendCommandRecord()
 			close(p.cmdRecordChan)
 			close(p.userOutputChan)
 			close(p.srvOutputChan)
 			p.zmodemParser.Cleanup()
+			p.trzszParser.Cleanup()
 			logger.Infof("Session %s: Parser routine done", p.id)
 		}()
 		cmdRecordTicker := time.NewTicker(time.Minute)
 		defer cmdRecordTicker.Stop()
 		lastActiveTime := time.Now()
+		shellInjectTimer := time.NewTimer(shellInjectQuiet)
+		shellInjectTimer.Stop()
+		defer shellInjectTimer.Stop()
+		outputFlushTimer := time.NewTimer(outputFilterFlushDelay)
+		outputFlushTimer.Stop()
+		defer outputFlushTimer.Stop()
 		for {
 			select {
 			case <-p.closed:
@@ -186,7 +222,14 @@ func (p *Parser) ParseStream(userInChan chan *exchange.RoomMessage, srvInChan <-
 					b = msg.Body
 				}
 				p.UpdateActiveUser(msg)
+				if len(b) > 0 && p.userInputRecorder != nil {
+					p.userInputRecorder(b, msg.Meta)
+				}
 				if len(b) > 0 {
+					if p.shellInjectPending {
+						p.shellInjectPending = false
+						shellInjectTimer.Stop()
+					}
 					b = p.ParseUserInput(b)
 				}
 				select {
@@ -197,14 +240,54 @@ func (p *Parser) ParseStream(userInChan chan *exchange.RoomMessage, srvInChan <-
 
 			case b, ok := <-srvInChan:
 				if !ok {
+					if p.outputFilter != nil && p.outputFilter.Pending() {
+						select {
+						case <-p.closed:
+						case p.srvOutputChan <- p.flushServerOutput(false):
+						}
+					}
 					return
 				}
+				if p.shellInjectPending {
+					shellInjectTimer.Reset(shellInjectQuiet)
+				}
 				b = p.ParseServerOutput(b)
+				if p.outputFilter != nil && p.outputFilter.Pending() {
+					outputFlushTimer.Reset(outputFilterFlushDelay)
+				}
 				select {
 				case <-p.closed:
 					return
 				case p.srvOutputChan <- b:
 				}
+			case <-outputFlushTimer.C:
+				if p.outputFilter == nil || !p.outputFilter.Pending() {
+					continue
+				}
+				out := p.flushServerOutput(true)
+				if len(out) == 0 {
+					// 固定前缀之后的内容继续保留
+					continue
+				}
+				select {
+				case <-p.closed:
+					return
+				case p.srvOutputChan <- out:
+				}
+				continue
+			case <-shellInjectTimer.C:
+				if !p.shellInjectPending {
+					continue
+				}
+				p.shellInjectPending = false
+				logger.Infof("Session %s: inject shell integration", p.id)
+				p.TerminalParser.ShellInjected()
+				select {
+				case <-p.closed:
+					return
+				case p.userOutputChan <- []byte(shellIntegrationScript):
+				}
+				continue
 			case now := <-cmdRecordTicker.C:
 				// 每隔一分钟超时，尝试结算一次命令
 				if now.Sub(lastActiveTime) > time.Minute {
@@ -242,6 +325,13 @@ func (p *Parser) isEnterKeyPress(b []byte) bool {
 // parseInputState 切换用户输入状态, 并结算命令和结果
 func (p *Parser) parseInputState(b []byte) []byte {
 	lang := i18n.NewLang(p.i18nLang)
+	if p.isZmodemDiscard(zmodem.TypeUpload) {
+		return nil
+	}
+	// 不是 trzsz 协议的输入会结束 trzsz 会话，按照普通输入解析
+	if p.trzszParser.IsStartSession() && p.trzszParser.ParseClient(b) {
+		return b
+	}
 	if p.zmodemParser.IsStartSession() {
 		switch p.zmodemParser.Status() {
 		case zmodem.ZParserStatusReceive:
@@ -254,6 +344,13 @@ func (p *Parser) parseInputState(b []byte) []byte {
 				p.srvOutputChan <- zmodem.SkipSequence
 				return zmodem.AbortSession
 			}
+			if p.zmodemParser.ExceedLimit() {
+				logger.Infof("Session %s: zmodem upload file exceeds the max transfer size", p.id)
+				p.abortZmodemTransfer(zmodem.TypeUpload)
+				p.srvOutputChan <- zmodem.CancelSequence
+				p.srvOutputChan <- []byte("\r\n" + lang.T("File size exceeds the transfer limit") + "\r\n")
+				return zmodem.CancelSequence
+			}
 
 			if !p.zmodemParser.IsStartSession() && p.abortedFileTransfer {
 				/*
@@ -403,7 +500,7 @@ func (p *Parser) parseInputState(b []byte) []byte {
 			default:
 			}
 		}
-		if strings.Contains(p.command, "\r") {
+		if strings.Contains(p.command, "\r") && !p.TerminalParser.ShellIntegrationActive() {
 			// 先记录一次 多行命令的输入，output 暂且为空
 			p.sendCommandToChan()
 			p.command = ""
@@ -451,12 +548,58 @@ func (p *Parser) ParseUserInput(b []byte) []byte {
 	return nb
 }
 
+const zmodemDiscardDuration = 3 * time.Second
+
+// abortZmodemTransfer 取消 zmodem 会话，记录当前文件失败
+func (p *Parser) abortZmodemTransfer(transferType string) {
+	p.zmodemParser.Abort()
+	p.zmodemDiscardType = transferType
+	p.zmodemDiscardUntil = time.Now().Add(zmodemDiscardDuration)
+}
+
+// isZmodemDiscard 发送端收到取消之前发出的数据不再转发，避免作为命令输入或者显示在终端
+func (p *Parser) isZmodemDiscard(transferType string) bool {
+	return p.zmodemDiscardType == transferType && time.Now().Before(p.zmodemDiscardUntil)
+}
+
 // parseZmodemState 解析数据，查看是不是处于zmodem状态
 // 处于zmodem状态不会再解析命令
 func (p *Parser) parseZmodemState(b []byte) {
 	p.zmodemParser.Parse(b)
 }
 
+// parseTrzszState 检测 trz tsz 的触发字符串。没有权限时去掉触发字符串，客户端不会开始传输，
+// 同时给资产上的 trz tsz 发送错误消息使其退出
+func (p *Parser) parseTrzszState(b []byte) []byte {
+	if p.zmodemParser.IsStartSession() {
+		p.trzszDetector.Reset()
+		return b
+	}
+	// 触发字符串可能跨越两次输出，前一部分已经发送给用户，去掉本次输出中的部分即可
+	transferType, loc, ok := p.trzszDetector.Detect(b)
+	if !ok {
+		return b
+	}
+	var msg string
+	switch {
+	case transferType == zmodem.TypeUpload && !p.enableUpload:
+		msg = "have no permission to upload file"
+	case transferType == zmodem.TypeDownload && !p.enableDownload:
+		msg = "have no permission to download file"
+	default:
+		p.trzszParser.Start(transferType)
+		p.trzszParser.ParseServer(b[loc[1]:])
+		return b
+	}
+	logger.Infof("Session %s: trzsz %s is not permitted", p.id, transferType)
+	lang := i18n.NewLang(p.i18nLang)
+	p.userOutputChan <- zmodem.TrzszFailMessage(lang.T(msg))
+	out := make([]byte, 0, len(b))
+	out = append(out, b[:loc[0]]...)
+	out = append(out, b[loc[1]:]...)
+	return out
+}
+
 // parseVimState 解析vim的状态，处于vim状态中，里面输入的命令不再记录
 func (p *Parser) parseVimState(b []byte) {
 	if !p.isEditMode && IsEditEnterMode(b) {
@@ -493,9 +636,23 @@ func (p *Parser) parseVimState(b []byte) {
 // splitCmdStream 将服务器输出流分离到命令buffer和命令输出buffer
 func (p *Parser) splitCmdStream(b []byte) []byte {
 	lang := i18n.NewLang(p.i18nLang)
+	if p.isZmodemDiscard(zmodem.TypeDownload) {
+		return nil
+	}
+	if p.trzszParser.IsStartSession() && p.trzszParser.ParseServer(b) {
+		return b
+	}
 	if p.zmodemParser.IsStartSession() {
 		if p.zmodemParser.Status() == zmodem.ZParserStatusSend {
 			p.zmodemParser.Parse(b)
+			if p.zmodemParser.ExceedLimit() {
+				logger.Infof("Session %s: zmodem download file exceeds the max transfer size", p.id)
+				p.abortZmodemTransfer(zmodem.TypeDownload)
+				p.userOutputChan <- zmodem.CancelSequence
+				msg := lang.T("File size exceeds the transfer limit")
+				out := append([]byte{}, zmodem.CancelSequence...)
+				return append(out, []byte("\r\n"+msg+"\r\n")...)
+			}
 		}
 		if !p.zmodemParser.IsStartSession() && p.abortedFileTransfer {
 			logger.Info("Zmodem abort download file finished")
@@ -513,16 +670,22 @@ func (p *Parser) splitCmdStream(b []byte) []byte {
 		}
 		return b
 	} else {
+		b = p.TerminalParser.ConsumeShellMarkers(b)
 		p.parseVimState(b)
 		if p.inVimState {
 			return b
 		}
 		p.parseZmodemState(b)
+		b = p.parseTrzszState(b)
 	}
 	if p.zmodemParser.IsStartSession() {
 		logger.Infof("Zmodem start session %s", p.zmodemParser.Status())
 		return b
 	}
+	if p.trzszParser.IsStartSession() {
+		logger.Infof("Trzsz start session %s", p.trzszParser.Status())
+		return b
+	}
 	p.TerminalParser.Feed(b)
 	return b
 }
@@ -531,14 +694,114 @@ func (p *Parser) splitCmdStream(b []byte) []byte {
 func (p *Parser) ParseServerOutput(b []byte) []byte {
 	p.lock.Lock()
 	defer p.lock.Unlock()
+	b = p.filterServerOutput(b)
 	return p.splitCmdStream(b)
 }
 
+// filterServerOutput 输出过滤规则匹配和替换，传输文件时不处理
+func (p *Parser) filterServerOutput(b []byte) []byte {
+	if p.outputFilter == nil {
+		return b
+	}
+	var matches []OutputFilterMatch
+	if p.IsInZmodemRecvState() {
+		if !p.outputFilter.Pending() {
+			return b
+		}
+		var out []byte
+		out, matches = p.outputFilter.Flush()
+		b = append(out, b...)
+	} else {
+		b, matches = p.outputFilter.Filter(b)
+	}
+	p.recordOutputFilterMatches(matches)
+	return b
+}
+
+// flushServerOutput 输出过滤暂存的数据，idle 为 true 时是没有新的输出，否则是会话结束
+func (p *Parser) flushServerOutput(idle bool) []byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var (
+		out     []byte
+		matches []OutputFilterMatch
+	)
+	if idle {
+		out, matches = p.outputFilter.FlushIdle()
+	} else {
+		out, matches = p.outputFilter.Flush()
+	}
+	p.recordOutputFilterMatches(matches)
+	return p.splitCmdStream(out)
+}
+
+func (p *Parser) recordOutputFilterMatches(matches []OutputFilterMatch) {
+	for _, match := range matches {
+		logger.Infof("Session %s: server output matched filter rule %s %d times, mask %t",
+			p.id, match.Rule.Name, match.Count, match.Rule.Mask)
+		p.cmdRecordChan <- p.outputFilterCommand(match)
+	}
+}
+
 // IsMatchCommandRule 判断命令是不是在过滤规则中
 func (p *Parser) IsMatchCommandRule(command string) (CommandRule,
 	string, bool) {
-	for i := range p.cmdFilterACLs {
-		rule := p.cmdFilterACLs[i]
+	return MatchCommandACLs(p.cmdFilterACLs, command)
+}
+
+// actionStrictness 多个子命令匹配到不同的规则时，使用最严格的动作
+var actionStrictness = map[model.CommandAction]int{
+	model.ActionReject:        0,
+	model.ActionReview:        1,
+	model.ActionNotifyAndWarn: 2,
+	model.ActionWarning:       3,
+	model.ActionAccept:        4,
+}
+
+/*
+MatchCommandACLs 按照 shell 语法拆分命令，整行命令和每个子命令分别匹配过滤规则，
+返回最严格的动作，例如 ls; rm -rf /、$(rm -rf /)、bash -c 'rm -rf /' 都会匹配 rm 的规则。
+acls 需要按照优先级排序，每个命令使用第一个匹配的规则。
+命令行嵌套过深或者子命令过多无法完全拆分时，没有匹配到拒绝或者复核规则的命令直接拒绝。
+*/
+func MatchCommandACLs(acls model.CommandACLs, command string) (CommandRule, string, bool) {
+	commands, complete := utils.ShellCommands(command)
+	candidates := append([]string{command}, commands...)
+	var (
+		result    CommandRule
+		resultCmd string
+		found     bool
+	)
+	for _, candidate := range candidates {
+		rule, cmd, ok := matchCommandACL(acls, candidate)
+		if !ok {
+			continue
+		}
+		if !found || actionStrictness[rule.Acl.Action] < actionStrictness[result.Acl.Action] {
+			result, resultCmd, found = rule, cmd, true
+		}
+		if result.Acl.Action == model.ActionReject {
+			break
+		}
+	}
+	if !complete && len(acls) > 0 && (!found || actionStrictness[result.Acl.Action] > actionStrictness[model.ActionReview]) {
+		logger.Warnf("Command is too complex to check, reject it: %s", command)
+		return incompleteCommandRule(), command, true
+	}
+	return result, resultCmd, found
+}
+
+// incompleteCommandRule 无法完全拆分的命令使用的拒绝规则
+func incompleteCommandRule() CommandRule {
+	return CommandRule{
+		Acl:  &model.CommandACL{Name: "incomplete command", Action: model.ActionReject, IsActive: true},
+		Item: &model.CommandFilterItem{},
+	}
+}
+
+func matchCommandACL(acls model.CommandACLs, command string) (CommandRule, string, bool) {
+	for i := range acls {
+		rule := acls[i]
 		item, allowed, cmd := rule.Match(command)
 		switch allowed {
 		case model.ActionAccept, model.ActionWarning, model.ActionNotifyAndWarn:
@@ -559,23 +822,19 @@ type CommandRule struct {
 func (p *Parser) waitCommandConfirm() {
 	cmd := p.confirmStatus.Cmd
 	rule := p.confirmStatus.Rule
-	resp, err := p.jmsService.SubmitCommandReview(p.id, rule.Acl.ID, p.confirmStatus.Cmd)
+	review, err := SubmitCommandReview(p.jmsService, p.id, rule, p.confirmStatus.Cmd)
 	if err != nil {
 		logger.Errorf("Session %s: submit command confirm api err: %s", p.id, err)
 		p.confirmStatus.SetAction(model.ActionReject)
 		return
 	}
 	lang := i18n.NewLang(p.i18nLang)
-	checkReq := resp.CheckReq
-	cancelReq := resp.CloseReq
-	detailURL := resp.TicketDetailUrl
-	reviewers := resp.Reviewers
+	detailURL := review.TicketDetailURL()
+	reviewers := review.Reviewers()
 	msg := lang.T("Please waiting for the reviewers to confirm command `%s`, cancel by CTRL+C or CTRL+D.")
 	cmd = strings.ReplaceAll(cmd, "\r", "")
 	cmd = strings.ReplaceAll(cmd, "\n", "")
 	waitMsg := fmt.Sprintf(msg, cmd)
-	checkTimer := time.NewTicker(10 * time.Second)
-	defer checkTimer.Stop()
 	ctx, cancelFunc := context.WithCancel(p.confirmStatus.ctx)
 	defer cancelFunc()
 	go func() {
@@ -598,6 +857,8 @@ func (p *Parser) waitCommandConfirm() {
 		for {
 			select {
 			case <-p.closed:
+				// 会话关闭时取消工单
+				cancelFunc()
 				return
 			case <-ctx.Done():
 				return
@@ -611,47 +872,25 @@ func (p *Parser) waitCommandConfirm() {
 			}
 		}
 	}()
-	for {
-		select {
-		case <-p.closed:
-			if err = p.jmsService.CancelConfirmByRequestInfo(cancelReq); err != nil {
-				logger.Errorf("Session %s: Cancel command confirm err: %s", p.id, err)
-			}
-			logger.Infof("Session %s: Closed", p.id)
-			return
-		case <-ctx.Done():
-			// 取消
-			if err = p.jmsService.CancelConfirmByRequestInfo(cancelReq); err != nil {
-				logger.Errorf("Session %s: Cancel command confirm err: %s", p.id, err)
+	action := review.Wait(ctx)
+	switch action {
+	case model.ActionAccept, model.ActionReject:
+		p.confirmStatus.SetProcessor(review.Processor())
+		p.confirmStatus.SetAction(action)
+	default:
+		logger.Infof("Session %s: Cancel confirm command", p.id)
+		if review.TimedOut() {
+			select {
+			case <-p.closed:
+			case p.srvOutputChan <- []byte("\r\n" + lang.T("Command review timed out")):
 			}
-			logger.Infof("Session %s: Cancel confirm command", p.id)
-			return
-		case <-checkTimer.C:
-		}
-		statusResp, err := p.jmsService.CheckConfirmStatusByRequestInfo(checkReq)
-		if err != nil {
-			logger.Errorf("Session %s: check command confirm status err: %s", p.id, err)
-			continue
-		}
-		switch statusResp.State {
-		case model.TicketOpen:
-			continue
-		case model.TicketApproved:
-			p.confirmStatus.SetAction(model.ActionAccept)
-			p.confirmStatus.SetProcessor(statusResp.Processor)
-			return
-		case model.TicketRejected, model.TicketClosed:
-			p.confirmStatus.SetProcessor(statusResp.Processor)
-			p.confirmStatus.SetAction(model.ActionReject)
-			return
-		default:
-			logger.Errorf("Receive unknown command confirm status %s", statusResp.Status)
 		}
 	}
 }
 
+// IsInZmodemRecvState 正在使用 rz sz 或者 trz tsz 传输文件
 func (p *Parser) IsInZmodemRecvState() bool {
-	return p.zmodemParser.IsStartSession()
+	return p.zmodemParser.IsStartSession() || p.trzszParser.IsStartSession()
 }
 
 // Close 关闭parser
@@ -667,6 +906,10 @@ func (p *Parser) Close() {
 }
 
 func (p *Parser) sendCommandRecord() {
+	if p.TerminalParser.ShellCommandRunning() {
+		// 命令结束时由 shell integration 记录
+		return
+	}
 	if p.command != "" {
 		p.output = p.TerminalParser.TryOutput()
 		p.sendCommandToChan()
@@ -680,15 +923,40 @@ func (p *Parser) EmitCommandEvent(cmd string, outputBuf string) {
 		logger.Debugf("Session %s: Command cannot be empty: %s", p.id, outputBuf)
 		return
 	}
+	if p.TerminalParser.shellActive() {
+		// 命令由 shell integration 记录
+		return
+	}
 	p.command = cmd
 	p.output = outputBuf
 	p.sendCommandToChan()
 }
 
+// EmitShellCommandEvent shell integration 解析出的命令，附带退出码和执行时长
+func (p *Parser) EmitShellCommandEvent(cmd ShellCommand) {
+	if cmd.Fallback && p.command != "" && p.command != cmd.Command {
+		// 提示符匹配解析的命令还没有记录，例如嵌套 shell 中最后执行的命令
+		p.sendCommandToChan()
+	}
+	p.command = cmd.Command
+	p.output = cmd.Output
+	p.cmdCreateDate = cmd.Start
+	item := p.newExecutedCommand()
+	item.ExitStatus = cmd.ExitCode
+	item.HasExitStatus = cmd.ExitCode >= 0
+	item.Duration = cmd.Duration
+	p.cmdRecordChan <- item
+}
+
 func (p *Parser) sendCommandToChan() {
 	if p.command == "" {
 		return
 	}
+	p.cmdRecordChan <- p.newExecutedCommand()
+}
+
+// newExecutedCommand 使用当前的命令、输出和匹配的规则生成命令记录，并重置状态
+func (p *Parser) newExecutedCommand() *ExecutedCommand {
 	cmd := p.command
 	output := p.output
 	cmdFilterId := ""
@@ -697,7 +965,7 @@ func (p *Parser) sendCommandToChan() {
 		cmdFilterId = rule.Acl.ID
 		cmdGroupId = rule.Item.ID
 	}
-	p.cmdRecordChan <- &ExecutedCommand{
+	item := &ExecutedCommand{
 		Command:        cmd,
 		Output:         output,
 		CreatedDate:    p.cmdCreateDate,
@@ -710,6 +978,7 @@ func (p *Parser) sendCommandToChan() {
 	p.resetCurrentCmdFilterRule()
 	p.command = ""
 	p.output = ""
+	return item
 }
 
 func (p *Parser) NeedRecord() bool {
@@ -734,6 +1003,11 @@ type ExecutedCommand struct {
 
 	CmdFilterACLId string
 	CmdGroupId     string
+
+	// shell integration 解析的退出码和执行时长
+	ExitStatus    int
+	HasExitStatus bool
+	Duration      time.Duration
 }
 
 type CurrentActiveUser struct {
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"github.com/jumpserver/koko/pkg/zmodem"
+)
+
+func TestMatchCommandACLs(t *testing.T) {
+	acls := model.CommandACLs{
+		{ID: "warn", Action: model.ActionWarning, Priority: 1,
+			CommandGroups: []model.CommandFilterItem{{RePattern: `\bls\b`}}},
+		{ID: "reject", Action: model.ActionReject, Priority: 2,
+			CommandGroups: []model.CommandFilterItem{{RePattern: `\brm\s+-rf\b`}}},
+	}
+	tests := []struct {
+		command string
+		action  model.CommandAction
+		found   bool
+	}{
+		{"pwd", "", false},
+		{"ls -l", model.ActionWarning, true},
+		{"ls; rm -rf /", model.ActionReject, true},
+		{"ls $(r\\m -rf /)", model.ActionReject, true},
+		{"bash -c 'rm  -rf /'", model.ActionReject, true},
+		{"sudo -u root \"r\"m -rf /", model.ActionReject, true},
+		// 无法完全拆分的命令行直接拒绝
+		{strings.Repeat("echo $(", 10) + "rm -rf /" + strings.Repeat(")", 10), model.ActionReject, true},
+		{strings.Repeat("ls;", 64) + strings.Repeat("echo $(", 10) + "pwd" + strings.Repeat(")", 10),
+			model.ActionReject, true},
+	}
+	for _, tt := range tests {
+		rule, _, ok := MatchCommandACLs(acls, tt.command)
+		if ok != tt.found {
+			t.Errorf("MatchCommandACLs(%q) found = %v, want %v", tt.command, ok, tt.found)
+			continue
+		}
+		if ok && rule.Acl.Action != tt.action {
+			t.Errorf("MatchCommandACLs(%q) action = %s, want %s", tt.command, rule.Acl.Action, tt.action)
+		}
+	}
+}
+
+func TestParser_TrzszTriggerEcho(t *testing.T) {
+	acls := model.CommandACLs{
+		{ID: "reject", Action: model.ActionReject, Priority: 1,
+			CommandGroups: []model.CommandFilterItem{{RePattern: `\brm\s+-rf\b`}}},
+	}
+	platform := model.Platform{}
+	p := &Parser{
+		id:            "test",
+		protocolType:  model.ProtocolSSH,
+		cmdFilterACLs: acls,
+		enableUpload:  true,
+		zmodemParser:  zmodem.New(),
+		trzszParser:   zmodem.NewTrzsz(),
+		platform:      &platform,
+	}
+	p.initial(80, 24)
+	p.userOutputChan = make(chan []byte, 10)
+	p.srvOutputChan = make(chan []byte, 10)
+	// 资产输出了触发字符串，但用户没有使用 trzsz 客户端
+	p.ParseServerOutput([]byte("$ echo ::TRZSZ:TRANSFER:R:1.1.5:1\r\n::TRZSZ:TRANSFER:R:1.1.5:1\r\n$ "))
+	if !p.trzszParser.IsStartSession() {
+		t.Fatal("trzsz session should start")
+	}
+	if out := p.ParseUserInput([]byte("rm -rf /\r")); out != nil {
+		t.Fatalf("rm -rf / should be rejected, got %q", out)
+	}
+	if p.trzszParser.IsStartSession() {
+		t.Fatal("trzsz session should end on non-protocol input")
+	}
+	if msg := <-p.srvOutputChan; !strings.Contains(string(msg), "rm -rf") {
+		t.Fatalf("unexpected forbidden message %q", msg)
+	}
+}
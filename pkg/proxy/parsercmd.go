@@ -64,6 +64,10 @@ type TerminalParser struct {
 
 	EmitCommands func(cmd, out string)
 
+	// shell integration 开启时由 OSC 133 标记解析命令
+	shell            *shellState
+	EmitShellCommand func(cmd ShellCommand)
+
 	tmuxParser *terminalparser.TmuxParser
 	isSubMode  bool
 
@@ -99,6 +103,7 @@ func (s *TerminalParser) CheckSubScreen(b []byte) {
 func (s *TerminalParser) resetCommand() {
 	s.cmd = ""
 	s.commands = nil
+	s.resetShellCommand()
 }
 
 func (s *TerminalParser) GetCursorRow() string {
@@ -307,6 +312,7 @@ func (s *TerminalParser) WriteInput(chars []byte) (string, bool) {
 	*/
 	s.InputBuf.Write(chars)
 	if isEnterFunc(chars) {
+		s.shellEnter()
 		inputStr := strings.TrimSpace(s.InputBuf.String())
 		s.state = OutputState
 		//if s.isSubMode {
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -13,6 +14,7 @@ import (
 	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver-dev/sdk-go/service"
 	"github.com/jumpserver/koko/pkg/asciinema"
+	"github.com/jumpserver/koko/pkg/audit"
 	"github.com/jumpserver/koko/pkg/common"
 	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/logger"
@@ -22,13 +24,37 @@ type CommandRecorder struct {
 	sessionID string
 	storage   CommandStorage
 
-	queue  chan *model.Command
+	queue  chan *storage.Command
 	closed chan struct{}
 
 	jmsService *service.JMService
+
+	// 未保存成功的命令持久化到磁盘
+	spool *commandSpool
+
+	// 开启签名时，每批保存成功的命令追加到哈希链
+	chain        *audit.CommandChain
+	chainStorage Storage
+	chainTarget  string
+	chainPending bool
+}
+
+// NewCommandRecorder 创建命令记录器并开始保存命令，会话结束时调用 End
+func NewCommandRecorder(sid string, jmsService *service.JMService, conf *model.TerminalConfig) *CommandRecorder {
+	cmdR := CommandRecorder{
+		sessionID:  sid,
+		storage:    NewCommandStorage(jmsService, conf),
+		queue:      make(chan *storage.Command, 10),
+		closed:     make(chan struct{}),
+		jmsService: jmsService,
+		spool:      newCommandSpool(sid),
+	}
+	cmdR.enableChain(NewReplayStorage(jmsService, conf), time.Now())
+	go cmdR.record()
+	return &cmdR
 }
 
-func (c *CommandRecorder) Record(command *model.Command) {
+func (c *CommandRecorder) Record(command *storage.Command) {
 	c.queue <- command
 }
 
@@ -41,30 +67,53 @@ func (c *CommandRecorder) End() {
 	close(c.closed)
 }
 
+func (c *CommandRecorder) drainQueue(cmdList []*storage.Command) []*storage.Command {
+	for {
+		select {
+		case p, ok := <-c.queue:
+			if !ok {
+				return cmdList
+			}
+			c.spool.Append(p)
+			cmdList = append(cmdList, p)
+		default:
+			return cmdList
+		}
+	}
+}
+
 func (c *CommandRecorder) record() {
-	cmdList := make([]*model.Command, 0, 10)
-	notificationList := make([]*model.Command, 0, 10)
-	maxRetry := 0
+	cmdList := make([]*storage.Command, 0, 10)
+	notificationList := make([]*storage.Command, 0, 10)
+	failedCount := 0
 	logger.Infof("Session %s: Command recorder start", c.sessionID)
 	defer logger.Infof("Session %s: Command recorder close", c.sessionID)
+	defer c.storeChain()
 	tick := time.NewTicker(time.Second * 10)
 	defer tick.Stop()
 	for {
+		closed := false
 		select {
 		case <-c.closed:
+			// 结束前收取队列中剩余的命令
+			cmdList = c.drainQueue(cmdList)
 			if len(cmdList) == 0 {
+				c.spool.Remove()
 				return
 			}
+			closed = true
 		case p, ok := <-c.queue:
 			if !ok {
 				return
 			}
+			c.spool.Append(p)
 			if p.RiskLevel >= model.WarningLevel && p.RiskLevel < model.ReviewAccept {
 				notificationList = append(notificationList, p)
 				logger.Debugf("Session %s: command notify %d", c.sessionID, p.RiskLevel)
 			}
 			cmdList = append(cmdList, p)
-			if len(cmdList) < 5 {
+			// 保存失败后只在定时器触发时重试
+			if len(cmdList) < 5 || failedCount > 0 {
 				continue
 			}
 		case <-tick.C:
@@ -73,31 +122,33 @@ func (c *CommandRecorder) record() {
 			}
 		}
 		if len(notificationList) > 0 {
-			if err := c.jmsService.NotifyCommand(notificationList); err == nil {
+			if err := c.jmsService.NotifyCommand(storage.ModelCommands(notificationList)); err == nil {
 				logger.Debugf("Session %s: %d command notify success", c.sessionID, len(notificationList))
 				notificationList = notificationList[:0]
 			} else {
 				logger.Errorf("Session %s: command notify err: %s", c.sessionID, err)
 			}
 		}
-		err := c.storage.BulkSave(cmdList)
-		if err != nil && c.storage.TypeName() != "server" {
-			logger.Warnf("Session %s: Switch default command storage save.", c.sessionID)
-			err = c.jmsService.PushSessionCommand(cmdList)
-		}
-		if err == nil {
-			cmdList = cmdList[:0]
-			maxRetry = 0
+		if err := SaveCommands(c.jmsService, c.storage, cmdList); err != nil {
+			failedCount++
+			logger.Errorf("Session %s: command bulk save err: %s, %d commands kept in spool",
+				c.sessionID, err, len(cmdList))
+			if closed {
+				// 命令保留在 spool 文件中，下次启动时补传
+				c.spool.Close()
+				c.chainPending = true
+				return
+			}
 			continue
 		}
-		if err != nil {
-			logger.Errorf("Session %s: command bulk save err: %s", c.sessionID, err)
-		}
-
-		if maxRetry > 5 {
-			cmdList = cmdList[1:]
+		c.appendChain(cmdList)
+		cmdList = cmdList[:0]
+		failedCount = 0
+		c.spool.Truncate()
+		if closed {
+			c.spool.Remove()
+			return
 		}
-		maxRetry++
 	}
 }
 
@@ -109,8 +160,7 @@ new file format: sessionId.cast.replay.gz "application/x-asciicast"
 const (
 	dateTimeFormat = "2006-01-02"
 
-	replayFilenameSuffix   = ".cast"
-	replayGzFilenameSuffix = ".gz"
+	replayFilenameSuffix = ".cast"
 )
 
 func NewReplayRecord(sid string, jmsService *service.JMService,
@@ -125,6 +175,15 @@ func NewReplayRecord(sid string, jmsService *service.JMService,
 	if recorder.isNullStorage() {
 		return recorder, nil
 	}
+	if recordingRefused() {
+		logger.Errorf("Session %s: replay not recorded: %s", sid, ErrDiskFull)
+		reason := model.SessionReplayErrCreatedFailed
+		if _, err1 := jmsService.SessionReplayFailed(sid, reason); err1 != nil {
+			logger.Errorf("Session[%s] update replay status %s failed: %s", sid, reason, err1)
+		}
+		recorder.err = ErrDiskFull
+		return recorder, ErrDiskFull
+	}
 	today := info.TimeStamp.UTC().Format(dateTimeFormat)
 	replayRootDir := config.GetConf().ReplayFolderPath
 	sessionReplayDirPath := filepath.Join(replayRootDir, today)
@@ -135,14 +194,25 @@ func NewReplayRecord(sid string, jmsService *service.JMService,
 		return recorder, err
 	}
 	filename := sid + replayFilenameSuffix
-	gzFilename := filename + replayGzFilenameSuffix
+	gzFilename := filename + replayCompressSuffix()
 	absFilePath := filepath.Join(sessionReplayDirPath, filename)
 	absGZFilePath := filepath.Join(sessionReplayDirPath, gzFilename)
 	storageTargetName := strings.Join([]string{today, gzFilename}, "/")
 	recorder.absGzipFilePath = absGZFilePath
 	recorder.absFilePath = absFilePath
 	recorder.Target = storageTargetName
-	fd, err := os.Create(recorder.absFilePath)
+	var output io.Writer
+	recorder.file, err = os.Create(recorder.absFilePath)
+	output = recorder.file
+	if segment := newReplaySegment(sid, today, sessionReplayDirPath, info, storage); err == nil && segment != nil {
+		recorder.segment = segment
+		if err1 := recorder.openSegmentPart(); err1 != nil {
+			logger.Errorf("Create replay part file error: %s", err1)
+			recorder.segment = nil
+		} else {
+			output = recorder.segmentWriter()
+		}
+	}
 	if err != nil {
 		logger.Errorf("Create replay file %s error: %s\n", recorder.absFilePath, err)
 		reason := model.SessionReplayErrCreatedFailed
@@ -153,13 +223,20 @@ func NewReplayRecord(sid string, jmsService *service.JMService,
 		return recorder, err
 	}
 	logger.Infof("Create replay file %s", recorder.absFilePath)
-	recorder.file = fd
+	if recorder.segment != nil {
+		go recorder.runSegmentUpload()
+		go recorder.runSegmentRotate()
+	}
 
-	options := make([]asciinema.Option, 0, 3)
+	conf := config.GetConf()
+	options := make([]asciinema.Option, 0, 6)
 	options = append(options, asciinema.WithHeight(info.Height))
 	options = append(options, asciinema.WithWidth(info.Width))
 	options = append(options, asciinema.WithTimestamp(info.TimeStamp))
-	recorder.Writer = asciinema.NewWriter(recorder.file, options...)
+	options = append(options, asciinema.WithVersion(conf.ReplayCastVersion))
+	options = append(options, asciinema.WithCoalesce(time.Duration(conf.ReplayCoalesceMs)*time.Millisecond))
+	options = append(options, asciinema.WithIdleLimit(time.Duration(conf.ReplayIdleLimit)*time.Second))
+	recorder.Writer = asciinema.NewWriter(output, options...)
 	return recorder, nil
 }
 
@@ -177,6 +254,13 @@ type ReplyRecorder struct {
 
 	file *os.File
 	once sync.Once
+	lock sync.Mutex
+
+	// 开启分段录像时不为空
+	segment *replaySegment
+
+	// 开启文本记录时不为空
+	transcript *replayTranscript
 }
 
 func (r *ReplyRecorder) isNullStorage() bool {
@@ -188,23 +272,82 @@ func (r *ReplyRecorder) Record(p []byte) {
 		return
 	}
 	if len(p) > 0 {
-		r.once.Do(func() {
-			if err := r.Writer.WriteHeader(); err != nil {
-				logger.Errorf("Session %s write replay header failed: %s", r.SessionID, err)
-			}
-		})
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.writeHeaderOnce()
 		if err := r.Writer.WriteRow(p); err != nil {
 			logger.Errorf("Session %s write replay row failed: %s", r.SessionID, err)
 		}
+		r.rotateIfNeed()
+	}
+}
+
+// RecordInput 记录用户的原始输入，包括被解析器拦截和 ACL 拒绝的输入
+func (r *ReplyRecorder) RecordInput(p []byte, user string) {
+	if r.isNullStorage() {
+		return
+	}
+	if len(p) > 0 {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.writeHeaderOnce()
+		if err := r.Writer.WriteInputRow(p, user); err != nil {
+			logger.Errorf("Session %s write replay input row failed: %s", r.SessionID, err)
+		}
+		r.rotateIfNeed()
+	}
+}
+
+// RecordResize 记录窗口大小变化，保证回放时按照实际大小渲染
+func (r *ReplyRecorder) RecordResize(width, height int) {
+	if r.isNullStorage() {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.writeHeaderOnce()
+	if err := r.Writer.WriteResizeRow(width, height); err != nil {
+		logger.Errorf("Session %s write replay resize row failed: %s", r.SessionID, err)
+	}
+	r.rotateIfNeed()
+}
+
+// RecordMarker 记录一个标记，例如会话断开的原因
+func (r *ReplyRecorder) RecordMarker(label string) {
+	if r.isNullStorage() {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.writeHeaderOnce()
+	if err := r.Writer.WriteMarkerRow(label); err != nil {
+		logger.Errorf("Session %s write replay marker row failed: %s", r.SessionID, err)
 	}
+	r.rotateIfNeed()
+}
+
+func (r *ReplyRecorder) writeHeaderOnce() {
+	r.once.Do(func() {
+		if err := r.Writer.WriteHeader(); err != nil {
+			logger.Errorf("Session %s write replay header failed: %s", r.SessionID, err)
+		}
+	})
 }
 
 func (r *ReplyRecorder) End() {
+	if r.segment != nil {
+		r.endSegment()
+		return
+	}
 	if r.isNullStorage() {
 		r.recordLifecycleLog(model.ReplayUploadFailure, string(model.ReasonErrNullStorage))
 		return
 	}
+	r.lock.Lock()
+	r.flushWriter()
 	_ = r.file.Close()
+	r.endWriterStats()
+	r.lock.Unlock()
 	go r.uploadReplay()
 }
 
@@ -220,8 +363,11 @@ func (r *ReplyRecorder) uploadReplay() {
 		return
 	}
 	if !common.FileExists(r.absGzipFilePath) {
+		r.renderTranscript()
 		logger.Debug("Compress replay file: ", r.absFilePath)
-		_ = common.GzipCompressFile(r.absFilePath, r.absGzipFilePath)
+		if err := r.compressReplayFile(r.absFilePath, r.absGzipFilePath); err != nil {
+			logger.Errorf("Session %s: compress replay file failed: %s", r.SessionID, err)
+		}
 		_ = os.Remove(r.absFilePath)
 	}
 	r.UploadGzipFile(3)
@@ -241,12 +387,14 @@ func (r *ReplyRecorder) UploadGzipFile(maxRetry int) {
 	}
 	replaySize := absFileInfo.Size()
 	r.recordLifecycleLog(model.ReplayUploadStart, "")
+	sig := signFile(r.absGzipFilePath, r.Target)
 
 	for i := 0; i <= maxRetry; i++ {
 		logger.Infof("Upload replay file: %s, type: %s", r.absGzipFilePath, r.storage.TypeName())
 		err := r.storage.Upload(r.absGzipFilePath, r.Target)
 		if err == nil {
 			_ = os.Remove(r.absGzipFilePath)
+			storeSignature(r.storage, sig)
 			if _, err = r.jmsService.FinishReplyWithSize(r.SessionID, replaySize); err != nil {
 				logger.Errorf("Session[%s] finish replay err: %s", r.SessionID, err)
 			}
@@ -256,13 +404,21 @@ func (r *ReplyRecorder) UploadGzipFile(maxRetry int) {
 		failureMsg := strings.ReplaceAll(err.Error(), ",", " ")
 		r.recordLifecycleLog(model.ReplayUploadFailure, failureMsg)
 		logger.Errorf("Upload replay file err: %s", err)
-		// 如果还是失败，上传 server 再传一次
+		if errors.Is(err, storage.ErrLocalRootUnavailable) {
+			// 挂载目录不可用时重试没有意义，直接使用 server 存储
+			i = maxRetry
+		}
+		// 如果还是失败，上传 server 再传一次，开启存储加密时不能以明文上传到 server
 		if i == maxRetry {
-			if r.storage.TypeName() == "server" {
+			if r.storage.TypeName() == "server" || storageEncryptEnabled() {
 				reason := model.SessionReplayErrUploadFailed
 				if _, err1 := r.jmsService.SessionReplayFailed(r.SessionID, reason); err1 != nil {
 					logger.Errorf("Session[%s] update replay status %s failed: %s", r.SessionID, reason, err1)
 				}
+				// 交给上传队列继续重试
+				sealLocalFile(r.absGzipFilePath)
+				enqueueUpload(UploadItem{Path: r.absGzipFilePath, Target: r.Target,
+					Kind: UploadKindReplay, ObjectID: r.SessionID}, err)
 				break
 			}
 			logger.Errorf("Session[%s] using server storage retry upload", r.SessionID)
@@ -275,7 +431,7 @@ func (r *ReplyRecorder) UploadGzipFile(maxRetry int) {
 
 func (r *ReplyRecorder) recordLifecycleLog(event model.LifecycleEvent, reason string) {
 	eventLog := model.SessionLifecycleLog{Reason: reason}
-	if err := r.jmsService.RecordSessionLifecycleLog(r.SessionID, event, eventLog); err != nil {
+	if err := audit.RecordSessionLifecycleLog(r.jmsService, r.SessionID, event, eventLog); err != nil {
 		logger.Errorf("Update session %s activity log %s failed: %s", r.SessionID, event, err)
 	}
 }
@@ -330,6 +486,10 @@ func (r *FTPFileRecorder) setFTPFile(id string, info *FTPFileInfo) {
 }
 
 func (r *FTPFileRecorder) CreateFTPFileInfo(logData *model.FTPLog) (info *FTPFileInfo, err error) {
+	if recordingRefused() {
+		logger.Errorf("FTP file %s not recorded: %s", logData.ID, ErrDiskFull)
+		return nil, ErrDiskFull
+	}
 	info = &FTPFileInfo{
 		ftpLog: logData,
 
@@ -386,6 +546,47 @@ func (r *FTPFileRecorder) Record(ftpLog *model.FTPLog, reader io.Reader) (err er
 	return
 }
 
+// RecordChunk 按顺序写入文件内容，用于 scp 等流式传输，写完后调用 FinishFTPFile
+func (r *FTPFileRecorder) RecordChunk(ftpLog *model.FTPLog, p []byte) (err error) {
+	if r.isNullStorage() {
+		return
+	}
+	info := r.getFTPFile(ftpLog.ID)
+	if info == nil {
+		info, err = r.CreateFTPFileInfo(ftpLog)
+	}
+	if err != nil {
+		return err
+	}
+	return info.write(p)
+}
+
+// RecordChunkAt 按照位置写入文件内容，用于 zmodem 等可以重传的传输，位置回退时丢弃后面的内容
+func (r *FTPFileRecorder) RecordChunkAt(ftpLog *model.FTPLog, offset int64, p []byte) (err error) {
+	if r.isNullStorage() {
+		return
+	}
+	info := r.getFTPFile(ftpLog.ID)
+	if info == nil {
+		info, err = r.CreateFTPFileInfo(ftpLog)
+	}
+	if err != nil {
+		return err
+	}
+	return info.writeAt(p, offset)
+}
+
+// AbortFTPFile 删除传输失败的文件，不上传
+func (r *FTPFileRecorder) AbortFTPFile(id string) {
+	info := r.getFTPFile(id)
+	if info == nil {
+		return
+	}
+	_ = info.Close()
+	_ = os.Remove(info.absFilePath)
+	r.removeFTPFile(id)
+}
+
 func (r *FTPFileRecorder) ChunkedRecord(ftpLog *model.FTPLog, readerAt io.ReaderAt, offset, totalSize int64) (err error) {
 	if r.isNullStorage() {
 		return
@@ -444,12 +645,14 @@ func (r *FTPFileRecorder) UploadFile(maxRetry int, ftpLogId string) {
 		return
 	}
 	logger.Infof("FTPLog %s: FTP File recorder is uploading", info.ftpLog.ID)
+	sig := signFile(info.absFilePath, info.Target)
 
 	for i := 0; i <= maxRetry; i++ {
 		logger.Infof("Upload FTP file: %s, type: %s", info.absFilePath, r.storage.TypeName())
 		err := r.storage.Upload(info.absFilePath, info.Target)
 		if err == nil {
 			_ = os.Remove(info.absFilePath)
+			storeSignature(r.storage, sig)
 			if err := r.jmsService.FinishFTPFile(info.ftpLog.ID); err != nil {
 				logger.Errorf("FTP file %s upload failed: %s", info.ftpLog.ID, err)
 			}
@@ -457,9 +660,19 @@ func (r *FTPFileRecorder) UploadFile(maxRetry int, ftpLogId string) {
 			break
 		}
 		logger.Errorf("Upload FTP file err: %s", err)
-		// 如果还是失败，上传 server 再传一次
+		if errors.Is(err, storage.ErrLocalRootUnavailable) {
+			// 挂载目录不可用时重试没有意义，直接使用 server 存储
+			i = maxRetry
+		}
+		// 如果还是失败，上传 server 再传一次，开启存储加密时不能以明文上传到 server
 		if i == maxRetry {
-			if r.storage.TypeName() == "server" {
+			if r.storage.TypeName() == "server" || storageEncryptEnabled() {
+				// 交给上传队列继续重试
+				sealLocalFile(info.absFilePath)
+				if enqueueUpload(UploadItem{Path: info.absFilePath, Target: info.Target,
+					Kind: UploadKindFTPFile, ObjectID: info.ftpLog.ID}, err) {
+					r.removeFTPFile(info.ftpLog.ID)
+				}
 				break
 			}
 			logger.Errorf("Session[%s] using server storage retry upload", info.ftpLog.ID)
@@ -515,6 +728,34 @@ func (f *FTPFileInfo) WriteFromReader(r io.Reader) error {
 	return err
 }
 
+// write 超过保存大小后丢弃后面的内容，上传时删除
+func (f *FTPFileInfo) write(p []byte) error {
+	if f.fd == nil || f.isExceedWrittenSize() {
+		return nil
+	}
+	nw, err := f.fd.Write(p)
+	f.writtenBytes += int64(nw)
+	return err
+}
+
+func (f *FTPFileInfo) writeAt(p []byte, offset int64) error {
+	if f.fd == nil {
+		return nil
+	}
+	if offset < f.writtenBytes {
+		if err := f.fd.Truncate(offset); err != nil {
+			return err
+		}
+		f.writtenBytes = offset
+	}
+	if f.isExceedWrittenSize() {
+		return nil
+	}
+	nw, err := f.fd.WriteAt(p, offset)
+	f.writtenBytes = offset + int64(nw)
+	return err
+}
+
 func (f *FTPFileInfo) isExceedWrittenSize() bool {
 	return f.writtenBytes >= f.maxWrittenSize
 }
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"os"
+	"sync"
+
+	"github.com/jumpserver/koko/pkg/asciinema"
+	"github.com/jumpserver/koko/pkg/common"
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+录像压缩统计: 累计压缩前后的大小和录像写入时合并、压缩空闲的效果，通过健康检查接口查看，
+用于评估 REPLAY_COALESCE_MS、REPLAY_IDLE_LIMIT 和 REPLAY_COMPRESSION 的配置。
+*/
+
+type ReplayCompressionStats struct {
+	Algorithm       string  `json:"algorithm"`
+	Files           int64   `json:"files"`
+	RawBytes        int64   `json:"raw_bytes"`
+	CompressedBytes int64   `json:"compressed_bytes"`
+	Ratio           float64 `json:"ratio"` // 压缩后大小 / 压缩前大小
+
+	Sessions    int64   `json:"sessions"`
+	Events      int64   `json:"events"`
+	Coalesced   int64   `json:"coalesced"`
+	IdleSkipped float64 `json:"idle_skipped"`
+}
+
+var (
+	replayStatsLock sync.Mutex
+	replayStats     ReplayCompressionStats
+)
+
+func GetReplayCompressionStats() ReplayCompressionStats {
+	replayStatsLock.Lock()
+	defer replayStatsLock.Unlock()
+	stats := replayStats
+	stats.Algorithm = replayCompression()
+	if stats.RawBytes > 0 {
+		stats.Ratio = float64(stats.CompressedBytes) / float64(stats.RawBytes)
+	}
+	return stats
+}
+
+func addReplayWriterStats(stats asciinema.WriterStats) {
+	replayStatsLock.Lock()
+	defer replayStatsLock.Unlock()
+	replayStats.Sessions++
+	replayStats.Events += stats.Events
+	replayStats.Coalesced += stats.Coalesced
+	replayStats.IdleSkipped += stats.IdleSkipped
+}
+
+func addReplayCompressedFile(raw, compressed int64) {
+	replayStatsLock.Lock()
+	defer replayStatsLock.Unlock()
+	replayStats.Files++
+	replayStats.RawBytes += raw
+	replayStats.CompressedBytes += compressed
+}
+
+// replayCompression 启动时已拒绝 zstd (core 的播放器只支持 gzip)，实际总是 gzip
+func replayCompression() string {
+	if config.GetConf().ReplayCompression == common.CompressionZstd {
+		return common.CompressionZstd
+	}
+	return common.CompressionGzip
+}
+
+// replayCompressSuffix 压缩后的录像文件后缀
+func replayCompressSuffix() string {
+	return common.CompressionSuffix(replayCompression())
+}
+
+// compressReplayFile 压缩录像并记录压缩率
+func (r *ReplyRecorder) compressReplayFile(srcPath, dstPath string) error {
+	algorithm := replayCompression()
+	if err := common.CompressFile(srcPath, dstPath, algorithm); err != nil {
+		return err
+	}
+	rawStat, err := os.Stat(srcPath)
+	if err != nil {
+		return nil
+	}
+	dstStat, err := os.Stat(dstPath)
+	if err != nil {
+		return nil
+	}
+	addReplayCompressedFile(rawStat.Size(), dstStat.Size())
+	if rawStat.Size() > 0 {
+		logger.Infof("Session %s: replay %s compressed %d -> %d bytes (%.1f%%) with %s", r.SessionID,
+			srcPath, rawStat.Size(), dstStat.Size(),
+			float64(dstStat.Size())*100/float64(rawStat.Size()), algorithm)
+	}
+	return nil
+}
+
+// flushWriter 关闭录像文件前调用，调用方需持有 r.lock
+func (r *ReplyRecorder) flushWriter() {
+	if r.Writer == nil {
+		return
+	}
+	if err := r.Writer.Flush(); err != nil {
+		logger.Errorf("Session %s flush replay failed: %s", r.SessionID, err)
+	}
+}
+
+// endWriterStats 会话结束时记录录像写入的统计
+func (r *ReplyRecorder) endWriterStats() {
+	if r.Writer == nil {
+		return
+	}
+	stats := r.Writer.Stats()
+	addReplayWriterStats(stats)
+	if stats.Coalesced > 0 || stats.IdleSkipped > 0 {
+		logger.Infof("Session %s: replay %d events, %d outputs coalesced, %.1fs idle skipped",
+			r.SessionID, stats.Events, stats.Coalesced, stats.IdleSkipped)
+	}
+}
@@ -0,0 +1,455 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/jumpserver/koko/pkg/asciinema"
+	"github.com/jumpserver/koko/pkg/audit"
+	"github.com/jumpserver/koko/pkg/common"
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
+)
+
+/*
+分段录像: 会话进行中按照大小或者时长切分录像，每个分段关闭后立即压缩上传，
+同时更新 manifest (sessionId.manifest.json)，koko 异常退出时，已上传的分段不会丢失。
+录像只写入分段，压缩后的分段保留在本地，会话结束后按照 manifest 的顺序拼接出完整录像，
+再按照原来的方式上传到会话的 Target，core 的播放器可以直接播放。
+分段通过队列交给上传协程，不阻塞录像的写入。
+*/
+
+// segmentRotateCheckInterval 按照时长切分时检查的间隔，没有新的输出时也会切分
+const segmentRotateCheckInterval = 10 * time.Second
+
+type replaySegment struct {
+	sid         string
+	today       string
+	dirPath     string
+	startTime   time.Time
+	maxSize     int64
+	maxDuration time.Duration
+	// storage 上传失败时完整录像会切换到 server 存储，分段仍然使用原来的存储
+	storage ReplayStorage
+
+	// 以下字段由录像协程在持有 r.lock 时访问
+	index     int
+	file      *os.File
+	partPath  string
+	partStart time.Time
+	written   int64
+
+	// 以下字段只由上传协程访问
+	manifest       asciinema.Manifest
+	manifestPath   string
+	manifestTarget string
+	// 压缩后的分段，拼接完整录像之后删除，上传失败的交给上传队列
+	localParts []replayLocalPart
+
+	queueLock sync.Mutex
+	queue     []replayPartFile
+	closed    bool
+	notify    chan struct{}
+	done      chan struct{}
+
+	// 录像协程和上传协程都会设置
+	failed atomic.Bool
+}
+
+type replayPartFile struct {
+	index int
+	path  string
+	start float64
+	end   float64
+}
+
+type replayLocalPart struct {
+	path     string
+	target   string
+	uploaded error
+}
+
+func newReplaySegment(sid, today, dirPath string, info *ReplyInfo, replayStorage ReplayStorage) *replaySegment {
+	conf := config.GetConf()
+	if conf.ReplaySegmentSize <= 0 && conf.ReplaySegmentDuration <= 0 {
+		return nil
+	}
+	switch replayStorage.TypeName() {
+	case "server", "null":
+		// server 存储按照会话上传完整录像，不支持分段
+		return nil
+	}
+	version := asciinema.Version2
+	if conf.ReplayCastVersion == asciinema.Version3 {
+		version = asciinema.Version3
+	}
+	manifestFilename := asciinema.ManifestFilename(sid)
+	return &replaySegment{
+		sid:            sid,
+		today:          today,
+		dirPath:        dirPath,
+		startTime:      info.TimeStamp,
+		maxSize:        int64(conf.ReplaySegmentSize) * 1024 * 1024,
+		maxDuration:    time.Duration(conf.ReplaySegmentDuration) * time.Minute,
+		storage:        replayStorage,
+		manifestPath:   filepath.Join(dirPath, manifestFilename),
+		manifestTarget: strings.Join([]string{today, manifestFilename}, "/"),
+		manifest: asciinema.Manifest{
+			SessionID: sid,
+			Version:   version,
+			DateStart: info.TimeStamp,
+		},
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func (s *replaySegment) next() string {
+	s.index++
+	s.written = 0
+	s.partStart = time.Now()
+	s.partPath = filepath.Join(s.dirPath, asciinema.PartFilename(s.sid, s.index))
+	return s.partPath
+}
+
+func (s *replaySegment) shouldRotate() bool {
+	if s.file == nil || s.written == 0 {
+		return false
+	}
+	if s.maxSize > 0 && s.written >= s.maxSize {
+		return true
+	}
+	return s.maxDuration > 0 && time.Since(s.partStart) >= s.maxDuration
+}
+
+// closePart 关闭当前分段并加入上传队列，不会阻塞
+func (s *replaySegment) closePart() {
+	if s.file == nil {
+		return
+	}
+	_ = s.file.Close()
+	s.file = nil
+	if s.written == 0 {
+		_ = os.Remove(s.partPath)
+		return
+	}
+	s.enqueue(replayPartFile{
+		index: s.index,
+		path:  s.partPath,
+		start: s.partStart.Sub(s.startTime).Seconds(),
+		end:   time.Since(s.startTime).Seconds(),
+	})
+}
+
+func (s *replaySegment) enqueue(part replayPartFile) {
+	s.queueLock.Lock()
+	s.queue = append(s.queue, part)
+	s.queueLock.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// close 不再有新的分段，上传协程处理完队列后退出
+func (s *replaySegment) close() {
+	s.queueLock.Lock()
+	s.closed = true
+	s.queueLock.Unlock()
+	close(s.done)
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue 返回队列中的分段，队列为空且已经关闭时返回 false
+func (s *replaySegment) dequeue() ([]replayPartFile, bool) {
+	for {
+		s.queueLock.Lock()
+		parts := s.queue
+		s.queue = nil
+		closed := s.closed
+		s.queueLock.Unlock()
+		if len(parts) > 0 {
+			return parts, true
+		}
+		if closed {
+			return nil, false
+		}
+		<-s.notify
+	}
+}
+
+func (s *replaySegment) Write(p []byte) (int, error) {
+	s.written += int64(len(p))
+	return len(p), nil
+}
+
+// openSegmentPart 调用方需持有 r.lock 或者在录像开始前调用
+func (r *ReplyRecorder) openSegmentPart() error {
+	path := r.segment.next()
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Create replay part file %s", path)
+	r.segment.file = fd
+	// 每一段都写入 header，单独下载也可以播放；第一段的 header 和完整录像一起写入
+	if r.segment.index > 1 && r.Writer != nil {
+		if err = r.Writer.WriteHeaderTo(fd); err != nil {
+			logger.Errorf("Session %s write replay part header failed: %s", r.SessionID, err)
+		}
+	}
+	return nil
+}
+
+// segmentWriter 分段创建失败后直接写入完整录像，拼接时追加在分段之后
+func (r *ReplyRecorder) segmentWriter() io.Writer {
+	if r.segment.file == nil {
+		return r.file
+	}
+	return io.MultiWriter(r.segment.file, r.segment)
+}
+
+// rotateIfNeed 调用方需持有 r.lock
+func (r *ReplyRecorder) rotateIfNeed() {
+	if r.segment == nil || !r.segment.shouldRotate() {
+		return
+	}
+	r.flushWriter()
+	r.segment.closePart()
+	if err := r.openSegmentPart(); err != nil {
+		// 不再分段，之后的录像直接写入完整录像
+		logger.Errorf("Session %s create replay part file failed: %s", r.SessionID, err)
+		r.segment.failed.Store(true)
+	}
+	r.Writer.SetOutput(r.segmentWriter())
+}
+
+// runSegmentRotate 按照时长切分时，没有新的输出也需要切分并上传
+func (r *ReplyRecorder) runSegmentRotate() {
+	if r.segment.maxDuration <= 0 {
+		return
+	}
+	ticker := time.NewTicker(segmentRotateCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.segment.done:
+			return
+		case <-ticker.C:
+			r.lock.Lock()
+			r.rotateIfNeed()
+			r.lock.Unlock()
+		}
+	}
+}
+
+// endSegment 关闭最后一个分段，上传协程处理完所有分段后拼接并上传完整录像
+func (r *ReplyRecorder) endSegment() {
+	r.lock.Lock()
+	r.flushWriter()
+	r.segment.closePart()
+	_ = r.file.Close()
+	r.endWriterStats()
+	r.segment.close()
+	r.lock.Unlock()
+}
+
+func (r *ReplyRecorder) runSegmentUpload() {
+	logger.Infof("Session %s: Replay part uploader start", r.SessionID)
+	defer logger.Infof("Session %s: Replay part uploader done", r.SessionID)
+	for {
+		parts, ok := r.segment.dequeue()
+		if !ok {
+			break
+		}
+		for _, part := range parts {
+			if err := r.uploadPart(part); err != nil {
+				logger.Errorf("Session %s: upload replay part %s failed: %s", r.SessionID, part.path, err)
+				r.segment.failed.Store(true)
+			}
+		}
+	}
+	r.finishSegment()
+	r.rebuildReplay()
+	r.uploadReplay()
+}
+
+func (r *ReplyRecorder) uploadPart(part replayPartFile) error {
+	gzPath := part.path + replayCompressSuffix()
+	if err := r.compressReplayFile(part.path, gzPath); err != nil {
+		// 未压缩的分段也需要拼接到完整录像中
+		target := strings.Join([]string{r.segment.today, filepath.Base(part.path)}, "/")
+		r.segment.localParts = append(r.segment.localParts,
+			replayLocalPart{path: part.path, target: target, uploaded: err})
+		return err
+	}
+	_ = os.Remove(part.path)
+	target := strings.Join([]string{r.segment.today, filepath.Base(gzPath)}, "/")
+	local := replayLocalPart{path: gzPath, target: target}
+	var err error
+	defer func() {
+		local.uploaded = err
+		r.segment.localParts = append(r.segment.localParts, local)
+	}()
+	stat, err := os.Stat(gzPath)
+	if err != nil {
+		return err
+	}
+	// 分段的摘要记录在 manifest 中，签名 manifest 即可
+	var digest string
+	if sum, _, err1 := audit.FileDigest(gzPath); err1 == nil {
+		digest = hex.EncodeToString(sum)
+	}
+	for i := 0; i <= 3; i++ {
+		logger.Infof("Upload replay part file: %s, type: %s", gzPath, r.segment.storage.TypeName())
+		if err = r.segment.storage.Upload(gzPath, target); err == nil {
+			break
+		}
+		logger.Errorf("Upload replay part file %s err: %s", gzPath, err)
+		if errors.Is(err, storage.ErrLocalRootUnavailable) {
+			break
+		}
+	}
+	if err != nil {
+		// 拼接完整录像之后交给上传队列继续重试
+		return err
+	}
+	r.segment.manifest.AddPart(asciinema.Part{
+		Index:  part.index,
+		Target: target,
+		Size:   stat.Size(),
+		SHA256: digest,
+		Start:  part.start,
+		End:    part.end,
+	})
+	if err1 := r.uploadManifest(); err1 != nil {
+		logger.Errorf("Session %s: upload replay manifest failed: %s", r.SessionID, err1)
+	}
+	return nil
+}
+
+func (r *ReplyRecorder) uploadManifest() error {
+	if err := r.segment.manifest.WriteFile(r.segment.manifestPath); err != nil {
+		return err
+	}
+	return r.segment.storage.Upload(r.segment.manifestPath, r.segment.manifestTarget)
+}
+
+// finishSegment 上传最终的 manifest，录像的状态由完整录像的上传结果决定
+func (r *ReplyRecorder) finishSegment() {
+	manifest := &r.segment.manifest
+	if len(manifest.Parts) == 0 {
+		logger.Infof("Session %s: no replay part uploaded", r.SessionID)
+		_ = os.Remove(r.segment.manifestPath)
+		return
+	}
+	manifest.Finished = !r.segment.failed.Load()
+	manifest.DateEnd = time.Now()
+	if err := r.uploadManifest(); err != nil {
+		logger.Errorf("Session %s: upload replay manifest failed: %s", r.SessionID, err)
+		return
+	}
+	storeSignature(r.segment.storage, signFile(r.segment.manifestPath, r.segment.manifestTarget))
+	_ = os.Remove(r.segment.manifestPath)
+	if !manifest.Finished {
+		logger.Errorf("Session %s: replay parts incomplete, full replay uploaded to %s",
+			r.SessionID, r.Target)
+	}
+}
+
+// rebuildReplay 按照顺序拼接本地的分段，之后删除已上传的分段，上传失败的分段交给上传队列
+func (r *ReplyRecorder) rebuildReplay() {
+	paths := make([]string, 0, len(r.segment.localParts))
+	for _, part := range r.segment.localParts {
+		paths = append(paths, part.path)
+	}
+	if err := RebuildReplayFile(r.absFilePath, paths); err != nil {
+		logger.Errorf("Session %s: rebuild replay from parts failed: %s", r.SessionID, err)
+	}
+	for _, part := range r.segment.localParts {
+		if part.uploaded == nil {
+			_ = os.Remove(part.path)
+			continue
+		}
+		sealLocalFile(part.path)
+		enqueueUpload(UploadItem{Path: part.path, Target: part.target,
+			Kind: UploadKindReplayPart, ObjectID: r.SessionID}, part.uploaded)
+	}
+	r.segment.localParts = nil
+}
+
+// RebuildReplayFile 按照分段的顺序拼接完整录像，dstPath 中已有的内容 (分段创建失败后直接写入的录像) 追加在最后。
+// 无法读取的分段跳过，尽量保留其他分段的内容
+func RebuildReplayFile(dstPath string, partPaths []string) error {
+	tmpPath := dstPath + ".tmp"
+	fd, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fd)
+	withHeader := true
+	for _, path := range partPaths {
+		if err = copyReplayPart(w, path, withHeader); err != nil {
+			logger.Errorf("Copy replay part %s failed: %s", path, err)
+			continue
+		}
+		withHeader = false
+	}
+	if src, err1 := os.Open(dstPath); err1 == nil {
+		_, err = io.Copy(w, src)
+		_ = src.Close()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err1 := fd.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, dstPath)
+}
+
+// copyReplayPart 按照后缀解压分段，异常退出时最后一个分段还没有压缩
+func copyReplayPart(w io.Writer, path string, withHeader bool) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	var reader io.Reader = fd
+	switch {
+	case strings.HasSuffix(path, common.SuffixGzip):
+		gz, err1 := gzip.NewReader(fd)
+		if err1 != nil {
+			return err1
+		}
+		defer gz.Close()
+		reader = gz
+	case strings.HasSuffix(path, common.SuffixZstd):
+		zr, err1 := zstd.NewReader(fd)
+		if err1 != nil {
+			return err1
+		}
+		defer zr.Close()
+		reader = zr
+	}
+	return asciinema.CopyPart(w, reader, withHeader)
+}
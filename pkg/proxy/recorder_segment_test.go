@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jumpserver/koko/pkg/common"
+)
+
+func TestRebuildReplayFile(t *testing.T) {
+	dir := t.TempDir()
+	header := `{"version":3,"term":{"cols":80,"rows":24},"timestamp":1700000000}`
+	part1 := filepath.Join(dir, "sid.part-0001.cast")
+	part2 := filepath.Join(dir, "sid.part-0002.cast")
+	if err := os.WriteFile(part1, []byte(header+"\n[0.1,\"o\",\"a\"]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.GzipCompressFile(part1, part1+common.SuffixGzip); err != nil {
+		t.Fatal(err)
+	}
+	// 异常退出时最后一个分段没有压缩
+	if err := os.WriteFile(part2, []byte(header+"\n[0.2,\"o\",\"b\"]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// 分段创建失败后直接写入完整录像的内容
+	fullPath := filepath.Join(dir, "sid.cast")
+	if err := os.WriteFile(fullPath, []byte("[0.3,\"o\",\"c\"]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "sid.part-0003.cast.gz")
+	if err := RebuildReplayFile(fullPath, []string{part1 + common.SuffixGzip, part2, missing}); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(fullPath)
+	want := header + "\n[0.1,\"o\",\"a\"]\n[0.2,\"o\",\"b\"]\n[0.3,\"o\",\"c\"]\n"
+	if string(raw) != want {
+		t.Fatalf("unexpected rebuilt replay:\n%s", raw)
+	}
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/service"
+
+	"github.com/jumpserver/koko/pkg/audit"
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
+)
+
+var (
+	auditSignerOnce sync.Once
+	auditSigner     *audit.Signer
+)
+
+// getAuditSigner 未开启签名或者密钥加载失败时返回 nil
+func getAuditSigner() *audit.Signer {
+	auditSignerOnce.Do(func() {
+		conf := config.GetConf()
+		if !conf.AuditSignEnabled {
+			return
+		}
+		keyPath := conf.AuditSignKeyFile
+		if keyPath == "" {
+			keyPath = filepath.Join(conf.KeyFolderPath, "audit_ed25519")
+		}
+		signer, err := audit.LoadOrCreateSigner(keyPath)
+		if err != nil {
+			logger.Errorf("Load audit sign key %s failed: %s", keyPath, err)
+			return
+		}
+		logger.Infof("Audit sign key loaded, key id %s", signer.KeyID)
+		auditSigner = signer
+	})
+	return auditSigner
+}
+
+// signFile 在上传前计算文件摘要并签名，target 为对象名称
+func signFile(absPath, target string) *audit.Signature {
+	signer := getAuditSigner()
+	if signer == nil {
+		return nil
+	}
+	sig, err := signer.SignFile(absPath, target)
+	if err != nil {
+		logger.Errorf("Sign file %s failed: %s", absPath, err)
+		return nil
+	}
+	return sig
+}
+
+// storeSignature 签名上传到对象旁边 (target + ".sig")
+func storeSignature(st Storage, sig *audit.Signature) {
+	if sig == nil {
+		return
+	}
+	localPath := auditLocalPath(sig.Object + audit.SignatureSuffix)
+	if err := audit.WriteSignatureFile(localPath, sig); err != nil {
+		logger.Errorf("Write signature file %s failed: %s", localPath, err)
+		return
+	}
+	storeAuditFile(st, localPath, sig.Object+audit.SignatureSuffix)
+}
+
+// storeAuditFile server 存储按照文件名识别会话，无法保存签名文件，此时把签名提交给 core，
+// 同时保留在本地 data/audit 目录
+func storeAuditFile(st Storage, localPath, target string) {
+	switch st.TypeName() {
+	case "server":
+		if err := reportAuditFile(st, localPath, target); err != nil {
+			logger.Errorf("Report audit file %s to core failed, kept in local: %s", target, err)
+			return
+		}
+		logger.Infof("Audit file %s reported to core, kept in local", target)
+		return
+	case "null":
+		logger.Infof("Audit file %s kept in local: storage %s not supported", target, st.TypeName())
+		return
+	}
+	// 签名文件不需要加密
+	if encryptStorage, ok := st.(EncryptStorage); ok {
+		st = encryptStorage.Storage
+	}
+	if err := st.Upload(localPath, target); err != nil {
+		logger.Errorf("Upload audit file %s failed, kept in local: %s", target, err)
+		return
+	}
+	_ = os.Remove(localPath)
+}
+
+// reportAuditFile 录像签名和命令哈希链提交到会话，上传下载文件的签名提交到文件记录
+func reportAuditFile(st Storage, localPath, target string) error {
+	id := strings.Split(filepath.Base(target), ".")[0]
+	var data map[string]interface{}
+	if strings.HasSuffix(target, commandChainSuffix) {
+		links, err := audit.ReadChainFile(localPath)
+		if err != nil {
+			return err
+		}
+		data = map[string]interface{}{"command_chain": links}
+	} else {
+		sig, err := audit.ReadSignatureFile(localPath)
+		if err != nil {
+			return err
+		}
+		data = map[string]interface{}{"signature": sig}
+	}
+	var (
+		jmsService *service.JMService
+		url        string
+	)
+	switch s := st.(type) {
+	case storage.ServerStorage:
+		jmsService, url = s.JmsService, fmt.Sprintf(service.SessionDetailURL, id)
+	case storage.FTPServerStorage:
+		jmsService, url = s.JmsService, fmt.Sprintf(service.FTPLogUpdateURL, id)
+	default:
+		return fmt.Errorf("storage %s not supported", st.TypeName())
+	}
+	client := jmsService.CloneClient()
+	_, err := client.Patch(url, data, nil)
+	return err
+}
+
+func auditLocalPath(target string) string {
+	localPath := filepath.Join(config.GetConf().DataFolderPath, "audit", filepath.FromSlash(target))
+	_ = os.MkdirAll(filepath.Dir(localPath), 0700)
+	return localPath
+}
+
+const commandChainSuffix = ".commands.sig.jsonl"
+
+func (c *CommandRecorder) enableChain(st Storage, date time.Time) {
+	signer := getAuditSigner()
+	if signer == nil {
+		return
+	}
+	c.chain = audit.NewCommandChain(c.sessionID, signer)
+	c.chainStorage = st
+	today := date.UTC().Format(dateTimeFormat)
+	c.chainTarget = strings.Join([]string{today, c.sessionID + commandChainSuffix}, "/")
+}
+
+func (c *CommandRecorder) appendChain(commands []*storage.Command) {
+	if c.chain == nil {
+		return
+	}
+	link := c.chain.Append(storage.ModelCommands(commands))
+	localPath := auditLocalPath(c.chainTarget)
+	if err := audit.AppendChainLink(localPath, link); err != nil {
+		logger.Errorf("Session %s: append command chain failed: %s", c.sessionID, err)
+	}
+}
+
+// resumeChain 补传 spool 中的命令时，继续会话中断前保留在本地的哈希链
+func (c *CommandRecorder) resumeChain(st Storage, date time.Time) {
+	signer := getAuditSigner()
+	if signer == nil {
+		return
+	}
+	auditDir := filepath.Join(config.GetConf().DataFolderPath, "audit")
+	matches, _ := filepath.Glob(filepath.Join(auditDir, "*", c.sessionID+commandChainSuffix))
+	if len(matches) == 0 {
+		c.enableChain(st, date)
+		return
+	}
+	links, err := audit.ReadChainFile(matches[0])
+	if err == nil {
+		c.chain, err = audit.ResumeCommandChain(c.sessionID, signer, links)
+	}
+	if err != nil {
+		logger.Errorf("Session %s: resume command chain %s failed: %s", c.sessionID, matches[0], err)
+		return
+	}
+	c.chainStorage = st
+	target, _ := filepath.Rel(auditDir, matches[0])
+	c.chainTarget = filepath.ToSlash(target)
+}
+
+// SaveRemainCommands 补传 spool 中的命令，保存成功后追加到会话的哈希链
+func SaveRemainCommands(jmsService *service.JMService, cmdStorage CommandStorage, replayStorage Storage,
+	sid string, commands []*storage.Command) error {
+	if err := SaveCommands(jmsService, cmdStorage, commands); err != nil {
+		return err
+	}
+	c := &CommandRecorder{sessionID: sid}
+	c.resumeChain(replayStorage, time.Unix(commands[0].Timestamp, 0))
+	c.appendChain(commands)
+	c.storeChain()
+	return nil
+}
+
+// storeChain 命令记录结束后上传哈希链，与录像保存在同一个存储
+// 还有命令保留在 spool 中时不上传，补传命令时继续追加
+func (c *CommandRecorder) storeChain() {
+	if c.chain == nil || c.chainPending {
+		return
+	}
+	localPath := auditLocalPath(c.chainTarget)
+	if _, err := os.Stat(localPath); err != nil {
+		return
+	}
+	storeAuditFile(c.chainStorage, localPath, c.chainTarget)
+}
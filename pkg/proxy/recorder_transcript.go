@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+
+	"github.com/jumpserver/koko/pkg/asciinema"
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
+)
+
+/*
+录像文本记录: 录像输出经过终端解析生成去重的纯文本，每行带有相对会话开始的时间，
+会话结束时上传到录像旁边 (today/sid.transcript.txt)，或者索引到 es 命令存储的 <index>-transcript。
+录像文件关闭后在上传协程中解析完整的录像，不影响会话中录像的写入。
+*/
+
+const (
+	TranscriptModeStorage = "storage"
+	TranscriptModeES      = "es"
+
+	transcriptSuffix    = ".transcript.txt"
+	transcriptBatchSize = 500
+)
+
+type replayTranscript struct {
+	localPath string
+	target    string
+
+	// 索引到 es 时不为空
+	es   *storage.ESCommandStorage
+	base model.Command
+}
+
+// enableTranscript base 为会话信息，用于填充 es 文档
+func (r *ReplyRecorder) enableTranscript(conf *model.TerminalConfig, base *model.Command) {
+	mode := config.GetConf().ReplayTranscript
+	if mode == "" || r.isNullStorage() {
+		return
+	}
+	today := r.info.TimeStamp.UTC().Format(dateTimeFormat)
+	target := strings.Join([]string{today, r.SessionID + transcriptSuffix}, "/")
+	localPath := filepath.Join(filepath.Dir(r.absFilePath), r.SessionID+transcriptSuffix)
+	t := &replayTranscript{
+		localPath: localPath,
+		target:    target,
+		base:      *base,
+	}
+	if mode == TranscriptModeES {
+		if es, ok := newCommandStorageByType(r.jmsService, conf, conf.CommandStorage.TypeName).(storage.ESCommandStorage); ok {
+			t.es = &es
+		} else {
+			logger.Warnf("Session %s: command storage is not es, transcript upload to replay storage",
+				r.SessionID)
+		}
+	}
+	r.transcript = t
+}
+
+// renderTranscript 在上传协程中调用，此时录像文件已经关闭
+func (r *ReplyRecorder) renderTranscript() {
+	t := r.transcript
+	if t == nil {
+		return
+	}
+	fd, err := os.Open(r.absFilePath)
+	if err != nil {
+		logger.Errorf("Session %s: open replay for transcript failed: %s", r.SessionID, err)
+		return
+	}
+	_, lines, err := asciinema.RenderTranscript(fd)
+	_ = fd.Close()
+	if err != nil {
+		logger.Errorf("Session %s: render transcript failed: %s", r.SessionID, err)
+		return
+	}
+	if len(lines) == 0 {
+		return
+	}
+	if err = t.writeFile(lines); err != nil {
+		logger.Errorf("Session %s: write transcript file failed: %s", r.SessionID, err)
+		_ = os.Remove(t.localPath)
+		return
+	}
+	go r.storeTranscript(t)
+}
+
+func (t *replayTranscript) writeFile(lines []asciinema.TranscriptLine) error {
+	fd, err := os.Create(t.localPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fd)
+	if err = asciinema.WriteTranscript(w, lines); err == nil {
+		err = w.Flush()
+	}
+	if err1 := fd.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (r *ReplyRecorder) storeTranscript(t *replayTranscript) {
+	if stat, err := os.Stat(t.localPath); err != nil || stat.Size() == 0 {
+		_ = os.Remove(t.localPath)
+		return
+	}
+	if t.es != nil {
+		err := t.indexES()
+		if err == nil {
+			_ = os.Remove(t.localPath)
+			logger.Infof("Session %s: transcript indexed to %s", r.SessionID, t.es.TranscriptIndex())
+			return
+		}
+		logger.Errorf("Session %s: index transcript failed, upload to replay storage: %s", r.SessionID, err)
+	}
+	switch r.storage.TypeName() {
+	case "server", "null":
+		// server 存储按照文件名识别录像，无法保存文本记录
+		logger.Infof("Session %s: transcript kept in local %s: storage %s not supported",
+			r.SessionID, t.localPath, r.storage.TypeName())
+		return
+	}
+	if err := r.storage.Upload(t.localPath, t.target); err != nil {
+		logger.Errorf("Session %s: upload transcript failed, kept in local: %s", r.SessionID, err)
+		return
+	}
+	_ = os.Remove(t.localPath)
+}
+
+func (t *replayTranscript) indexES() error {
+	fd, err := os.Open(t.localPath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	start := t.base.DateCreated
+	docs := make([]storage.TranscriptDoc, 0, transcriptBatchSize)
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line, ok := asciinema.ParseTranscriptLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		date := start.Add(time.Duration(line.Time * float64(time.Second)))
+		docs = append(docs, storage.TranscriptDoc{
+			SessionID:   t.base.SessionID,
+			OrgID:       t.base.OrgID,
+			User:        t.base.User,
+			Server:      t.base.Server,
+			Account:     t.base.Account,
+			Offset:      line.Time,
+			Text:        line.Text,
+			Timestamp:   date.Unix(),
+			DateCreated: date.UTC(),
+		})
+		if len(docs) >= transcriptBatchSize {
+			if err = t.es.BulkSaveTranscript(docs); err != nil {
+				return err
+			}
+			docs = docs[:0]
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if len(docs) > 0 {
+		return t.es.BulkSaveTranscript(docs)
+	}
+	return nil
+}
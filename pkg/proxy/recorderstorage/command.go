@@ -0,0 +1,35 @@
+package recorderstorage
+
+import (
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+)
+
+// Command 命令记录，model.Command 没有 stderr、退出码和执行时长的字段，由 koko 的命令存储单独保存，
+// 推送到 core 时不包含这些字段
+type Command struct {
+	model.Command
+
+	// shell integration 和 ssh exec 命令的退出码，没有时为空
+	ExitStatus *int `json:"exit_status,omitempty"`
+	// 执行时长 (秒)
+	Duration *float64 `json:"duration,omitempty"`
+	// ssh exec 命令的 stderr，Output 只保存 stdout
+	Stderr string `json:"stderr,omitempty"`
+}
+
+func (c *Command) SetExitStatus(exitStatus int, duration time.Duration) {
+	seconds := duration.Seconds()
+	c.ExitStatus = &exitStatus
+	c.Duration = &seconds
+}
+
+// ModelCommands 转换为 core 的命令记录
+func ModelCommands(commands []*Command) []*model.Command {
+	items := make([]*model.Command, 0, len(commands))
+	for i := range commands {
+		items = append(items, &commands[i].Command)
+	}
+	return items
+}
@@ -8,12 +8,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/elastic/go-elasticsearch/v6"
 	"github.com/elastic/go-elasticsearch/v6/esapi"
 	elasticsearch8 "github.com/elastic/go-elasticsearch/v8"
 
-	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver/koko/pkg/logger"
 )
 
@@ -26,7 +26,7 @@ type ESCommandStorage struct {
 	InsecureSkipVerify bool
 }
 
-func (es ESCommandStorage) BulkSave(commands []*model.Command) error {
+func (es ESCommandStorage) BulkSave(commands []*Command) error {
 	if es.IsEs8() {
 		return es.BulkSaveEs8(commands)
 	}
@@ -57,9 +57,13 @@ type bulkResponse struct {
 	Items  []map[string]*bulkActionResponse `json:"items"`
 }
 
-func (es ESCommandStorage) bulkActionBuffer(action string, commands []*model.Command) *bytes.Buffer {
+func (es ESCommandStorage) bulkActionBuffer(action string, commands []*Command) *bytes.Buffer {
+	return bulkDocsBuffer(action, commands)
+}
+
+func bulkDocsBuffer[T any](action string, docs []T) *bytes.Buffer {
 	var buf bytes.Buffer
-	for _, item := range commands {
+	for _, item := range docs {
 		meta := []byte(fmt.Sprintf(`{ "%s" : { } }%s`, action, "\n"))
 		data, _ := json.Marshal(item)
 		data = append(data, "\n"...)
@@ -69,19 +73,26 @@ func (es ESCommandStorage) bulkActionBuffer(action string, commands []*model.Com
 	return &buf
 }
 
-func (es ESCommandStorage) BulkSaveEs(commands []*model.Command) error {
-	action := "index"
+func (es ESCommandStorage) bulkAction() string {
 	if es.IsDataStream {
-		action = "create"
+		return "create"
 	}
-	buf := es.bulkActionBuffer(action, commands)
+	return "index"
+}
+
+func (es ESCommandStorage) BulkSaveEs(commands []*Command) error {
+	action := es.bulkAction()
+	return es.bulkSaveEs(es.Index, action, es.bulkActionBuffer(action, commands))
+}
+
+func (es ESCommandStorage) bulkSaveEs(index, action string, buf *bytes.Buffer) error {
 	esClient, err := es.createEsClient()
 	if err != nil {
 		logger.Errorf("ES new client err: %s", err)
 		return err
 	}
 	opts := make([]func(*esapi.BulkRequest), 0, 2)
-	opts = append(opts, esClient.Bulk.WithIndex(es.Index))
+	opts = append(opts, esClient.Bulk.WithIndex(index))
 	opts = append(opts, esClient.Bulk.WithDocumentType(es.DocType))
 	response, err := esClient.Bulk(buf, opts...)
 	if err != nil {
@@ -92,18 +103,18 @@ func (es ESCommandStorage) BulkSaveEs(commands []*model.Command) error {
 	return es.handleResp(action, response.IsError(), response.Body)
 }
 
-func (es ESCommandStorage) BulkSaveEs8(commands []*model.Command) (err error) {
-	action := "index"
-	if es.IsDataStream {
-		action = "create"
-	}
-	buf := es.bulkActionBuffer(action, commands)
+func (es ESCommandStorage) BulkSaveEs8(commands []*Command) (err error) {
+	action := es.bulkAction()
+	return es.bulkSaveEs8(es.Index, action, es.bulkActionBuffer(action, commands))
+}
+
+func (es ESCommandStorage) bulkSaveEs8(index, action string, buf *bytes.Buffer) error {
 	esClient, err := es.createEs8Client()
 	if err != nil {
 		logger.Errorf("ES8 new client err: %s", err)
 		return err
 	}
-	response, err := esClient.Bulk(buf, esClient.Bulk.WithIndex(es.Index))
+	response, err := esClient.Bulk(buf, esClient.Bulk.WithIndex(index))
 	if err != nil {
 		logger.Errorf("ES8 client bulk save err: %s", err)
 		return err
@@ -112,6 +123,33 @@ func (es ESCommandStorage) BulkSaveEs8(commands []*model.Command) (err error) {
 	return es.handleResp(action, response.IsError(), response.Body)
 }
 
+// TranscriptDoc 会话文本记录中的一行，字段名称与命令记录保持一致，方便关联查询
+type TranscriptDoc struct {
+	SessionID   string    `json:"session"`
+	OrgID       string    `json:"org_id"`
+	User        string    `json:"user"`
+	Server      string    `json:"asset"`
+	Account     string    `json:"account"`
+	Offset      float64   `json:"offset"`
+	Text        string    `json:"text"`
+	Timestamp   int64     `json:"timestamp"`
+	DateCreated time.Time `json:"@timestamp"`
+}
+
+// TranscriptIndex 文本记录保存在单独的索引，不影响命令记录的查询
+func (es ESCommandStorage) TranscriptIndex() string {
+	return es.Index + "-transcript"
+}
+
+func (es ESCommandStorage) BulkSaveTranscript(docs []TranscriptDoc) error {
+	action := es.bulkAction()
+	buf := bulkDocsBuffer(action, docs)
+	if es.IsEs8() {
+		return es.bulkSaveEs8(es.TranscriptIndex(), action, buf)
+	}
+	return es.bulkSaveEs(es.TranscriptIndex(), action, buf)
+}
+
 func (es ESCommandStorage) handleResp(action string, isErr bool, reader io.Reader) error {
 	var (
 		blk        *bulkResponse
@@ -7,7 +7,6 @@ import (
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 
-	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver/koko/pkg/logger"
 )
 
@@ -22,7 +21,7 @@ func NewInfluxdbClient(serverURL, authToken string) influxdb2.Client {
 	return influxdb2.NewClient(serverURL, authToken)
 }
 
-func (influx InfluxdbStorage) BulkSave(commands []*model.Command) (err error) {
+func (influx InfluxdbStorage) BulkSave(commands []*Command) (err error) {
 	client := NewInfluxdbClient(influx.ServerURL, influx.AuthToken)
 	defer client.Close()
 	for _, item := range commands {
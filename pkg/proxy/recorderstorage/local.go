@@ -0,0 +1,121 @@
+package recorderstorage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+var (
+	ErrLocalRootUnavailable = errors.New("local storage root is unavailable")
+	ErrInvalidTarget        = errors.New("invalid storage target")
+)
+
+// LocalStorage 将录像和文件复制到挂载的目录 (NFS/CIFS)，目录结构与 target 保持一致
+type LocalStorage struct {
+	Root string
+}
+
+func (l LocalStorage) Upload(gZipFilePath, target string) (err error) {
+	if err = l.checkRoot(); err != nil {
+		logger.Errorf("Local storage root %s check failed: %s", l.Root, err)
+		return err
+	}
+	dstPath, err := l.targetPath(target)
+	if err != nil {
+		return err
+	}
+	dstDir := filepath.Dir(dstPath)
+	if err = os.MkdirAll(dstDir, 0755); err != nil {
+		logger.Errorf("Local storage create dir %s failed: %s", dstDir, err)
+		return err
+	}
+	if err = copyFileAtomic(gZipFilePath, dstPath); err != nil {
+		logger.Errorf("Local storage copy file %s to %s failed: %s", gZipFilePath, dstPath, err)
+		return err
+	}
+	return nil
+}
+
+func (l LocalStorage) TypeName() string {
+	return "local"
+}
+
+// checkRoot 根目录必须已经存在，避免挂载点丢失时把文件写到本地磁盘
+func (l LocalStorage) checkRoot() error {
+	if l.Root == "" {
+		return fmt.Errorf("%w: empty root path", ErrLocalRootUnavailable)
+	}
+	stat, err := os.Stat(l.Root)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrLocalRootUnavailable, err)
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%w: %s is not a directory", ErrLocalRootUnavailable, l.Root)
+	}
+	return nil
+}
+
+func (l LocalStorage) targetPath(target string) (string, error) {
+	cleanTarget := filepath.Clean(filepath.FromSlash(target))
+	if filepath.IsAbs(cleanTarget) || cleanTarget == "." ||
+		cleanTarget == ".." || strings.HasPrefix(cleanTarget, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidTarget, target)
+	}
+	return filepath.Join(l.Root, cleanTarget), nil
+}
+
+// copyFileAtomic 先写入临时文件并 fsync，再 rename 到目标路径，保证目标文件完整
+func copyFileAtomic(srcPath, dstPath string) (err error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dstDir := filepath.Dir(dstPath)
+	tmp, err := os.CreateTemp(dstDir, "."+filepath.Base(dstPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	if _, err = io.Copy(tmp, src); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpPath, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, dstPath); err != nil {
+		return err
+	}
+	return syncDir(dstDir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		// 部分网络文件系统不支持目录 fsync
+		logger.Debugf("Local storage sync dir %s failed: %s", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package recorderstorage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStorage_Upload(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(t.TempDir(), "session.cast.gz")
+	if err := os.WriteFile(src, []byte("replay data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := LocalStorage{Root: root}
+	target := "2024-01-02/session.cast.gz"
+	if err := s.Upload(src, target); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "2024-01-02", "session.cast.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "replay data" {
+		t.Fatalf("unexpected content %s", data)
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, "2024-01-02"))
+	if len(entries) != 1 {
+		t.Fatalf("expected no temp file left, got %d entries", len(entries))
+	}
+
+	if err = s.Upload(src, "../escape.gz"); !errors.Is(err, ErrInvalidTarget) {
+		t.Fatalf("expected invalid target error, got %v", err)
+	}
+	missing := LocalStorage{Root: filepath.Join(root, "not-mounted")}
+	if err = missing.Upload(src, target); !errors.Is(err, ErrLocalRootUnavailable) {
+		t.Fatalf("expected root unavailable error, got %v", err)
+	}
+}
@@ -1,7 +1,6 @@
 package recorderstorage
 
 import (
-	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver/koko/pkg/logger"
 )
 
@@ -13,7 +12,7 @@ func NewNullStorage() (storage NullStorage) {
 type NullStorage struct {
 }
 
-func (f NullStorage) BulkSave(commands []*model.Command) (err error) {
+func (f NullStorage) BulkSave(commands []*Command) (err error) {
 	logger.Infof("Null Storage discard %d commands.", len(commands))
 	return
 }
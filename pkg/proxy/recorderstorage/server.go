@@ -4,7 +4,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver-dev/sdk-go/service"
 )
 
@@ -27,8 +26,8 @@ func (s FTPServerStorage) TypeName() string {
 	return s.StorageType
 }
 
-func (s ServerStorage) BulkSave(commands []*model.Command) (err error) {
-	return s.JmsService.PushSessionCommand(commands)
+func (s ServerStorage) BulkSave(commands []*Command) (err error) {
+	return s.JmsService.PushSessionCommand(ModelCommands(commands))
 }
 
 func (s ServerStorage) Upload(gZipFilePath, target string) (err error) {
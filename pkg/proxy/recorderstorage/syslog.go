@@ -0,0 +1,290 @@
+package recorderstorage
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+)
+
+/*
+RFC 5424 syslog 命令存储，支持 udp、tcp、tls (RFC 5425)，消息内容为 CEF 或者 JSON。
+tcp 和 tls 使用 octet counting 分帧 (RFC 6587)。
+同时接收会话生命周期事件，SOC 不需要轮询 core 就能看到连接、断开等事件。
+*/
+
+const (
+	SyslogFormatCEF  = "cef"
+	SyslogFormatJSON = "json"
+
+	syslogVersion     = 1
+	syslogAppName     = "koko"
+	syslogFacility    = 13 // log audit
+	syslogDialTimeout = 5 * time.Second
+	syslogSendTimeout = 10 * time.Second
+
+	cefVendor  = "JumpServer"
+	cefProduct = "KoKo"
+)
+
+// syslog severity
+const (
+	severityError   = 3
+	severityWarning = 4
+	severityNotice  = 5
+	severityInfo    = 6
+)
+
+func NewSyslogStorage(network, address, format string, insecureSkipVerify bool) *SyslogStorage {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	if format != SyslogFormatJSON {
+		format = SyslogFormatCEF
+	}
+	return &SyslogStorage{
+		Network:            network,
+		Address:            address,
+		Format:             format,
+		InsecureSkipVerify: insecureSkipVerify,
+		hostname:           hostname,
+	}
+}
+
+type SyslogStorage struct {
+	Network            string // udp, tcp, tls
+	Address            string
+	Format             string // cef, json
+	InsecureSkipVerify bool
+
+	hostname string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func (s *SyslogStorage) BulkSave(commands []*Command) error {
+	messages := make([]string, 0, len(commands))
+	for _, item := range commands {
+		messages = append(messages, s.formatCommand(item))
+	}
+	return s.send(messages)
+}
+
+func (s *SyslogStorage) TypeName() string {
+	return "syslog"
+}
+
+// SessionLifecycle 发送会话生命周期事件
+func (s *SyslogStorage) SessionLifecycle(sid string, event model.LifecycleEvent, logObj model.SessionLifecycleLog) error {
+	return s.send([]string{s.formatLifecycle(sid, event, logObj, time.Now())})
+}
+
+func (s *SyslogStorage) send(messages []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var err error
+	// 连接断开时重连一次
+	for i := 0; i < 2; i++ {
+		if err = s.connect(); err != nil {
+			return err
+		}
+		if err = s.write(messages); err == nil {
+			return nil
+		}
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *SyslogStorage) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	switch s.Network {
+	case "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.Address, &tls.Config{
+			InsecureSkipVerify: s.InsecureSkipVerify,
+		})
+	case "tcp":
+		conn, err = dialer.Dial("tcp", s.Address)
+	default:
+		conn, err = dialer.Dial("udp", s.Address)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *SyslogStorage) write(messages []string) error {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(syslogSendTimeout))
+	for _, msg := range messages {
+		data := msg
+		if s.Network != "udp" && s.Network != "" {
+			data = strconv.Itoa(len(msg)) + " " + msg
+		}
+		if _, err := s.conn.Write([]byte(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// header <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA
+func (s *SyslogStorage) header(severity int, msgID string, ts time.Time) string {
+	pri := syslogFacility*8 + severity
+	return fmt.Sprintf("<%d>%d %s %s %s %d %s -", pri, syslogVersion,
+		ts.UTC().Format(time.RFC3339Nano), s.hostname, syslogAppName, os.Getpid(), msgID)
+}
+
+func (s *SyslogStorage) formatCommand(item *Command) string {
+	ts := item.DateCreated
+	if ts.IsZero() {
+		ts = time.Unix(item.Timestamp, 0)
+	}
+	var body string
+	switch s.Format {
+	case SyslogFormatJSON:
+		fields := map[string]interface{}{
+			"type":       "command",
+			"session":    item.SessionID,
+			"org_id":     item.OrgID,
+			"user":       item.User,
+			"asset":      item.Server,
+			"account":    item.Account,
+			"input":      item.Input,
+			"output":     item.Output,
+			"risk_level": item.RiskLevel,
+			"timestamp":  item.Timestamp,
+		}
+		if item.ExitStatus != nil {
+			fields["exit_status"] = *item.ExitStatus
+			fields["duration"] = *item.Duration
+		}
+		if item.Stderr != "" {
+			fields["stderr"] = item.Stderr
+		}
+		raw, _ := json.Marshal(fields)
+		body = string(raw)
+	default:
+		ext := []cefField{
+			{"rt", strconv.FormatInt(ts.UnixMilli(), 10)},
+			{"suser", item.User},
+			{"dhost", item.Server},
+			{"duser", item.Account},
+			{"cs1Label", "session"},
+			{"cs1", item.SessionID},
+			{"cs2Label", "org_id"},
+			{"cs2", item.OrgID},
+			{"cs3Label", "input"},
+			{"cs3", item.Input},
+			{"cs4Label", "output"},
+			{"cs4", item.Output},
+			{"cn1Label", "risk_level"},
+			{"cn1", strconv.FormatInt(item.RiskLevel, 10)},
+		}
+		if item.ExitStatus != nil {
+			ext = append(ext, cefField{"cn2Label", "exit_status"}, cefField{"cn2", strconv.Itoa(*item.ExitStatus)},
+				cefField{"cfp1Label", "duration"}, cefField{"cfp1", strconv.FormatFloat(*item.Duration, 'f', 3, 64)})
+		}
+		if item.Stderr != "" {
+			ext = append(ext, cefField{"cs5Label", "stderr"}, cefField{"cs5", item.Stderr})
+		}
+		body = formatCEF("command", "Session command", cefSeverity(item.RiskLevel), ext)
+	}
+	return s.header(commandSeverity(item.RiskLevel), "command", ts) + " " + body
+}
+
+func (s *SyslogStorage) formatLifecycle(sid string, event model.LifecycleEvent,
+	logObj model.SessionLifecycleLog, ts time.Time) string {
+	var body string
+	switch s.Format {
+	case SyslogFormatJSON:
+		raw, _ := json.Marshal(map[string]interface{}{
+			"type":      "session",
+			"session":   sid,
+			"event":     event,
+			"reason":    logObj.Reason,
+			"user":      logObj.User,
+			"timestamp": ts.Unix(),
+		})
+		body = string(raw)
+	default:
+		ext := []cefField{
+			{"rt", strconv.FormatInt(ts.UnixMilli(), 10)},
+			{"suser", logObj.User},
+			{"reason", logObj.Reason},
+			{"cs1Label", "session"},
+			{"cs1", sid},
+		}
+		body = formatCEF("session:"+string(event), string(event), 3, ext)
+	}
+	return s.header(severityInfo, "session", ts) + " " + body
+}
+
+type cefField struct {
+	key   string
+	value string
+}
+
+// formatCEF CEF:Version|Device Vendor|Device Product|Device Version|Signature ID|Name|Severity|Extension
+func formatCEF(signatureID, name string, severity int, ext []cefField) string {
+	fields := make([]string, 0, len(ext))
+	for _, f := range ext {
+		if f.value == "" {
+			continue
+		}
+		fields = append(fields, f.key+"="+cefExtensionEscaper.Replace(f.value))
+	}
+	return fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s", cefVendor, cefProduct, "1.0",
+		cefHeaderEscaper.Replace(signatureID), cefHeaderEscaper.Replace(name), severity,
+		strings.Join(fields, " "))
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func commandSeverity(riskLevel int64) int {
+	switch riskLevel {
+	case model.WarningLevel:
+		return severityWarning
+	case model.RejectLevel, model.ReviewReject:
+		return severityError
+	case model.ReviewAccept, model.ReviewCancel:
+		return severityNotice
+	default:
+		return severityInfo
+	}
+}
+
+// cefSeverity CEF 的严重程度为 0-10
+func cefSeverity(riskLevel int64) int {
+	switch riskLevel {
+	case model.WarningLevel:
+		return 6
+	case model.RejectLevel, model.ReviewReject:
+		return 8
+	case model.ReviewAccept, model.ReviewCancel:
+		return 4
+	default:
+		return 2
+	}
+}
@@ -0,0 +1,50 @@
+package recorderstorage
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+)
+
+func TestSyslogStorage_BulkSave(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := NewSyslogStorage("udp", conn.LocalAddr().String(), SyslogFormatCEF, false)
+	cmd := &Command{Command: model.Command{
+		SessionID:   "sid",
+		User:        "admin(Administrator)",
+		Server:      "web01(10.0.0.1)",
+		Account:     "root",
+		Input:       "echo a=b|c",
+		RiskLevel:   model.RejectLevel,
+		DateCreated: time.Now(),
+	}}
+	cmd.SetExitStatus(1, 1500*time.Millisecond)
+	cmd.Stderr = "permission denied"
+	if err = s.BulkSave([]*Command{cmd}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	// facility 13 * 8 + severity 3
+	if !strings.HasPrefix(msg, "<107>1 ") {
+		t.Fatalf("unexpected syslog header: %s", msg)
+	}
+	for _, expected := range []string{"CEF:0|JumpServer|KoKo|", "|command|", `cs3=echo a\=b|c`, "duser=root", "cs1=sid",
+		"cn2=1", "cfp1=1.500", "cs5Label=stderr", "cs5=permission denied"} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("message %s should contain %s", msg, expected)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package recorderstorage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+Webhook 命令存储，适用于 Splunk HEC、Loki push 或者内部的采集服务。
+body 默认是命令的 json 数组或者 ndjson，也可以使用 text/template 模板自定义，模板数据为
+{{.Commands}}，可以使用 json 函数，例如 Splunk HEC:
+
+	{{range .Commands}}{"event": {{json .}}, "sourcetype": "jumpserver:command"}{{end}}
+
+设置 Secret 后，请求头带上 HMAC-SHA256 签名:
+
+	X-Koko-Timestamp: unix 时间戳
+	X-Koko-Signature: sha256=hex(hmac(secret, timestamp + "." + body))
+
+每个批次带上 X-Koko-Idempotency-Key (批次内容的 sha256)，重试时相同的批次使用相同的 key，服务端可以去重。
+一次保存多个批次时，部分批次失败返回 PartialSaveError，调用方只需要重试未保存的命令。
+
+服务端返回 429/503 时，按照 Retry-After 暂停发送，期间直接返回 ErrWebhookBackpressure，
+不会阻塞调用方，命令由调用方保留重试。
+*/
+
+const (
+	WebhookFormatJSON   = "json"
+	WebhookFormatNDJSON = "ndjson"
+
+	webhookDefaultBatchSize  = 500
+	webhookDefaultRetryAfter = 30 * time.Second
+	webhookRequestTimeout    = 30 * time.Second
+
+	WebhookSignatureHeader   = "X-Koko-Signature"
+	WebhookTimestampHeader   = "X-Koko-Timestamp"
+	WebhookIdempotencyHeader = "X-Koko-Idempotency-Key"
+)
+
+var ErrWebhookBackpressure = errors.New("webhook backpressure, retry later")
+
+// PartialSaveError 前 Saved 条命令已经保存成功
+type PartialSaveError struct {
+	Saved int
+	Err   error
+}
+
+func (e *PartialSaveError) Error() string {
+	return fmt.Sprintf("%d commands saved: %s", e.Saved, e.Err)
+}
+
+func (e *PartialSaveError) Unwrap() error {
+	return e.Err
+}
+
+type WebhookOptions struct {
+	URL                string
+	Method             string
+	Format             string
+	BodyTemplate       string
+	Headers            map[string]string
+	Secret             string
+	BatchSize          int
+	InsecureSkipVerify bool
+}
+
+func NewWebhookStorage(opts WebhookOptions) (*WebhookStorage, error) {
+	if opts.Method == "" {
+		opts.Method = http.MethodPost
+	}
+	if opts.Format != WebhookFormatNDJSON {
+		opts.Format = WebhookFormatJSON
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = webhookDefaultBatchSize
+	}
+	w := &WebhookStorage{opts: opts}
+	if opts.BodyTemplate != "" {
+		tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				raw, err := json.Marshal(v)
+				return string(raw), err
+			},
+		}).Parse(opts.BodyTemplate)
+		if err != nil {
+			return nil, err
+		}
+		w.tmpl = tmpl
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+	w.client = &http.Client{Transport: transport, Timeout: webhookRequestTimeout}
+	return w, nil
+}
+
+type WebhookStorage struct {
+	opts   WebhookOptions
+	tmpl   *template.Template
+	client *http.Client
+
+	lock         sync.Mutex
+	blockedUntil time.Time
+}
+
+func (w *WebhookStorage) BulkSave(commands []*Command) error {
+	for start := 0; start < len(commands); start += w.opts.BatchSize {
+		end := start + w.opts.BatchSize
+		if end > len(commands) {
+			end = len(commands)
+		}
+		if err := w.sendBatch(commands[start:end]); err != nil {
+			if start > 0 {
+				return &PartialSaveError{Saved: start, Err: err}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *WebhookStorage) TypeName() string {
+	return "webhook"
+}
+
+// sendBatch 不在这里等待和重试，由调用方的重试队列处理
+func (w *WebhookStorage) sendBatch(commands []*Command) error {
+	if wait := w.backoffRemain(); wait > 0 {
+		return fmt.Errorf("%w: %s", ErrWebhookBackpressure, wait.Round(time.Second))
+	}
+	body, err := w.renderBody(commands)
+	if err != nil {
+		return err
+	}
+	return w.post(body)
+}
+
+func (w *WebhookStorage) backoffRemain() time.Duration {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return time.Until(w.blockedUntil)
+}
+
+func (w *WebhookStorage) setBackoff(d time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.blockedUntil = time.Now().Add(d)
+}
+
+func (w *WebhookStorage) renderBody(commands []*Command) ([]byte, error) {
+	var buf bytes.Buffer
+	if w.tmpl != nil {
+		err := w.tmpl.Execute(&buf, map[string]interface{}{"Commands": commands})
+		return buf.Bytes(), err
+	}
+	if w.opts.Format == WebhookFormatNDJSON {
+		encoder := json.NewEncoder(&buf)
+		for i := range commands {
+			if err := encoder.Encode(commands[i]); err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+	}
+	return json.Marshal(commands)
+}
+
+func (w *WebhookStorage) contentType() string {
+	if w.opts.Format == WebhookFormatNDJSON {
+		return "application/x-ndjson"
+	}
+	return "application/json"
+}
+
+// post 服务端要求等待时，记录等待时间，期间不再发送
+func (w *WebhookStorage) post(body []byte) error {
+	req, err := http.NewRequest(w.opts.Method, w.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.contentType())
+	req.Header.Set(WebhookIdempotencyHeader, WebhookIdempotencyKey(body))
+	for k, v := range w.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	if w.opts.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, ts)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(w.opts.Secret, ts, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		w.setBackoff(retryAfter)
+		logger.Warnf("Webhook %s backpressure %d, retry after %s", w.opts.URL, resp.StatusCode, retryAfter)
+		return fmt.Errorf("%w: status %d", ErrWebhookBackpressure, resp.StatusCode)
+	default:
+		return fmt.Errorf("webhook status %d: %s", resp.StatusCode, respBody)
+	}
+}
+
+func WebhookIdempotencyKey(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseRetryAfter Retry-After 可以是秒数或者 HTTP 时间
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return webhookDefaultRetryAfter
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return webhookDefaultRetryAfter
+}
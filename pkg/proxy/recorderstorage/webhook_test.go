@@ -0,0 +1,114 @@
+package recorderstorage
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+)
+
+func TestWebhookStorage_BulkSave(t *testing.T) {
+	var (
+		bodies   []string
+		throttle bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if throttle {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		ts := r.Header.Get(WebhookTimestampHeader)
+		if r.Header.Get(WebhookSignatureHeader) != "sha256="+WebhookSignature("secret", ts, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		bodies = append(bodies, string(body))
+	}))
+	defer srv.Close()
+
+	st, err := NewWebhookStorage(WebhookOptions{
+		URL:       srv.URL,
+		Format:    WebhookFormatNDJSON,
+		Secret:    "secret",
+		BatchSize: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := testCommands("ls", "id", "pwd")
+	if err = st.BulkSave(commands); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 || strings.Count(bodies[0], "\n") != 2 {
+		t.Fatalf("unexpected batches %q", bodies)
+	}
+
+	throttle = true
+	if err = st.BulkSave(commands); !errors.Is(err, ErrWebhookBackpressure) {
+		t.Fatalf("expected backpressure, got %v", err)
+	}
+	// Retry-After 期间不再发送请求
+	throttle = false
+	if err = st.BulkSave(commands); !errors.Is(err, ErrWebhookBackpressure) {
+		t.Fatalf("expected backpressure during retry-after, got %v", err)
+	}
+}
+
+func TestWebhookStorage_BodyTemplate(t *testing.T) {
+	st, err := NewWebhookStorage(WebhookOptions{
+		URL:          "http://127.0.0.1",
+		BodyTemplate: `{{range .Commands}}{"event": {{json .Input}}}{{end}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := st.renderBody(testCommands("ls", "id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"event": "ls"}{"event": "id"}` {
+		t.Fatalf("unexpected body %s", body)
+	}
+}
+
+func TestWebhookStorage_PartialSave(t *testing.T) {
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(WebhookIdempotencyHeader))
+		if len(keys) == 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	st, err := NewWebhookStorage(WebhookOptions{URL: srv.URL, BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := testCommands("ls", "id", "pwd")
+	var partial *PartialSaveError
+	if err = st.BulkSave(commands); !errors.As(err, &partial) || partial.Saved != 2 {
+		t.Fatalf("expected partial save of 2 commands, got %v", err)
+	}
+	// 相同的批次使用相同的 key
+	if err = st.BulkSave(commands[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] == "" || keys[0] != keys[2] || keys[0] == keys[1] {
+		t.Fatalf("unexpected idempotency keys %q", keys)
+	}
+}
+
+func testCommands(inputs ...string) []*Command {
+	commands := make([]*Command, 0, len(inputs))
+	for _, input := range inputs {
+		commands = append(commands, &Command{Command: model.Command{Input: input}})
+	}
+	return commands
+}
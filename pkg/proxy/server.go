@@ -20,9 +20,11 @@ import (
 	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver-dev/sdk-go/service"
 
+	"github.com/jumpserver/koko/pkg/audit"
 	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/exchange"
 	"github.com/jumpserver/koko/pkg/logger"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
 	"github.com/jumpserver/koko/pkg/session"
 	"github.com/jumpserver/koko/pkg/srvconn"
 	"github.com/jumpserver/koko/pkg/utils"
@@ -105,6 +107,12 @@ func NewServer(conn UserConnection, jmsService *service.JMService, opts ...Conne
 		return nil, ErrPermission
 	}
 
+	if config.GetConf().DiskFailClosed && recordingRefused() {
+		msg := lang.T("Terminal disk space is insufficient, new sessions are refused, please contact the administrator")
+		utils.IgnoreErrWriteString(conn, utils.WrapperWarn(msg))
+		return nil, ErrDiskFull
+	}
+
 	return &Server{
 		ID:            apiSession.ID,
 		UserConn:      conn,
@@ -155,6 +163,10 @@ type Server struct {
 
 	keyboardMode int32
 
+	// rz sz 正在传输的文件
+	zmodemFile     *zmodemFile
+	zmodemRecorder *FTPFileRecorder
+
 	OnSessionInfo func(info *SessionInfo)
 
 	BroadcastEvent func(event *exchange.RoomMessage)
@@ -186,20 +198,29 @@ func (s *Server) CheckPermissionExpired(now time.Time) bool {
 	return s.connOpts.authInfo.ExpireAt.IsExpired(now)
 }
 
-func (s *Server) ZmodemFileTransferEvent(zinfo *zmodem.ZFileInfo, status bool) {
-	protocol := s.connOpts.authInfo.Protocol
+// zmodemFile ZDATA 中的内容按照位置写入文件记录，传输结束时生成上传下载记录
+type zmodemFile struct {
+	info        *zmodem.ZFileInfo
+	ftpLog      *model.FTPLog
+	recordError bool
+}
+
+func (s *Server) getZmodemFile(zinfo *zmodem.ZFileInfo) *zmodemFile {
+	if s.zmodemFile != nil && s.zmodemFile.info == zinfo {
+		return s.zmodemFile
+	}
 	asset := s.connOpts.authInfo.Asset
 	user := s.connOpts.authInfo.User
-	switch protocol {
-	case srvconn.ProtocolTELNET, srvconn.ProtocolSSH:
-		operate := model.OperateDownload
-		switch zinfo.Type() {
-		case zmodem.TypeUpload:
-			operate = model.OperateUpload
-		case zmodem.TypeDownload:
-			operate = model.OperateDownload
-		}
-		item := model.FTPLog{
+	operate := model.OperateDownload
+	switch zinfo.Type() {
+	case zmodem.TypeUpload:
+		operate = model.OperateUpload
+	case zmodem.TypeDownload:
+		operate = model.OperateDownload
+	}
+	s.zmodemFile = &zmodemFile{
+		info: zinfo,
+		ftpLog: &model.FTPLog{
 			ID:         common.UUID(),
 			OrgID:      asset.OrgID,
 			User:       user.String(),
@@ -209,12 +230,64 @@ func (s *Server) ZmodemFileTransferEvent(zinfo *zmodem.ZFileInfo, status bool) {
 			Operate:    operate,
 			Path:       zinfo.Filename(),
 			DateStart:  common.NewUTCTime(zinfo.Time()),
-			IsSuccess:  status,
 			Session:    s.sessionInfo.ID,
-		}
-		if err := s.jmsService.CreateFileOperationLog(item); err != nil {
-			logger.Errorf("Create zmodem ftp log err: %s", err)
-		}
+		},
+	}
+	return s.zmodemFile
+}
+
+func (s *Server) getZmodemRecorder() *FTPFileRecorder {
+	if s.zmodemRecorder == nil {
+		maxSize := int64(s.terminalConf.MaxStoreFTPFileSize) * 1024 * 1024
+		s.zmodemRecorder = NewFTPFileRecord(s.jmsService,
+			NewFTPFileStorage(s.jmsService, s.terminalConf), maxSize)
+	}
+	return s.zmodemRecorder
+}
+
+func (s *Server) isZmodemProtocol() bool {
+	switch s.connOpts.authInfo.Protocol {
+	case srvconn.ProtocolTELNET, srvconn.ProtocolSSH:
+		return true
+	}
+	return false
+}
+
+// ZmodemFileDataEvent 断点续传的文件只有后面的部分，不保存文件内容
+func (s *Server) ZmodemFileDataEvent(zinfo *zmodem.ZFileInfo, offset int64, p []byte) {
+	if !s.isZmodemProtocol() {
+		return
+	}
+	zFile := s.getZmodemFile(zinfo)
+	if zFile.recordError || zinfo.Resumed() {
+		return
+	}
+	if err := s.getZmodemRecorder().RecordChunkAt(zFile.ftpLog, offset, p); err != nil {
+		logger.Errorf("Record zmodem file %s err: %s", zinfo.Filename(), err)
+		zFile.recordError = true
+	}
+}
+
+func (s *Server) ZmodemFileTransferEvent(zinfo *zmodem.ZFileInfo, status bool) {
+	if !s.isZmodemProtocol() {
+		return
+	}
+	zFile := s.getZmodemFile(zinfo)
+	s.zmodemFile = nil
+	item := *zFile.ftpLog
+	item.IsSuccess = status
+	if err := s.jmsService.CreateFileOperationLog(item); err != nil {
+		logger.Errorf("Create zmodem ftp log err: %s", err)
+	}
+	recorder := s.getZmodemRecorder()
+	switch {
+	case zinfo.Resumed():
+		logger.Warnf("Zmodem file %s resumed, file content not recorded", zinfo.Filename())
+		recorder.AbortFTPFile(item.ID)
+	case status && !zFile.recordError:
+		recorder.FinishFTPFile(item.ID)
+	default:
+		recorder.AbortFTPFile(item.ID)
 	}
 }
 
@@ -232,6 +305,10 @@ func (s *Server) GetFilterParser() *Parser {
 	}
 	zParser := zmodem.New()
 	zParser.FileEventCallback = s.ZmodemFileTransferEvent
+	zParser.FileDataCallback = s.ZmodemFileDataEvent
+	zParser.MaxTransferSize = int64(config.GetConf().ZmodemMaxFileSize) * 1024 * 1024
+	tParser := zmodem.NewTrzsz()
+	tParser.FileEventCallback = s.ZmodemFileTransferEvent
 	protocol := s.connOpts.authInfo.Protocol
 	filterRules := s.connOpts.authInfo.CommandFilterACLs
 	platform := s.connOpts.authInfo.Platform
@@ -246,9 +323,14 @@ func (s *Server) GetFilterParser() *Parser {
 		enableDownload: enableDownload,
 		enableUpload:   enableUpload,
 		zmodemParser:   zParser,
+		trzszParser:    tParser,
 		i18nLang:       s.connOpts.i18nLang,
 		platform:       &platform,
 	}
+	switch protocol {
+	case srvconn.ProtocolSSH, srvconn.ProtocolTELNET:
+		parser.shellIntegration = config.GetConf().ShellIntegration && isLinux(&platform)
+	}
 	parser.initial(pty.Window.Width, pty.Window.Height)
 	return &parser
 }
@@ -265,23 +347,19 @@ func (s *Server) GetReplayRecorder() *ReplyRecorder {
 		info)
 	if err != nil {
 		logger.Error(err)
+		return recorder
 	}
+	user := s.connOpts.authInfo.User
+	recorder.enableTranscript(s.terminalConf, &s.GenerateCommandItem(user.String(), "", "",
+		&ExecutedCommand{CreatedDate: info.TimeStamp}).Command)
 	return recorder
 }
 
 func (s *Server) GetCommandRecorder() *CommandRecorder {
-	cmdR := CommandRecorder{
-		sessionID:  s.ID,
-		storage:    NewCommandStorage(s.jmsService, s.terminalConf),
-		queue:      make(chan *model.Command, 10),
-		closed:     make(chan struct{}),
-		jmsService: s.jmsService,
-	}
-	go cmdR.record()
-	return &cmdR
+	return NewCommandRecorder(s.ID, s.jmsService, s.terminalConf)
 }
 
-func (s *Server) GenerateCommandItem(user, input, output string, item *ExecutedCommand) *model.Command {
+func (s *Server) GenerateCommandItem(user, input, output string, item *ExecutedCommand) *storage.Command {
 	asset := s.connOpts.authInfo.Asset
 	protocol := s.connOpts.authInfo.Protocol
 	server := asset.String()
@@ -293,7 +371,7 @@ func (s *Server) GenerateCommandItem(user, input, output string, item *ExecutedC
 		}
 	}
 	createdDate := item.CreatedDate
-	return &model.Command{
+	cmd := &storage.Command{Command: model.Command{
 		SessionID:   s.ID,
 		OrgID:       asset.OrgID,
 		Server:      server,
@@ -307,7 +385,11 @@ func (s *Server) GenerateCommandItem(user, input, output string, item *ExecutedC
 
 		CmdFilterAclId: item.CmdFilterACLId,
 		CmdGroupId:     item.CmdGroupId,
+	}}
+	if item.HasExitStatus {
+		cmd.SetExitStatus(item.ExitStatus, item.Duration)
 	}
+	return cmd
 }
 
 func (s *Server) getAuthPasswordIfNeed() (err error) {
@@ -1036,14 +1118,14 @@ func (s *Server) Proxy() {
 			logger.Errorf("Conn[%s] update session err: %s", s.UserConn.ID(), err2)
 		}
 		errLog := model.SessionLifecycleLog{Reason: err.Error()}
-		if err1 := s.jmsService.RecordSessionLifecycleLog(s.sessionInfo.ID, model.AssetConnectFinished,
+		if err1 := audit.RecordSessionLifecycleLog(s.jmsService, s.sessionInfo.ID, model.AssetConnectFinished,
 			errLog); err1 != nil {
 			logger.Errorf("Conn[%s] record session activity log err: %s", s.UserConn.ID(), err1)
 		}
 		return
 	}
 	defer srvCon.Close()
-	if err1 := s.jmsService.RecordSessionLifecycleLog(s.sessionInfo.ID, model.AssetConnectSuccess,
+	if err1 := audit.RecordSessionLifecycleLog(s.jmsService, s.sessionInfo.ID, model.AssetConnectSuccess,
 		model.EmptyLifecycleLog); err1 != nil {
 		logger.Errorf("Conn[%s] record session activity log err: %s", s.UserConn.ID(), err1)
 	}
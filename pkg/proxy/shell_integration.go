@@ -0,0 +1,416 @@
+package proxy
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LeeEirc/terminalparser"
+)
+
+/*
+shell integration (OSC 133):
+	登录后向 bash、zsh 注入 PROMPT_COMMAND/precmd，每个命令输出标记:
+		ESC ] 133 ; A BEL   提示符开始
+		ESC ] 133 ; B BEL   提示符结束，之后是用户输入的命令
+		ESC ] 133 ; C BEL   命令开始执行，之后是命令的输出 (bash 需要 4.4 以上的 PS0)
+		ESC ] 133 ; D ; 退出码 BEL   命令结束
+	B 和 C 之间是命令 (包含多行命令和 heredoc)，C 和 D 之间是输出，标记不显示给用户
+	注入的命令以 __jms_si=1; 开始，回显直到第一个标记之间的内容不显示
+	其他 shell 只输出结束标记，仍然使用提示符匹配解析命令
+	没有标记的命令 (嵌套的 shell、unset PROMPT_COMMAND 之后) 使用提示符匹配解析，直到下一个 B 标记:
+		命令执行中用户回车，没有 B 标记时用户回车，或者没有 B 标记的 C 标记
+*/
+
+const (
+	osc133Prefix = "\x1b]133;"
+	// osc133MaxLen 标记的最大长度，超过时按照普通数据处理
+	osc133MaxLen = 64
+
+	shellInjectToken = "__jms_si=1;"
+	// shellInjectQuiet 服务器输出停止一段时间后认为出现了提示符，注入 shell integration
+	shellInjectQuiet = 500 * time.Millisecond
+	// shellInjectMaxHidden 隐藏回显的最大长度，超过时不再隐藏
+	shellInjectMaxHidden = 64 * 1024
+
+	bashIntegration = `__jms_pc(){ local s=$?; printf "\033]133;D;%s\007\033]133;A\007" "$s"; return $s; }; ` +
+		`PROMPT_COMMAND="__jms_pc${PROMPT_COMMAND:+;$PROMPT_COMMAND}"; PS0="${PS0}\e]133;C\a"; ` +
+		`PS1="${PS1}\[\e]133;B\a\]"`
+	zshIntegration = `__jms_pc(){ local s=$?; printf "\033]133;D;%s\007\033]133;A\007" "$s"; }; ` +
+		`__jms_pe(){ printf "\033]133;C\007"; }; precmd_functions+=(__jms_pc); preexec_functions+=(__jms_pe); ` +
+		`PS1="${PS1}%{$(printf "\033]133;B\007")%}"`
+
+	// shellIntegrationScript 以空格开始，HISTCONTROL 包含 ignorespace 时不记录历史
+	shellIntegrationScript = " " + shellInjectToken + ` [ -n "$BASH_VERSION" ] && eval '` + bashIntegration +
+		`'; [ -n "$ZSH_VERSION" ] && eval '` + zshIntegration + `'; unset __jms_si; printf "\033]133;A\007"` + "\r"
+)
+
+const (
+	shellPhaseNone = iota
+	shellPhasePrompt
+	shellPhaseInput
+	shellPhaseOutput
+)
+
+const (
+	shellEchoNone = iota
+	shellEchoWaitToken
+	shellEchoHiding
+)
+
+// ShellCommand shell integration 解析的命令
+type ShellCommand struct {
+	Command  string
+	Output   string
+	ExitCode int
+	Start    time.Time
+	Duration time.Duration
+	// 命令执行期间使用了提示符匹配，可能有提示符匹配解析的命令还没有记录
+	Fallback bool
+}
+
+type osc133Segment struct {
+	data   []byte
+	marker byte
+	param  string
+}
+
+// osc133Scanner 去掉数据中的 OSC 133 标记，标记可能分布在多个数据包中
+type osc133Scanner struct {
+	pending []byte
+}
+
+func (o *osc133Scanner) split(p []byte) []osc133Segment {
+	if len(o.pending) > 0 {
+		p = append(o.pending, p...)
+		o.pending = nil
+	}
+	var segments []osc133Segment
+	for {
+		idx := bytes.Index(p, []byte(osc133Prefix))
+		if idx == -1 {
+			// 结尾可能是标记的开始部分
+			keep := partialPrefixLen(p, osc133Prefix)
+			o.pending = append(o.pending, p[len(p)-keep:]...)
+			segments = append(segments, osc133Segment{data: p[:len(p)-keep]})
+			return segments
+		}
+		body := p[idx+len(osc133Prefix):]
+		end, termLen := osc133End(body)
+		if end == -1 {
+			if len(body) < osc133MaxLen {
+				o.pending = append(o.pending, p[idx:]...)
+				segments = append(segments, osc133Segment{data: p[:idx]})
+				return segments
+			}
+			// 不是完整的标记
+			segments = append(segments, osc133Segment{data: p[:idx+len(osc133Prefix)]})
+			p = body
+			continue
+		}
+		content := string(body[:end])
+		seg := osc133Segment{data: p[:idx]}
+		if content != "" {
+			seg.marker = content[0]
+			if len(content) > 2 && content[1] == ';' {
+				seg.param = content[2:]
+			}
+		}
+		segments = append(segments, seg)
+		p = body[end+termLen:]
+	}
+}
+
+// osc133End 标记以 BEL 或者 ST (ESC \) 结束
+func osc133End(body []byte) (int, int) {
+	for i := 0; i < len(body) && i < osc133MaxLen; i++ {
+		switch body[i] {
+		case '\a':
+			return i, 1
+		case '\x1b':
+			if i+1 < len(body) && body[i+1] == '\\' {
+				return i, 2
+			}
+			if i+1 == len(body) {
+				return -1, 0
+			}
+		}
+	}
+	return -1, 0
+}
+
+func partialPrefixLen(p []byte, prefix string) int {
+	for n := len(prefix) - 1; n > 0; n-- {
+		if len(p) >= n && bytes.HasSuffix(p, []byte(prefix[:n])) {
+			return n
+		}
+	}
+	return 0
+}
+
+type shellState struct {
+	scanner osc133Scanner
+
+	// 收到 B 标记后，按照标记解析命令
+	active bool
+	// 出现了没有标记的命令，改用提示符匹配，收到 B 标记后恢复
+	fallback bool
+	// 当前命令执行期间使用过提示符匹配
+	fellBack bool
+	// 收到过 C 标记，否则用户回车时开始输出
+	sawExecMarker bool
+	phase         int
+
+	echoState int
+	hidden    int
+
+	cmdBuf  bytes.Buffer
+	outBuf  bytes.Buffer
+	command string
+	start   time.Time
+}
+
+// EnableShellIntegration 开启 OSC 133 标记的解析
+func (s *TerminalParser) EnableShellIntegration() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.shell = &shellState{}
+}
+
+// ShellIntegrationActive 已经收到标记，命令由标记确定
+func (s *TerminalParser) ShellIntegrationActive() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.shellActive()
+}
+
+// ShellCommandRunning 命令还没有结束，等待 D 标记记录命令
+func (s *TerminalParser) ShellCommandRunning() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.shellActive() && s.shell.phase == shellPhaseOutput
+}
+
+// shellActive 不加锁，在 EmitCommands 等持有锁的回调中使用
+func (s *TerminalParser) shellActive() bool {
+	return s.shell != nil && s.shell.active && !s.shell.fallback
+}
+
+// resetShellCommand 命令被拦截或者取消，不再记录当前的命令
+func (s *TerminalParser) resetShellCommand() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.shell == nil {
+		return
+	}
+	s.shell.phase = shellPhaseNone
+	s.shell.command = ""
+	s.shell.cmdBuf.Reset()
+	s.shell.outBuf.Reset()
+}
+
+// ShellInjected 已经注入 shell integration，开始隐藏回显
+func (s *TerminalParser) ShellInjected() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.shell != nil {
+		s.shell.echoState = shellEchoWaitToken
+	}
+}
+
+// ConsumeShellMarkers 解析并去掉 OSC 133 标记，返回显示给用户的数据
+func (s *TerminalParser) ConsumeShellMarkers(p []byte) []byte {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.shell == nil {
+		return p
+	}
+	sh := s.shell
+	out := make([]byte, 0, len(p))
+	for _, seg := range sh.scanner.split(p) {
+		data := seg.data
+		switch sh.echoState {
+		case shellEchoWaitToken:
+			if idx := bytes.Index(data, []byte(shellInjectToken)); idx != -1 {
+				// 清除注入之前的提示符所在的行，之后显示新的提示符
+				out = append(out, data[:idx]...)
+				out = append(out, "\r\x1b[K"...)
+				sh.echoState = shellEchoHiding
+				sh.hidden = len(data) - idx
+				data = nil
+			}
+		case shellEchoHiding:
+			sh.hidden += len(data)
+			if sh.hidden > shellInjectMaxHidden {
+				sh.echoState = shellEchoNone
+			} else {
+				data = nil
+			}
+		}
+		sh.feed(data)
+		out = append(out, data...)
+		if seg.marker != 0 {
+			if sh.echoState != shellEchoNone {
+				sh.echoState = shellEchoNone
+			}
+			if cmd, ok := sh.onMarker(seg.marker, seg.param); ok && s.EmitShellCommand != nil {
+				s.EmitShellCommand(cmd)
+			}
+		}
+	}
+	return out
+}
+
+// shellEnter 没有 C 标记的 shell (bash 4.4 以下)，用户回车时开始输出。
+// 不在输入阶段的回车是没有标记的命令，例如嵌套的 shell，改用提示符匹配
+func (s *TerminalParser) shellEnter() {
+	sh := s.shell
+	if sh == nil || !sh.active {
+		return
+	}
+	if sh.phase != shellPhaseInput {
+		sh.startFallback()
+		return
+	}
+	if !sh.sawExecMarker {
+		sh.startOutput()
+	}
+}
+
+// FlushShellCommand 会话结束时返回还在执行的命令，没有退出码
+func (s *TerminalParser) FlushShellCommand() (ShellCommand, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.shell == nil || s.shell.phase != shellPhaseOutput {
+		return ShellCommand{}, false
+	}
+	cmd := s.shell.finish(-1)
+	return cmd, cmd.Command != ""
+}
+
+func (sh *shellState) feed(data []byte) {
+	var buf *bytes.Buffer
+	switch sh.phase {
+	case shellPhaseInput:
+		buf = &sh.cmdBuf
+	case shellPhaseOutput:
+		buf = &sh.outBuf
+	default:
+		return
+	}
+	if buf.Len() < maxBufSize {
+		buf.Write(data)
+	}
+}
+
+func (sh *shellState) onMarker(marker byte, param string) (ShellCommand, bool) {
+	switch marker {
+	case 'A':
+		if sh.phase == shellPhaseOutput {
+			// 没有 D 标记，例如命令执行时按下 CTRL+C 之后 zsh 的提示符
+			cmd := sh.finish(-1)
+			sh.phase = shellPhasePrompt
+			return cmd, cmd.Command != ""
+		}
+		sh.phase = shellPhasePrompt
+	case 'B':
+		var (
+			cmd ShellCommand
+			ok  bool
+		)
+		if sh.phase == shellPhaseOutput {
+			// 没有 D 标记，例如 unset PROMPT_COMMAND 之后
+			cmd = sh.finish(-1)
+			ok = cmd.Command != ""
+		}
+		sh.active = true
+		sh.fallback = false
+		sh.phase = shellPhaseInput
+		sh.cmdBuf.Reset()
+		return cmd, ok
+	case 'C':
+		sh.sawExecMarker = true
+		switch sh.phase {
+		case shellPhaseInput:
+			sh.startOutput()
+		case shellPhaseOutput:
+		default:
+			// 没有 B 标记，不知道命令的内容
+			sh.startFallback()
+		}
+	case 'D':
+		if sh.phase != shellPhaseOutput {
+			sh.phase = shellPhaseNone
+			return ShellCommand{}, false
+		}
+		exitCode := -1
+		if code, err := strconv.Atoi(strings.SplitN(param, ";", 2)[0]); err == nil {
+			exitCode = code
+		}
+		cmd := sh.finish(exitCode)
+		sh.phase = shellPhaseNone
+		return cmd, cmd.Command != ""
+	}
+	return ShellCommand{}, false
+}
+
+func (sh *shellState) startOutput() {
+	sh.command = parseShellInput(sh.cmdBuf.Bytes())
+	sh.cmdBuf.Reset()
+	sh.outBuf.Reset()
+	sh.start = time.Now()
+	sh.phase = shellPhaseOutput
+	sh.fellBack = sh.fallback
+}
+
+func (sh *shellState) startFallback() {
+	sh.fallback = true
+	sh.fellBack = true
+}
+
+func (sh *shellState) finish(exitCode int) ShellCommand {
+	cmd := ShellCommand{
+		Command:  sh.command,
+		Output:   parseShellOutput(sh.outBuf.Bytes()),
+		ExitCode: exitCode,
+		Start:    sh.start,
+		Duration: time.Since(sh.start),
+		Fallback: sh.fellBack,
+	}
+	sh.command = ""
+	sh.fellBack = false
+	sh.outBuf.Reset()
+	if sh.outBuf.Cap() > maxBufSize {
+		sh.outBuf = bytes.Buffer{}
+	}
+	return cmd
+}
+
+// parseShellInput 多行命令和 heredoc 的后续行以 PS2 (默认 "> ") 开始
+func parseShellInput(p []byte) string {
+	lines := parseShellRows(p)
+	for i := 1; i < len(lines); i++ {
+		lines[i] = strings.TrimPrefix(strings.TrimPrefix(lines[i], ">"), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func parseShellOutput(p []byte) string {
+	var str strings.Builder
+	for _, line := range parseShellRows(p) {
+		if str.Len() >= maxBufSize {
+			break
+		}
+		str.WriteString(line)
+		str.WriteString("\n")
+	}
+	return str.String()
+}
+
+// parseShellRows ParseOutput 会忽略第一行 (命令的回显)，标记之间的数据从第一行开始都需要保留
+func parseShellRows(p []byte) []string {
+	buf := make([]byte, 0, len(p)+2)
+	buf = append(buf, "\r\n"...)
+	return terminalparser.ParseOutput(append(buf, p...))
+}
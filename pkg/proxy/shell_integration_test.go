@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/LeeEirc/terminalparser"
+)
+
+func TestOsc133Scanner_Split(t *testing.T) {
+	var scanner osc133Scanner
+	chunks := []string{
+		"root@host:~# \x1b]133;B\x07ls\r\n\x1b]13",
+		"3;C\x07a.txt\r\n\x1b]133;D;0\x1b",
+		"\\\x1b]133;A\x07root@host:~# \x1b",
+		"[0m",
+	}
+	var (
+		data    strings.Builder
+		markers []string
+	)
+	for _, chunk := range chunks {
+		for _, seg := range scanner.split([]byte(chunk)) {
+			data.Write(seg.data)
+			if seg.marker != 0 {
+				markers = append(markers, string(seg.marker)+seg.param)
+			}
+		}
+	}
+	if want := "root@host:~# ls\r\na.txt\r\nroot@host:~# \x1b[0m"; data.String() != want {
+		t.Errorf("split() data = %q, want %q", data.String(), want)
+	}
+	if got := strings.Join(markers, ","); got != "B,C,D0,A" {
+		t.Errorf("split() markers = %s, want B,C,D0,A", got)
+	}
+}
+
+func TestTerminalParser_ShellIntegration(t *testing.T) {
+	var commands []ShellCommand
+	s := &TerminalParser{Screen: terminalparser.NewScreen(24, 80), screenType: LinuxScreen}
+	s.EnableShellIntegration()
+	s.EmitShellCommand = func(cmd ShellCommand) {
+		commands = append(commands, cmd)
+	}
+	s.ShellInjected()
+
+	var shown strings.Builder
+	stream := []string{
+		"root@host:~# ",
+		" __jms_si=1; [ -n \"$BASH_VERSION\" ] && eval '...'\r\n",
+		"\x1b]133;A\x07root@host:~# \x1b]133;B\x07",
+		"cat <<EOF\r\n> hello\r\n> EOF\r\n",
+		"\x1b]133;C\x07hello\r\n\x1b]133;D;0\x07\x1b]133;A\x07root@host:~# \x1b]133;B\x07",
+		"false\r\n\x1b]133;C\x07\x1b]133;D;1\x07\x1b]133;A\x07root@host:~# \x1b]133;B\x07",
+	}
+	for _, chunk := range stream {
+		shown.Write(s.ConsumeShellMarkers([]byte(chunk)))
+	}
+	if strings.Contains(shown.String(), shellInjectToken) || strings.Contains(shown.String(), "\x1b]133") {
+		t.Errorf("injected command or markers shown: %q", shown.String())
+	}
+	if !s.ShellIntegrationActive() {
+		t.Fatal("shell integration should be active")
+	}
+	if len(commands) != 2 {
+		t.Fatalf("emit %d commands, want 2: %+v", len(commands), commands)
+	}
+	if want := "cat <<EOF\nhello\nEOF"; commands[0].Command != want || commands[0].Output != "hello\n" ||
+		commands[0].ExitCode != 0 {
+		t.Errorf("heredoc command = %+v", commands[0])
+	}
+	if commands[1].Command != "false" || commands[1].Output != "" || commands[1].ExitCode != 1 {
+		t.Errorf("false command = %+v", commands[1])
+	}
+	if _, ok := s.FlushShellCommand(); ok {
+		t.Error("no running command to flush")
+	}
+}
+
+func TestTerminalParser_ShellIntegrationFallback(t *testing.T) {
+	var commands []ShellCommand
+	s := &TerminalParser{Screen: terminalparser.NewScreen(24, 80), screenType: LinuxScreen}
+	s.EnableShellIntegration()
+	s.EmitShellCommand = func(cmd ShellCommand) {
+		commands = append(commands, cmd)
+	}
+	enter := func() {
+		s.mux.Lock()
+		s.shellEnter()
+		s.mux.Unlock()
+	}
+	feed := func(chunk string) {
+		s.ConsumeShellMarkers([]byte(chunk))
+	}
+
+	// 嵌套的 shell 没有标记，命令执行中用户回车后使用提示符匹配
+	feed("\x1b]133;A\x07root@host:~# \x1b]133;B\x07bash\r\n\x1b]133;C\x07root@host:~# ")
+	if !s.ShellIntegrationActive() {
+		t.Fatal("shell integration should be active")
+	}
+	enter()
+	if s.ShellIntegrationActive() || s.ShellCommandRunning() {
+		t.Fatal("input without markers should fall back to prompt parsing")
+	}
+	feed("rm x\r\nroot@host:~# exit\r\n\x1b]133;D;0\x07\x1b]133;A\x07root@host:~# \x1b]133;B\x07")
+	if !s.ShellIntegrationActive() {
+		t.Fatal("shell integration should be active after B marker")
+	}
+	if len(commands) != 1 || commands[0].Command != "bash" || !commands[0].Fallback {
+		t.Fatalf("nested shell command = %+v", commands)
+	}
+
+	// unset PROMPT_COMMAND 之后没有 D 标记
+	feed("ls\r\n\x1b]133;C\x07a.txt\r\nroot@host:~# \x1b]133;B\x07")
+	if len(commands) != 2 || commands[1].Command != "ls" || commands[1].ExitCode != -1 || commands[1].Fallback {
+		t.Fatalf("command without D marker = %+v", commands)
+	}
+
+	// 没有 B 标记的 C 标记
+	feed("\x1b]133;D;0\x07\x1b]133;C\x07")
+	if s.ShellIntegrationActive() {
+		t.Fatal("C marker without B marker should fall back to prompt parsing")
+	}
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+var (
+	envelopeKeyOnce sync.Once
+	envelopeKey     *utils.EnvelopeKey
+	envelopeKeyErr  error
+)
+
+func getEnvelopeKey() (*utils.EnvelopeKey, error) {
+	envelopeKeyOnce.Do(func() {
+		conf := config.GetConf()
+		envelopeKey, envelopeKeyErr = utils.LoadEnvelopeKey(conf.SecretEncryptKey, conf.StorageEncryptKeyFile)
+		if envelopeKeyErr == nil {
+			logger.Infof("Storage encrypt key loaded, key id %s", envelopeKey.ID)
+		}
+	})
+	return envelopeKey, envelopeKeyErr
+}
+
+// wrapEncryptStorage 开启存储加密时，录像和文件上传到外部存储前先加密
+func wrapEncryptStorage(s Storage) Storage {
+	if s == nil || !config.GetConf().StorageEncryptEnabled {
+		return s
+	}
+	if s.TypeName() == "null" {
+		return s
+	}
+	return EncryptStorage{Storage: s}
+}
+
+// EncryptStorage 上传前使用信封加密，对象名称不变，文件头标记了加密算法和密钥 id
+type EncryptStorage struct {
+	Storage
+}
+
+func (e EncryptStorage) Upload(gZipFile, target string) error {
+	if utils.IsEncryptedFile(gZipFile) {
+		return e.Storage.Upload(gZipFile, target)
+	}
+	key, err := getEnvelopeKey()
+	if err != nil {
+		// 返回错误，文件保留在本地由上传队列重试
+		return err
+	}
+	tmpFile, err := os.CreateTemp("", filepath.Base(gZipFile)+".*.enc")
+	if err != nil {
+		return err
+	}
+	encryptedPath := tmpFile.Name()
+	_ = tmpFile.Close()
+	defer os.Remove(encryptedPath)
+	if err = utils.EncryptFile(gZipFile, encryptedPath, key); err != nil {
+		return err
+	}
+	return e.Storage.Upload(encryptedPath, target)
+}
+
+func storageEncryptEnabled() bool {
+	return config.GetConf().StorageEncryptEnabled
+}
+
+// sealLocalFile 开启存储加密时，上传失败保留在本地的文件也加密保存，不能再上传到 server 存储
+func sealLocalFile(path string) {
+	if !storageEncryptEnabled() || utils.IsEncryptedFile(path) {
+		return
+	}
+	key, err := getEnvelopeKey()
+	if err != nil {
+		logger.Errorf("Encrypt local file %s failed: %s", path, err)
+		return
+	}
+	encryptedPath := path + ".enc"
+	if err = utils.EncryptFile(path, encryptedPath, key); err != nil {
+		logger.Errorf("Encrypt local file %s failed: %s", path, err)
+		_ = os.Remove(encryptedPath)
+		return
+	}
+	if err = os.Rename(encryptedPath, path); err != nil {
+		logger.Errorf("Encrypt local file %s failed: %s", path, err)
+		_ = os.Remove(encryptedPath)
+	}
+}
+
+var ErrPlaintextUpload = errors.New("storage encrypt enabled, refuse to upload plaintext to unencrypted storage")
+
+/*
+UploadFile 本地已加密的文件上传到不加密的存储 (例如 server 存储):
+开启存储加密时不能以明文上传，返回错误，文件保留在上传队列中，等待存储配置改为外部存储后重试；
+关闭存储加密后才解密上传。
+*/
+func UploadFile(st Storage, path, target string) error {
+	if _, ok := st.(EncryptStorage); ok || !utils.IsEncryptedFile(path) {
+		return st.Upload(path, target)
+	}
+	if storageEncryptEnabled() {
+		return fmt.Errorf("%w: %s", ErrPlaintextUpload, st.TypeName())
+	}
+	logger.Warnf("Storage encrypt disabled, upload decrypted file %s to %s storage", path, st.TypeName())
+	key, err := getEnvelopeKey()
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp("", filepath.Base(path)+".*.dec")
+	if err != nil {
+		return err
+	}
+	decryptedPath := tmpFile.Name()
+	_ = tmpFile.Close()
+	defer os.Remove(decryptedPath)
+	if err = utils.DecryptFile(path, decryptedPath, key); err != nil {
+		return err
+	}
+	return st.Upload(decryptedPath, target)
+}
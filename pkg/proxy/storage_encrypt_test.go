@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+type fakeUploadStorage struct {
+	uploaded []string
+}
+
+func (f *fakeUploadStorage) Upload(gZipFile, target string) error {
+	f.uploaded = append(f.uploaded, target)
+	return nil
+}
+
+func (f *fakeUploadStorage) TypeName() string {
+	return "server"
+}
+
+func TestUploadFile_RefusePlaintext(t *testing.T) {
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "sid.cast")
+	encryptedPath := filepath.Join(dir, "sid.cast.gz")
+	if err := os.WriteFile(plainPath, []byte("replay"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.EncryptFile(plainPath, encryptedPath, utils.NewEnvelopeKey([]byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+	old := config.GlobalConfig
+	defer func() { config.GlobalConfig = old }()
+	conf := config.GetConf()
+	conf.StorageEncryptEnabled = true
+	config.GlobalConfig = &conf
+
+	st := &fakeUploadStorage{}
+	if err := UploadFile(st, encryptedPath, "2024-01-01/sid.cast.gz"); !errors.Is(err, ErrPlaintextUpload) {
+		t.Fatalf("expected plaintext upload refused, got %v", err)
+	}
+	if len(st.uploaded) != 0 {
+		t.Fatalf("unexpected uploaded %v", st.uploaded)
+	}
+}
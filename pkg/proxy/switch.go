@@ -11,8 +11,10 @@ import (
 
 	"github.com/jumpserver-dev/sdk-go/common"
 	"github.com/jumpserver-dev/sdk-go/model"
+	"github.com/jumpserver/koko/pkg/audit"
 	"github.com/jumpserver/koko/pkg/exchange"
 	"github.com/jumpserver/koko/pkg/logger"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
 	"github.com/jumpserver/koko/pkg/srvconn"
 	"github.com/jumpserver/koko/pkg/utils"
 	"github.com/jumpserver/koko/pkg/zmodem"
@@ -141,7 +143,7 @@ func (s *SwitchSession) recordCommand(cmdRecordChan chan *ExecutedCommand) {
 }
 
 // generateCommandResult 生成命令结果
-func (s *SwitchSession) generateCommandResult(item *ExecutedCommand) *model.Command {
+func (s *SwitchSession) generateCommandResult(item *ExecutedCommand) *storage.Command {
 	var (
 		input  string
 		output string
@@ -174,6 +176,13 @@ func (s *SwitchSession) Bridge(userConn UserConnection, srvConn srvconn.ServerCo
 	// 处理数据流
 	userOutChan, srvOutChan := parser.ParseStream(userInputMessageChan, srvInChan)
 	parser.SetUserInputFilter(s.filterUserInput)
+	if ReplayRecordInputEnabled() {
+		parser.SetUserInputRecorder(func(p []byte, meta exchange.MetaMessage) {
+			if parser.NeedRecord() {
+				replayRecorder.RecordInput(p, meta.User)
+			}
+		})
+	}
 
 	defer func() {
 		close(done)
@@ -215,7 +224,7 @@ func (s *SwitchSession) Bridge(userConn UserConnection, srvConn srvconn.ServerCo
 			nr, err2 := srvConn.Read(buf)
 			validBytes := buf[:nr]
 			if nr > 0 {
-				isZmodem := parser.zmodemParser.IsStartSession()
+				isZmodem := parser.IsInZmodemRecvState()
 				if !isZmodem {
 					bufferLen := buffer.Len()
 					if bufferLen > 0 || nr == maxLen {
@@ -272,19 +281,23 @@ func (s *SwitchSession) Bridge(userConn UserConnection, srvConn srvconn.ServerCo
 		Event: exchange.ShareJoin,
 		Meta:  meta,
 	})
-	if parser.zmodemParser != nil {
-		parser.zmodemParser.FireStatusEvent = func(event zmodem.StatusEvent) {
-			msg := exchange.RoomMessage{Event: exchange.ActionEvent}
-			switch event {
-			case zmodem.StartEvent:
-				msg.Body = []byte(exchange.ZmodemStartEvent)
-			case zmodem.EndEvent:
-				msg.Body = []byte(exchange.ZmodemEndEvent)
-			default:
-				msg.Body = []byte(event)
-			}
-			room.Broadcast(&msg)
+	fireStatusEvent := func(event zmodem.StatusEvent) {
+		msg := exchange.RoomMessage{Event: exchange.ActionEvent}
+		switch event {
+		case zmodem.StartEvent:
+			msg.Body = []byte(exchange.ZmodemStartEvent)
+		case zmodem.EndEvent:
+			msg.Body = []byte(exchange.ZmodemEndEvent)
+		default:
+			msg.Body = []byte(event)
 		}
+		room.Broadcast(&msg)
+	}
+	if parser.zmodemParser != nil {
+		parser.zmodemParser.FireStatusEvent = fireStatusEvent
+	}
+	if parser.trzszParser != nil {
+		parser.trzszParser.FireStatusEvent = fireStatusEvent
 	}
 	go func() {
 		for {
@@ -347,6 +360,7 @@ func (s *SwitchSession) Bridge(userConn UserConnection, srvConn srvconn.ServerCo
 				return
 			}
 			_ = srvConn.SetWinSize(win.Width, win.Height)
+			replayRecorder.RecordResize(win.Width, win.Height)
 			logger.Infof("Session[%s] Window server change: %d*%d",
 				s.ID, win.Width, win.Height)
 			p, _ := json.Marshal(win)
@@ -403,6 +417,7 @@ func (s *SwitchSession) Bridge(userConn UserConnection, srvConn srvconn.ServerCo
 	}
 }
 func (s *SwitchSession) disconnection(room *exchange.Room, parser *Parser, replayRecorder *ReplyRecorder, msg string) {
+	replayRecorder.RecordMarker(msg)
 	msg = utils.WrapperWarn(msg)
 	replayRecorder.Record([]byte(msg))
 
@@ -419,7 +434,7 @@ func (s *SwitchSession) disconnection(room *exchange.Room, parser *Parser, repla
 
 func (s *SwitchSession) recordSessionFinished(reason model.SessionLifecycleReasonErr) {
 	logObj := model.SessionLifecycleLog{Reason: string(reason)}
-	if err := s.p.jmsService.RecordSessionLifecycleLog(s.ID, model.AssetConnectFinished, logObj); err != nil {
+	if err := audit.RecordSessionLifecycleLog(s.p.jmsService, s.ID, model.AssetConnectFinished, logObj); err != nil {
 		logger.Errorf("Session[%s] record session asset_connect_finished failed: %s", s.ID, err)
 	}
 }
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"reflect"
+	"sync/atomic"
+
+	"github.com/jumpserver-dev/sdk-go/service"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+core 下发的终端配置中，sdk 的 TerminalConfig 没有的字段，单独解析同一个接口:
+	TERMINAL_REPLAY_RECORD_INPUT 录像中是否记录用户输入，没有下发时使用本地配置 REPLAY_RECORD_INPUT
+	TERMINAL_OUTPUT_FILTER_RULES 服务器输出的过滤规则
+*/
+
+// TerminalConfigExt sdk 的 TerminalConfig 之外的终端配置
+type TerminalConfigExt struct {
+	ReplayRecordInput *bool              `json:"TERMINAL_REPLAY_RECORD_INPUT"`
+	OutputFilterRules []OutputFilterRule `json:"TERMINAL_OUTPUT_FILTER_RULES"`
+}
+
+var terminalConfigExt atomic.Pointer[TerminalConfigExt]
+
+// FetchTerminalConfigExt 获取 sdk 的 TerminalConfig 之外的终端配置
+func FetchTerminalConfigExt(jmsService *service.JMService) (TerminalConfigExt, error) {
+	var conf TerminalConfigExt
+	client := jmsService.CloneClient()
+	_, err := client.Get(service.TerminalConfigURL, &conf)
+	return conf, err
+}
+
+// UpdateTerminalConfigExt 更新配置，只对之后创建的会话生效
+func UpdateTerminalConfigExt(conf TerminalConfigExt) {
+	last := terminalConfigExt.Swap(&conf)
+	if last == nil || !reflect.DeepEqual(last.OutputFilterRules, conf.OutputFilterRules) {
+		updateOutputFilterRules(conf.OutputFilterRules)
+		logger.Infof("Update output filter rules: %d", len(conf.OutputFilterRules))
+	}
+}
+
+// ReplayRecordInputEnabled 录像中是否记录用户输入，优先使用 core 下发的配置
+func ReplayRecordInputEnabled() bool {
+	if conf := terminalConfigExt.Load(); conf != nil && conf.ReplayRecordInput != nil {
+		return *conf.ReplayRecordInput
+	}
+	return config.GetConf().ReplayRecordInput
+}
@@ -0,0 +1,392 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jumpserver-dev/sdk-go/model"
+	"github.com/jumpserver-dev/sdk-go/service"
+
+	"github.com/jumpserver/koko/pkg/audit"
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
+)
+
+/*
+上传队列: 录像和上传下载文件重试多次仍然失败后进入队列，按照指数退避持续重试，不需要重启 koko。
+队列状态保存在 data/upload_queue.json，重启后继续重试。
+先使用终端配置的存储，失败次数达到 UPLOAD_QUEUE_FALLBACK_ATTEMPTS 后使用 server 存储 (分段录像除外)。
+*/
+
+const (
+	UploadKindReplay     = "replay"
+	UploadKindReplayPart = "replay_part"
+	UploadKindFTPFile    = "ftp_file"
+
+	UploadStatusPending   = "pending"
+	UploadStatusUploading = "uploading"
+	UploadStatusFailed    = "failed"
+
+	uploadQueueFilename = "upload_queue.json"
+	uploadQueueInterval = 5 * time.Second
+
+	uploadMinBackoff = 30 * time.Second
+	uploadMaxBackoff = time.Hour
+
+	defaultUploadWorkers          = 2
+	defaultUploadFallbackAttempts = 5
+)
+
+type UploadItem struct {
+	Path      string    `json:"path"`
+	Target    string    `json:"target"`
+	Kind      string    `json:"kind"`
+	ObjectID  string    `json:"object_id"` // 会话 ID 或者 FTP log ID
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Fallback  bool      `json:"fallback"` // 使用 server 存储
+	LastError string    `json:"last_error,omitempty"`
+	NextRetry time.Time `json:"next_retry"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type UploadQueueStatus struct {
+	Pending   int          `json:"pending"`
+	Uploading int          `json:"uploading"`
+	Failed    int          `json:"failed"`
+	Items     []UploadItem `json:"items"`
+}
+
+var (
+	uploadQueueLock sync.Mutex
+	uploadQueue     *UploadQueue
+)
+
+// StartUploadQueue 加载保存的队列并启动上传任务
+func StartUploadQueue(jmsService *service.JMService) *UploadQueue {
+	uploadQueueLock.Lock()
+	defer uploadQueueLock.Unlock()
+	if uploadQueue != nil {
+		return uploadQueue
+	}
+	conf := config.GetConf()
+	q := &UploadQueue{
+		jmsService:       jmsService,
+		statePath:        filepath.Join(conf.DataFolderPath, uploadQueueFilename),
+		workers:          conf.UploadQueueWorkers,
+		fallbackAttempts: conf.UploadQueueFallbackAttempts,
+		items:            make(map[string]*UploadItem),
+	}
+	if q.workers <= 0 {
+		q.workers = defaultUploadWorkers
+	}
+	if q.fallbackAttempts <= 0 {
+		q.fallbackAttempts = defaultUploadFallbackAttempts
+	}
+	q.tasks = make(chan string, q.workers)
+	q.load()
+	for i := 0; i < q.workers; i++ {
+		go q.worker()
+	}
+	go q.schedule()
+	uploadQueue = q
+	return q
+}
+
+// GetUploadQueue 上传队列未启动时返回 nil
+func GetUploadQueue() *UploadQueue {
+	uploadQueueLock.Lock()
+	defer uploadQueueLock.Unlock()
+	return uploadQueue
+}
+
+// GetUploadQueueStatus 上传队列未启动时返回 nil
+func GetUploadQueueStatus() *UploadQueueStatus {
+	q := GetUploadQueue()
+	if q == nil {
+		return nil
+	}
+	status := q.Status()
+	return &status
+}
+
+type UploadQueue struct {
+	jmsService       *service.JMService
+	statePath        string
+	workers          int
+	fallbackAttempts int
+
+	lock  sync.Mutex
+	items map[string]*UploadItem
+	tasks chan string
+}
+
+// Enqueue 同一个文件只保留一条记录
+func (q *UploadQueue) Enqueue(item UploadItem) {
+	now := time.Now()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if exist, ok := q.items[item.Path]; ok {
+		exist.Fallback = exist.Fallback || item.Fallback
+		if exist.LastError == "" {
+			exist.LastError = item.LastError
+		}
+		q.save()
+		return
+	}
+	if item.Status == "" {
+		item.Status = UploadStatusPending
+	}
+	if item.NextRetry.IsZero() {
+		item.NextRetry = now.Add(uploadMinBackoff)
+	}
+	item.CreatedAt = now
+	item.UpdatedAt = now
+	q.items[item.Path] = &item
+	logger.Infof("Upload queue add %s %s, next retry at %s", item.Kind, item.Path,
+		item.NextRetry.Format(time.RFC3339))
+	q.save()
+}
+
+func (q *UploadQueue) Has(path string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	_, ok := q.items[path]
+	return ok
+}
+
+func (q *UploadQueue) Status() UploadQueueStatus {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	status := UploadQueueStatus{Items: make([]UploadItem, 0, len(q.items))}
+	for _, item := range q.items {
+		switch item.Status {
+		case UploadStatusUploading:
+			status.Uploading++
+		case UploadStatusFailed:
+			status.Failed++
+		default:
+			status.Pending++
+		}
+		status.Items = append(status.Items, *item)
+	}
+	sort.Slice(status.Items, func(i, j int) bool {
+		return status.Items[i].CreatedAt.Before(status.Items[j].CreatedAt)
+	})
+	return status
+}
+
+func (q *UploadQueue) schedule() {
+	tick := time.NewTicker(uploadQueueInterval)
+	defer tick.Stop()
+	for range tick.C {
+		for _, path := range q.dueItems() {
+			q.tasks <- path
+		}
+	}
+}
+
+// dueItems 每次最多取 workers 个到期的任务
+func (q *UploadQueue) dueItems() []string {
+	now := time.Now()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	due := make([]*UploadItem, 0, q.workers)
+	for _, item := range q.items {
+		if item.Status == UploadStatusUploading || now.Before(item.NextRetry) {
+			continue
+		}
+		due = append(due, item)
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextRetry.Before(due[j].NextRetry)
+	})
+	if len(due) > q.workers {
+		due = due[:q.workers]
+	}
+	paths := make([]string, 0, len(due))
+	for _, item := range due {
+		item.Status = UploadStatusUploading
+		paths = append(paths, item.Path)
+	}
+	return paths
+}
+
+func (q *UploadQueue) worker() {
+	for path := range q.tasks {
+		q.process(path)
+	}
+}
+
+func (q *UploadQueue) process(path string) {
+	q.lock.Lock()
+	itemPtr, ok := q.items[path]
+	if !ok {
+		q.lock.Unlock()
+		return
+	}
+	item := *itemPtr
+	q.lock.Unlock()
+
+	stat, err := os.Stat(item.Path)
+	if err != nil {
+		// 文件已被清理或者删除
+		logger.Errorf("Upload queue drop %s: %s", item.Path, err)
+		q.remove(item.Path)
+		return
+	}
+	st, err := q.getStorage(item)
+	if err == nil {
+		sig := signFile(item.Path, item.Target)
+		logger.Infof("Upload queue upload %s %s, attempts %d, type: %s", item.Kind, item.Path,
+			item.Attempts+1, st.TypeName())
+		if err = UploadFile(st, item.Path, item.Target); err == nil {
+			storeSignature(st, sig)
+			q.finish(item, stat.Size())
+			return
+		}
+	}
+	logger.Errorf("Upload queue upload %s failed: %s", item.Path, err)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	itemPtr, ok = q.items[path]
+	if !ok {
+		return
+	}
+	itemPtr.Attempts++
+	itemPtr.Status = UploadStatusFailed
+	itemPtr.LastError = err.Error()
+	itemPtr.UpdatedAt = time.Now()
+	itemPtr.NextRetry = itemPtr.UpdatedAt.Add(uploadBackoff(itemPtr.Attempts))
+	// 分段录像和开启存储加密时不切换 server 存储
+	if itemPtr.Kind != UploadKindReplayPart && !storageEncryptEnabled() &&
+		(itemPtr.Attempts >= q.fallbackAttempts || errors.Is(err, storage.ErrLocalRootUnavailable)) {
+		itemPtr.Fallback = true
+	}
+	q.save()
+}
+
+// getStorage 每次都获取最新的终端配置，存储配置修改后立即生效
+func (q *UploadQueue) getStorage(item UploadItem) (Storage, error) {
+	if item.Fallback {
+		if item.Kind == UploadKindFTPFile {
+			return storage.FTPServerStorage{StorageType: "server", JmsService: q.jmsService}, nil
+		}
+		return storage.ServerStorage{StorageType: "server", JmsService: q.jmsService}, nil
+	}
+	conf, err := q.jmsService.GetTerminalConfig()
+	if err != nil {
+		return nil, err
+	}
+	if item.Kind == UploadKindFTPFile {
+		return NewFTPFileStorage(q.jmsService, &conf), nil
+	}
+	return NewReplayStorage(q.jmsService, &conf), nil
+}
+
+func (q *UploadQueue) finish(item UploadItem, size int64) {
+	_ = os.Remove(item.Path)
+	q.remove(item.Path)
+	logger.Infof("Upload queue upload %s %s success", item.Kind, item.Path)
+	switch item.Kind {
+	case UploadKindReplay:
+		if _, err := q.jmsService.FinishReplyWithSize(item.ObjectID, size); err != nil {
+			logger.Errorf("Session[%s] finish replay err: %s", item.ObjectID, err)
+		}
+		eventLog := model.SessionLifecycleLog{}
+		if err := audit.RecordSessionLifecycleLog(q.jmsService, item.ObjectID,
+			model.ReplayUploadSuccess, eventLog); err != nil {
+			logger.Errorf("Update session %s activity log failed: %s", item.ObjectID, err)
+		}
+	case UploadKindFTPFile:
+		if err := q.jmsService.FinishFTPFile(item.ObjectID); err != nil {
+			logger.Errorf("FTP file %s upload failed: %s", item.ObjectID, err)
+		}
+	}
+}
+
+func (q *UploadQueue) remove(path string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.items, path)
+	q.save()
+}
+
+func (q *UploadQueue) load() {
+	raw, err := os.ReadFile(q.statePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("Read upload queue %s failed: %s", q.statePath, err)
+		}
+		return
+	}
+	var items []UploadItem
+	if err = json.Unmarshal(raw, &items); err != nil {
+		logger.Errorf("Parse upload queue %s failed: %s", q.statePath, err)
+		return
+	}
+	for i := range items {
+		item := items[i]
+		if _, err1 := os.Stat(item.Path); err1 != nil {
+			continue
+		}
+		// 上一次退出时正在上传的任务重新开始
+		if item.Status == UploadStatusUploading {
+			item.Status = UploadStatusPending
+		}
+		q.items[item.Path] = &item
+	}
+	logger.Infof("Upload queue loaded %d items", len(q.items))
+}
+
+// save 调用方持有锁
+func (q *UploadQueue) save() {
+	items := make([]UploadItem, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, *item)
+	}
+	raw, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		logger.Errorf("Marshal upload queue failed: %s", err)
+		return
+	}
+	tmpPath := q.statePath + ".tmp"
+	if err = os.WriteFile(tmpPath, raw, 0600); err == nil {
+		err = os.Rename(tmpPath, q.statePath)
+	}
+	if err != nil {
+		logger.Errorf("Save upload queue %s failed: %s", q.statePath, err)
+	}
+}
+
+func uploadBackoff(attempts int) time.Duration {
+	backoff := uploadMinBackoff
+	for i := 1; i < attempts && backoff < uploadMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > uploadMaxBackoff {
+		backoff = uploadMaxBackoff
+	}
+	return backoff
+}
+
+// enqueueUpload 上传队列未启动时返回 false，由调用方按照原来的方式处理
+func enqueueUpload(item UploadItem, err error) bool {
+	q := GetUploadQueue()
+	if q == nil {
+		return false
+	}
+	if err != nil {
+		item.LastError = strings.TrimSpace(err.Error())
+	}
+	q.Enqueue(item)
+	return true
+}
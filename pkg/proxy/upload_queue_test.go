@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		0:  30 * time.Second,
+		1:  30 * time.Second,
+		2:  time.Minute,
+		4:  4 * time.Minute,
+		8:  time.Hour,
+		30: time.Hour,
+	}
+	for attempts, want := range cases {
+		if got := uploadBackoff(attempts); got != want {
+			t.Errorf("uploadBackoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestUploadQueuePersist(t *testing.T) {
+	dir := t.TempDir()
+	replayPath := filepath.Join(dir, "sid.cast.gz")
+	if err := os.WriteFile(replayPath, []byte("replay"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(dir, uploadQueueFilename)
+	q := &UploadQueue{statePath: statePath, workers: 1, items: make(map[string]*UploadItem)}
+	q.Enqueue(UploadItem{Path: replayPath, Target: "2024-01-01/sid.cast.gz", Kind: UploadKindReplay, ObjectID: "sid"})
+	q.Enqueue(UploadItem{Path: replayPath, Kind: UploadKindReplay, Fallback: true})
+	q.Enqueue(UploadItem{Path: filepath.Join(dir, "missing.cast.gz"), Kind: UploadKindReplay})
+	q.items[replayPath].Status = UploadStatusUploading
+	q.lock.Lock()
+	q.save()
+	q.lock.Unlock()
+
+	// 重新加载时丢弃已不存在的文件，正在上传的任务重新开始
+	loaded := &UploadQueue{statePath: statePath, workers: 1, items: make(map[string]*UploadItem)}
+	loaded.load()
+	status := loaded.Status()
+	if len(status.Items) != 1 || status.Pending != 1 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	item := status.Items[0]
+	if item.Target != "2024-01-01/sid.cast.gz" || !item.Fallback || item.Status != UploadStatusPending {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+	if paths := loaded.dueItems(); len(paths) != 0 {
+		t.Fatalf("item should not be due before next retry: %v", paths)
+	}
+}
@@ -3,9 +3,13 @@ package proxy
 import (
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver-dev/sdk-go/service"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
 	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
 )
 
@@ -27,7 +31,7 @@ type FTPFileStorage interface {
 }
 
 type CommandStorage interface {
-	BulkSave(commands []*model.Command) error
+	BulkSave(commands []*storage.Command) error
 	StorageType
 }
 
@@ -120,6 +124,13 @@ func GetStorage(conf *model.TerminalConfig) Storage {
 			AccessKey: accessKey,
 			SecretKey: secretKey,
 		}
+	case "local":
+		root := config.GetConf().LocalStorageRoot
+		if root == "" {
+			logger.Errorf("Local replay storage root is empty, please set LOCAL_STORAGE_ROOT")
+			return nil
+		}
+		return storage.LocalStorage{Root: root}
 	case "null":
 		return storage.NewNullStorage()
 	default:
@@ -128,7 +139,7 @@ func GetStorage(conf *model.TerminalConfig) Storage {
 }
 
 func NewReplayStorage(jmsService *service.JMService, conf *model.TerminalConfig) ReplayStorage {
-	replayStorage := GetStorage(conf)
+	replayStorage := wrapEncryptStorage(GetStorage(conf))
 	if replayStorage == nil {
 		replayStorage = storage.ServerStorage{StorageType: "server", JmsService: jmsService}
 	}
@@ -136,7 +147,7 @@ func NewReplayStorage(jmsService *service.JMService, conf *model.TerminalConfig)
 }
 
 func NewFTPFileStorage(jmsService *service.JMService, conf *model.TerminalConfig) FTPFileStorage {
-	ftpStorage := GetStorage(conf)
+	ftpStorage := wrapEncryptStorage(GetStorage(conf))
 	if ftpStorage == nil {
 		ftpStorage = storage.FTPServerStorage{StorageType: "server", JmsService: jmsService}
 	}
@@ -144,8 +155,16 @@ func NewFTPFileStorage(jmsService *service.JMService, conf *model.TerminalConfig
 }
 
 func NewCommandStorage(jmsService *service.JMService, conf *model.TerminalConfig) CommandStorage {
+	primary := newCommandStorageByType(jmsService, conf, conf.CommandStorage.TypeName)
+	extraTypes := config.GetConf().CommandStorageExtra
+	if len(extraTypes) == 0 && !needBacklog(primary) {
+		return primary
+	}
+	return getMultiCommandStorage(jmsService, conf, primary, extraTypes)
+}
+
+func newCommandStorageByType(jmsService *service.JMService, conf *model.TerminalConfig, tp string) CommandStorage {
 	cf := conf.CommandStorage
-	tp := cf.TypeName
 	if tp == "" {
 		tp = "server"
 	}
@@ -209,6 +228,17 @@ func NewCommandStorage(jmsService *service.JMService, conf *model.TerminalConfig
 			Measurement: measurement,
 		}
 
+	case "webhook":
+		if webhookStorage := GetWebhookStorage(); webhookStorage != nil {
+			return webhookStorage
+		}
+		return storage.ServerStorage{StorageType: "server", JmsService: jmsService}
+	case "syslog":
+		if syslogStorage := GetSyslogStorage(); syslogStorage != nil {
+			return syslogStorage
+		}
+		logger.Errorf("Syslog command storage address is empty, please set SYSLOG_ADDRESS")
+		return storage.ServerStorage{StorageType: "server", JmsService: jmsService}
 	case "null":
 		return storage.NewNullStorage()
 	default:
@@ -216,6 +246,56 @@ func NewCommandStorage(jmsService *service.JMService, conf *model.TerminalConfig
 	}
 }
 
+var (
+	webhookStorageOnce sync.Once
+	webhookStorage     *storage.WebhookStorage
+)
+
+// GetWebhookStorage 未配置地址或者模板错误时返回 nil
+func GetWebhookStorage() *storage.WebhookStorage {
+	webhookStorageOnce.Do(func() {
+		conf := config.GetConf()
+		if conf.WebhookURL == "" {
+			logger.Errorf("Webhook command storage url is empty, please set WEBHOOK_URL")
+			return
+		}
+		st, err := storage.NewWebhookStorage(storage.WebhookOptions{
+			URL:                conf.WebhookURL,
+			Method:             conf.WebhookMethod,
+			Format:             conf.WebhookFormat,
+			BodyTemplate:       conf.WebhookBodyTemplate,
+			Headers:            conf.WebhookHeaders,
+			Secret:             conf.WebhookSecret,
+			BatchSize:          conf.WebhookBatchSize,
+			InsecureSkipVerify: conf.WebhookInsecureSkipVerify,
+		})
+		if err != nil {
+			logger.Errorf("Webhook command storage init failed: %s", err)
+			return
+		}
+		webhookStorage = st
+	})
+	return webhookStorage
+}
+
+var (
+	syslogStorageOnce sync.Once
+	syslogStorage     *storage.SyslogStorage
+)
+
+// GetSyslogStorage 所有会话共用一个 syslog 连接，未配置地址时返回 nil
+func GetSyslogStorage() *storage.SyslogStorage {
+	syslogStorageOnce.Do(func() {
+		conf := config.GetConf()
+		if conf.SyslogAddress == "" {
+			return
+		}
+		syslogStorage = storage.NewSyslogStorage(conf.SyslogNetwork, conf.SyslogAddress,
+			conf.SyslogFormat, conf.SyslogInsecureSkipVerify)
+	})
+	return syslogStorage
+}
+
 func ParseEndpointRegion(s string) string {
 	if strings.Contains(s, amazonawsSuffix) {
 		return ParseAWSURLRegion(s)
@@ -0,0 +1,724 @@
+package rsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+)
+
+/*
+只解析发送端发送的文件列表，不解析后面的文件内容 (增量传输的数据无法还原文件)。
+支持协议版本 30 和 31 (rsync 3.x)，需要关闭增量递归，保证文件列表在传输开始前发送完整。
+
+握手:
+	双方发送 int32 协议版本，取较小的一个
+	资产发送 varint 兼容标志 (协议 >= 30)
+	兼容标志包含 CF_VARINT_FLIST_FLAGS 时双方发送 checksum 和 compress 算法列表 (vstring)
+	资产发送 int32 checksum seed
+之后发送端的数据使用多路复用，MSG_DATA 中依次是过滤规则 (接收端需要时) 和文件列表。
+*/
+
+const (
+	minProtocol = 30
+
+	cfIncRecurse        = 1 << 0
+	cfVarintFlistFlags  = 1 << 7
+	mplexBase           = 7
+	msgData             = 0
+	maxFilterRuleLength = 64 * 1024
+
+	xmitTopDir           = 1 << 0
+	xmitSameMode         = 1 << 1
+	xmitExtendedFlags    = 1 << 2
+	xmitSameUID          = 1 << 3
+	xmitSameGID          = 1 << 4
+	xmitSameName         = 1 << 5
+	xmitLongName         = 1 << 6
+	xmitSameTime         = 1 << 7
+	xmitSameRdevMajor    = 1 << 8
+	xmitHlinked          = 1 << 9
+	xmitUserNameFollows  = 1 << 10
+	xmitGroupNameFollows = 1 << 11
+	xmitHlinkFirst       = 1 << 12
+	xmitIOErrorEndList   = 1 << 12
+	xmitModNsec          = 1 << 13
+	xmitSameAtime        = 1 << 14
+	xmitCrtimeEqMtime    = 1 << 17
+
+	sIFMT   = 0170000
+	sIFDIR  = 0040000
+	sIFREG  = 0100000
+	sIFLNK  = 0120000
+	sIFCHR  = 0020000
+	sIFBLK  = 0060000
+	sIFIFO  = 0010000
+	sIFSOCK = 0140000
+
+	handshakeTimeout = 30 * time.Second
+)
+
+var ErrUnsupported = errors.New("rsync: unsupported protocol")
+
+type Entry struct {
+	Name    string // 相对传输目录的名称
+	Path    string // 资产上的路径
+	Size    int64
+	Mode    uint32
+	ModTime time.Time
+	Link    string
+}
+
+func (e *Entry) IsDir() bool {
+	return e.Mode&sIFMT == sIFDIR
+}
+
+func (e *Entry) IsRegular() bool {
+	return e.Mode&sIFMT == sIFREG
+}
+
+func (e *Entry) IsLink() bool {
+	return e.Mode&sIFMT == sIFLNK
+}
+
+func NewParser(cmd Command) *Parser {
+	p := &Parser{
+		cmd:           cmd,
+		clientVersion: make(chan struct{}),
+		compatFlags:   make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	p.client = newTap(func(r *bufio.Reader) {
+		defer p.clientOnce.Do(func() { close(p.clientVersion) })
+		if err := p.parseClient(r); err != nil {
+			p.setErr(err)
+		}
+	})
+	p.server = newTap(func(r *bufio.Reader) {
+		defer p.compatOnce.Do(func() { close(p.compatFlags) })
+		if err := p.parseServer(r); err != nil {
+			p.setErr(err)
+		}
+	})
+	go p.wait()
+	return p
+}
+
+// Parser 同时接收两个方向的数据，协议的握手信息分布在两个方向
+type Parser struct {
+	cmd Command
+
+	client *tap
+	server *tap
+
+	// 握手信息解析完成或者解析失败时关闭
+	clientVersion chan struct{}
+	compatFlags   chan struct{}
+	clientOnce    sync.Once
+	compatOnce    sync.Once
+	done          chan struct{}
+
+	lock     sync.Mutex
+	protocol int32
+	remote   int32
+	compat   int32
+	entries  []Entry
+	err      error
+	finished bool
+}
+
+// ClientWriter 客户端发送给资产的数据
+func (p *Parser) ClientWriter() io.Writer {
+	return p.client
+}
+
+// ServerWriter 资产发送给客户端的数据，需要在转发给客户端之前写入
+func (p *Parser) ServerWriter() io.Writer {
+	return p.server
+}
+
+// Close 传输结束后调用，返回解析出的文件列表
+func (p *Parser) Close() ([]Entry, error) {
+	p.client.close()
+	p.server.close()
+	<-p.done
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.finished && p.err == nil {
+		p.err = io.ErrUnexpectedEOF
+	}
+	return p.entries, p.err
+}
+
+func (p *Parser) wait() {
+	<-p.client.done
+	<-p.server.done
+	close(p.done)
+}
+
+func (p *Parser) setErr(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *Parser) waitSignal(ch chan struct{}) error {
+	select {
+	case <-ch:
+		return nil
+	case <-time.After(handshakeTimeout):
+		return errors.New("rsync: handshake timeout")
+	}
+}
+
+// parseClient 客户端: 协议版本、算法列表，上传时是发送端
+func (p *Parser) parseClient(r *bufio.Reader) error {
+	version, err := readInt(r)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.remote = version
+	p.lock.Unlock()
+	p.clientOnce.Do(func() { close(p.clientVersion) })
+	if p.cmd.Mode != ModeReceiver {
+		return nil
+	}
+	if err = p.waitSignal(p.compatFlags); err != nil {
+		return err
+	}
+	if !p.negotiated() {
+		return nil
+	}
+	if err = p.readNegotiation(r); err != nil {
+		return err
+	}
+	data := newDemuxReader(r)
+	if p.cmd.Delete || p.cmd.PruneEmptyDirs {
+		if err = skipFilterList(data); err != nil {
+			return err
+		}
+	}
+	return p.readFileList(data)
+}
+
+// parseServer 资产: 协议版本、兼容标志、算法列表和 seed，下载时是发送端
+func (p *Parser) parseServer(r *bufio.Reader) error {
+	version, err := readInt(r)
+	if err != nil {
+		return err
+	}
+	if err = p.waitSignal(p.clientVersion); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	protocol := version
+	if p.remote < protocol {
+		protocol = p.remote
+	}
+	if p.cmd.Protocol > 0 && int32(p.cmd.Protocol) < protocol {
+		protocol = int32(p.cmd.Protocol)
+	}
+	p.protocol = protocol
+	p.lock.Unlock()
+	if protocol < minProtocol {
+		return fmt.Errorf("%w: version %d", ErrUnsupported, protocol)
+	}
+	compat, err := readVarint(r)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.compat = compat
+	p.lock.Unlock()
+	p.compatOnce.Do(func() { close(p.compatFlags) })
+	if compat&cfIncRecurse != 0 {
+		return fmt.Errorf("%w: incremental recursion", ErrUnsupported)
+	}
+	if reason := p.cmd.unsupported(); reason != "" {
+		return fmt.Errorf("%w: %s", ErrUnsupported, reason)
+	}
+	if err = p.readNegotiation(r); err != nil {
+		return err
+	}
+	// checksum seed
+	if _, err = readInt(r); err != nil {
+		return err
+	}
+	if p.cmd.Mode != ModeSender {
+		return nil
+	}
+	return p.readFileList(newDemuxReader(r))
+}
+
+// negotiated 资产发送了兼容标志，协议版本不支持时客户端不再解析
+func (p *Parser) negotiated() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.protocol >= minProtocol
+}
+
+func (p *Parser) varintFlags() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.compat&cfVarintFlistFlags != 0
+}
+
+// readNegotiation 兼容标志包含 CF_VARINT_FLIST_FLAGS 时发送算法列表，命令中指定了算法的不发送
+func (p *Parser) readNegotiation(r io.Reader) error {
+	if !p.varintFlags() {
+		return nil
+	}
+	if !p.cmd.ChecksumChoice {
+		if _, err := readVstring(r); err != nil {
+			return err
+		}
+	}
+	if p.cmd.Compress && !p.cmd.CompressChoice {
+		if _, err := readVstring(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Parser) readFileList(r io.Reader) error {
+	if reason := p.cmd.unsupported(); reason != "" {
+		return fmt.Errorf("%w: %s", ErrUnsupported, reason)
+	}
+	fr := &flistReader{r: r, cmd: &p.cmd, varint: p.varintFlags(), root: p.cmd.Root()}
+	for {
+		entry, end, err := fr.next()
+		if err != nil {
+			return err
+		}
+		if end {
+			break
+		}
+		p.lock.Lock()
+		p.entries = append(p.entries, entry)
+		p.lock.Unlock()
+	}
+	p.lock.Lock()
+	p.finished = true
+	p.lock.Unlock()
+	return nil
+}
+
+type flistReader struct {
+	r      io.Reader
+	cmd    *Command
+	varint bool
+	root   string
+
+	lastName  string
+	mode      uint32
+	modTime   int64
+	rdevMajor int32
+}
+
+func (f *flistReader) next() (entry Entry, end bool, err error) {
+	var flags int32
+	if f.varint {
+		if flags, err = readVarint(f.r); err != nil {
+			return
+		}
+		if flags == 0 {
+			// io_error
+			_, err = readVarint(f.r)
+			return entry, true, err
+		}
+	} else {
+		var b byte
+		if b, err = readByte(f.r); err != nil {
+			return
+		}
+		if b == 0 {
+			return entry, true, nil
+		}
+		flags = int32(b)
+		if flags&xmitExtendedFlags != 0 {
+			if b, err = readByte(f.r); err != nil {
+				return
+			}
+			flags |= int32(b) << 8
+		}
+		if flags == xmitExtendedFlags|xmitIOErrorEndList {
+			_, err = readVarint(f.r)
+			return entry, true, err
+		}
+	}
+
+	var l1, l2 int32
+	if flags&xmitSameName != 0 {
+		var b byte
+		if b, err = readByte(f.r); err != nil {
+			return
+		}
+		l1 = int32(b)
+	}
+	if flags&xmitLongName != 0 {
+		if l2, err = readVarint(f.r); err != nil {
+			return
+		}
+	} else {
+		var b byte
+		if b, err = readByte(f.r); err != nil {
+			return
+		}
+		l2 = int32(b)
+	}
+	if int(l1) > len(f.lastName) || l2 < 0 || l2 > 4096 {
+		return entry, false, errors.New("rsync: invalid file name length")
+	}
+	buf := make([]byte, l2)
+	if _, err = io.ReadFull(f.r, buf); err != nil {
+		return
+	}
+	entry.Name = f.lastName[:l1] + string(buf)
+	f.lastName = entry.Name
+	entry.Path = path.Join(f.root, entry.Name)
+
+	if f.cmd.HardLinks && flags&xmitHlinked != 0 && flags&xmitHlinkFirst == 0 {
+		// 硬链接只发送第一个文件的索引，属性与第一个文件相同
+		_, err = readVarint(f.r)
+		entry.Mode = sIFREG
+		return
+	}
+
+	if entry.Size, err = readVarlong(f.r, 3); err != nil {
+		return
+	}
+	if flags&xmitSameTime == 0 {
+		if f.modTime, err = readVarlong(f.r, 4); err != nil {
+			return
+		}
+	}
+	entry.ModTime = time.Unix(f.modTime, 0)
+	if flags&xmitModNsec != 0 {
+		if _, err = readVarint(f.r); err != nil {
+			return
+		}
+	}
+	if f.cmd.Crtimes && flags&xmitCrtimeEqMtime == 0 {
+		if _, err = readVarlong(f.r, 4); err != nil {
+			return
+		}
+	}
+	if flags&xmitSameMode == 0 {
+		var mode int32
+		if mode, err = readInt(f.r); err != nil {
+			return
+		}
+		f.mode = uint32(mode)
+	}
+	entry.Mode = f.mode
+	if f.cmd.Atimes && !entry.IsDir() && flags&xmitSameAtime == 0 {
+		if _, err = readVarlong(f.r, 4); err != nil {
+			return
+		}
+	}
+	if f.cmd.PreserveUID && flags&xmitSameUID == 0 {
+		if err = f.skipID(flags&xmitUserNameFollows != 0); err != nil {
+			return
+		}
+	}
+	if f.cmd.PreserveGID && flags&xmitSameGID == 0 {
+		if err = f.skipID(flags&xmitGroupNameFollows != 0); err != nil {
+			return
+		}
+	}
+	fileType := entry.Mode & sIFMT
+	isDevice := fileType == sIFCHR || fileType == sIFBLK
+	isSpecial := fileType == sIFIFO || fileType == sIFSOCK
+	if (f.cmd.PreserveDevice && isDevice) || (f.cmd.PreserveSpec && isSpecial && f.protocol() < 31) {
+		if flags&xmitSameRdevMajor == 0 {
+			if f.rdevMajor, err = readVarint(f.r); err != nil {
+				return
+			}
+		}
+		if _, err = readVarint(f.r); err != nil {
+			return
+		}
+	}
+	if f.cmd.PreserveLinks && entry.IsLink() {
+		var length int32
+		if length, err = readVarint(f.r); err != nil {
+			return
+		}
+		if length < 0 || length > 4096 {
+			return entry, false, errors.New("rsync: invalid link length")
+		}
+		link := make([]byte, length)
+		if _, err = io.ReadFull(f.r, link); err != nil {
+			return
+		}
+		entry.Link = string(link)
+	}
+	if f.cmd.HardLinks && flags&xmitHlinked != 0 && flags&xmitHlinkFirst != 0 {
+		// 协议 30 以后第一个硬链接文件没有额外的数据
+		return
+	}
+	return
+}
+
+// protocol 设备文件的编码与协议版本有关，文件列表只在协议 30 及以上解析
+func (f *flistReader) protocol() int {
+	if f.cmd.Protocol > 0 {
+		return f.cmd.Protocol
+	}
+	return 31
+}
+
+func (f *flistReader) skipID(nameFollows bool) error {
+	if _, err := readVarint(f.r); err != nil {
+		return err
+	}
+	if !nameFollows {
+		return nil
+	}
+	length, err := readByte(f.r)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(io.Discard, f.r, int64(length))
+	return err
+}
+
+func skipFilterList(r io.Reader) error {
+	for {
+		length, err := readInt(r)
+		if err != nil {
+			return err
+		}
+		if length == 0 {
+			return nil
+		}
+		if length < 0 || length > maxFilterRuleLength {
+			return errors.New("rsync: invalid filter rule length")
+		}
+		if _, err = io.CopyN(io.Discard, r, int64(length)); err != nil {
+			return err
+		}
+	}
+}
+
+// demuxReader 只返回 MSG_DATA 中的数据，跳过其他消息
+type demuxReader struct {
+	r       io.Reader
+	remain  int
+	headBuf [4]byte
+}
+
+func newDemuxReader(r io.Reader) *demuxReader {
+	return &demuxReader{r: r}
+}
+
+func (d *demuxReader) Read(p []byte) (int, error) {
+	for d.remain == 0 {
+		if _, err := io.ReadFull(d.r, d.headBuf[:]); err != nil {
+			return 0, err
+		}
+		header := binary.LittleEndian.Uint32(d.headBuf[:])
+		tag := int(header>>24) - mplexBase
+		length := int(header & 0xffffff)
+		if tag == msgData {
+			d.remain = length
+			continue
+		}
+		if _, err := io.CopyN(io.Discard, d.r, int64(length)); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) > d.remain {
+		p = p[:d.remain]
+	}
+	n, err := d.r.Read(p)
+	d.remain -= n
+	return n, err
+}
+
+func readByte(r io.Reader) (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+func readInt(r io.Reader) (int32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return int32(binary.LittleEndian.Uint32(b[:])), nil
+}
+
+// intByteExtra 变长编码第一个字节的高位表示后面还有几个字节
+func intByteExtra(b byte) int {
+	switch {
+	case b < 0x80:
+		return 0
+	case b < 0xc0:
+		return 1
+	case b < 0xe0:
+		return 2
+	case b < 0xf0:
+		return 3
+	case b < 0xf8:
+		return 4
+	case b < 0xfc:
+		return 5
+	default:
+		return 6
+	}
+}
+
+func readVarint(r io.Reader) (int32, error) {
+	first, err := readByte(r)
+	if err != nil {
+		return 0, err
+	}
+	extra := intByteExtra(first)
+	if extra > 4 {
+		return 0, errors.New("rsync: invalid varint")
+	}
+	var b [5]byte
+	if extra == 0 {
+		b[0] = first
+	} else {
+		if _, err = io.ReadFull(r, b[:extra]); err != nil {
+			return 0, err
+		}
+		bit := byte(1) << (8 - extra)
+		b[extra] = first & (bit - 1)
+	}
+	return int32(binary.LittleEndian.Uint32(b[:4])), nil
+}
+
+func readVarlong(r io.Reader, minBytes int) (int64, error) {
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:minBytes]); err != nil {
+		return 0, err
+	}
+	var b [9]byte
+	copy(b[:], head[1:minBytes])
+	extra := intByteExtra(head[0])
+	if minBytes+extra > len(b) {
+		return 0, errors.New("rsync: invalid varlong")
+	}
+	if extra == 0 {
+		b[minBytes-1] = head[0]
+	} else {
+		if _, err := io.ReadFull(r, b[minBytes-1:minBytes-1+extra]); err != nil {
+			return 0, err
+		}
+		bit := byte(1) << (8 - extra)
+		b[minBytes+extra-1] = head[0] & (bit - 1)
+	}
+	return int64(binary.LittleEndian.Uint64(b[:8])), nil
+}
+
+func readVstring(r io.Reader) (string, error) {
+	b, err := readByte(r)
+	if err != nil {
+		return "", err
+	}
+	length := int(b)
+	if length&0x80 != 0 {
+		b2, err1 := readByte(r)
+		if err1 != nil {
+			return "", err1
+		}
+		length = (length&0x7f)<<8 | int(b2)
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+// tapBufferSize 等待解析的数据的最大长度，超过时不再解析，文件列表按照命令中的路径记录
+const tapBufferSize = 4 * 1024 * 1024
+
+var (
+	errParseDone   = errors.New("rsync: parse done")
+	errTapOverflow = errors.New("rsync: parser too slow, data dropped")
+)
+
+// tap 把数据流转成阻塞读取，写入不阻塞数据的转发，解析结束或者缓冲区满了之后丢弃后面的数据
+type tap struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	closed bool
+	err    error
+	done   chan struct{}
+}
+
+func newTap(parse func(r *bufio.Reader)) *tap {
+	t := &tap{done: make(chan struct{})}
+	t.cond = sync.NewCond(&t.lock)
+	go func() {
+		defer close(t.done)
+		parse(bufio.NewReader(t))
+		t.stop(errParseDone)
+	}()
+	return t
+}
+
+func (t *tap) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.err != nil || t.closed {
+		return len(p), nil
+	}
+	if len(t.buf)+len(p) > tapBufferSize {
+		t.err = errTapOverflow
+		t.buf = nil
+	} else {
+		t.buf = append(t.buf, p...)
+	}
+	t.cond.Signal()
+	return len(p), nil
+}
+
+func (t *tap) Read(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for len(t.buf) == 0 && t.err == nil && !t.closed {
+		t.cond.Wait()
+	}
+	if t.err != nil {
+		return 0, t.err
+	}
+	if len(t.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	if len(t.buf) == 0 {
+		t.buf = nil
+	}
+	return n, nil
+}
+
+func (t *tap) stop(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.buf = nil
+	t.cond.Broadcast()
+}
+
+func (t *tap) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	t.cond.Broadcast()
+}
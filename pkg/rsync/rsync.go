@@ -0,0 +1,235 @@
+package rsync
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+/*
+rsync over ssh: 客户端在资产上执行 rsync --server，通过 exec 通道使用 rsync 协议传输。
+
+	rsync --server [--sender] -vlogDtpre.iLsfxCIvu [--long-options] . path...
+
+有 --sender 时资产是发送端 (下载)，否则资产是接收端 (上传)。
+*/
+
+const (
+	ModeReceiver = "receiver" // 上传
+	ModeSender   = "sender"   // 下载
+)
+
+type Command struct {
+	Mode  string
+	Paths []string
+
+	// 影响文件列表格式的选项
+	Recursive      bool
+	PreserveUID    bool
+	PreserveGID    bool
+	PreserveLinks  bool
+	PreserveDevice bool
+	PreserveSpec   bool
+	HardLinks      bool
+	Checksum       bool
+	ACLs           bool
+	Xattrs         bool
+	Atimes         bool
+	Crtimes        bool
+	Compress       bool
+	Delete         bool
+	PruneEmptyDirs bool
+	Iconv          bool
+	FilesFrom      bool
+	ChecksumChoice bool
+	CompressChoice bool
+	Protocol       int // --protocol，0 表示未指定
+
+	// -e 后面的客户端能力，例如 .iLsfxCIvu
+	ClientInfo string
+
+	args     []string
+	infoArg  int // ClientInfo 所在的参数
+	infoFrom int
+}
+
+// ParseCommand 解析资产上执行的 rsync server 命令
+func ParseCommand(rawStr string) (cmd Command, ok bool) {
+	args := utils.SplitShellArgs(rawStr)
+	if len(args) < 2 || path.Base(args[0]) != "rsync" || args[1] != "--server" {
+		return cmd, false
+	}
+	cmd.args = args
+	cmd.infoArg = -1
+	cmd.Mode = ModeReceiver
+	pathStart := -1
+	for i := 2; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == ".":
+			// 选项和路径之间的占位参数
+			pathStart = i + 1
+		case strings.HasPrefix(arg, "--"):
+			cmd.parseLongOption(arg)
+		case strings.HasPrefix(arg, "-"):
+			cmd.parseShortOptions(i, arg)
+		}
+		if pathStart != -1 {
+			break
+		}
+	}
+	if pathStart == -1 {
+		return cmd, false
+	}
+	cmd.Paths = append(cmd.Paths, args[pathStart:]...)
+	return cmd, true
+}
+
+func (c *Command) parseLongOption(arg string) {
+	name, value, _ := strings.Cut(arg, "=")
+	switch name {
+	case "--sender":
+		c.Mode = ModeSender
+	case "--recursive":
+		c.Recursive = true
+	case "--owner":
+		c.PreserveUID = true
+	case "--group":
+		c.PreserveGID = true
+	case "--links":
+		c.PreserveLinks = true
+	case "--devices":
+		c.PreserveDevice = true
+	case "--specials":
+		c.PreserveSpec = true
+	case "--hard-links":
+		c.HardLinks = true
+	case "--checksum":
+		c.Checksum = true
+	case "--acls":
+		c.ACLs = true
+	case "--xattrs":
+		c.Xattrs = true
+	case "--atimes":
+		c.Atimes = true
+	case "--crtimes":
+		c.Crtimes = true
+	case "--compress", "--new-compress", "--old-compress":
+		c.Compress = true
+	case "--compress-choice", "--zc":
+		c.Compress = true
+		c.CompressChoice = true
+	case "--checksum-choice", "--cc":
+		c.ChecksumChoice = true
+	case "--prune-empty-dirs":
+		c.PruneEmptyDirs = true
+	case "--iconv":
+		c.Iconv = true
+	case "--files-from":
+		c.FilesFrom = true
+	case "--protocol":
+		c.Protocol, _ = strconv.Atoi(value)
+	default:
+		if strings.HasPrefix(name, "--delete") {
+			c.Delete = true
+		}
+	}
+}
+
+func (c *Command) parseShortOptions(index int, arg string) {
+	for i := 1; i < len(arg); i++ {
+		switch arg[i] {
+		case 'e':
+			// -e 后面的内容都是客户端能力
+			c.ClientInfo = arg[i+1:]
+			c.infoArg = index
+			c.infoFrom = i + 1
+			return
+		case 'r':
+			c.Recursive = true
+		case 'o':
+			c.PreserveUID = true
+		case 'g':
+			c.PreserveGID = true
+		case 'l':
+			c.PreserveLinks = true
+		case 'D':
+			c.PreserveDevice = true
+			c.PreserveSpec = true
+		case 'H':
+			c.HardLinks = true
+		case 'c':
+			c.Checksum = true
+		case 'A':
+			c.ACLs = true
+		case 'X':
+			c.Xattrs = true
+		case 'U':
+			c.Atimes = true
+		case 'N':
+			c.Crtimes = true
+		case 'z':
+			c.Compress = true
+		case 'm':
+			c.PruneEmptyDirs = true
+		}
+	}
+}
+
+// varintFlist 客户端支持变长编码的文件列表标志和字符串协商
+func (c *Command) varintFlist() bool {
+	return strings.Contains(c.ClientInfo, "v")
+}
+
+// DisableIncRecurse 去掉客户端的增量递归能力，资产会在传输开始前发送完整的文件列表。
+// 返回修改后的命令，没有修改时返回原命令
+func (c *Command) DisableIncRecurse(rawStr string) string {
+	if c.infoArg == -1 || !strings.Contains(c.ClientInfo, "i") {
+		return rawStr
+	}
+	arg := c.args[c.infoArg]
+	info := strings.ReplaceAll(c.ClientInfo, "i", "")
+	newArg := arg[:c.infoFrom] + info
+	// 选项在路径前面，只替换第一个，不改变路径的转义
+	idx := strings.Index(rawStr, " "+arg)
+	if idx == -1 {
+		return rawStr
+	}
+	c.ClientInfo = info
+	c.args[c.infoArg] = newArg
+	return rawStr[:idx+1] + newArg + rawStr[idx+1+len(arg):]
+}
+
+// Root 文件列表中的名称相对的目录
+func (c *Command) Root() string {
+	if len(c.Paths) == 0 {
+		return ""
+	}
+	if c.Mode == ModeReceiver {
+		return c.Paths[len(c.Paths)-1]
+	}
+	src := c.Paths[0]
+	if strings.HasSuffix(src, "/") {
+		return src
+	}
+	return path.Dir(src)
+}
+
+// unsupported 文件列表中包含无法解析的内容时返回原因
+func (c *Command) unsupported() string {
+	switch {
+	case c.Checksum:
+		return "checksum"
+	case c.ACLs:
+		return "acls"
+	case c.Xattrs:
+		return "xattrs"
+	case c.Iconv:
+		return "iconv"
+	case c.FilesFrom:
+		return "files-from"
+	}
+	return ""
+}
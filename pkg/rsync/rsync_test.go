@@ -0,0 +1,246 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	raw := "rsync --server -vlogDtpre.iLsfxCIvu --delete . /tmp/dst"
+	cmd, ok := ParseCommand(raw)
+	if !ok {
+		t.Fatal("parse rsync command failed")
+	}
+	if cmd.Mode != ModeReceiver || !cmd.Recursive || !cmd.Delete || !cmd.PreserveLinks {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+	if cmd.ClientInfo != ".iLsfxCIvu" || cmd.Root() != "/tmp/dst" {
+		t.Fatalf("unexpected client info %q root %q", cmd.ClientInfo, cmd.Root())
+	}
+	newRaw := cmd.DisableIncRecurse(raw)
+	if newRaw != "rsync --server -vlogDtpre.LsfxCIvu --delete . /tmp/dst" {
+		t.Fatalf("disable inc recurse: %s", newRaw)
+	}
+
+	cmd, ok = ParseCommand("rsync --server --sender -vlogDtpre.iLsfxCIvu . /data/logs")
+	if !ok || cmd.Mode != ModeSender || cmd.Root() != "/data" {
+		t.Fatalf("unexpected sender command: %+v", cmd)
+	}
+	if _, ok = ParseCommand("rsync -av /tmp/a /tmp/b"); ok {
+		t.Fatal("client command should not be parsed")
+	}
+}
+
+func TestVarintRoundTrip(t *testing.T) {
+	for _, v := range []int32{0, 1, 0x7f, 0x80, 0x3fff, 0x4000, 0x1fffff, 0x7fffffff} {
+		var buf bytes.Buffer
+		writeVarint(&buf, v)
+		got, err := readVarint(&buf)
+		if err != nil || got != v {
+			t.Fatalf("varint %d: got %d err %v", v, got, err)
+		}
+	}
+	for _, v := range []int64{0, 1, 0xffffff, 1 << 32, 1700000000, 1 << 50} {
+		for _, minBytes := range []int{3, 4} {
+			var buf bytes.Buffer
+			writeVarlong(&buf, v, minBytes)
+			got, err := readVarlong(&buf, minBytes)
+			if err != nil || got != v {
+				t.Fatalf("varlong %d min %d: got %d err %v", v, minBytes, got, err)
+			}
+		}
+	}
+}
+
+func TestParserUpload(t *testing.T) {
+	cmd, _ := ParseCommand("rsync --server -lDtpre.LsfxCIvu --delete . /tmp/dst")
+	p := NewParser(cmd)
+
+	var server bytes.Buffer
+	writeInt(&server, 31)
+	writeVarint(&server, cfVarintFlistFlags)
+	writeVstring(&server, "xxh128 md5")
+	writeInt(&server, 12345)
+
+	var client bytes.Buffer
+	writeInt(&client, 31)
+	writeVstring(&client, "xxh128 md5")
+	var data bytes.Buffer
+	// --delete 时先发送过滤规则
+	writeInt(&data, 3)
+	data.WriteString("- a")
+	writeInt(&data, 0)
+	writeEntry(&data, 0, "", ".", 4096, sIFDIR|0755, 1700000000)
+	writeEntry(&data, 0, "", "a.txt", 12, sIFREG|0644, 1700000001)
+	writeEntry(&data, xmitSameName|xmitSameMode, "a.", "a.log", 1<<33, 0, 1700000002)
+	writeVarint(&data, 0)
+	writeVarint(&data, 0)
+	payload := data.Bytes()
+	writeMessage(&client, 0, payload[:10])
+	writeMessage(&client, 3, []byte("info"))
+	writeMessage(&client, 0, payload[10:])
+
+	_, _ = p.ServerWriter().Write(server.Bytes())
+	_, _ = p.ClientWriter().Write(client.Bytes())
+	entries, err := p.Close()
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expect 3 entries, got %+v", entries)
+	}
+	if !entries[0].IsDir() || entries[1].Path != "/tmp/dst/a.txt" || entries[1].Size != 12 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if entries[2].Name != "a.log" || !entries[2].IsRegular() || entries[2].Size != 1<<33 {
+		t.Fatalf("unexpected entry: %+v", entries[2])
+	}
+}
+
+func TestParserDownload(t *testing.T) {
+	cmd, _ := ParseCommand("rsync --server --sender -lre.LsfxCIvu . /data/logs")
+	p := NewParser(cmd)
+
+	var client bytes.Buffer
+	writeInt(&client, 31)
+	writeVstring(&client, "md5")
+
+	var server bytes.Buffer
+	writeInt(&server, 31)
+	writeVarint(&server, cfVarintFlistFlags)
+	writeVstring(&server, "md5")
+	writeInt(&server, 1)
+	var data bytes.Buffer
+	writeEntry(&data, 0, "", "logs", 0, sIFDIR|0755, 1700000000)
+	writeEntry(&data, 0, "", "logs/link", 4, sIFLNK|0777, 1700000000)
+	writeVarint(&data, 4)
+	data.WriteString("a.gz")
+	writeVarint(&data, 0)
+	writeVarint(&data, 0)
+	writeMessage(&server, 0, data.Bytes())
+
+	_, _ = p.ClientWriter().Write(client.Bytes())
+	_, _ = p.ServerWriter().Write(server.Bytes())
+	entries, err := p.Close()
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	if len(entries) != 2 || entries[1].Path != "/data/logs/link" || entries[1].Link != "a.gz" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestParserOldProtocol(t *testing.T) {
+	cmd, _ := ParseCommand("rsync --server -vlogDtpre.LsfxCIvu . /tmp/dst")
+	p := NewParser(cmd)
+	var buf bytes.Buffer
+	writeInt(&buf, 29)
+	_, _ = p.ClientWriter().Write(buf.Bytes())
+	_, _ = p.ServerWriter().Write(buf.Bytes())
+	if _, err := p.Close(); err == nil {
+		t.Fatal("expect unsupported protocol error")
+	}
+}
+
+func writeEntry(buf *bytes.Buffer, flags int32, prefix, name string, size int64, mode uint32, mtime int64) {
+	if flags == 0 {
+		// flags 为 0 表示列表结束，使用 XMIT_TOP_DIR 代替
+		flags = xmitTopDir
+	}
+	writeVarint(buf, flags)
+	if flags&xmitSameName != 0 {
+		buf.WriteByte(byte(len(prefix)))
+		name = name[len(prefix):]
+	}
+	buf.WriteByte(byte(len(name)))
+	buf.WriteString(name)
+	writeVarlong(buf, size, 3)
+	writeVarlong(buf, mtime, 4)
+	if flags&xmitSameMode == 0 {
+		writeInt(buf, int32(mode))
+	}
+}
+
+func writeMessage(buf *bytes.Buffer, tag int, data []byte) {
+	writeInt(buf, int32(uint32(tag+mplexBase)<<24|uint32(len(data))))
+	buf.Write(data)
+}
+
+func writeInt(buf *bytes.Buffer, v int32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(v))
+	buf.Write(b[:])
+}
+
+func writeVstring(buf *bytes.Buffer, s string) {
+	buf.WriteByte(byte(len(s)))
+	buf.WriteString(s)
+}
+
+// writeVarint 与 rsync 的 write_varint 相同
+func writeVarint(buf *bytes.Buffer, v int32) {
+	var b [5]byte
+	binary.LittleEndian.PutUint32(b[1:], uint32(v))
+	cnt := 4
+	for cnt > 1 && b[cnt] == 0 {
+		cnt--
+	}
+	bit := byte(1) << (7 - cnt + 1)
+	switch {
+	case b[cnt] >= bit:
+		cnt++
+		b[0] = ^(bit - 1)
+	case cnt > 1:
+		b[0] = b[cnt] | ^(bit*2 - 1)
+	default:
+		b[0] = b[cnt]
+	}
+	buf.Write(b[:cnt])
+}
+
+// writeVarlong 与 rsync 的 write_varlong 相同
+func writeVarlong(buf *bytes.Buffer, v int64, minBytes int) {
+	var b [9]byte
+	binary.LittleEndian.PutUint64(b[1:], uint64(v))
+	cnt := 8
+	for cnt > minBytes && b[cnt] == 0 {
+		cnt--
+	}
+	bit := byte(1) << (7 - cnt + minBytes)
+	switch {
+	case b[cnt] >= bit:
+		cnt++
+		b[0] = ^(bit - 1)
+	case cnt > minBytes:
+		b[0] = b[cnt] | ^(bit*2 - 1)
+	default:
+		b[0] = b[cnt]
+	}
+	buf.Write(b[:cnt])
+}
+
+func TestTapOverflow(t *testing.T) {
+	release := make(chan struct{})
+	var readErr error
+	tp := newTap(func(r *bufio.Reader) {
+		<-release
+		_, readErr = io.ReadAll(r)
+	})
+	// 解析阻塞时写入也不会阻塞，超过缓冲区后丢弃
+	chunk := make([]byte, 1024*1024)
+	for i := 0; i < tapBufferSize/len(chunk)+1; i++ {
+		if n, err := tp.Write(chunk); err != nil || n != len(chunk) {
+			t.Fatalf("write %d: n %d err %v", i, n, err)
+		}
+	}
+	close(release)
+	tp.close()
+	<-tp.done
+	if !errors.Is(readErr, errTapOverflow) {
+		t.Fatalf("expected overflow error, got %v", readErr)
+	}
+}
@@ -0,0 +1,283 @@
+package scp
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+/*
+scp 协议解析 (rcp 协议)，koko 位于客户端和资产的 scp 之间，只解析不修改数据:
+	scp -t 目标路径: 资产作为接收端 (上传)，解析客户端发送的数据
+	scp -f 源路径:   资产作为发送端 (下载)，解析资产发送的数据
+
+发送端的数据格式:
+	T<mtime> 0 <atime> 0\n   -p 时在文件或目录前发送
+	C<mode> <size> <name>\n  文件，随后是 size 字节的内容和一个 \0
+	D<mode> 0 <name>\n       进入目录 (-r)
+	E\n                      离开目录
+	\x01<msg>\n \x02<msg>\n  警告和错误
+接收端的确认 (\0 或者错误) 在另一个方向，不解析，文件的结果以发送端为准。
+*/
+
+const (
+	ModeSink   = "sink"   // scp -t
+	ModeSource = "source" // scp -f
+)
+
+const maxControlLine = 4096
+
+type Command struct {
+	Mode      string
+	Recursive bool
+	Preserve  bool
+	TargetDir bool // -d 目标必须是目录
+	Paths     []string
+}
+
+// ParseCommand 解析资产上执行的 scp 命令，复合命令中取第一个 scp
+func ParseCommand(rawStr string) (cmd Command, ok bool) {
+	for _, part := range splitCommands(rawStr) {
+		args := utils.SplitShellArgs(part)
+		if len(args) == 0 || path.Base(args[0]) != "scp" {
+			continue
+		}
+		endOfFlags := false
+		for _, arg := range args[1:] {
+			if endOfFlags || !strings.HasPrefix(arg, "-") || arg == "-" {
+				cmd.Paths = append(cmd.Paths, arg)
+				continue
+			}
+			if arg == "--" {
+				endOfFlags = true
+				continue
+			}
+			for _, c := range arg[1:] {
+				switch c {
+				case 't':
+					cmd.Mode = ModeSink
+				case 'f':
+					cmd.Mode = ModeSource
+				case 'r':
+					cmd.Recursive = true
+				case 'p':
+					cmd.Preserve = true
+				case 'd':
+					cmd.TargetDir = true
+				}
+			}
+		}
+		return cmd, cmd.Mode != ""
+	}
+	return cmd, false
+}
+
+func splitCommands(rawStr string) []string {
+	replacer := strings.NewReplacer("&&", ";", "||", ";", "\n", ";")
+	return strings.Split(replacer.Replace(rawStr), ";")
+}
+
+type FileInfo struct {
+	Path    string // 资产上的完整路径
+	Name    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time // -p 时有效
+
+	written int64
+}
+
+const (
+	stateControl = iota
+	stateData
+	stateDataEnd
+	stateStopped
+)
+
+func NewParser(cmd Command) *Parser {
+	return &Parser{cmd: cmd}
+}
+
+// Parser 解析发送端的数据
+type Parser struct {
+	cmd Command
+
+	OnFileStart func(info *FileInfo)
+	OnFileData  func(info *FileInfo, p []byte)
+	OnFileEnd   func(info *FileInfo, success bool)
+	OnDir       func(dirPath string)
+
+	state   int
+	line    bytes.Buffer
+	dirs    []string
+	modTime time.Time
+	current *FileInfo
+}
+
+// Write 不会返回错误，无法解析时停止解析，不影响数据传输
+func (p *Parser) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		switch p.state {
+		case stateStopped:
+			return n, nil
+		case stateData:
+			remain := p.current.Size - p.current.written
+			chunk := b
+			if int64(len(chunk)) > remain {
+				chunk = chunk[:remain]
+			}
+			p.current.written += int64(len(chunk))
+			if p.OnFileData != nil && len(chunk) > 0 {
+				p.OnFileData(p.current, chunk)
+			}
+			b = b[len(chunk):]
+			if p.current.written == p.current.Size {
+				p.state = stateDataEnd
+			}
+		case stateDataEnd:
+			// 内容后面的 \0 表示发送端读取文件成功
+			success := b[0] == 0
+			p.endFile(success)
+			p.state = stateControl
+			if success {
+				b = b[1:]
+			}
+		default:
+			idx := bytes.IndexByte(b, '\n')
+			if idx == -1 {
+				p.line.Write(b)
+				if p.line.Len() > maxControlLine {
+					p.stop("control line too long")
+				}
+				return n, nil
+			}
+			p.line.Write(b[:idx])
+			b = b[idx+1:]
+			line := p.line.String()
+			p.line.Reset()
+			p.handleControl(line)
+		}
+	}
+	return n, nil
+}
+
+// Close 传输中断时结束未完成的文件
+func (p *Parser) Close() {
+	if p.current != nil {
+		p.endFile(false)
+	}
+	p.state = stateStopped
+}
+
+func (p *Parser) handleControl(line string) {
+	if line == "" {
+		return
+	}
+	switch line[0] {
+	case 'T':
+		fields := strings.Fields(line[1:])
+		if len(fields) > 0 {
+			if sec, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+				p.modTime = time.Unix(sec, 0)
+			}
+		}
+	case 'C', 'D':
+		mode, size, name, ok := parseEntry(line[1:])
+		if !ok {
+			p.stop("invalid entry: " + line)
+			return
+		}
+		entryPath := p.entryPath(name)
+		if line[0] == 'D' {
+			p.dirs = append(p.dirs, entryPath)
+			p.modTime = time.Time{}
+			if p.OnDir != nil {
+				p.OnDir(entryPath)
+			}
+			return
+		}
+		p.current = &FileInfo{Path: entryPath, Name: name, Mode: mode, Size: size, ModTime: p.modTime}
+		p.modTime = time.Time{}
+		if p.OnFileStart != nil {
+			p.OnFileStart(p.current)
+		}
+		p.state = stateData
+		if size == 0 {
+			p.state = stateDataEnd
+		}
+	case 'E':
+		if len(p.dirs) > 0 {
+			p.dirs = p.dirs[:len(p.dirs)-1]
+		}
+	case 0x01:
+		logger.Warnf("Scp warning: %s", line[1:])
+	case 0x02:
+		logger.Errorf("Scp error: %s", line[1:])
+		p.stop("fatal error")
+	default:
+		p.stop("unknown control line")
+	}
+}
+
+func (p *Parser) endFile(success bool) {
+	info := p.current
+	p.current = nil
+	if info != nil && p.OnFileEnd != nil {
+		p.OnFileEnd(info, success && info.written == info.Size)
+	}
+}
+
+func (p *Parser) stop(reason string) {
+	logger.Errorf("Scp parser stopped: %s", reason)
+	p.Close()
+}
+
+// entryPath 资产上的路径。接收端没有 -d 和 -r 时目标可能是目录也可能是文件，
+// 文件名与目标的最后一部分不同时按照目录处理
+func (p *Parser) entryPath(name string) string {
+	if len(p.dirs) > 0 {
+		return path.Join(p.dirs[len(p.dirs)-1], name)
+	}
+	if len(p.cmd.Paths) == 0 {
+		return name
+	}
+	switch p.cmd.Mode {
+	case ModeSink:
+		target := p.cmd.Paths[len(p.cmd.Paths)-1]
+		if !p.cmd.TargetDir && !p.cmd.Recursive && !strings.HasSuffix(target, "/") &&
+			path.Base(target) == name {
+			return target
+		}
+		return path.Join(target, name)
+	default:
+		for _, src := range p.cmd.Paths {
+			if path.Base(src) == name {
+				return src
+			}
+		}
+		// 通配符由资产上的 shell 展开
+		return path.Join(path.Dir(p.cmd.Paths[0]), name)
+	}
+}
+
+func parseEntry(s string) (mode os.FileMode, size int64, name string, ok bool) {
+	fields := strings.SplitN(s, " ", 3)
+	if len(fields) != 3 || fields[2] == "" || strings.Contains(fields[2], "/") {
+		return
+	}
+	perm, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return
+	}
+	if size, err = strconv.ParseInt(fields[1], 10, 64); err != nil || size < 0 {
+		return
+	}
+	return os.FileMode(perm), size, fields[2], true
+}
@@ -0,0 +1,121 @@
+package scp
+
+import (
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		raw   string
+		ok    bool
+		mode  string
+		paths []string
+		r     bool
+		p     bool
+	}{
+		{"scp -t /tmp", true, ModeSink, []string{"/tmp"}, false, false},
+		{"scp -r -p -t -- '/tmp/my dir'", true, ModeSink, []string{"/tmp/my dir"}, true, true},
+		{"cd /tmp; scp -prf a.txt b.txt", true, ModeSource, []string{"a.txt", "b.txt"}, true, true},
+		{"/usr/bin/scp -v -f /etc/hosts", true, ModeSource, []string{"/etc/hosts"}, false, false},
+		{"scp a.txt host:/tmp", false, "", nil, false, false},
+		{"ls -l", false, "", nil, false, false},
+	}
+	for _, tt := range tests {
+		cmd, ok := ParseCommand(tt.raw)
+		if ok != tt.ok {
+			t.Fatalf("%q: expected ok %v, got %v", tt.raw, tt.ok, ok)
+		}
+		if !ok {
+			continue
+		}
+		if cmd.Mode != tt.mode || cmd.Recursive != tt.r || cmd.Preserve != tt.p ||
+			len(cmd.Paths) != len(tt.paths) {
+			t.Fatalf("%q: unexpected command %+v", tt.raw, cmd)
+		}
+		for i := range tt.paths {
+			if cmd.Paths[i] != tt.paths[i] {
+				t.Fatalf("%q: expected paths %v, got %v", tt.raw, tt.paths, cmd.Paths)
+			}
+		}
+	}
+}
+
+type fileResult struct {
+	path    string
+	content string
+	success bool
+	mtime   int64
+}
+
+func parseStream(t *testing.T, raw string, stream []byte, chunk int) ([]fileResult, []string) {
+	cmd, ok := ParseCommand(raw)
+	if !ok {
+		t.Fatalf("parse command %q failed", raw)
+	}
+	var (
+		files   []fileResult
+		dirs    []string
+		content []byte
+	)
+	p := NewParser(cmd)
+	p.OnFileStart = func(info *FileInfo) { content = content[:0] }
+	p.OnFileData = func(info *FileInfo, b []byte) { content = append(content, b...) }
+	p.OnFileEnd = func(info *FileInfo, success bool) {
+		files = append(files, fileResult{info.Path, string(content), success, info.ModTime.Unix()})
+	}
+	p.OnDir = func(dirPath string) { dirs = append(dirs, dirPath) }
+	for len(stream) > 0 {
+		n := chunk
+		if n > len(stream) {
+			n = len(stream)
+		}
+		_, _ = p.Write(stream[:n])
+		stream = stream[n:]
+	}
+	p.Close()
+	return files, dirs
+}
+
+func TestParserRecursive(t *testing.T) {
+	stream := []byte("T1700000000 0 1700000000 0\nD0755 0 logs\n" +
+		"C0644 5 a.log\nhello\x00" +
+		"D0755 0 sub\nC0600 0 empty\n\x00E\n" +
+		"C0644 3 b.log\nabc\x00E\n")
+	for _, chunk := range []int{1, 3, 1024} {
+		files, dirs := parseStream(t, "scp -r -p -t /data", stream, chunk)
+		expected := []fileResult{
+			{"/data/logs/a.log", "hello", true, 0},
+			{"/data/logs/sub/empty", "", true, 0},
+			{"/data/logs/b.log", "abc", true, 0},
+		}
+		if len(files) != len(expected) {
+			t.Fatalf("chunk %d: expected %d files, got %+v", chunk, len(expected), files)
+		}
+		for i := range expected {
+			got := files[i]
+			got.mtime = 0
+			if got != expected[i] {
+				t.Fatalf("chunk %d: file %d expected %+v, got %+v", chunk, i, expected[i], files[i])
+			}
+		}
+		if len(dirs) != 2 || dirs[0] != "/data/logs" || dirs[1] != "/data/logs/sub" {
+			t.Fatalf("chunk %d: unexpected dirs %v", chunk, dirs)
+		}
+	}
+}
+
+func TestParserSource(t *testing.T) {
+	stream := []byte("T1700000000 0 1700000000 0\nC0644 4 hosts\nabcd\x00" +
+		"C0644 10 passwd\nabc\x01scp: /etc/passwd: read error\n")
+	files, _ := parseStream(t, "scp -p -f /etc/hosts /etc/passwd", stream, 7)
+	if len(files) != 2 {
+		t.Fatalf("unexpected files %+v", files)
+	}
+	if files[0].path != "/etc/hosts" || !files[0].success || files[0].mtime != 1700000000 {
+		t.Fatalf("unexpected file %+v", files[0])
+	}
+	// 传输中断的文件记录为失败
+	if files[1].path != "/etc/passwd" || files[1].success {
+		t.Fatalf("unexpected file %+v", files[1])
+	}
+}
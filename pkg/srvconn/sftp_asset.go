@@ -16,6 +16,7 @@ import (
 	"github.com/jumpserver-dev/sdk-go/common"
 	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver-dev/sdk-go/service"
+	"github.com/jumpserver/koko/pkg/audit"
 	com "github.com/jumpserver/koko/pkg/common"
 	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/logger"
@@ -832,7 +833,7 @@ func (ad *AssetDir) CreateFTPLog(su *model.PermAccount, operate, filename string
 
 func (ad *AssetDir) recordSessionLifecycle(sid string, event model.LifecycleEvent, reason string) {
 	logObj := model.SessionLifecycleLog{Reason: reason}
-	if err := ad.jmsService.RecordSessionLifecycleLog(sid, event, logObj); err != nil {
+	if err := audit.RecordSessionLifecycleLog(ad.jmsService, sid, event, logObj); err != nil {
 		logger.Errorf("Update session %s lifecycle %s failed: %s", sid, event, err)
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/jumpserver-dev/sdk-go/common"
 	"github.com/jumpserver-dev/sdk-go/model"
 	"github.com/jumpserver-dev/sdk-go/service"
+	"github.com/jumpserver/koko/pkg/audit"
 	"github.com/jumpserver/koko/pkg/logger"
 	"github.com/jumpserver/koko/pkg/session"
 )
@@ -26,7 +27,7 @@ func (s *SftpSession) CloseWithReason(reason model.SessionLifecycleReasonErr) {
 		}
 		logger.Debugf("SFTP Session finished %s", s.sess.ID)
 		logObj := model.SessionLifecycleLog{Reason: reason.String()}
-		if err := s.jmsService.RecordSessionLifecycleLog(s.sess.ID, model.AssetConnectFinished, logObj); err != nil {
+		if err := audit.RecordSessionLifecycleLog(s.jmsService, s.sess.ID, model.AssetConnectFinished, logObj); err != nil {
 			logger.Errorf("Update session %s lifecycle asset_connect_finished failed: %s", s.sess.ID, err)
 		}
 	})
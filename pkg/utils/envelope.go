@@ -0,0 +1,383 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+信封加密文件格式:
+
+	magic(8) | header length(uint32 big endian) | header(json) | chunk | chunk | ... | last chunk
+
+每个文件随机生成 AES-256 数据密钥，数据密钥由主密钥使用 AES-GCM 加密后写入 header。
+明文按 chunkSize 分块加密，nonce 为 header 中的随机 nonce 与分块序号异或，
+每一块的附加数据为 magic、header 长度和 header 之后加一个字节的标记，最后一块的标记为 1，
+修改 header (alg、kid 等) 或者截断文件都会导致解密失败。
+*/
+
+const (
+	EnvelopeAlgorithm = "AES-256-GCM-STREAM"
+
+	envelopeChunkSize    = 64 * 1024
+	envelopeMaxHeaderLen = 4096
+)
+
+var envelopeMagic = []byte("JMSENC01")
+
+var (
+	ErrEnvelopeFormat = errors.New("envelope: invalid encrypted file format")
+	ErrEnvelopeKeyID  = errors.New("envelope: key id mismatch")
+	ErrEnvelopeTrunc  = errors.New("envelope: encrypted file is truncated")
+)
+
+type EnvelopeHeader struct {
+	Algorithm  string `json:"alg"`
+	KeyID      string `json:"kid"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Nonce      []byte `json:"nonce"`
+	ChunkSize  int    `json:"chunk_size"`
+}
+
+// EnvelopeKey 主密钥，只用于加密每个文件的数据密钥
+type EnvelopeKey struct {
+	ID  string
+	key []byte
+}
+
+// NewEnvelopeKey 任意长度的密钥经过 sha256 派生成 32 字节，key id 是派生密钥的指纹
+func NewEnvelopeKey(secret []byte) *EnvelopeKey {
+	derived := sha256.Sum256(secret)
+	fingerprint := sha256.Sum256(derived[:])
+	return &EnvelopeKey{
+		ID:  hex.EncodeToString(fingerprint[:8]),
+		key: derived[:],
+	}
+}
+
+// LoadEnvelopeKey 优先使用密钥文件，其次使用 secret
+func LoadEnvelopeKey(secret, keyFile string) (*EnvelopeKey, error) {
+	if keyFile != "" {
+		raw, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		raw = bytes.TrimSpace(raw)
+		if len(raw) == 0 {
+			return nil, fmt.Errorf("envelope: key file %s is empty", keyFile)
+		}
+		return NewEnvelopeKey(raw), nil
+	}
+	if secret == "" {
+		return nil, errors.New("envelope: no encrypt key")
+	}
+	return NewEnvelopeKey([]byte(secret)), nil
+}
+
+func newChunkAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(base []byte, index uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], index)
+	offset := len(nonce) - len(counter)
+	for i := range counter {
+		nonce[offset+i] ^= counter[i]
+	}
+	return nonce
+}
+
+const (
+	chunkFlag     = 0
+	lastChunkFlag = 1
+)
+
+// chunkAdditional 附加数据绑定文件头
+func chunkAdditional(prefix []byte, last bool) []byte {
+	additional := make([]byte, len(prefix)+1)
+	copy(additional, prefix)
+	if last {
+		additional[len(prefix)] = lastChunkFlag
+	} else {
+		additional[len(prefix)] = chunkFlag
+	}
+	return additional
+}
+
+type envelopeWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	prefix []byte
+	index  uint64
+	buf    []byte
+}
+
+// NewEncryptWriter 返回的 writer 必须 Close，否则最后一块不会写入
+func NewEncryptWriter(w io.Writer, key *EnvelopeKey) (io.WriteCloser, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	wrappedKey, err := aseGcmEncrypt(dataKey, string(key.key))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newChunkAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	header := EnvelopeHeader{
+		Algorithm:  EnvelopeAlgorithm,
+		KeyID:      key.ID,
+		WrappedKey: wrappedKey,
+		Nonce:      nonce,
+		ChunkSize:  envelopeChunkSize,
+	}
+	raw, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	var prefix bytes.Buffer
+	prefix.Write(envelopeMagic)
+	_ = binary.Write(&prefix, binary.BigEndian, uint32(len(raw)))
+	prefix.Write(raw)
+	if _, err = w.Write(prefix.Bytes()); err != nil {
+		return nil, err
+	}
+	return &envelopeWriter{
+		w:      w,
+		aead:   aead,
+		nonce:  nonce,
+		prefix: prefix.Bytes(),
+		buf:    make([]byte, 0, envelopeChunkSize),
+	}, nil
+}
+
+func (e *envelopeWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// 缓冲区满了之后，确认还有数据才写出，保证最后一块一定由 Close 写出
+		if len(e.buf) == envelopeChunkSize {
+			if err = e.flush(false); err != nil {
+				return
+			}
+		}
+		size := envelopeChunkSize - len(e.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		e.buf = append(e.buf, p[:size]...)
+		p = p[size:]
+		n += size
+	}
+	return
+}
+
+func (e *envelopeWriter) flush(last bool) error {
+	additional := chunkAdditional(e.prefix, last)
+	sealed := e.aead.Seal(nil, chunkNonce(e.nonce, e.index), e.buf, additional)
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *envelopeWriter) Close() error {
+	return e.flush(true)
+}
+
+type envelopeReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	nonce  []byte
+	prefix []byte
+	index  uint64
+
+	chunk   []byte
+	plain   []byte
+	gotLast bool
+}
+
+// ReadEnvelopeHeader 读取并校验文件头
+func ReadEnvelopeHeader(r io.Reader) (*EnvelopeHeader, error) {
+	header, _, err := readEnvelopePrefix(r)
+	return header, err
+}
+
+// readEnvelopePrefix 返回文件头和原始的 magic、长度、header，用于附加数据
+func readEnvelopePrefix(r io.Reader) (*EnvelopeHeader, []byte, error) {
+	prefix := make([]byte, len(envelopeMagic)+4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, nil, ErrEnvelopeFormat
+	}
+	if !bytes.Equal(prefix[:len(envelopeMagic)], envelopeMagic) {
+		return nil, nil, ErrEnvelopeFormat
+	}
+	headerLen := binary.BigEndian.Uint32(prefix[len(envelopeMagic):])
+	if headerLen == 0 || headerLen > envelopeMaxHeaderLen {
+		return nil, nil, ErrEnvelopeFormat
+	}
+	raw := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, nil, ErrEnvelopeFormat
+	}
+	var header EnvelopeHeader
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, nil, ErrEnvelopeFormat
+	}
+	if header.Algorithm != EnvelopeAlgorithm || header.ChunkSize <= 0 {
+		return nil, nil, fmt.Errorf("envelope: unsupported algorithm %s", header.Algorithm)
+	}
+	return &header, append(prefix, raw...), nil
+}
+
+// NewDecryptReader 返回解密后的明文 reader，读到被截断或者被篡改的数据时返回错误
+func NewDecryptReader(r io.Reader, key *EnvelopeKey) (io.Reader, error) {
+	header, prefix, err := readEnvelopePrefix(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.KeyID != key.ID {
+		return nil, fmt.Errorf("%w: file %s, key %s", ErrEnvelopeKeyID, header.KeyID, key.ID)
+	}
+	dataKey, err := aseGcmDecrypt(header.WrappedKey, string(key.key))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newChunkAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.Nonce) != aead.NonceSize() {
+		return nil, ErrEnvelopeFormat
+	}
+	return &envelopeReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		nonce:  header.Nonce,
+		prefix: prefix,
+		chunk:  make([]byte, header.ChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (e *envelopeReader) Read(p []byte) (int, error) {
+	for len(e.plain) == 0 {
+		if e.gotLast {
+			return 0, io.EOF
+		}
+		if err := e.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.plain)
+	e.plain = e.plain[n:]
+	return n, nil
+}
+
+func (e *envelopeReader) next() error {
+	n, err := io.ReadFull(e.r, e.chunk)
+	switch {
+	case err == io.EOF:
+		return ErrEnvelopeTrunc
+	case errors.Is(err, io.ErrUnexpectedEOF):
+	case err != nil:
+		return err
+	}
+	// 读满一块时需要判断后面是否还有数据，才能确定是不是最后一块
+	last := n < len(e.chunk)
+	if !last {
+		if _, err = e.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+	additional := chunkAdditional(e.prefix, last)
+	plain, err := e.aead.Open(e.chunk[:0], chunkNonce(e.nonce, e.index), e.chunk[:n], additional)
+	if err != nil {
+		if last {
+			return ErrEnvelopeTrunc
+		}
+		return err
+	}
+	e.index++
+	e.plain = plain
+	e.gotLast = last
+	return nil
+}
+
+func EncryptFile(src, dst string, key *EnvelopeKey) error {
+	srcFd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFd.Close()
+	dstFd, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFd.Close()
+	w, err := NewEncryptWriter(dstFd, key)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, srcFd); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return dstFd.Sync()
+}
+
+func DecryptFile(src, dst string, key *EnvelopeKey) error {
+	srcFd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFd.Close()
+	r, err := NewDecryptReader(srcFd, key)
+	if err != nil {
+		return err
+	}
+	dstFd, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFd.Close()
+	_, err = io.Copy(dstFd, r)
+	return err
+}
+
+func IsEncryptedFile(path string) bool {
+	fd, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	magic := make([]byte, len(envelopeMagic))
+	if _, err = io.ReadFull(fd, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, envelopeMagic)
+}
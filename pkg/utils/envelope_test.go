@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestEnvelopeEncryptDecrypt(t *testing.T) {
+	key := NewEnvelopeKey([]byte("JumpServer Secret Encrypt Key"))
+	for _, size := range []int{0, 1, envelopeChunkSize, envelopeChunkSize*2 + 7} {
+		plain := bytes.Repeat([]byte{'a'}, size)
+		var encrypted bytes.Buffer
+		w, err := NewEncryptWriter(&encrypted, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(plain)
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		raw := encrypted.Bytes()
+
+		r, err := NewDecryptReader(bytes.NewReader(raw), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d decrypt err: %s", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d decrypt mismatch", size)
+		}
+
+		// 截断最后一块
+		r, _ = NewDecryptReader(bytes.NewReader(raw[:len(raw)-1]), key)
+		if _, err = io.ReadAll(r); err == nil {
+			t.Fatalf("size %d expected truncated error", size)
+		}
+	}
+}
+
+func TestEnvelopeKeyMismatch(t *testing.T) {
+	var encrypted bytes.Buffer
+	w, _ := NewEncryptWriter(&encrypted, NewEnvelopeKey([]byte("key1")))
+	_, _ = w.Write([]byte("hello"))
+	_ = w.Close()
+	_, err := NewDecryptReader(&encrypted, NewEnvelopeKey([]byte("key2")))
+	if !errors.Is(err, ErrEnvelopeKeyID) {
+		t.Fatalf("expected key id mismatch, got %v", err)
+	}
+}
+
+func TestEnvelopeHeaderTampered(t *testing.T) {
+	key := NewEnvelopeKey([]byte("key1"))
+	var encrypted bytes.Buffer
+	w, _ := NewEncryptWriter(&encrypted, key)
+	_, _ = w.Write([]byte("hello"))
+	_ = w.Close()
+	raw := encrypted.Bytes()
+
+	// header 仍然是合法的 json，只改变了原始内容
+	magicLen := len(envelopeMagic)
+	headerLen := binary.BigEndian.Uint32(raw[magicLen:])
+	header := raw[magicLen+4 : magicLen+4+int(headerLen)]
+	tampered := append([]byte(nil), raw[:magicLen]...)
+	tampered = binary.BigEndian.AppendUint32(tampered, headerLen+1)
+	tampered = append(tampered, '{', ' ')
+	tampered = append(tampered, header[1:]...)
+	tampered = append(tampered, raw[magicLen+4+int(headerLen):]...)
+
+	r, err := NewDecryptReader(bytes.NewReader(tampered), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(r); err == nil {
+		t.Fatal("expected error for tampered header")
+	}
+}
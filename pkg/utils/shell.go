@@ -0,0 +1,686 @@
+package utils
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+/*
+按照 POSIX shell 的语法把命令行拆分成实际执行的命令，用于命令过滤:
+	列表和管道:       ls; rm -rf /    a && b || c | d
+	子 shell 和命令替换: (rm x)  $(rm x)  `rm x`  <(rm x)
+	引号和转义:       r\m  "r"m  'r'm  $'\x72m'
+	包装命令:         env sudo nohup timeout nice xargs ...
+	shell 字符串:     sh -c 'rm x'  su -c 'rm x'  eval rm x
+	here document:  内容不是命令，只解析没有引号的分隔符内容中的命令替换
+返回的命令去掉了引号和转义，单词之间用一个空格连接。无法静态解析的内容 (例如变量) 保持原样。
+嵌套超过 maxShellDepth 或者命令超过 maxShellCommands 时不再继续拆分，complete 返回 false。
+*/
+
+const (
+	maxShellDepth    = 8
+	maxShellCommands = 128
+)
+
+// ShellCommands 返回命令行中所有会执行的命令，包装命令同时返回包装命令本身和被包装的命令，
+// complete 为 false 表示命令行没有完全拆分
+func ShellCommands(line string) (commands []string, complete bool) {
+	s := &shellSplitter{seen: make(map[string]bool)}
+	s.parse(line, 0)
+	return s.commands, !s.truncated
+}
+
+// SplitShellArgs 按照 shell 的规则拆分第一个命令的参数，与 ShellCommands 使用同一个词法分析，
+// 去掉引号和转义，忽略重定向
+func SplitShellArgs(line string) []string {
+	lx := &shellLexer{src: []rune(line)}
+	var args []string
+	for {
+		tok := lx.next()
+		switch tok.kind {
+		case shellTokWord:
+			args = append(args, tok.text)
+		case shellTokRedirect:
+			lx.next()
+		default:
+			return args
+		}
+	}
+}
+
+type shellSplitter struct {
+	commands  []string
+	seen      map[string]bool
+	truncated bool
+}
+
+type shellHeredoc struct {
+	delim     string
+	quoted    bool
+	stripTabs bool
+}
+
+func (s *shellSplitter) parse(line string, depth int) {
+	if depth > maxShellDepth {
+		s.truncated = true
+		return
+	}
+	lx := &shellLexer{src: []rune(line)}
+	var (
+		words    []string
+		heredocs []shellHeredoc
+	)
+	for {
+		if len(s.commands) >= maxShellCommands {
+			s.truncated = true
+			return
+		}
+		tok := lx.next()
+		for _, sub := range tok.subs {
+			s.parse(sub, depth+1)
+		}
+		switch tok.kind {
+		case shellTokWord:
+			words = append(words, tok.text)
+		case shellTokRedirect:
+			// 重定向的目标不是命令的参数
+			target := lx.next()
+			for _, sub := range target.subs {
+				s.parse(sub, depth+1)
+			}
+			if target.kind != shellTokWord {
+				s.addCommand(words, depth)
+				words = nil
+				break
+			}
+			if tok.text == "<<" || tok.text == "<<-" {
+				heredocs = append(heredocs, shellHeredoc{delim: target.text,
+					quoted: target.quoted, stripTabs: tok.text == "<<-"})
+			}
+		case shellTokOperator:
+			s.addCommand(words, depth)
+			words = nil
+			if tok.text != "\n" && tok.text != "\r" {
+				break
+			}
+			// here document 的内容从下一行开始
+			for _, doc := range heredocs {
+				body := lx.heredoc(doc.delim, doc.stripTabs)
+				if doc.quoted {
+					continue
+				}
+				for _, sub := range heredocSubstitutions(body) {
+					s.parse(sub, depth+1)
+				}
+			}
+			heredocs = nil
+		case shellTokEOF:
+			s.addCommand(words, depth)
+			return
+		}
+	}
+}
+
+var shellReservedWords = map[string]bool{
+	"if": true, "then": true, "else": true, "elif": true, "fi": true,
+	"do": true, "done": true, "while": true, "until": true,
+	"esac": true, "{": true, "}": true, "!": true,
+}
+
+func (s *shellSplitter) addCommand(words []string, depth int) {
+	for len(words) > 0 && (shellReservedWords[words[0]] || isShellAssignment(words[0])) {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return
+	}
+	if depth > maxShellDepth {
+		s.truncated = true
+		return
+	}
+	switch words[0] {
+	case "for", "case", "select", "function":
+		return
+	}
+	cmd := strings.Join(words, " ")
+	if !s.seen[cmd] {
+		s.seen[cmd] = true
+		s.commands = append(s.commands, cmd)
+	}
+	inner, script := unwrapShellCommand(words)
+	if script != "" {
+		s.parse(script, depth+1)
+	}
+	if len(inner) > 0 {
+		s.addCommand(inner, depth+1)
+	}
+}
+
+func isShellAssignment(word string) bool {
+	name, _, ok := strings.Cut(word, "=")
+	if !ok || name == "" {
+		return false
+	}
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// unwrapShellCommand 返回包装命令执行的命令，或者 shell 执行的字符串
+func unwrapShellCommand(words []string) (inner []string, script string) {
+	args := words[1:]
+	switch path.Base(words[0]) {
+	case "sudo", "doas":
+		return skipShellOptions(args, "ughpCDrtUTR", []string{"--user", "--group", "--host",
+			"--prompt", "--close-from", "--chdir", "--role", "--type", "--other-user",
+			"--command-timeout", "--chroot"}), ""
+	case "env":
+		args = skipShellOptions(args, "uCS", []string{"--unset", "--chdir", "--split-string"})
+		for len(args) > 0 && isShellAssignment(args[0]) {
+			args = args[1:]
+		}
+		return args, ""
+	case "nohup", "setsid", "exec", "builtin", "command", "time", "chroot":
+		if path.Base(words[0]) == "command" && len(args) > 0 && (args[0] == "-v" || args[0] == "-V") {
+			// command -v 只查找命令，不执行
+			return nil, ""
+		}
+		args = skipShellOptions(args, "", nil)
+		if path.Base(words[0]) == "chroot" && len(args) > 0 {
+			args = args[1:]
+		}
+		return args, ""
+	case "nice":
+		return skipShellOptions(args, "n", []string{"--adjustment"}), ""
+	case "ionice":
+		return skipShellOptions(args, "cnp", []string{"--class", "--classdata", "--pid"}), ""
+	case "stdbuf":
+		return skipShellOptions(args, "ioe", []string{"--input", "--output", "--error"}), ""
+	case "timeout":
+		args = skipShellOptions(args, "sk", []string{"--signal", "--kill-after"})
+		if len(args) > 0 {
+			// 超时时间
+			args = args[1:]
+		}
+		return args, ""
+	case "xargs":
+		return skipShellOptions(args, "IiLlnPsdEea", []string{"--replace", "--max-lines",
+			"--max-args", "--max-procs", "--max-chars", "--delimiter", "--eof", "--arg-file",
+			"--process-slot-var"}), ""
+	case "sh", "bash", "zsh", "dash", "ksh", "ash", "fish":
+		return nil, shellScriptArg(args)
+	case "su":
+		for i, arg := range args {
+			switch {
+			case arg == "-c" || arg == "--command":
+				if i+1 < len(args) {
+					return nil, args[i+1]
+				}
+			case strings.HasPrefix(arg, "--command="):
+				return nil, strings.TrimPrefix(arg, "--command=")
+			}
+		}
+	case "eval":
+		return nil, strings.Join(args, " ")
+	}
+	return nil, ""
+}
+
+// skipShellOptions 跳过选项，withArg 是需要参数的短选项，longWithArg 是需要参数的长选项
+func skipShellOptions(args []string, withArg string, longWithArg []string) []string {
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			return args[1:]
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return args
+		}
+		args = args[1:]
+		if strings.HasPrefix(arg, "--") {
+			if strings.Contains(arg, "=") {
+				continue
+			}
+			for _, name := range longWithArg {
+				if arg == name && len(args) > 0 {
+					args = args[1:]
+					break
+				}
+			}
+			continue
+		}
+		// 短选项可以合并，需要参数的选项在最后时参数是下一个单词
+		for i := 1; i < len(arg); i++ {
+			if strings.IndexByte(withArg, arg[i]) == -1 {
+				if arg[i] >= '0' && arg[i] <= '9' {
+					// nice -10
+					break
+				}
+				continue
+			}
+			if i == len(arg)-1 && len(args) > 0 {
+				args = args[1:]
+			}
+			break
+		}
+	}
+	return args
+}
+
+// shellScriptArg sh -c 后面的字符串，-c 可以和其他选项合并，例如 -lc
+func shellScriptArg(args []string) string {
+	hasC := false
+	for _, arg := range args {
+		if !hasC && strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") {
+			if strings.Contains(arg, "c") {
+				hasC = true
+			}
+			continue
+		}
+		if hasC {
+			return arg
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return ""
+		}
+	}
+	return ""
+}
+
+const (
+	shellTokEOF = iota
+	shellTokWord
+	shellTokOperator
+	shellTokRedirect
+)
+
+type shellToken struct {
+	kind int
+	// 单词去掉引号后的内容，重定向的操作符
+	text string
+	// 单词中的命令替换
+	subs []string
+	// 单词中有引号或者转义
+	quoted bool
+}
+
+type shellLexer struct {
+	src []rune
+	pos int
+}
+
+func (l *shellLexer) peek(offset int) rune {
+	if l.pos+offset < len(l.src) {
+		return l.src[l.pos+offset]
+	}
+	return 0
+}
+
+func (l *shellLexer) next() shellToken {
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return shellToken{kind: shellTokEOF}
+	}
+	c := l.src[l.pos]
+	switch c {
+	case '\n', '\r', ';', '(', ')':
+		l.pos++
+		return shellToken{kind: shellTokOperator, text: string(c)}
+	case '&', '|':
+		l.pos++
+		if c == '&' && l.peek(0) == '>' {
+			l.pos++
+			if l.peek(0) == '>' {
+				l.pos++
+			}
+			return shellToken{kind: shellTokRedirect}
+		}
+		if l.peek(0) == c || (c == '|' && l.peek(0) == '&') {
+			l.pos++
+		}
+		return shellToken{kind: shellTokOperator, text: string(c)}
+	case '<', '>':
+		if l.peek(1) == '(' {
+			// 进程替换
+			return l.word()
+		}
+		return shellToken{kind: shellTokRedirect, text: l.skipRedirect()}
+	case '#':
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+		return l.next()
+	}
+	return l.word()
+}
+
+// skipRedirect < > >> << <<- <<< <> >| >& <&，返回重定向的操作符
+func (l *shellLexer) skipRedirect() string {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case '<', '>', '|', '&', '-':
+			l.pos++
+			continue
+		}
+		return string(l.src[start:l.pos])
+	}
+	return string(l.src[start:l.pos])
+}
+
+// heredoc 跳过 here document 的内容，直到只有分隔符的一行，返回跳过的内容
+func (l *shellLexer) heredoc(delim string, stripTabs bool) string {
+	var body strings.Builder
+	for l.pos < len(l.src) {
+		start := l.pos
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+			l.pos++
+		}
+		line := string(l.src[start:l.pos])
+		if l.peek(0) == '\r' && l.peek(1) == '\n' {
+			l.pos++
+		}
+		l.pos++
+		if stripTabs {
+			line = strings.TrimLeft(line, "\t")
+		}
+		if line == delim {
+			break
+		}
+		body.WriteString(line)
+		body.WriteByte('\n')
+	}
+	if l.pos > len(l.src) {
+		l.pos = len(l.src)
+	}
+	return body.String()
+}
+
+// heredocSubstitutions here document 内容中的 $(...) 和 `...`
+func heredocSubstitutions(body string) []string {
+	l := &shellLexer{src: []rune(body)}
+	var subs []string
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch {
+		case c == '\\':
+			l.pos++
+		case c == '`':
+			subs = append(subs, l.untilBacktick())
+		case c == '$' && l.peek(0) == '(' && l.peek(1) != '(':
+			l.pos++
+			subs = append(subs, l.untilParen())
+		}
+	}
+	return subs
+}
+
+func isShellMeta(c rune) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', ';', '&', '|', '(', ')', '<', '>':
+		return true
+	}
+	return false
+}
+
+func (l *shellLexer) word() shellToken {
+	var (
+		b   strings.Builder
+		tok = shellToken{kind: shellTokWord}
+	)
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if (c == '<' || c == '>') && l.peek(1) == '(' {
+			l.pos += 2
+			inner := l.untilParen()
+			tok.subs = append(tok.subs, inner)
+			b.WriteString(string(c) + "(" + inner + ")")
+			continue
+		}
+		if isShellMeta(c) {
+			// 2>file 中的文件描述符
+			if (c == '<' || c == '>') && isShellNumber(b.String()) {
+				return shellToken{kind: shellTokRedirect, text: l.skipRedirect(), subs: tok.subs}
+			}
+			break
+		}
+		l.pos++
+		switch c {
+		case '\\', '\'', '"':
+			tok.quoted = true
+		}
+		switch c {
+		case '\\':
+			if l.pos < len(l.src) {
+				if l.src[l.pos] != '\n' {
+					b.WriteRune(l.src[l.pos])
+				}
+				l.pos++
+			}
+		case '\'':
+			for l.pos < len(l.src) && l.src[l.pos] != '\'' {
+				b.WriteRune(l.src[l.pos])
+				l.pos++
+			}
+			l.pos++
+		case '"':
+			l.doubleQuote(&b, &tok)
+		case '$':
+			l.dollar(&b, &tok)
+		case '`':
+			inner := l.untilBacktick()
+			tok.subs = append(tok.subs, inner)
+			b.WriteString("`" + inner + "`")
+		default:
+			b.WriteRune(c)
+		}
+	}
+	tok.text = b.String()
+	return tok
+}
+
+func isShellNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func (l *shellLexer) doubleQuote(b *strings.Builder, tok *shellToken) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case '"':
+			return
+		case '\\':
+			if l.pos < len(l.src) {
+				next := l.src[l.pos]
+				switch next {
+				case '$', '`', '"', '\\':
+					b.WriteRune(next)
+				case '\n':
+				default:
+					b.WriteRune('\\')
+					b.WriteRune(next)
+				}
+				l.pos++
+			}
+		case '$':
+			l.dollar(b, tok)
+		case '`':
+			inner := l.untilBacktick()
+			tok.subs = append(tok.subs, inner)
+			b.WriteString("`" + inner + "`")
+		default:
+			b.WriteRune(c)
+		}
+	}
+}
+
+// dollar $(...) 命令替换，$((...)) 算术运算，${...} 变量，$'...' 转义字符串
+func (l *shellLexer) dollar(b *strings.Builder, tok *shellToken) {
+	switch l.peek(0) {
+	case '(':
+		l.pos++
+		if l.peek(0) == '(' {
+			l.pos++
+			inner := l.untilParen()
+			if l.peek(0) == ')' {
+				l.pos++
+			}
+			b.WriteString("$((" + inner + "))")
+			return
+		}
+		inner := l.untilParen()
+		tok.subs = append(tok.subs, inner)
+		b.WriteString("$(" + inner + ")")
+	case '{':
+		start := l.pos
+		for l.pos < len(l.src) && l.src[l.pos] != '}' {
+			l.pos++
+		}
+		l.pos++
+		if l.pos > len(l.src) {
+			l.pos = len(l.src)
+		}
+		b.WriteString("$" + string(l.src[start:l.pos]))
+	case '\'':
+		l.pos++
+		b.WriteString(l.ansiCQuote())
+	default:
+		b.WriteRune('$')
+	}
+}
+
+// untilParen 返回到匹配的右括号之前的内容，跳过引号中的括号
+func (l *shellLexer) untilParen() string {
+	start := l.pos
+	depth := 1
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '\\':
+			l.pos++
+		case '\'':
+			l.pos++
+			for l.pos < len(l.src) && l.src[l.pos] != '\'' {
+				l.pos++
+			}
+		case '"':
+			l.pos++
+			for l.pos < len(l.src) && l.src[l.pos] != '"' {
+				if l.src[l.pos] == '\\' {
+					l.pos++
+				}
+				l.pos++
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				inner := string(l.src[start:l.pos])
+				l.pos++
+				return inner
+			}
+		}
+		l.pos++
+	}
+	if l.pos > len(l.src) {
+		l.pos = len(l.src)
+	}
+	return string(l.src[start:l.pos])
+}
+
+// untilBacktick 反引号中的 \` \\ \$ 去掉转义
+func (l *shellLexer) untilBacktick() string {
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case '`':
+			return b.String()
+		case '\\':
+			if l.pos < len(l.src) {
+				next := l.src[l.pos]
+				if next != '`' && next != '\\' && next != '$' {
+					b.WriteRune('\\')
+				}
+				b.WriteRune(next)
+				l.pos++
+			}
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func (l *shellLexer) ansiCQuote() string {
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		if c == '\'' {
+			break
+		}
+		if c != '\\' || l.pos >= len(l.src) {
+			b.WriteRune(c)
+			continue
+		}
+		next := l.src[l.pos]
+		l.pos++
+		switch next {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'e', 'E':
+			b.WriteByte(0x1b)
+		case 'x':
+			b.WriteRune(l.readCode(16, 2))
+		case 'u':
+			b.WriteRune(l.readCode(16, 4))
+		case 'U':
+			b.WriteRune(l.readCode(16, 8))
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			l.pos--
+			b.WriteRune(l.readCode(8, 3))
+		default:
+			b.WriteRune(next)
+		}
+	}
+	return b.String()
+}
+
+func (l *shellLexer) readCode(base, maxDigits int) rune {
+	start := l.pos
+	for l.pos < len(l.src) && l.pos-start < maxDigits {
+		if _, err := strconv.ParseUint(string(l.src[l.pos]), base, 8); err != nil {
+			break
+		}
+		l.pos++
+	}
+	value, err := strconv.ParseUint(string(l.src[start:l.pos]), base, 32)
+	if err != nil {
+		return 0
+	}
+	return rune(value)
+}
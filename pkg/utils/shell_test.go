@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestShellCommands(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"ls -l", []string{"ls -l"}},
+		{"ls; rm -rf /", []string{"ls", "rm -rf /"}},
+		{"ls && rm -rf / || echo ok | grep o", []string{"ls", "rm -rf /", "echo ok", "grep o"}},
+		{"(cd /tmp; rm -rf x)", []string{"cd /tmp", "rm -rf x"}},
+		{"echo $(rm -rf /)", []string{"rm -rf /", "echo $(rm -rf /)"}},
+		{"echo `rm -rf /`", []string{"rm -rf /", "echo `rm -rf /`"}},
+		{"diff <(rm a) b", []string{"rm a", "diff <(rm a) b"}},
+		{"bash -c 'rm -rf /'", []string{"bash -c rm -rf /", "rm -rf /"}},
+		{"/bin/sh -lc \"ls; rm x\"", []string{"/bin/sh -lc ls; rm x", "ls", "rm x"}},
+		{"sudo -u root rm -rf /", []string{"sudo -u root rm -rf /", "rm -rf /"}},
+		{"env -i A=1 nohup timeout -s 9 10 rm x", []string{
+			"env -i A=1 nohup timeout -s 9 10 rm x", "nohup timeout -s 9 10 rm x",
+			"timeout -s 9 10 rm x", "rm x"}},
+		{"find . | xargs -n 1 rm", []string{"find .", "xargs -n 1 rm", "rm"}},
+		{"su - root -c 'rm x'", []string{"su - root -c rm x", "rm x"}},
+		{"eval rm x", []string{"eval rm x", "rm x"}},
+		{`r\m x`, []string{"rm x"}},
+		{`"r"m x`, []string{"rm x"}},
+		{`$'\x72m' x`, []string{"rm x"}},
+		{"A=1 rm x > /dev/null 2>&1", []string{"rm x"}},
+		{"if true; then rm x; fi", []string{"true", "rm x"}},
+		{"rm x # comment", []string{"rm x"}},
+		{"echo '$(rm x)'", []string{"echo $(rm x)"}},
+		{"cat <<EOF > a\nrm x\nEOF\nls", []string{"cat", "ls"}},
+		{"cat <<-EOF\n\trm x $(id)\n\tEOF", []string{"cat", "id"}},
+		{"cat <<'EOF'\n$(rm x)\nEOF", []string{"cat"}},
+	}
+	for _, tt := range tests {
+		got, _ := ShellCommands(tt.line)
+		if len(got) != len(tt.want) {
+			t.Errorf("ShellCommands(%q) = %q, want %q", tt.line, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ShellCommands(%q) = %q, want %q", tt.line, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestShellCommands_Incomplete(t *testing.T) {
+	if _, complete := ShellCommands("ls; rm x"); !complete {
+		t.Error("simple command should be complete")
+	}
+	var b strings.Builder
+	for i := 0; i < maxShellCommands; i++ {
+		b.WriteString("ls " + strconv.Itoa(i) + ";")
+	}
+	line := b.String() + "rm x"
+	if commands, complete := ShellCommands(line); complete || len(commands) > maxShellCommands {
+		t.Errorf("too many commands should be incomplete: %d %t", len(commands), complete)
+	}
+	line = strings.Repeat("echo $(", maxShellDepth+2) + "rm x" + strings.Repeat(")", maxShellDepth+2)
+	if _, complete := ShellCommands(line); complete {
+		t.Error("too deep command should be incomplete")
+	}
+}
+
+func TestSplitShellArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{`scp -t "/tmp/a b"`, []string{"scp", "-t", "/tmp/a b"}},
+		{`scp -f "/tmp/a\ b" '/tmp/c\d'`, []string{"scp", "-f", `/tmp/a\ b`, `/tmp/c\d`}},
+		{`scp -t "/tmp/\"x\""`, []string{"scp", "-t", `/tmp/"x"`}},
+		{`rsync --server . /tmp/a\ b 2>/dev/null; rm x`, []string{"rsync", "--server", ".", "/tmp/a b"}},
+	}
+	for _, tt := range tests {
+		got := SplitShellArgs(tt.line)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("SplitShellArgs(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
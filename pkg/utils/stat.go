@@ -34,8 +34,12 @@ func CpuLoad1Usage() float64 {
 }
 
 func DiskUsagePercent() float64 {
-	rootPath := config.GetConf().RootPath
-	usage, err := disk.Usage(rootPath)
+	return DiskUsagePercentOf(config.GetConf().RootPath)
+}
+
+// DiskUsagePercentOf 路径所在文件系统的使用率
+func DiskUsagePercentOf(path string) float64 {
+	usage, err := disk.Usage(path)
 	if err != nil {
 		logger.Errorf("Get disk usage err: %s", err)
 		return -1
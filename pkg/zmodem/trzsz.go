@@ -0,0 +1,490 @@
+package zmodem
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+trzsz (trz 上传，tsz 下载) 的解析，资产上的 trz tsz 输出触发字符串:
+
+	::TRZSZ:TRANSFER:R:1.1.5:1234567890123   R 上传文件，D 上传目录，S 下载
+
+之后双方发送以换行结尾的消息 #TYPE:value，字符串使用 zlib 压缩后 base64 编码:
+	客户端 #ACT:{"confirm":true,...}  用户取消时 confirm 为 false
+	发送端 #NUM:n  #NAME:名称  #SIZE:n  #DATA:...  #MD5:...
+	接收端 #SUCC:...  每一步确认，MD5 的确认表示文件传输成功
+	#fail: #FAIL: 出错，#EXIT: 资产上的 trz tsz 结束
+DATA 在 binary 模式下是 #DATA:长度 后面跟着原始数据，否则是编码后的数据。
+*/
+
+var trzszTriggerRegexp = regexp.MustCompile(`::TRZSZ:TRANSFER:([SRD]):(\d+\.\d+\.\d+)(:\d+)?`)
+
+const (
+	trzszMaxTypeLen   = 16
+	trzszMaxValueLen  = 64 * 1024
+	trzszMaxDataLen   = 32
+	trzszIdleTimeout  = 5 * time.Minute
+	trzszActTimeout   = 20 * time.Second
+	trzszMsgData      = "DATA"
+	trzszMsgName      = "NAME"
+	trzszMsgSize      = "SIZE"
+	trzszMsgMD5       = "MD5"
+	trzszMsgSucc      = "SUCC"
+	trzszMsgAction    = "ACT"
+	trzszMsgExit      = "EXIT"
+	trzszMsgFail      = "FAIL"
+	trzszMsgFailLower = "fail"
+)
+
+// DetectTrzsz 查找资产输出中的 trzsz 触发字符串，返回传输类型和位置
+func DetectTrzsz(p []byte) (transferType string, loc []int, ok bool) {
+	loc = trzszTriggerRegexp.FindSubmatchIndex(p)
+	if loc == nil {
+		return "", nil, false
+	}
+	transferType = TypeUpload
+	if p[loc[2]] == 'S' {
+		transferType = TypeDownload
+	}
+	return transferType, loc[:2], true
+}
+
+// trzszTriggerMaxLen 触发字符串的最大长度，跨越两次输出时保留上次输出的结尾
+const trzszTriggerMaxLen = 64
+
+// TrzszDetector 检测跨越多次输出的触发字符串，保留上次输出的结尾和本次输出一起查找
+type TrzszDetector struct {
+	tail []byte
+}
+
+// Detect 返回的位置相对于 p，触发字符串从上次输出开始时 loc[0] 为 0
+func (d *TrzszDetector) Detect(p []byte) (transferType string, loc []int, ok bool) {
+	buf := p
+	if len(d.tail) > 0 {
+		buf = make([]byte, 0, len(d.tail)+len(p))
+		buf = append(buf, d.tail...)
+		buf = append(buf, p...)
+	}
+	offset := len(buf) - len(p)
+	transferType, loc, ok = DetectTrzsz(buf)
+	if !ok {
+		d.keep(buf)
+		return "", nil, false
+	}
+	// 同一个触发字符串不再重复检测
+	d.keep(buf[loc[1]:])
+	start, end := loc[0]-offset, loc[1]-offset
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	return transferType, []int{start, end}, true
+}
+
+func (d *TrzszDetector) keep(buf []byte) {
+	if len(buf) > trzszTriggerMaxLen {
+		buf = buf[len(buf)-trzszTriggerMaxLen:]
+	}
+	d.tail = append(d.tail[:0], buf...)
+}
+
+// Reset 清空保留的输出
+func (d *TrzszDetector) Reset() {
+	d.tail = d.tail[:0]
+}
+
+// TrzszFailMessage 发送给 trz tsz 的错误消息，资产上的 trz tsz 显示错误并退出
+func TrzszFailMessage(msg string) []byte {
+	return []byte("#fail:" + trzszEncodeString(msg) + "\n")
+}
+
+func NewTrzsz() *TrzszParser {
+	var p TrzszParser
+	p.setStatus(ZParserStatusNone)
+	return &p
+}
+
+type TrzszParser struct {
+	sync.Mutex
+
+	status atomic.Value
+
+	FileEventCallback func(zinfo *ZFileInfo, status bool)
+
+	FireStatusEvent func(event StatusEvent)
+
+	transferType string
+	client       trzszScanner
+	server       trzszScanner
+	current      *ZFileInfo
+	currentIsDir bool
+	lastActive   time.Time
+	// 收到客户端的 #ACT 之后才确认是 trzsz 客户端
+	acted bool
+}
+
+// Start 检测到触发字符串后开始解析
+func (t *TrzszParser) Start(transferType string) {
+	t.Lock()
+	defer t.Unlock()
+	t.transferType = transferType
+	t.client = trzszScanner{}
+	t.server = trzszScanner{}
+	t.current = nil
+	t.lastActive = time.Now()
+	t.acted = false
+	status := ZParserStatusReceive
+	if transferType == TypeDownload {
+		status = ZParserStatusSend
+	}
+	t.setStatus(status)
+	logger.Infof("Trzsz session %s start", transferType)
+	if t.FireStatusEvent != nil {
+		t.FireStatusEvent(StartEvent)
+	}
+}
+
+func (t *TrzszParser) IsStartSession() bool {
+	return t.Status() != ZParserStatusNone
+}
+
+func (t *TrzszParser) Status() string {
+	return t.status.Load().(string)
+}
+
+func (t *TrzszParser) setStatus(status string) {
+	t.status.Store(status)
+}
+
+// ParseClient 解析用户发送给资产的数据，返回 false 表示不是 trzsz 协议的数据，
+// 此时会话已经结束，数据需要按照普通输入处理
+func (t *TrzszParser) ParseClient(p []byte) bool {
+	return t.parse(p, true)
+}
+
+// ParseServer 解析资产发送给用户的数据，返回 false 表示会话已经超时结束
+func (t *TrzszParser) ParseServer(p []byte) bool {
+	return t.parse(p, false)
+}
+
+/*
+资产的输出中包含触发字符串就会开始解析，例如 echo 触发字符串，此时用户并没有使用 trzsz 客户端，
+所以在 trzszActTimeout 内没有收到客户端的 #ACT，或者客户端发送了不是协议的数据，都结束会话。
+只有解析到消息时才更新活跃时间，避免普通的输出使会话一直不超时。
+*/
+func (t *TrzszParser) parse(p []byte, fromClient bool) bool {
+	t.Lock()
+	defer t.Unlock()
+	if !t.IsStartSession() {
+		return false
+	}
+	if !t.acted && time.Since(t.lastActive) > trzszActTimeout {
+		logger.Infof("Trzsz session %s wait client action timeout", t.transferType)
+		t.end(false)
+		return false
+	}
+	if time.Since(t.lastActive) > trzszIdleTimeout {
+		logger.Infof("Trzsz session %s idle timeout", t.transferType)
+		t.end(false)
+		return false
+	}
+	scanner := &t.server
+	if fromClient {
+		scanner = &t.client
+	}
+	messages := scanner.feed(p)
+	if fromClient && scanner.invalid {
+		logger.Infof("Trzsz session %s got non-protocol client input", t.transferType)
+		t.end(false)
+		return false
+	}
+	for _, msg := range messages {
+		if fromClient && !t.acted && msg.typ != trzszMsgAction {
+			logger.Infof("Trzsz session %s got client message %s before action", t.transferType, msg.typ)
+			t.end(false)
+			return false
+		}
+		t.lastActive = time.Now()
+		t.onMessage(msg, fromClient)
+		if !t.IsStartSession() {
+			return true
+		}
+	}
+	return true
+}
+
+// isSender 上传时客户端是发送端，下载时资产是发送端
+func (t *TrzszParser) isSender(fromClient bool) bool {
+	return fromClient == (t.transferType == TypeUpload)
+}
+
+func (t *TrzszParser) onMessage(msg trzszMessage, fromClient bool) {
+	switch msg.typ {
+	case trzszMsgFail, trzszMsgFailLower:
+		errMsg, _ := trzszDecodeString(msg.value)
+		logger.Infof("Trzsz session %s failed: %s", t.transferType, errMsg)
+		t.end(false)
+		return
+	case trzszMsgExit:
+		t.end(false)
+		return
+	case trzszMsgAction:
+		if fromClient {
+			t.acted = true
+		}
+		var action struct {
+			Confirm bool `json:"confirm"`
+		}
+		if value, err := trzszDecodeString(msg.value); err == nil &&
+			json.Unmarshal([]byte(value), &action) == nil && !action.Confirm {
+			logger.Infof("Trzsz session %s cancelled by user", t.transferType)
+			t.end(false)
+		}
+		return
+	}
+	if !t.isSender(fromClient) {
+		if msg.typ == trzszMsgSucc && t.current != nil && t.current.gotEOF {
+			t.finishFile(true)
+		}
+		return
+	}
+	switch msg.typ {
+	case trzszMsgName:
+		t.finishFile(false)
+		name, isDir, err := trzszDecodeName(msg.value)
+		if err != nil {
+			logger.Errorf("Trzsz decode file name err: %s", err)
+			return
+		}
+		t.current = &ZFileInfo{filename: name, parserTime: time.Now(), transferType: t.transferType}
+		t.currentIsDir = isDir
+		logger.Infof("Trzsz parser got filename: %s", name)
+	case trzszMsgSize:
+		if t.current != nil {
+			size, _ := strconv.Atoi(msg.value)
+			t.current.size = size
+		}
+	case trzszMsgData:
+		if t.current != nil {
+			t.current.dataStarted = true
+			t.current.offset += msg.dataLen
+		}
+	case trzszMsgMD5:
+		if t.current != nil {
+			t.current.gotEOF = true
+		}
+	}
+}
+
+// finishFile 目录只确认创建，不记录
+func (t *TrzszParser) finishFile(success bool) {
+	info := t.current
+	t.current = nil
+	if info == nil || t.currentIsDir {
+		return
+	}
+	logger.Infof("Trzsz file %s size %d success: %v", info.filename, info.size, success)
+	if t.FileEventCallback != nil {
+		t.FileEventCallback(info, success)
+	}
+}
+
+func (t *TrzszParser) end(success bool) {
+	t.finishFile(success)
+	logger.Infof("Trzsz session %s end", t.transferType)
+	t.setStatus(ZParserStatusNone)
+	if t.FireStatusEvent != nil {
+		t.FireStatusEvent(EndEvent)
+	}
+}
+
+// Cleanup 会话结束时记录未完成的文件
+func (t *TrzszParser) Cleanup() {
+	t.Lock()
+	defer t.Unlock()
+	if t.IsStartSession() {
+		t.end(false)
+	}
+}
+
+type trzszMessage struct {
+	typ     string
+	value   string
+	dataLen int64
+}
+
+const (
+	trzszStateLineStart = iota
+	trzszStateType
+	trzszStateValue
+	trzszStateSkipLine
+	trzszStateBinary
+)
+
+// trzszScanner 按行解析消息，DATA 的内容不保存
+type trzszScanner struct {
+	state  int
+	typ    bytes.Buffer
+	value  bytes.Buffer
+	remain int64
+	// DATA 是编码后的数据时只统计长度
+	skipped int64
+	// 出现了不是 #TYPE: 开头的行
+	invalid bool
+}
+
+func (s *trzszScanner) feed(p []byte) []trzszMessage {
+	var messages []trzszMessage
+	for len(p) > 0 {
+		switch s.state {
+		case trzszStateBinary:
+			n := int64(len(p))
+			if n > s.remain {
+				n = s.remain
+			}
+			s.remain -= n
+			p = p[n:]
+			if s.remain == 0 {
+				s.state = trzszStateLineStart
+			}
+			continue
+		case trzszStateSkipLine:
+			idx := bytes.IndexByte(p, '\n')
+			if idx == -1 {
+				s.skipped += int64(len(p))
+				return messages
+			}
+			s.skipped += int64(idx)
+			p = p[idx+1:]
+			if s.typ.String() == trzszMsgData {
+				messages = append(messages, trzszMessage{typ: trzszMsgData, dataLen: s.skipped})
+			}
+			s.reset()
+			continue
+		}
+		c := p[0]
+		p = p[1:]
+		switch s.state {
+		case trzszStateLineStart:
+			switch c {
+			case '#':
+				s.state = trzszStateType
+			case '\r', '\n':
+			default:
+				s.invalid = true
+				s.state = trzszStateSkipLine
+			}
+		case trzszStateType:
+			switch {
+			case c == ':':
+				s.state = trzszStateValue
+			case (c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') &&
+				s.typ.Len() < trzszMaxTypeLen:
+				s.typ.WriteByte(c)
+			case c == '\n':
+				s.invalid = true
+				s.reset()
+			default:
+				s.invalid = true
+				s.state = trzszStateSkipLine
+			}
+		case trzszStateValue:
+			if c == '\n' {
+				messages = append(messages, s.endLine()...)
+				continue
+			}
+			s.value.WriteByte(c)
+			limit := trzszMaxValueLen
+			if s.typ.String() == trzszMsgData {
+				limit = trzszMaxDataLen
+			}
+			if s.value.Len() > limit {
+				s.skipped = int64(s.value.Len())
+				s.value.Reset()
+				s.state = trzszStateSkipLine
+			}
+		}
+	}
+	return messages
+}
+
+func (s *trzszScanner) endLine() []trzszMessage {
+	msg := trzszMessage{
+		typ:   s.typ.String(),
+		value: strings.TrimSuffix(s.value.String(), "\r"),
+	}
+	s.reset()
+	if msg.typ != trzszMsgData {
+		return []trzszMessage{msg}
+	}
+	// binary 模式: #DATA:长度 后面是原始数据
+	if n, err := strconv.ParseInt(msg.value, 10, 64); err == nil && n >= 0 {
+		msg.dataLen = n
+		if n > 0 {
+			s.state = trzszStateBinary
+			s.remain = n
+		}
+	} else {
+		msg.dataLen = int64(len(msg.value))
+	}
+	return []trzszMessage{msg}
+}
+
+func (s *trzszScanner) reset() {
+	s.state = trzszStateLineStart
+	s.typ.Reset()
+	s.value.Reset()
+	s.skipped = 0
+}
+
+func trzszDecodeString(value string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	buf, err := io.ReadAll(io.LimitReader(r, trzszMaxValueLen))
+	return string(buf), err
+}
+
+func trzszEncodeString(value string) string {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	_, _ = w.Write([]byte(value))
+	_ = w.Close()
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// trzszDecodeName 传输目录时名称是 json，包含相对路径和是否是目录
+func trzszDecodeName(value string) (name string, isDir bool, err error) {
+	name, err = trzszDecodeString(value)
+	if err != nil || !strings.HasPrefix(name, "{") {
+		return
+	}
+	var pathInfo struct {
+		PathName []string `json:"path_name"`
+		IsDir    bool     `json:"is_dir"`
+	}
+	if json.Unmarshal([]byte(name), &pathInfo) == nil && len(pathInfo.PathName) > 0 {
+		return strings.Join(pathInfo.PathName, "/"), pathInfo.IsDir, nil
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package zmodem
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTrzszParser_Upload(t *testing.T) {
+	output := []byte("\x1b7\x07::TRZSZ:TRANSFER:R:1.1.5:1700000000000\r\n")
+	transferType, loc, ok := DetectTrzsz(output)
+	if !ok || transferType != TypeUpload || loc[0] != 3 {
+		t.Fatalf("detect trzsz failed: %s %v", transferType, loc)
+	}
+	p := NewTrzsz()
+	type result struct {
+		name    string
+		size    int64
+		success bool
+	}
+	var results []result
+	p.FileEventCallback = func(info *ZFileInfo, status bool) {
+		results = append(results, result{info.Filename(), info.Size(), status})
+	}
+	p.Start(transferType)
+	p.ParseClient([]byte("#ACT:" + trzszEncodeString(`{"confirm":true}`) + "\n"))
+	p.ParseServer([]byte("#CFG:" + trzszEncodeString(`{"binary":true}`) + "\n"))
+	p.ParseClient([]byte("#NUM:1\n#NAME:" + trzszEncodeString("a.txt") + "\n"))
+	p.ParseServer([]byte("#SUCC:" + trzszEncodeString("a.txt") + "\n"))
+	data := "#FAIL:\n\x00\x01"
+	p.ParseClient([]byte(fmt.Sprintf("#SIZE:%d\n#DATA:%d\n%s", len(data), len(data), data[:3])))
+	p.ParseClient([]byte(data[3:] + "#MD5:" + trzszEncodeString("md5") + "\n"))
+	if !p.IsStartSession() || len(results) != 0 {
+		t.Fatalf("transfer should be in progress, got %v", results)
+	}
+	p.ParseServer([]byte("#SUCC:" + trzszEncodeString("md5") + "\n"))
+	p.ParseServer([]byte("#EXIT:" + trzszEncodeString("Received a.txt") + "\n"))
+	if p.IsStartSession() {
+		t.Fatal("trzsz session should be end")
+	}
+	if len(results) != 1 || results[0] != (result{"a.txt", int64(len(data)), true}) {
+		t.Fatalf("unexpected results: %v", results)
+	}
+}
+
+func TestTrzszParser_Cancel(t *testing.T) {
+	p := NewTrzsz()
+	p.Start(TypeDownload)
+	p.ParseClient([]byte("#ACT:" + trzszEncodeString(`{"confirm":false}`) + "\n"))
+	if p.IsStartSession() {
+		t.Fatal("cancelled trzsz session should be end")
+	}
+}
+
+func TestTrzszDetector_Split(t *testing.T) {
+	var d TrzszDetector
+	if _, _, ok := d.Detect([]byte("$ tsz a.txt\r\n\x1b7\x07::TRZSZ:TRAN")); ok {
+		t.Fatal("incomplete trigger should not be detected")
+	}
+	output := []byte("SFER:S:1.1.5:1700000000000\r\n")
+	transferType, loc, ok := d.Detect(output)
+	if !ok || transferType != TypeDownload || loc[0] != 0 || loc[1] != len(output)-2 {
+		t.Fatalf("detect split trzsz failed: %s %v", transferType, loc)
+	}
+	if _, _, ok = d.Detect([]byte("#ACT:")); ok {
+		t.Fatal("trigger detected twice")
+	}
+}
+
+func TestTrzszParser_NotClient(t *testing.T) {
+	p := NewTrzsz()
+	p.Start(TypeDownload)
+	if p.ParseClient([]byte("rm -rf /\r")) || p.IsStartSession() {
+		t.Fatal("non-protocol input should end trzsz session")
+	}
+	p.Start(TypeUpload)
+	if p.ParseClient([]byte("#NAME:"+trzszEncodeString("a.txt")+"\n")) || p.IsStartSession() {
+		t.Fatal("message before action should end trzsz session")
+	}
+	p.Start(TypeUpload)
+	p.lastActive = time.Now().Add(-trzszActTimeout - time.Second)
+	if p.ParseServer([]byte("$ ")) || p.IsStartSession() {
+		t.Fatal("trzsz session should end without client action")
+	}
+}
@@ -0,0 +1,85 @@
+package zmodem
+
+/*
+ZDATA 帧后面是一个或多个数据子包，数据经过 ZDLE 转义:
+
+	data... ZDLE ZCRCx CRC-1 CRC-2 [CRC-3 CRC-4]
+
+ZCRCG、ZCRCQ 后面继续是同一帧的子包，ZCRCE、ZCRCW 表示帧结束，后面是下一个头部。
+CRC 的长度与 ZDATA 头部的类型相同 (ZBIN 2 字节，ZBIN32 4 字节)，不校验 CRC。
+*/
+
+// maxSubPacketLen 子包的最大长度，超过说明解析出错
+const maxSubPacketLen = 16 * 1024
+
+type dataDecoder struct {
+	crcLen int
+
+	escaped    bool
+	crcRemain  int
+	frameEnd   bool
+	packetSize int
+
+	onData func(p []byte)
+}
+
+func newDataDecoder(crcLen int, onData func(p []byte)) *dataDecoder {
+	return &dataDecoder{crcLen: crcLen, onData: onData}
+}
+
+// feed 解析数据子包，返回使用的字节数，帧结束时 end 为 true，剩余的数据是后面的头部
+func (d *dataDecoder) feed(p []byte) (n int, end bool, ok bool) {
+	data := make([]byte, 0, len(p))
+	flush := func() {
+		if len(data) > 0 && d.onData != nil {
+			d.onData(data)
+		}
+		data = data[:0]
+	}
+	for i, c := range p {
+		if c == 0x11 || c == 0x13 || c == 0x91 || c == 0x93 {
+			// XON XOFF 流控字符，数据中的这些字符都会被转义
+			continue
+		}
+		if !d.escaped && c == ZDLE {
+			d.escaped = true
+			continue
+		}
+		escaped := d.escaped
+		d.escaped = false
+		if d.crcRemain > 0 {
+			d.crcRemain--
+			if d.crcRemain == 0 && d.frameEnd {
+				flush()
+				return i + 1, true, true
+			}
+			continue
+		}
+		if !escaped {
+			data = append(data, c)
+			d.packetSize++
+			if d.packetSize > maxSubPacketLen {
+				flush()
+				return i + 1, true, false
+			}
+			continue
+		}
+		switch c {
+		case ZCRCE, ZCRCW, ZCRCG, ZCRCQ:
+			d.frameEnd = c == ZCRCE || c == ZCRCW
+			d.crcRemain = d.crcLen
+			d.packetSize = 0
+		case ZRUB0:
+			data = append(data, 0x7f)
+			d.packetSize++
+		case ZRUB1:
+			data = append(data, 0xff)
+			d.packetSize++
+		default:
+			data = append(data, c^0x40)
+			d.packetSize++
+		}
+	}
+	flush()
+	return len(p), false, true
+}
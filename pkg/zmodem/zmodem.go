@@ -28,12 +28,19 @@ type ZmodemParser struct {
 
 	FileEventCallback func(zinfo *ZFileInfo, status bool)
 
+	// FileDataCallback ZDATA 中的文件内容和在文件中的位置
+	FileDataCallback func(zinfo *ZFileInfo, offset int64, p []byte)
+
+	// MaxTransferSize 单个文件的最大传输大小，0 表示不限制
+	MaxTransferSize int64
+
 	currentZFileInfo *ZFileInfo
 
 	currentHeader *ZmodemHeader
 
 	abortMark       bool // 不记录中断的文件
 	hasDataTransfer bool
+	exceedLimit     bool
 
 	FireStatusEvent func(event StatusEvent)
 
@@ -54,7 +61,7 @@ func (z *ZmodemParser) Parse(p []byte) {
 			if z.FileEventCallback != nil && z.currentZFileInfo != nil {
 				info := z.currentZFileInfo
 				transferStatus := false
-				if zSession.transferStatus != TransferStatusAbort {
+				if zSession.transferStatus != TransferStatusAbort && info.Completed() {
 					transferStatus = true
 				}
 				if !z.abortMark {
@@ -93,6 +100,8 @@ func (z *ZmodemParser) Parse(p []byte) {
 			},
 			ZFileHeaderCallback: z.zFileFrameCallback,
 			zOnHeader:           z.OnHeader,
+			zOnData:             z.onData,
+			zOnDataError:        z.onDataError,
 		}
 		z.setStatus(ZParserStatusSend)
 		if z.FireStatusEvent != nil {
@@ -109,6 +118,8 @@ func (z *ZmodemParser) Parse(p []byte) {
 			},
 			ZFileHeaderCallback: z.zFileFrameCallback,
 			zOnHeader:           z.OnHeader,
+			zOnData:             z.onData,
+			zOnDataError:        z.onDataError,
 		}
 		z.setStatus(ZParserStatusReceive)
 		if z.FireStatusEvent != nil {
@@ -120,6 +131,7 @@ func (z *ZmodemParser) Parse(p []byte) {
 		z.abortMark = false
 		z.setStatus(ZParserStatusNone)
 	}
+	z.exceedLimit = false
 }
 
 func (z *ZmodemParser) IsStartSession() bool {
@@ -148,25 +160,30 @@ func (z *ZmodemParser) SetAbortMark() {
 func (z *ZmodemParser) OnHeader(hd *ZmodemHeader) {
 	z.currentHeader = hd
 	switch hd.Type {
-	case ZEOF, ZFILE:
+	case ZFILE:
+		// 接收端可能使用 ZRPOS 要求 ZEOF 之后重传，下一个文件开始时才结束上一个文件
 		if z.FileEventCallback != nil && z.currentZFileInfo != nil {
-			z.FileEventCallback(z.currentZFileInfo, true)
+			z.FileEventCallback(z.currentZFileInfo, z.currentZFileInfo.Completed())
 		}
 		z.currentZFileInfo = nil
 		z.hasDataTransfer = false
+	case ZEOF:
+		if info := z.currentZFileInfo; info != nil {
+			info.gotEOF = true
+			info.eofOffset = hd.Position()
+		}
 	case ZDATA:
 		z.hasDataTransfer = true
+		if info := z.currentZFileInfo; info != nil {
+			info.onPosition(hd.Position())
+		}
 	case ZFIN:
 		if !z.abortMark {
 			if z.FileEventCallback != nil && z.currentZFileInfo != nil {
-				status := true
-				if !z.hasDataTransfer && z.currentZFileInfo.size > 0 {
-					/*
-					 如果没有文件传输，且文件大小大于0， 则代表下载失败
-					*/
-					status = false
-				}
-				z.FileEventCallback(z.currentZFileInfo, status)
+				/*
+				 没有收到 ZEOF 或者数据不完整，则代表传输失败
+				*/
+				z.FileEventCallback(z.currentZFileInfo, z.currentZFileInfo.Completed())
 			}
 		}
 		z.currentZFileInfo = nil
@@ -174,9 +191,66 @@ func (z *ZmodemParser) OnHeader(hd *ZmodemHeader) {
 	}
 }
 
+func (z *ZmodemParser) onData(p []byte) {
+	info := z.currentZFileInfo
+	if info == nil || info.exceeded || z.abortMark {
+		return
+	}
+	offset := info.offset
+	info.offset += int64(len(p))
+	if z.MaxTransferSize > 0 && info.offset > z.MaxTransferSize {
+		logger.Errorf("Zmodem file %s exceeds the max transfer size %d", info.filename,
+			z.MaxTransferSize)
+		info.exceeded = true
+		z.exceedLimit = true
+		return
+	}
+	if z.FileDataCallback != nil {
+		z.FileDataCallback(info, offset, p)
+	}
+}
+
+func (z *ZmodemParser) onDataError() {
+	if info := z.currentZFileInfo; info != nil {
+		info.incomplete = true
+	}
+}
+
+// ExceedLimit 当前文件超过了传输大小的限制，需要调用 Abort 取消传输
+func (z *ZmodemParser) ExceedLimit() bool {
+	return z.exceedLimit
+}
+
+// Abort 取消传输，记录当前文件失败并结束会话
+func (z *ZmodemParser) Abort() {
+	z.Lock()
+	defer z.Unlock()
+	if !z.IsStartSession() {
+		return
+	}
+	if z.FileEventCallback != nil && z.currentZFileInfo != nil && !z.abortMark {
+		z.FileEventCallback(z.currentZFileInfo, false)
+	}
+	logger.Infof("Zmodem session %s aborted", z.Status())
+	z.currentZFileInfo = nil
+	z.currentSession = nil
+	z.hasDataTransfer = false
+	z.exceedLimit = false
+	z.setStatus(ZParserStatusNone)
+	if z.FireStatusEvent != nil {
+		z.FireStatusEvent(EndEvent)
+	}
+}
+
 func (z *ZmodemParser) zFileFrameCallback(info *ZFileInfo) {
 	z.currentZFileInfo = info
 	logger.Infof("Zmodem parser got filename: %s siz: %d", info.filename, info.size)
+	if z.MaxTransferSize > 0 && info.Size() > z.MaxTransferSize {
+		logger.Errorf("Zmodem file %s size %d exceeds the max transfer size %d", info.filename,
+			info.size, z.MaxTransferSize)
+		info.exceeded = true
+		z.exceedLimit = true
+	}
 }
 
 func (z *ZmodemParser) IsZFilePacket() bool {
@@ -1,6 +1,8 @@
 package zmodem
 
 import (
+	"bytes"
+	"fmt"
 	"testing"
 )
 
@@ -22,3 +24,82 @@ func TestDecodeB16FrameHeader(t *testing.T) {
 	}
 	t.Logf("frame len: %d, parse offset: %d\n", len(jsFileFrame), offset)
 }
+
+func hexHeader(frameType byte) []byte {
+	return []byte(fmt.Sprintf("**\x18B%02x00000000%04x\r\x8a", frameType, 0))
+}
+
+func b16Header(frameType byte, pos int64) []byte {
+	return []byte{ZPAD, ZDLE, ZBIN, frameType,
+		byte(pos), byte(pos >> 8), byte(pos >> 16), byte(pos >> 24), 0, 0}
+}
+
+func subPacket(data []byte, end byte) []byte {
+	var buf bytes.Buffer
+	for _, c := range data {
+		switch c {
+		case ZDLE, 0x11, 0x13:
+			buf.Write([]byte{ZDLE, c ^ 0x40})
+		case 0x7f:
+			buf.Write([]byte{ZDLE, ZRUB0})
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.Write([]byte{ZDLE, end, 0, 0})
+	return buf.Bytes()
+}
+
+func TestZmodemParser_FileData(t *testing.T) {
+	content := []byte("hello\x18\x11\x7fzmodem")
+	p := New()
+	file := make([]byte, 0)
+	var results []bool
+	p.FileDataCallback = func(info *ZFileInfo, offset int64, data []byte) {
+		file = append(file[:offset], data...)
+	}
+	p.FileEventCallback = func(info *ZFileInfo, status bool) {
+		results = append(results, status)
+	}
+	p.Parse(hexHeader(ZRQINIT))
+	if p.Status() != ZParserStatusSend {
+		t.Fatalf("expect send status, got %q", p.Status())
+	}
+	zfile := append(b16Header(ZFILE, 0), subPacket([]byte(fmt.Sprintf("a.txt\x00%d 0 0", len(content))), ZCRCW)...)
+	p.Parse(zfile)
+	p.Parse(append(b16Header(ZDATA, 0), subPacket(content[:4], ZCRCG)...))
+	p.Parse(subPacket(content[4:10], ZCRCE))
+	// 接收端 ZRPOS 要求从 2 开始重传
+	p.Parse(append(b16Header(ZDATA, 2), subPacket(content[2:], ZCRCE)...))
+	p.Parse(b16Header(ZEOF, int64(len(content))))
+	p.Parse(hexHeader(ZFIN))
+	p.Parse([]byte("OO"))
+	if !bytes.Equal(file, content) {
+		t.Fatalf("file content mismatch: %q", file)
+	}
+	if len(results) != 1 || !results[0] {
+		t.Fatalf("expect one successful file, got %v", results)
+	}
+	if p.IsStartSession() {
+		t.Fatal("zmodem session should be end")
+	}
+}
+
+func TestZmodemParser_ExceedLimit(t *testing.T) {
+	p := New()
+	p.MaxTransferSize = 4
+	var results []bool
+	p.FileEventCallback = func(info *ZFileInfo, status bool) {
+		results = append(results, status)
+	}
+	p.Parse(hexHeader(ZRQINIT))
+	p.Parse(append(b16Header(ZFILE, 0), subPacket([]byte("a.txt\x00"), ZCRCW)...))
+	p.Parse(append(b16Header(ZDATA, 0), subPacket([]byte("123456"), ZCRCE)...))
+	if !p.ExceedLimit() {
+		t.Fatal("expect exceed limit")
+	}
+	p.Abort()
+	if p.IsStartSession() || len(results) != 1 || results[0] {
+		t.Fatalf("expect aborted failed file, got %v", results)
+	}
+}
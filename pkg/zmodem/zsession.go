@@ -138,6 +138,11 @@ type ZmodemHeader struct {
 	ZF3  byte
 }
 
+// Position ZDATA、ZEOF、ZRPOS 头部中的文件位置 (P0 是最低字节)
+func (h *ZmodemHeader) Position() int64 {
+	return int64(h.ZF0) | int64(h.ZF1)<<8 | int64(h.ZF2)<<16 | int64(h.ZF3)<<24
+}
+
 const (
 	TypeUpload   = "upload"
 	TypeDownload = "download"
@@ -155,6 +160,53 @@ type ZFileInfo struct {
 
 	parserTime   time.Time
 	transferType string
+
+	// offset 下一个数据的文件位置，ZRPOS 重传时回退到 ZDATA 中的位置
+	offset      int64
+	startOffset int64
+	dataStarted bool
+	eofOffset   int64
+	gotEOF      bool
+	incomplete  bool
+	exceeded    bool
+}
+
+func (z *ZFileInfo) Size() int64 {
+	return int64(z.size)
+}
+
+// Offset 已传输的文件位置
+func (z *ZFileInfo) Offset() int64 {
+	return z.offset
+}
+
+// Resumed 断点续传，第一个 ZDATA 的位置不是 0，只传输了文件后面的部分
+func (z *ZFileInfo) Resumed() bool {
+	return z.startOffset > 0
+}
+
+// Exceeded 文件超过了传输大小的限制
+func (z *ZFileInfo) Exceeded() bool {
+	return z.exceeded
+}
+
+// Completed 收到 ZEOF 并且数据连续、完整
+func (z *ZFileInfo) Completed() bool {
+	return z.gotEOF && z.eofOffset == z.offset && !z.incomplete && !z.exceeded
+}
+
+// onPosition ZDATA 头部的位置，小于当前位置是 ZRPOS 重传，大于当前位置说明丢失了数据
+func (z *ZFileInfo) onPosition(pos int64) {
+	switch {
+	case !z.dataStarted:
+		z.dataStarted = true
+		z.startOffset = pos
+	case pos > z.offset:
+		z.incomplete = true
+	case pos < z.offset:
+		logger.Infof("Zmodem file %s resend from %d", z.filename, pos)
+	}
+	z.offset = pos
 }
 
 func (z *ZFileInfo) Type() string {
@@ -186,6 +238,11 @@ type ZSession struct {
 
 	zOnHeader func(hd *ZmodemHeader)
 
+	// ZDATA 子包中的文件内容，数据解析出错时调用 zOnDataError
+	data         *dataDecoder
+	zOnData      func(p []byte)
+	zOnDataError func()
+
 	AbnormalFinish bool
 }
 
@@ -209,6 +266,10 @@ func (s *ZSession) consume(p []byte) {
 		s.transferStatus = TransferStatusAbort
 		return
 	}
+	if s.data != nil {
+		s.consumeData(p)
+		return
+	}
 	if s.IsNeedSubPacket() {
 		s.subPacketBuf.Write(p)
 		s.consumeSubPacket()
@@ -285,6 +346,38 @@ func (s *ZSession) consumeSubPacket() {
 	s.consume(buf[offset+1:])
 }
 
+func (s *ZSession) consumeData(p []byte) {
+	n, end, ok := s.data.feed(p)
+	if !ok {
+		logger.Errorf("Zmodem session %s parse data subpacket failed", s.Type)
+		if s.zOnDataError != nil {
+			s.zOnDataError()
+		}
+	}
+	if !end {
+		return
+	}
+	s.data = nil
+	s.currentHd = nil
+	if n < len(p) {
+		s.consume(p[n:])
+	}
+}
+
+func (s *ZSession) onData(p []byte) {
+	if s.zOnData != nil {
+		s.zOnData(p)
+	}
+}
+
+// startData ZDATA 头部后面是数据子包
+func (s *ZSession) startData(crcLen int, p []byte) {
+	s.data = newDataDecoder(crcLen, s.onData)
+	if len(p) > 0 {
+		s.consumeData(p)
+	}
+}
+
 func (s *ZSession) onSubPacket(p []byte) {
 	switch s.currentHd.Type {
 	case ZFILE:
@@ -318,6 +411,10 @@ func (s *ZSession) onSubPacket(p []byte) {
 func (s *ZSession) getHexHeader(p []byte) {
 	if hd, offset, ok := DecodeHexFrameHeader(p); ok {
 		s.onHeader(&hd)
+		if hd.Type == ZDATA {
+			s.startData(2, p[offset+1:])
+			return
+		}
 		if s.IsNeedSubPacket() {
 			s.subPacketBuf.Write(p[offset:])
 		}
@@ -327,6 +424,10 @@ func (s *ZSession) getHexHeader(p []byte) {
 func (s *ZSession) getB16Header(p []byte) {
 	if hd, offset, ok := DecodeB16FrameHeader(p); ok {
 		s.onHeader(&hd)
+		if hd.Type == ZDATA {
+			s.startData(2, p[offset:])
+			return
+		}
 		if s.IsNeedSubPacket() {
 			s.subPacketBuf.Write(p[offset:])
 		}
@@ -336,6 +437,10 @@ func (s *ZSession) getB16Header(p []byte) {
 func (s *ZSession) getB32Header(p []byte) {
 	if hd, offset, ok := DecodeB32FrameHeader(p); ok {
 		s.onHeader(&hd)
+		if hd.Type == ZDATA {
+			s.startData(4, p[offset:])
+			return
+		}
 		if s.IsNeedSubPacket() {
 			s.subPacketBuf.Write(p[offset:])
 		}